@@ -0,0 +1,235 @@
+// Package alias maps the numeric unit and talkgroup IDs scanners report to human readable names and tags.
+package alias
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+type Kind string
+
+const (
+	KindUnit      Kind = "unit"
+	KindTalkgroup Kind = "talkgroup"
+)
+
+// ErrUnknownKind is returned when an alias is neither a unit nor a talkgroup.
+var ErrUnknownKind = fmt.Errorf("alias kind must be %s or %s", KindUnit, KindTalkgroup)
+
+// Tags is a list of free form labels. In CSV files tags are separated by a pipe.
+type Tags []string
+
+// Convert the internal tags as CSV string.
+func (t Tags) MarshalCSV() (string, error) {
+	return strings.Join(t, "|"), nil
+}
+
+// Convert the CSV string as internal tags.
+func (t *Tags) UnmarshalCSV(csv string) error {
+	*t = Tags{}
+	for _, tag := range strings.Split(csv, "|") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// Alias names a single unit or talkgroup.
+// System is the WACN, NAC or system name the ID belongs to. An empty System matches every system.
+type Alias struct {
+	System string `csv:"System" yaml:"system" json:",omitempty"`
+	Kind   Kind   `csv:"Kind" yaml:"kind"`
+	ID     string `csv:"ID" yaml:"id"`
+	Name   string `csv:"Name" yaml:"name"`
+	Tags   Tags   `csv:"Tags" yaml:"tags" json:",omitempty"`
+}
+
+// Validate checks that the alias can be stored.
+func (a *Alias) Validate() error {
+	if a.Kind != KindUnit && a.Kind != KindTalkgroup {
+		return fmt.Errorf("%w, got %q", ErrUnknownKind, a.Kind)
+	}
+	if NormalizeID(a.ID) == "" {
+		return fmt.Errorf("alias %q has no ID", a.Name)
+	}
+	return nil
+}
+
+type key struct {
+	system string
+	kind   Kind
+	id     string
+}
+
+func newKey(system string, kind Kind, id string) key {
+	return key{
+		system: strings.ToLower(strings.TrimSpace(system)),
+		kind:   kind,
+		id:     NormalizeID(id),
+	}
+}
+
+// NormalizeID strips the prefixes scanners put in front of IDs, for example TGID:10961 or UID:2468170.
+func NormalizeID(id string) string {
+	id = strings.TrimSpace(id)
+	for _, prefix := range []string{"TGID:", "UID:"} {
+		id = strings.TrimPrefix(id, prefix)
+	}
+	return strings.TrimSpace(id)
+}
+
+// Store holds aliases in memory. It is safe for concurrent use.
+type Store struct {
+	mu      sync.RWMutex
+	aliases map[key]*Alias
+}
+
+func NewStore() *Store {
+	return &Store{
+		aliases: map[key]*Alias{},
+	}
+}
+
+// Add stores an alias, replacing any alias with the same system, kind and ID.
+func (s *Store) Add(a *Alias) error {
+	if validateErr := a.Validate(); validateErr != nil {
+		return validateErr
+	}
+	s.mu.Lock()
+	s.aliases[newKey(a.System, a.Kind, a.ID)] = a
+	s.mu.Unlock()
+	return nil
+}
+
+// Remove deletes an alias and returns true if it existed.
+func (s *Store) Remove(system string, kind Kind, id string) bool {
+	k := newKey(system, kind, id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.aliases[k]; !ok {
+		return false
+	}
+	delete(s.aliases, k)
+	return true
+}
+
+// Lookup finds the alias for an ID. Systems are tried in order, then aliases that match every system.
+func (s *Store) Lookup(kind Kind, id string, systems ...string) *Alias {
+	if s == nil || NormalizeID(id) == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	candidates := append(append([]string{}, systems...), "")
+	for _, system := range candidates {
+		if a, ok := s.aliases[newKey(system, kind, id)]; ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// Unit finds the alias for a unit ID.
+func (s *Store) Unit(id string, systems ...string) *Alias {
+	return s.Lookup(KindUnit, id, systems...)
+}
+
+// Talkgroup finds the alias for a talkgroup ID.
+func (s *Store) Talkgroup(id string, systems ...string) *Alias {
+	return s.Lookup(KindTalkgroup, id, systems...)
+}
+
+// All returns every alias sorted by system, kind and ID.
+func (s *Store) All() []*Alias {
+	s.mu.RLock()
+	all := make([]*Alias, 0, len(s.aliases))
+	for _, a := range s.aliases {
+		all = append(all, a)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].System != all[j].System {
+			return all[i].System < all[j].System
+		}
+		if all[i].Kind != all[j].Kind {
+			return all[i].Kind < all[j].Kind
+		}
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
+// Len returns the number of stored aliases.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.aliases)
+}
+
+// RecordingSystems returns the system keys a recording can be matched with, most specific first.
+func RecordingSystems(rec *wavparse.Recording) []string {
+	systems := []string{}
+	if rec.Private != nil {
+		systems = append(systems, rec.Private.Metadata.WACN, rec.Private.Metadata.NAC, rec.Private.System.Name)
+	}
+	if rec.Public != nil {
+		systems = append(systems, rec.Public.System)
+	}
+
+	filtered := systems[:0]
+	for _, system := range systems {
+		if system != "" {
+			filtered = append(filtered, system)
+		}
+	}
+	return filtered
+}
+
+// Apply attaches the unit and talkgroup aliases to a recording. It returns false if neither was found.
+func (s *Store) Apply(rec *wavparse.Recording) bool {
+	if s == nil || rec == nil {
+		return false
+	}
+
+	systems := RecordingSystems(rec)
+
+	// The private chunk sometimes carries a stale UnitID, so the public one is preferred for units.
+	var unitID, tgid string
+	if rec.Public != nil {
+		unitID = rec.Public.UnitID
+		tgid = rec.Public.TGIDFreq
+	}
+	if rec.Private != nil {
+		if unitID == "" {
+			unitID = rec.Private.Metadata.UnitID
+		}
+		if rec.Private.Metadata.TGID != "" {
+			tgid = rec.Private.Metadata.TGID
+		}
+	}
+
+	unit := s.Unit(unitID, systems...)
+	talkgroup := s.Talkgroup(tgid, systems...)
+	if unit == nil && talkgroup == nil {
+		return false
+	}
+
+	rec.Aliases = &wavparse.Aliases{}
+	if unit != nil {
+		rec.Aliases.UnitIDName = unit.Name
+		rec.Aliases.UnitIDTags = strings.Join(unit.Tags, "|")
+	}
+	if talkgroup != nil {
+		rec.Aliases.TGIDName = talkgroup.Name
+		rec.Aliases.TGIDTags = strings.Join(talkgroup.Tags, "|")
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package alias_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+const aliasCSV = `System,Kind,ID,Name,Tags
+,unit,2468170,Engine 5,fire|apparatus
+Howard County (Project 25),talkgroup,10961,District 1 Dispatch,police
+BEE00,unit,2468170,Medic 12,ems
+`
+
+const aliasYAML = `aliases:
+  - kind: talkgroup
+    id: "TGID:10005"
+    name: EBRPD Dispatch
+    tags: [police, parks]
+`
+
+func TestLookup(t *testing.T) {
+	store := alias.NewStore()
+	if _, loadErr := store.LoadCSV(strings.NewReader(aliasCSV)); loadErr != nil {
+		t.Fatalf("error when loading aliases: %v", loadErr)
+	}
+
+	assert := assert.New(t)
+	assert.Equal(3, store.Len())
+
+	assert.Equal("Engine 5", store.Unit("2468170").Name, "Aliases without a system should match any system")
+	assert.Equal("Medic 12", store.Unit("UID:2468170", "bee00").Name, "System specific aliases should win")
+	assert.Equal(alias.Tags{"fire", "apparatus"}, store.Unit("2468170", "Other").Tags)
+	assert.Equal("District 1 Dispatch", store.Talkgroup("10961", "howard county (project 25)").Name)
+	assert.Nil(store.Talkgroup("10961", "Other"))
+
+	assert.True(store.Remove("", alias.KindUnit, "2468170"))
+	assert.Nil(store.Unit("2468170"))
+}
+
+func TestLoadYAML(t *testing.T) {
+	store := alias.NewStore()
+	loaded, loadErr := store.LoadYAML(strings.NewReader(aliasYAML))
+	if loadErr != nil {
+		t.Fatalf("error when loading aliases: %v", loadErr)
+	}
+
+	assert := assert.New(t)
+	assert.Equal(1, loaded)
+	assert.Equal("EBRPD Dispatch", store.Talkgroup("10005").Name)
+	assert.Equal(alias.Tags{"police", "parks"}, store.Talkgroup("10005").Tags)
+}
+
+func TestApply(t *testing.T) {
+	store := alias.NewStore()
+	if _, loadErr := store.LoadCSV(strings.NewReader(aliasCSV)); loadErr != nil {
+		t.Fatalf("error when loading aliases: %v", loadErr)
+	}
+
+	rec, decodeErr := wavparse.DecodeRecording("../wavparse/fixtures/2020-06-21_18-06-38.wav")
+	if decodeErr != nil {
+		t.Fatalf("error when decoding fixture: %v", decodeErr)
+	}
+
+	assert := assert.New(t)
+	assert.True(store.Apply(rec))
+	assert.Equal("Engine 5", rec.Aliases.UnitIDName)
+	assert.Equal("fire|apparatus", rec.Aliases.UnitIDTags)
+	assert.Equal("District 1 Dispatch", rec.Aliases.TGIDName)
+}
+
+func TestHandler(t *testing.T) {
+	store := alias.NewStore()
+	handler := alias.Handler(store)
+
+	add := httptest.NewRecorder()
+	handler.ServeHTTP(add, httptest.NewRequest(http.MethodPost, "/api/aliases", strings.NewReader(`{"Kind":"unit","ID":"109","Name":"Car 9"}`)))
+
+	assert := assert.New(t)
+	assert.Equal(http.StatusOK, add.Code)
+	assert.Equal("Car 9", store.Unit("109").Name)
+
+	invalid := httptest.NewRecorder()
+	handler.ServeHTTP(invalid, httptest.NewRequest(http.MethodPost, "/api/aliases", strings.NewReader(`{"Kind":"site","ID":"1"}`)))
+	assert.Equal(http.StatusBadRequest, invalid.Code)
+
+	remove := httptest.NewRecorder()
+	handler.ServeHTTP(remove, httptest.NewRequest(http.MethodDelete, "/api/aliases?kind=unit&id=109", nil))
+	assert.Equal(http.StatusNoContent, remove.Code)
+	assert.Equal(0, store.Len())
+}
@@ -0,0 +1,47 @@
+package alias
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler serves the store over HTTP.
+//
+//	GET    lists every alias
+//	POST   adds or replaces the alias in the JSON body
+//	DELETE removes the alias given by the system, kind and id query parameters
+func Handler(s *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.All())
+		case http.MethodPost, http.MethodPut:
+			a := &Alias{}
+			if decodeErr := json.NewDecoder(r.Body).Decode(a); decodeErr != nil {
+				http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+				return
+			}
+			if addErr := s.Add(a); addErr != nil {
+				http.Error(w, addErr.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, a)
+		case http.MethodDelete:
+			query := r.URL.Query()
+			if !s.Remove(query.Get("system"), Kind(query.Get("kind")), query.Get("id")) {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,69 @@
+package alias
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+	"gopkg.in/yaml.v2"
+)
+
+// yamlFile is the layout of a YAML alias file.
+type yamlFile struct {
+	Aliases []*Alias `yaml:"aliases"`
+}
+
+// LoadCSV adds every alias in a CSV file with System, Kind, ID, Name and Tags columns.
+func (s *Store) LoadCSV(r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	aliases := []*Alias{}
+	if unmarshalErr := gocsv.UnmarshalCSV(reader, &aliases); unmarshalErr != nil {
+		return 0, fmt.Errorf("error when unmarshalling alias csv: %w", unmarshalErr)
+	}
+	return s.addAll(aliases)
+}
+
+// LoadYAML adds every alias in a YAML file with a top level aliases list.
+func (s *Store) LoadYAML(r io.Reader) (int, error) {
+	file := yamlFile{}
+	if decodeErr := yaml.NewDecoder(r).Decode(&file); decodeErr != nil && decodeErr != io.EOF {
+		return 0, fmt.Errorf("error when unmarshalling alias yaml: %w", decodeErr)
+	}
+	return s.addAll(file.Aliases)
+}
+
+// LoadFile adds every alias in a CSV or YAML file, chosen by its extension.
+func (s *Store) LoadFile(path string) (int, error) {
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return 0, fmt.Errorf("error when opening alias file: %w", openErr)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return s.LoadCSV(f)
+	case ".yaml", ".yml":
+		return s.LoadYAML(f)
+	default:
+		return 0, fmt.Errorf("alias file %s must be a .csv, .yaml or .yml file", path)
+	}
+}
+
+func (s *Store) addAll(aliases []*Alias) (int, error) {
+	for i, a := range aliases {
+		if a == nil {
+			continue
+		}
+		if addErr := s.Add(a); addErr != nil {
+			return i, fmt.Errorf("alias %d: %w", i+1, addErr)
+		}
+	}
+	return len(aliases), nil
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// commandArgsEnv holds the arguments, separated by new lines, that runCommand runs the test binary as bearcatter with.
+const commandArgsEnv = "BEARCATTER_TEST_COMMAND_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(commandArgsEnv); args != "" {
+		rootCmd.SetArgs(strings.Split(args, "\n"))
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs bearcatter with args in a new process, as commands exit the process when they fail.
+// It returns what the command wrote to stdout and its exit status.
+func runCommand(t *testing.T, args ...string) (string, int) {
+	command := exec.Command(os.Args[0])
+	command.Env = append(os.Environ(), commandArgsEnv+"="+strings.Join(args, "\n"))
+
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	runErr := command.Run()
+	var exitErr *exec.ExitError
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		t.Fatalf("error when running %s: %v", strings.Join(args, " "), runErr)
+	}
+	t.Logf("%s logged:\n%s", strings.Join(args, " "), stderr.String())
+
+	return stdout.String(), command.ProcessState.ExitCode()
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"unicode/utf8"
 
+	"github.com/Bearcatter/bearcatter/alias"
 	"github.com/Bearcatter/bearcatter/wavparse"
 	"github.com/gocarina/gocsv"
 	log "github.com/sirupsen/logrus"
@@ -24,8 +25,12 @@ var continueOnError bool
 var jsonIndent string
 var jsonMultipleFiles bool
 var jsonMultipleFilesCount int
+var jsonMultipleFilesPath string
+var aliasPaths []string
 var csvDelimiter string
 var csvUseCRLF bool
+var jsonFormat string
+var shortName string
 
 // decodeCmd represents the decode command
 var decodeCmd = &cobra.Command{
@@ -34,32 +39,12 @@ var decodeCmd = &cobra.Command{
 	Long: `The decode command will decode every WAV file in the given directory and dump metadata to a CSV or JSON file(s).
 Metadata includes publicly documented and reverse engineered fields.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		outputFormat = strings.ToLower(outputFormat)
-
-		if outputFileName == "recordings.csv" && outputFormat == "json" {
-			outputFileName = "recordings.json"
-		}
-
-		if outputFormat != "csv" && outputFormat != "json" {
-			log.Fatalf(`%s is not a valid output format. Valid options are "csv" or "json"\n`, outputFormat)
+		prepareOutput()
+		if checkErr := wavparse.CheckSidecars([]string{jsonFormat}); checkErr != nil {
+			log.Fatalln("Invalid output.json.format", checkErr)
 		}
-
-		if outputFormat != filepath.Ext(outputFileName)[1:] {
-			log.Warnf("Output file name %s does not have output format extension %s\n", outputFileName, outputFormat)
-		}
-
-		csvDelimiterRune, _ := utf8.DecodeRuneInString(csvDelimiter)
-		if csvDelimiterRune == utf8.RuneError {
-			log.Fatalln("output.csv.delimiter can only be a single character")
-		}
-
-		if outputFormat == "csv" {
-			gocsv.SetCSVWriter(func(out io.Writer) *gocsv.SafeCSVWriter {
-				writer := csv.NewWriter(out)
-				writer.Comma = csvDelimiterRune
-				writer.UseCRLF = csvUseCRLF
-				return gocsv.NewSafeCSVWriter(writer)
-			})
+		if jsonFormat == wavparse.SidecarTrunkRecorder && outputFormat != "json" {
+			log.Fatalln("output.json.format trunk-recorder needs output.format json")
 		}
 
 		var recordingsPathErr error
@@ -68,12 +53,6 @@ Metadata includes publicly documented and reverse engineered fields.`,
 			log.Fatalln("Error when attempting to resolve recordings path", recordingsPathErr)
 		}
 
-		var outputPathErr error
-		outputFilePath, outputPathErr = filepath.Abs(outputFileName)
-		if outputPathErr != nil {
-			log.Fatalln("Error when attempting to resolve output file path", outputPathErr)
-		}
-
 		var wavs []string
 
 		if walkErr := filepath.Walk(recordingsPath, findWAVs(&wavs)); walkErr != nil {
@@ -82,6 +61,8 @@ Metadata includes publicly documented and reverse engineered fields.`,
 
 		log.Infof("Found %d files in %s\n", len(wavs), recordingsPath)
 
+		aliases := loadAliases(aliasPaths)
+
 		parsedRecordings := []*wavparse.Recording{}
 
 		errorLogLevel := log.FatalLevel
@@ -98,18 +79,26 @@ Metadata includes publicly documented and reverse engineered fields.`,
 
 			if decoded == nil {
 				log.StandardLogger().Logf(errorLogLevel, "File %s was not decodable", filePath)
+				continue
 			}
 
+			aliases.Apply(decoded)
+
 			if jsonMultipleFiles {
-				jsonFileName := fmt.Sprintf("%s.json", decoded.File)
-				outputFile, outputFileErr := os.OpenFile(jsonFileName, os.O_RDWR|os.O_TRUNC, os.ModePerm)
+				// Named like the server names the sidecars of recordings
+				jsonFileName := filepath.Join(jsonMultipleFilesPath, wavparse.SidecarName(decoded.File, jsonFormat))
+				var out interface{} = &decoded
+				if jsonFormat == wavparse.SidecarTrunkRecorder {
+					out = decoded.TrunkRecorder(shortName)
+				}
+				outputFile, outputFileErr := os.OpenFile(jsonFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 				if outputFileErr != nil {
 					log.Fatalf("Error when creating output file %s: %v\n", jsonFileName, outputFileErr)
 				}
-				defer outputFile.Close()
-				if saveErr := save(&decoded, outputFile); saveErr != nil {
+				if saveErr := save(out, outputFile); saveErr != nil {
 					log.StandardLogger().Logf(errorLogLevel, "Error when saving %s file: %v", outputFormat, saveErr)
 				}
+				outputFile.Close()
 				jsonMultipleFilesCount += 1
 			}
 
@@ -122,13 +111,21 @@ Metadata includes publicly documented and reverse engineered fields.`,
 		fmt.Printf("\n")
 
 		if !jsonMultipleFiles {
-			outputFile, outputFileErr := os.OpenFile(outputFilePath, os.O_RDWR|os.O_TRUNC, os.ModePerm)
+			outputFile, outputFileErr := os.OpenFile(outputFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 			if outputFileErr != nil {
 				log.Fatalf("Error when creating output file %s: %v\n", outputFilePath, outputFileErr)
 			}
 			defer outputFile.Close()
 
-			if saveErr := save(&parsedRecordings, outputFile); saveErr != nil {
+			var out interface{} = &parsedRecordings
+			if jsonFormat == wavparse.SidecarTrunkRecorder {
+				calls := []*wavparse.TrunkRecorderCall{}
+				for _, recording := range parsedRecordings {
+					calls = append(calls, recording.TrunkRecorder(shortName))
+				}
+				out = &calls
+			}
+			if saveErr := save(out, outputFile); saveErr != nil {
 				log.StandardLogger().Logf(errorLogLevel, "Error when saving %s file: %v", outputFormat, saveErr)
 			}
 
@@ -144,26 +141,94 @@ func init() {
 
 	decodeCmd.Flags().BoolVarP(&continueOnError, "continue", "c", true, "Whether to continue exporting if individual file error happens")
 
-	decodeCmd.Flags().StringVar(&csvDelimiter, "output.csv.delimiter", ",", "Field delimiter")
+	addOutputFlags(decodeCmd)
 
-	decodeCmd.Flags().BoolVar(&csvUseCRLF, "output.csv.crlf", false, "True to use \\r\\n as the line terminator")
+	decodeCmd.Flags().BoolVar(&jsonMultipleFiles, "output.json.multiple", false, "If true, one JSON file will be output to output.json.path for each WAV file")
 
-	decodeCmd.Flags().StringVar(&jsonIndent, "output.json.indent", "\t", "String to indent JSON with. Set to empty string for no indentation.")
+	decodeCmd.Flags().StringVar(&jsonMultipleFilesPath, "output.json.path", ".", "Directory to write JSON files to when output.json.multiple is set")
+	decodeCmd.Flags().StringVar(&jsonFormat, "output.json.format", wavparse.SidecarBearcatter, `Layout of the JSON: "bearcatter" for all of the metadata or "trunk-recorder" for the call JSON of trunk-recorder`)
+	decodeCmd.Flags().StringVar(&shortName, "short-name", "", "Short name of the system in trunk-recorder JSON, made of the system name if empty")
+	if markErr := decodeCmd.MarkFlagDirname("output.json.path"); markErr != nil {
+		log.Fatalln("Error when marking JSON output directory as only accepting dir names", markErr)
+	}
 
-	decodeCmd.Flags().BoolVar(&jsonMultipleFiles, "output.json.multiple", false, "If true, one JSON file will be output to the current directory for each WAV file")
+	decodeCmd.Flags().StringSliceVar(&aliasPaths, "aliases", []string{}, "CSV or YAML files of unit and talkgroup aliases to name recordings with")
 
 	decodeCmd.Flags().StringVarP(&recordingsPath, "recordings.path", "r", "audio", "Path to find recordings in")
 	if markErr := decodeCmd.MarkFlagDirname("recordings.path"); markErr != nil {
 		log.Fatalln("Error when marking recordings directory as only accepting dir names", markErr)
 	}
 
-	decodeCmd.Flags().StringVarP(&outputFormat, "output.format", "f", "csv", `What format to output results in. Valid options are "csv" or "json"`)
-	decodeCmd.Flags().StringVarP(&outputFileName, "output.file", "o", "recordings.csv", "Path to store output in")
-	if markErr := decodeCmd.MarkFlagFilename("output.file", "csv", "json"); markErr != nil {
+}
+
+// addOutputFlags registers the flags shared by every command that writes recordings with save.
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&csvDelimiter, "output.csv.delimiter", ",", "Field delimiter")
+
+	cmd.Flags().BoolVar(&csvUseCRLF, "output.csv.crlf", false, "True to use \\r\\n as the line terminator")
+
+	cmd.Flags().StringVar(&jsonIndent, "output.json.indent", "\t", "String to indent JSON with. Set to empty string for no indentation.")
+
+	cmd.Flags().StringVarP(&outputFormat, "output.format", "f", "csv", `What format to output results in. Valid options are "csv" or "json"`)
+	cmd.Flags().StringVarP(&outputFileName, "output.file", "o", "recordings.csv", "Path to store output in")
+	if markErr := cmd.MarkFlagFilename("output.file", "csv", "json"); markErr != nil {
 		log.Fatalln("Error when marking output file as only accepting certain extensions", markErr)
 	}
 }
 
+// prepareOutput validates the shared output flags and configures the CSV writer.
+func prepareOutput() {
+	outputFormat = strings.ToLower(outputFormat)
+
+	if outputFileName == "recordings.csv" && outputFormat == "json" {
+		outputFileName = "recordings.json"
+	}
+
+	if outputFormat != "csv" && outputFormat != "json" {
+		log.Fatalf(`%s is not a valid output format. Valid options are "csv" or "json"\n`, outputFormat)
+	}
+
+	if outputFormat != filepath.Ext(outputFileName)[1:] {
+		log.Warnf("Output file name %s does not have output format extension %s\n", outputFileName, outputFormat)
+	}
+
+	csvDelimiterRune, _ := utf8.DecodeRuneInString(csvDelimiter)
+	if csvDelimiterRune == utf8.RuneError {
+		log.Fatalln("output.csv.delimiter can only be a single character")
+	}
+
+	if outputFormat == "csv" {
+		gocsv.SetCSVWriter(func(out io.Writer) *gocsv.SafeCSVWriter {
+			writer := csv.NewWriter(out)
+			writer.Comma = csvDelimiterRune
+			writer.UseCRLF = csvUseCRLF
+			return gocsv.NewSafeCSVWriter(writer)
+		})
+	}
+
+	var outputPathErr error
+	outputFilePath, outputPathErr = filepath.Abs(outputFileName)
+	if outputPathErr != nil {
+		log.Fatalln("Error when attempting to resolve output file path", outputPathErr)
+	}
+}
+
+// loadAliases loads every alias file into a new store. It returns nil if no files were given.
+func loadAliases(paths []string) *alias.Store {
+	if len(paths) == 0 {
+		return nil
+	}
+	store := alias.NewStore()
+	for _, path := range paths {
+		loaded, loadErr := store.LoadFile(path)
+		if loadErr != nil {
+			log.Fatalf("Error when loading aliases from %s: %v\n", path, loadErr)
+		}
+		log.Infof("Loaded %d aliases from %s\n", loaded, path)
+	}
+	return store
+}
+
 func findWAVs(files *[]string) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Bearcatter/bearcatter/server"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var devicesDiscovery = &server.USBDiscovery{}
+
+// devicesCmd represents the devices command
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "List the Uniden scanners plugged in over USB",
+	Long: `The devices command looks for the serial ports of Uniden scanners in sysfs and asks every scanner for its model
+and firmware version. The server can select one of them with --usb.model or --usb.serial instead of a tty path, which
+may change across reboots. Ports the server has open can not be identified.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		devices, devicesErr := devicesDiscovery.Devices()
+		if devicesErr != nil {
+			log.Fatalln("Error when looking for scanners", devicesErr)
+		}
+		if len(devices) == 0 {
+			log.Infoln("No scanner is plugged in")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tMODEL\tVERSION\tSERIAL\tUSB ID")
+		for _, device := range devices {
+			if identifyErr := devicesDiscovery.Identify(device); identifyErr != nil {
+				log.Warnf("Failed to identify the scanner at %s: %v\n", device.Path, identifyErr)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s:%s\n", device.Path, device.Model, device.Version, device.Serial, device.VendorID, device.ProductID)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(devicesCmd)
+
+	devicesCmd.Flags().StringVar(&devicesDiscovery.SysfsPath, "sysfs", server.DefaultSysfsPath, "Where sysfs is mounted")
+	devicesCmd.Flags().DurationVar(&devicesDiscovery.IdentifyTimeout, "timeout", server.DefaultIdentifyTimeout, "How long a scanner has to answer MDL and VER")
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/gocarina/gocsv"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var diffOutputFormat string
+var diffIgnoreFields []string
+var diffCSVDelimiter string
+var diffFailOnChanges bool
+
+// RecordingDiff is every field that changed for a single recording.
+type RecordingDiff struct {
+	File   string
+	Fields []wavparse.FieldDiff
+}
+
+// DiffReport is the result of comparing two sets of recordings.
+type DiffReport struct {
+	Added   []string
+	Removed []string
+	Changed []*RecordingDiff
+}
+
+// Empty returns true if both sets of recordings were identical.
+func (r *DiffReport) Empty() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Changed) == 0
+}
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff <old> <new>",
+	Short: "Diff will compare two decode outputs or recording directories field by field",
+	Long: `The diff command compares two sets of recordings and reports added and removed files and every field that changed.
+Each side can be a CSV or JSON file written by the decode command or a directory of WAV files which will be decoded.
+The command exits non-zero if anything changed so it can be used as a regression gate for decoder changes.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		diffOutputFormat = strings.ToLower(diffOutputFormat)
+
+		if diffOutputFormat != "text" && diffOutputFormat != "json" {
+			log.Fatalf(`%s is not a valid output format. Valid options are "text" or "json"\n`, diffOutputFormat)
+		}
+
+		csvDelimiterRune, _ := utf8.DecodeRuneInString(diffCSVDelimiter)
+		if csvDelimiterRune == utf8.RuneError {
+			log.Fatalln("input.csv.delimiter can only be a single character")
+		}
+
+		gocsv.SetCSVReader(func(in io.Reader) gocsv.CSVReader {
+			reader := csv.NewReader(in)
+			reader.Comma = csvDelimiterRune
+			return reader
+		})
+
+		oldRecordings, oldErr := loadRecordings(args[0])
+		if oldErr != nil {
+			log.Fatalf("Error when loading recordings from %s: %v\n", args[0], oldErr)
+		}
+
+		newRecordings, newErr := loadRecordings(args[1])
+		if newErr != nil {
+			log.Fatalf("Error when loading recordings from %s: %v\n", args[1], newErr)
+		}
+
+		report := diffRecordings(oldRecordings, newRecordings, diffIgnoreFields)
+
+		if writeErr := writeDiffReport(report, os.Stdout); writeErr != nil {
+			log.Fatalf("Error when writing %s report: %v\n", diffOutputFormat, writeErr)
+		}
+
+		log.Infof("Compared %d old and %d new recordings: %d added, %d removed, %d changed\n",
+			len(oldRecordings), len(newRecordings), len(report.Added), len(report.Removed), len(report.Changed))
+
+		if diffFailOnChanges && !report.Empty() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVarP(&diffOutputFormat, "output.format", "f", "text", `What format to output the report in. Valid options are "text" or "json"`)
+
+	diffCmd.Flags().StringSliceVarP(&diffIgnoreFields, "ignore", "i", []string{}, "Field paths to ignore, for example Duration or Private.Metadata. Matches the field and everything below it")
+
+	diffCmd.Flags().StringVar(&diffCSVDelimiter, "input.csv.delimiter", ",", "Field delimiter of CSV inputs")
+
+	diffCmd.Flags().BoolVar(&diffFailOnChanges, "fail", true, "Whether to exit with a non-zero status if anything changed")
+}
+
+// loadRecordings loads recordings keyed by file name from a decode output or a directory of WAV files.
+func loadRecordings(path string) (map[string]*wavparse.Recording, error) {
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return nil, statErr
+	}
+
+	recordings := []*wavparse.Recording{}
+
+	if info.IsDir() {
+		var wavs []string
+		if walkErr := filepath.Walk(path, findWAVs(&wavs)); walkErr != nil {
+			return nil, fmt.Errorf("error when walking recordings directory: %w", walkErr)
+		}
+		for _, filePath := range wavs {
+			decoded, decodeErr := wavparse.DecodeRecording(filePath)
+			if decodeErr != nil {
+				log.Warnf("File %s was not decodable: %v\n", filePath, decodeErr)
+				continue
+			}
+			recordings = append(recordings, decoded)
+		}
+	} else {
+		raw, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			if unmarshalErr := gocsv.UnmarshalBytes(raw, &recordings); unmarshalErr != nil {
+				return nil, fmt.Errorf("error when unmarshalling csv: %w", unmarshalErr)
+			}
+		case ".json":
+			if unmarshalErr := json.Unmarshal(raw, &recordings); unmarshalErr != nil {
+				// Files written with output.json.multiple hold a single recording
+				single := &wavparse.Recording{}
+				if singleErr := json.Unmarshal(raw, single); singleErr != nil {
+					return nil, fmt.Errorf("error when unmarshalling json: %w", unmarshalErr)
+				}
+				recordings = append(recordings, single)
+			}
+		default:
+			return nil, fmt.Errorf("%s is not a directory, CSV or JSON file", path)
+		}
+	}
+
+	keyed := make(map[string]*wavparse.Recording, len(recordings))
+	for _, rec := range recordings {
+		if rec == nil {
+			continue
+		}
+		if _, exists := keyed[rec.File]; exists {
+			log.Warnf("File %s appears more than once in %s, using the last one\n", rec.File, path)
+		}
+		keyed[rec.File] = rec
+	}
+	return keyed, nil
+}
+
+func diffRecordings(oldRecordings map[string]*wavparse.Recording, newRecordings map[string]*wavparse.Recording, ignore []string) *DiffReport {
+	report := &DiffReport{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []*RecordingDiff{},
+	}
+
+	for file, oldRec := range oldRecordings {
+		newRec, ok := newRecordings[file]
+		if !ok {
+			report.Removed = append(report.Removed, file)
+			continue
+		}
+
+		fields := []wavparse.FieldDiff{}
+		for _, fieldDiff := range wavparse.Diff(oldRec, newRec) {
+			if !ignoredField(fieldDiff.Field, ignore) {
+				fields = append(fields, fieldDiff)
+			}
+		}
+		if len(fields) > 0 {
+			report.Changed = append(report.Changed, &RecordingDiff{File: file, Fields: fields})
+		}
+	}
+
+	for file := range newRecordings {
+		if _, ok := oldRecordings[file]; !ok {
+			report.Added = append(report.Added, file)
+		}
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	sort.Slice(report.Changed, func(i, j int) bool {
+		return report.Changed[i].File < report.Changed[j].File
+	})
+
+	return report
+}
+
+func ignoredField(field string, ignore []string) bool {
+	for _, prefix := range ignore {
+		if field == prefix || strings.HasPrefix(field, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeDiffReport(report *DiffReport, out io.Writer) error {
+	if diffOutputFormat == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "\t")
+		return encoder.Encode(report)
+	}
+
+	for _, file := range report.Added {
+		if _, err := fmt.Fprintf(out, "+ %s\n", file); err != nil {
+			return err
+		}
+	}
+	for _, file := range report.Removed {
+		if _, err := fmt.Fprintf(out, "- %s\n", file); err != nil {
+			return err
+		}
+	}
+	for _, changed := range report.Changed {
+		if _, err := fmt.Fprintf(out, "~ %s\n", changed.File); err != nil {
+			return err
+		}
+		for _, field := range changed.Fields {
+			if _, err := fmt.Fprintf(out, "\t%s: %q -> %q\n", field.Field, field.Old, field.New); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeRecordings writes recordings as JSON like the decode command does and returns the path of the file.
+func writeRecordings(t *testing.T, dir string, name string, recordings ...*wavparse.Recording) string {
+	marshalled, marshalErr := json.Marshal(recordings)
+	if marshalErr != nil {
+		t.Fatalf("error when marshalling recordings: %v", marshalErr)
+	}
+
+	path := filepath.Join(dir, name)
+	if writeErr := ioutil.WriteFile(path, marshalled, 0644); writeErr != nil {
+		t.Fatalf("error when writing recordings: %v", writeErr)
+	}
+	return path
+}
+
+func TestDiffCommand(t *testing.T) {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating directory: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	recording := func(file string, system string) *wavparse.Recording {
+		return &wavparse.Recording{File: file, Public: &wavparse.ListChunk{System: system}}
+	}
+
+	oldPath := writeRecordings(t, dir, "old.json", recording("changed.wav", "EBRCS"), recording("removed.wav", "EBRCS"))
+	newPath := writeRecordings(t, dir, "new.json", recording("changed.wav", "East Bay"), recording("added.wav", "EBRCS"))
+
+	assert := assert.New(t)
+
+	output, status := runCommand(t, "diff", oldPath, newPath)
+	assert.Equal("+ added.wav\n- removed.wav\n~ changed.wav\n\tPublic.System: \"EBRCS\" -> \"East Bay\"\n", output)
+	assert.Equal(1, status, "Changes should exit non-zero")
+
+	_, status = runCommand(t, "diff", "--fail=false", oldPath, newPath)
+	assert.Equal(0, status, "Changes should not fail with --fail=false")
+
+	output, status = runCommand(t, "diff", oldPath, oldPath)
+	assert.Empty(output)
+	assert.Equal(0, status, "Identical recordings should exit zero")
+}
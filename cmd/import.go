@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Bearcatter/bearcatter/importer"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var importFormat string
+var importDelimiter string
+var importRecordingsPath string
+var importAliasPaths []string
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import <export.csv>...",
+	Short: "Import will merge recording logs exported by other tools with decoded WAV metadata",
+	Long: `The import command reads CSV exports from UniDen WavPlayer, ProScan or theaton's WAV File Manager spreadsheet,
+optionally merges them with the metadata decoded from a directory of WAV files and writes the combined result to a CSV or JSON file.
+Decoded metadata always wins, exports fill in what the WAV files don't have such as UID names.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		prepareOutput()
+
+		format := importer.Format(strings.ToLower(importFormat))
+
+		delimiter := importer.DefaultDelimiter(format)
+		if importDelimiter != "" {
+			var size int
+			delimiter, size = utf8.DecodeRuneInString(importDelimiter)
+			if delimiter == utf8.RuneError || size != len(importDelimiter) {
+				log.Fatalln("import.delimiter can only be a single character")
+			}
+		}
+
+		entries := []*importer.Entry{}
+
+		for _, exportPath := range args {
+			exportFile, openErr := os.Open(exportPath)
+			if openErr != nil {
+				log.Fatalf("Error when opening export %s: %v\n", exportPath, openErr)
+			}
+
+			read, readErr := importer.Read(exportFile, format, delimiter)
+			exportFile.Close()
+			if readErr != nil {
+				log.Fatalf("Error when reading %s export %s: %v\n", format, exportPath, readErr)
+			}
+
+			log.Infof("Read %d entries from %s\n", len(read), exportPath)
+			entries = append(entries, read...)
+		}
+
+		recordings := []*wavparse.Recording{}
+
+		if importRecordingsPath != "" {
+			absRecordingsPath, absRecordingsPathErr := filepath.Abs(importRecordingsPath)
+			if absRecordingsPathErr != nil {
+				log.Fatalln("Error when attempting to resolve recordings path", absRecordingsPathErr)
+			}
+
+			var wavs []string
+			if walkErr := filepath.Walk(absRecordingsPath, findWAVs(&wavs)); walkErr != nil {
+				log.Fatalln("Error when walking recordings directory", walkErr)
+			}
+
+			for _, filePath := range wavs {
+				decoded, decodeErr := wavparse.DecodeRecording(filePath)
+				if decodeErr != nil {
+					log.Warnf("File %s was not decodable: %v\n", filePath, decodeErr)
+					continue
+				}
+				recordings = append(recordings, decoded)
+			}
+
+			log.Infof("Decoded %d files in %s\n", len(recordings), absRecordingsPath)
+		}
+
+		merged := importer.Merge(recordings, entries)
+
+		aliases := loadAliases(importAliasPaths)
+		for _, record := range merged {
+			aliases.Apply(&record.Recording)
+		}
+
+		outputFile, outputFileErr := os.OpenFile(outputFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if outputFileErr != nil {
+			log.Fatalf("Error when creating output file %s: %v\n", outputFilePath, outputFileErr)
+		}
+		defer outputFile.Close()
+
+		if saveErr := save(&merged, outputFile); saveErr != nil {
+			log.Fatalf("Error when saving %s file: %v\n", outputFormat, saveErr)
+		}
+
+		log.Infof("Wrote %d lines to %s\n", len(merged), outputFilePath)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVarP(&importFormat, "import.format", "t", string(importer.FormatWavPlayer), `Format of the exports. Valid options are "wavplayer", "proscan" or "theaton"`)
+
+	importCmd.Flags().StringVar(&importDelimiter, "import.delimiter", "", "Field delimiter of the exports. Defaults to the delimiter the tool writes")
+
+	importCmd.Flags().StringVarP(&importRecordingsPath, "recordings.path", "r", "", "Path to find recordings to merge with. Only the exports are converted if empty")
+	if markErr := importCmd.MarkFlagDirname("recordings.path"); markErr != nil {
+		log.Fatalln("Error when marking recordings directory as only accepting dir names", markErr)
+	}
+
+	importCmd.Flags().StringSliceVar(&importAliasPaths, "aliases", []string{}, "CSV or YAML files of unit and talkgroup aliases to name recordings with")
+
+	addOutputFlags(importCmd)
+}
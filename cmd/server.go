@@ -5,7 +5,10 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/history"
 	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/wavparse"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -14,7 +17,17 @@ import (
 var serverUdpAddress string
 var serverUdpPortNumber int
 var serverUsbPath string
+var serverUsbDiscover bool
+var serverUsbDiscovery = &server.USBDiscovery{}
 var serverRecordingPath string
+var serverAliasPaths []string
+var serverControlPolicy string
+var serverHistoryPath string
+var serverMQTT = &server.MQTTConfig{}
+var serverWebhooksPath string
+var serverPipelinePath string
+var serverUploadersPath string
+var serverS3 = server.S3Config{}
 
 var serverCfg = &server.Config{}
 
@@ -29,14 +42,31 @@ var serverCmd = &cobra.Command{
 			log.Fatalln("Error when attempting to resolve recordings path")
 		}
 
-		if _, err := os.Stat(absRecordingsPath); os.IsNotExist(err) {
-			if mkdirErr := os.Mkdir(absRecordingsPath, os.ModeDir); mkdirErr != nil {
-				log.Fatalf("Error when creating recordings directory %s: %v\n", absRecordingsPath, mkdirErr)
-			}
+		if mkdirErr := os.MkdirAll(absRecordingsPath, 0755); mkdirErr != nil {
+			log.Fatalf("Error when creating recordings directory %s: %v\n", absRecordingsPath, mkdirErr)
 		}
 
 		serverCfg.RecordingsPath = absRecordingsPath
 
+		if serverCfg.RecordingsLayout == wavparse.SidecarTrunkRecorder {
+			serverCfg.RecordingsLayout = server.TrunkRecorderLayout
+		}
+
+		if serverS3.Endpoint != "" {
+			// The keys are taken from the environment like other S3 clients do, so they stay out of the process list
+			if serverS3.AccessKey == "" {
+				serverS3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+			}
+			if serverS3.SecretKey == "" {
+				serverS3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			}
+			store, storeErr := server.NewS3Store(serverS3)
+			if storeErr != nil {
+				log.Fatalln("Error when setting up S3 storage", storeErr)
+			}
+			serverCfg.Recordings = store
+		}
+
 		if serverUdpAddress != "" {
 			udpIP, udpIPErr := net.ResolveIPAddr("ip", serverUdpAddress)
 			if udpIPErr != nil {
@@ -51,11 +81,63 @@ var serverCmd = &cobra.Command{
 
 		if serverUsbPath != "" {
 			serverCfg.USBPath = serverUsbPath
+		} else if serverUsbDiscover || serverUsbDiscovery.Model != "" || serverUsbDiscovery.Serial != "" {
+			serverCfg.USBDiscovery = serverUsbDiscovery
 		}
 
-		if serverCfg.UDPAddress == nil && serverCfg.USBPath == "" {
-			log.Fatal("UDP IP address or USB path must be set!")
+		serverCfg.Aliases = loadAliases(serverAliasPaths)
+		if serverCfg.Aliases == nil {
+			// An empty store still lets clients add aliases over HTTP
+			serverCfg.Aliases = alias.NewStore()
+		}
+
+		controlPolicy, controlPolicyErr := server.ParseControlPolicy(serverControlPolicy)
+		if controlPolicyErr != nil {
+			log.Fatalln("Error when processing control policy", controlPolicyErr)
+		}
+		serverCfg.ControlPolicy = controlPolicy
+
+		if serverCfg.UDPAddress == nil && serverCfg.USBPath == "" && serverCfg.USBDiscovery == nil {
+			log.Fatal("UDP IP address, USB path or USB discovery must be set!")
+		}
+
+		if serverHistoryPath != "" {
+			store, openErr := history.Open(serverHistoryPath)
+			if openErr != nil {
+				log.Fatalln("Error when opening history", openErr)
+			}
+			defer store.Close()
+			serverCfg.History = store
 		}
+
+		if serverWebhooksPath != "" {
+			webhooks, loadErr := server.LoadWebhooks(serverWebhooksPath)
+			if loadErr != nil {
+				log.Fatalln("Error when loading webhooks", loadErr)
+			}
+			serverCfg.Webhooks = webhooks
+		}
+
+		if serverPipelinePath != "" {
+			processors, loadErr := server.LoadPipeline(serverPipelinePath)
+			if loadErr != nil {
+				log.Fatalln("Error when loading pipeline", loadErr)
+			}
+			serverCfg.Pipeline = processors
+		}
+
+		if serverUploadersPath != "" {
+			uploaders, loadErr := server.LoadUploaders(serverUploadersPath)
+			if loadErr != nil {
+				log.Fatalln("Error when loading uploaders", loadErr)
+			}
+			serverCfg.Uploaders = uploaders
+		}
+
+		if serverMQTT.Broker != "" {
+			serverCfg.MQTT = serverMQTT
+		}
+
 		serverCfg.Serve()
 	},
 }
@@ -66,10 +148,55 @@ func init() {
 	serverCmd.Flags().StringVarP(&serverUdpAddress, "udp.address", "a", "", "IP address or hostname of SDS200")
 	serverCmd.Flags().IntVarP(&serverUdpPortNumber, "udp.port", "p", 50536, "UDP port of SDS200")
 	serverCmd.Flags().StringVarP(&serverUsbPath, "usb.path", "u", "", "Path to SDS100 USB port")
+	serverCmd.Flags().BoolVar(&serverUsbDiscover, "usb.discover", false, "Find the scanner among the USB devices instead of using --usb.path, implied by --usb.model and --usb.serial")
+	serverCmd.Flags().StringVar(&serverUsbDiscovery.Model, "usb.model", "", "Model of the scanner to find over USB, such as SDS100")
+	serverCmd.Flags().StringVar(&serverUsbDiscovery.Serial, "usb.serial", "", "USB serial number of the scanner to find, as listed by the devices command")
+	serverCmd.Flags().StringVar(&serverUsbDiscovery.SysfsPath, "usb.sysfs", server.DefaultSysfsPath, "Where sysfs is mounted, to find scanners in")
 
-	serverCmd.Flags().IntVar(&serverCfg.WebSocketPort, "websocket.port", 8080, "WebSocket port to accept connections on")
+	serverCmd.Flags().DurationVar(&serverCfg.ProbeInterval, "link.probe-interval", server.DefaultProbeInterval, "How long the scanner may stay quiet before it is asked for its model to check the link, never if negative")
+	serverCmd.Flags().DurationVar(&serverCfg.ProbeTimeout, "link.probe-timeout", server.DefaultProbeTimeout, "How long the scanner has to answer before the link is taken as dead and reconnected")
+	serverCmd.Flags().DurationVar(&serverCfg.ReconnectBackoff, "link.reconnect-backoff", server.DefaultReconnectBackoff, "How long to wait before reconnecting to the scanner, doubled after every failed attempt")
+	serverCmd.Flags().DurationVar(&serverCfg.MaxReconnectBackoff, "link.reconnect-max", server.DefaultMaxReconnectBackoff, "Longest wait between attempts to reconnect to the scanner")
 
-	serverCmd.Flags().StringVarP(&serverRecordingPath, "recordings.path", "r", "audio", "Path to store recordings in")
+	serverCmd.Flags().IntVar(&serverCfg.WebSocketPort, "websocket.port", 8080, "WebSocket port to accept connections on")
+	serverCmd.Flags().StringVar(&serverControlPolicy, "websocket.control", string(server.ControlSingle), "Which WebSocket clients may send commands: single (first client, the others observe), token (clients send CONTROL and RELEASE) or shared (everyone)")
+	serverCmd.Flags().IntVar(&serverCfg.ClientQueueSize, "websocket.queue", server.DefaultClientQueueSize, "Messages buffered for each WebSocket client before messages to a slow client are dropped")
+
+	serverCmd.Flags().IntVar(&serverCfg.EventBufferSize, "events.buffer", server.DefaultEventBufferSize, "Events kept for /events clients resuming with Last-Event-ID")
+
+	serverCmd.Flags().StringVar(&serverCfg.CallLogPath, "calls.log", "", "File to append every call to as a line of JSON")
+	serverCmd.Flags().DurationVar(&serverCfg.CallHangTime, "calls.hang", server.DefaultCallHangTime, "How long the scanner may stay muted before a call ends")
+
+	serverCmd.Flags().StringVar(&serverHistoryPath, "history.path", "", "Database file to archive calls and recordings in, searchable at /api/history")
+
+	serverCmd.Flags().StringVar(&serverMQTT.Broker, "mqtt.broker", "", "URL of an MQTT broker to publish the scanner state to and take commands from, for example tcp://localhost:1883")
+	serverCmd.Flags().StringVar(&serverMQTT.ClientID, "mqtt.client", server.DefaultMQTTClientID, "Client ID to connect to the MQTT broker with")
+	serverCmd.Flags().StringVar(&serverMQTT.Username, "mqtt.username", "", "Username for the MQTT broker")
+	serverCmd.Flags().StringVar(&serverMQTT.Password, "mqtt.password", "", "Password for the MQTT broker")
+	serverCmd.Flags().StringVar(&serverMQTT.Topic, "mqtt.topic", server.DefaultMQTTTopic, "Prefix of the MQTT topics")
+	serverCmd.Flags().Uint8Var(&serverMQTT.QoS, "mqtt.qos", 0, "QoS of the MQTT messages: 0, 1 or 2")
+
+	serverCmd.Flags().StringVar(&serverWebhooksPath, "webhooks", "", "YAML file of webhooks to notify about matching activity and recordings")
+	serverCmd.Flags().StringVar(&serverPipelinePath, "pipeline", "", "YAML file of processors to run every saved recording through, such as commands, encoders and uploads")
+	serverCmd.Flags().StringVar(&serverUploadersPath, "uploaders", "", "YAML file of call sharing services to upload recordings to: rdio-scanner, OpenMHz or Broadcastify Calls")
+	serverCmd.Flags().StringVar(&serverCfg.UploadQueuePath, "uploaders.queue", "", "Directory of uploads waiting to be retried, .uploads below the recordings path if empty")
+
+	serverCmd.Flags().StringSliceVar(&serverAliasPaths, "aliases", []string{}, "CSV or YAML files of unit and talkgroup aliases to name GSI/PSI updates and recordings with")
+
+	serverCmd.Flags().StringVarP(&serverRecordingPath, "recordings.path", "r", "audio", "Path to store recordings in, or to download them to before uploading them to S3")
+	serverCmd.Flags().StringVar(&serverCfg.RecordingsLayout, "recordings.layout", server.DefaultRecordingsLayout, `Template recordings are named with, for example '{{.Time.Format "2006/01/02"}}/{{.System}}/{{.Name}}', or trunk-recorder for its layout`)
+	serverCmd.Flags().StringSliceVar(&serverCfg.Sidecars, "recordings.sidecars", []string{wavparse.SidecarBearcatter}, "Formats of the JSON saved next to every recording: bearcatter (<name>.wav.json) and trunk-recorder (<name>.json)")
+	serverCmd.Flags().StringVar(&serverCfg.ShortName, "recordings.short-name", "", "Short name of the system in trunk-recorder sidecars and layouts, made of the system name if empty")
+	serverCmd.Flags().DurationVar(&serverCfg.Retention.MaxAge, "recordings.max-age", 0, "Remove recordings older than this, kept forever if 0")
+	serverCmd.Flags().Int64Var(&serverCfg.Retention.MaxBytes, "recordings.max-bytes", 0, "Remove the oldest recordings once all of them take more bytes than this, no limit if 0")
+	serverCmd.Flags().DurationVar(&serverCfg.Retention.Interval, "recordings.prune-interval", server.DefaultPruneInterval, "How often recordings are checked against --recordings.max-age and --recordings.max-bytes")
+
+	serverCmd.Flags().StringVar(&serverS3.Endpoint, "recordings.s3.endpoint", "", "URL of S3 compatible storage to keep recordings in, for example https://s3.us-west-2.amazonaws.com or http://localhost:9000")
+	serverCmd.Flags().StringVar(&serverS3.Region, "recordings.s3.region", server.DefaultS3Region, "Region of the S3 storage")
+	serverCmd.Flags().StringVar(&serverS3.Bucket, "recordings.s3.bucket", "", "Bucket to keep recordings in")
+	serverCmd.Flags().StringVar(&serverS3.Prefix, "recordings.s3.prefix", "", "Prefix of the object keys of recordings, such as scanner/")
+	serverCmd.Flags().StringVar(&serverS3.AccessKey, "recordings.s3.access-key", "", "Access key of the S3 storage, AWS_ACCESS_KEY_ID if empty")
+	serverCmd.Flags().StringVar(&serverS3.SecretKey, "recordings.s3.secret-key", "", "Secret key of the S3 storage, AWS_SECRET_ACCESS_KEY if empty")
 	if markErr := serverCmd.MarkFlagDirname("recordings.path"); markErr != nil {
 		log.Fatalln("Error when marking recordings directory as only accepting dir names", markErr)
 	}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var simulateUdpAddress string
+var simulateUsb bool
+var simulateScenarioPath string
+var simulateRecordings []string
+
+// simulateCmd represents the simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Simulate a Uniden scanner for the server to connect to",
+	Long: `The simulate command pretends to be a SDS200 on a UDP port, or a SDS100 on a pseudo terminal with --usb,
+so the server and its clients can be tried out without a radio. It answers the common remote commands, pushes PSI updates,
+plays back the calls of a YAML scenario and offers recordings for download over the AUF file transfer.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		scenario := sim.DefaultScenario()
+		if simulateScenarioPath != "" {
+			var scenarioErr error
+			scenario, scenarioErr = sim.LoadScenario(simulateScenarioPath)
+			if scenarioErr != nil {
+				log.Fatalf("Error when loading scenario %s: %v\n", simulateScenarioPath, scenarioErr)
+			}
+		}
+
+		simulator := sim.New(scenario)
+		for _, recording := range simulateRecordings {
+			if queueErr := simulator.Queue(recording); queueErr != nil {
+				log.Fatalf("Error when queueing recording %s: %v\n", recording, queueErr)
+			}
+		}
+
+		var link server.Transport
+		if simulateUsb {
+			pty, ptyErr := sim.OpenPTY()
+			if ptyErr != nil {
+				log.Fatalln("Error when creating pseudo terminal", ptyErr)
+			}
+			log.Infof("Start the server with --usb.path %s\n", pty.Path())
+			link = pty
+		} else {
+			udp, udpErr := sim.ListenUDP(simulateUdpAddress)
+			if udpErr != nil {
+				log.Fatalln("Error when listening for UDP", udpErr)
+			}
+			log.Infof("Start the server with --udp.address %s --udp.port %d\n", udp.Addr().IP, udp.Addr().Port)
+			link = udp
+		}
+
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, os.Interrupt)
+			<-c
+			log.Infoln("Terminating on signal...")
+			link.Close()
+		}()
+
+		if serveErr := simulator.Serve(link); serveErr != nil {
+			log.Fatalln("Error when simulating scanner", serveErr)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(simulateCmd)
+
+	simulateCmd.Flags().StringVarP(&simulateUdpAddress, "udp.address", "a", "127.0.0.1:50536", "Address to listen on for the server")
+	simulateCmd.Flags().BoolVar(&simulateUsb, "usb", false, "Simulate a SDS100 on a pseudo terminal instead of UDP (Linux only)")
+	simulateCmd.Flags().StringVarP(&simulateScenarioPath, "scenario", "s", "", "YAML scenario to play. Uses a built in scenario if empty")
+	simulateCmd.Flags().StringSliceVar(&simulateRecordings, "recordings", []string{}, "WAV files to offer for download")
+}
@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	v10 "github.com/go-playground/validator/v10"
+	"github.com/gocarina/gocsv"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	VerifyCheckHeader          = "header"
+	VerifyCheckDecode          = "decode"
+	VerifyCheckMissingLIST     = "missing_list"
+	VerifyCheckMissingUNID     = "missing_unid"
+	VerifyCheckMissingData     = "missing_data"
+	VerifyCheckSizeMismatch    = "size_mismatch"
+	VerifyCheckFutureTimestamp = "future_timestamp"
+	VerifyCheckRTCNotSet       = "rtc_not_set"
+	VerifyCheckValidation      = "validation"
+)
+
+var verifyRecordingsPath string
+var verifyOutputFileName string
+var verifyOutputFormat string
+var verifyMinTimestamp string
+var verifyFailOnIssues bool
+
+// VerifyIssue is a single problem found with a recording.
+type VerifyIssue struct {
+	File    string `csv:"File" json:"-"`
+	Check   string `csv:"Check"`
+	Message string `csv:"Message"`
+}
+
+// VerifyResult is every problem found with a single recording.
+type VerifyResult struct {
+	File   string
+	Issues []*VerifyIssue
+}
+
+func (r *VerifyResult) add(check string, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, &VerifyIssue{
+		File:    r.File,
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify will audit a directory of WAV files for corrupt or suspicious recordings",
+	Long: `The verify command will inspect every WAV file in the given directory and report files with invalid RIFF headers,
+missing LIST or unid chunks, truncated audio, suspicious timestamps or metadata that fails validation.
+Results are written as JSON or CSV and the command exits non-zero if any issue is found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyOutputFormat = strings.ToLower(verifyOutputFormat)
+
+		if verifyOutputFormat != "csv" && verifyOutputFormat != "json" {
+			log.Fatalf(`%s is not a valid output format. Valid options are "csv" or "json"\n`, verifyOutputFormat)
+		}
+
+		minTimestamp, minTimestampErr := time.ParseInLocation("2006-01-02", verifyMinTimestamp, time.Local)
+		if minTimestampErr != nil {
+			log.Fatalln("Error when parsing minimum timestamp", minTimestampErr)
+		}
+
+		absRecordingsPath, absRecordingsPathErr := filepath.Abs(verifyRecordingsPath)
+		if absRecordingsPathErr != nil {
+			log.Fatalln("Error when attempting to resolve recordings path", absRecordingsPathErr)
+		}
+
+		var wavs []string
+
+		if walkErr := filepath.Walk(absRecordingsPath, findWAVs(&wavs)); walkErr != nil {
+			log.Fatalln("Error when walking recordings directory", walkErr)
+		}
+
+		log.Infof("Found %d files in %s\n", len(wavs), absRecordingsPath)
+
+		validator := v10.New()
+		now := time.Now()
+
+		results := []*VerifyResult{}
+		issueCount := 0
+
+		for _, filePath := range wavs {
+			relPath, relPathErr := filepath.Rel(absRecordingsPath, filePath)
+			if relPathErr != nil {
+				relPath = filePath
+			}
+
+			result := verifyRecording(filePath, relPath, validator, minTimestamp, now)
+			if len(result.Issues) > 0 {
+				results = append(results, result)
+				issueCount += len(result.Issues)
+			}
+		}
+
+		output := io.Writer(os.Stdout)
+		if verifyOutputFileName != "" {
+			outputFile, outputFileErr := os.Create(verifyOutputFileName)
+			if outputFileErr != nil {
+				log.Fatalf("Error when creating output file %s: %v\n", verifyOutputFileName, outputFileErr)
+			}
+			defer outputFile.Close()
+			output = outputFile
+		}
+
+		if writeErr := writeVerifyResults(results, output); writeErr != nil {
+			log.Fatalf("Error when writing %s results: %v\n", verifyOutputFormat, writeErr)
+		}
+
+		log.Infof("Found %d issues in %d of %d files\n", issueCount, len(results), len(wavs))
+
+		if verifyFailOnIssues && issueCount > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyRecordingsPath, "recordings.path", "r", "audio", "Path to find recordings in")
+	if markErr := verifyCmd.MarkFlagDirname("recordings.path"); markErr != nil {
+		log.Fatalln("Error when marking recordings directory as only accepting dir names", markErr)
+	}
+
+	verifyCmd.Flags().StringVarP(&verifyOutputFormat, "output.format", "f", "json", `What format to output results in. Valid options are "csv" or "json"`)
+	verifyCmd.Flags().StringVarP(&verifyOutputFileName, "output.file", "o", "", "Path to store results in. Results are written to stdout if empty")
+
+	verifyCmd.Flags().StringVar(&verifyMinTimestamp, "timestamp.min", "2010-01-01", "Recordings stamped before this date (YYYY-MM-DD) are reported as made before the scanner clock was set")
+
+	verifyCmd.Flags().BoolVar(&verifyFailOnIssues, "fail", true, "Whether to exit with a non-zero status if any issue is found")
+}
+
+func verifyRecording(path string, name string, validator *v10.Validate, minTimestamp time.Time, now time.Time) *VerifyResult {
+	result := &VerifyResult{File: name}
+
+	layout, layoutErr := wavparse.DecodeLayout(path)
+	if layoutErr != nil {
+		if errors.Is(layoutErr, wavparse.ErrHeaderParsing) {
+			result.add(VerifyCheckHeader, "%v", layoutErr)
+		} else {
+			result.add(VerifyCheckDecode, "%v", layoutErr)
+		}
+		return result
+	}
+
+	if !layout.HasLIST {
+		result.add(VerifyCheckMissingLIST, "file has no LIST chunk")
+	}
+	if !layout.HasUNID {
+		result.add(VerifyCheckMissingUNID, "file has no unid chunk")
+	}
+	if !layout.HasData {
+		result.add(VerifyCheckMissingData, "file has no data chunk")
+		return result
+	}
+
+	if layout.FileSize < layout.ExpectedFileSize() {
+		result.add(VerifyCheckSizeMismatch, "file is %d bytes but data chunk declares %d bytes", layout.FileSize, layout.ExpectedFileSize())
+	} else if int64(layout.RIFFSize)+8 != layout.FileSize {
+		result.add(VerifyCheckSizeMismatch, "file is %d bytes but RIFF header declares %d bytes", layout.FileSize, int64(layout.RIFFSize)+8)
+	}
+
+	rec, decodeErr := wavparse.DecodeRecording(path)
+	if decodeErr != nil {
+		result.add(VerifyCheckDecode, "%v", decodeErr)
+		return result
+	}
+
+	if rec.Public != nil && rec.Public.Timestamp != nil {
+		if rec.Public.Timestamp.After(now) {
+			result.add(VerifyCheckFutureTimestamp, "timestamp %s is in the future", rec.Public.Timestamp.Format(time.RFC3339))
+		} else if rec.Public.Timestamp.Before(minTimestamp) {
+			result.add(VerifyCheckRTCNotSet, "timestamp %s is before %s", rec.Public.Timestamp.Format(time.RFC3339), minTimestamp.Format("2006-01-02"))
+		}
+	}
+
+	if validateErr := validator.Struct(rec); validateErr != nil {
+		var fieldErrs v10.ValidationErrors
+		if errors.As(validateErr, &fieldErrs) {
+			for _, fieldErr := range fieldErrs {
+				result.add(VerifyCheckValidation, "%s failed %s validation", fieldErr.Namespace(), fieldErr.Tag())
+			}
+		} else {
+			result.add(VerifyCheckValidation, "%v", validateErr)
+		}
+	}
+
+	return result
+}
+
+func writeVerifyResults(results []*VerifyResult, out io.Writer) error {
+	if verifyOutputFormat == "csv" {
+		issues := []*VerifyIssue{}
+		for _, result := range results {
+			issues = append(issues, result.Issues...)
+		}
+		return gocsv.Marshal(&issues, out)
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(results)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v10 "github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	verifiedFixture  = "../wavparse/fixtures/2020-06-20_22-22-20.wav"
+	truncatedFixture = "../wavparse/fixtures/2020-06-20_23-06-58.wav"
+)
+
+// verifyDir creates a directory of recordings for verify: a good one and, if broken, a truncated and a corrupt one.
+func verifyDir(t *testing.T, broken bool) string {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	files := map[string]string{"good.wav": verifiedFixture}
+	if broken {
+		files["truncated.wav"] = truncatedFixture
+	}
+	for name, fixture := range files {
+		recording, readErr := ioutil.ReadFile(fixture)
+		if readErr != nil {
+			t.Fatalf("error when reading fixture: %v", readErr)
+		}
+		if writeErr := ioutil.WriteFile(filepath.Join(dir, name), recording, 0644); writeErr != nil {
+			t.Fatalf("error when writing recording: %v", writeErr)
+		}
+	}
+	if broken {
+		if writeErr := ioutil.WriteFile(filepath.Join(dir, "corrupt.wav"), []byte("RIFF"), 0644); writeErr != nil {
+			t.Fatalf("error when writing recording: %v", writeErr)
+		}
+	}
+	return dir
+}
+
+func TestVerifyRecording(t *testing.T) {
+	dir := verifyDir(t, true)
+	minTimestamp := time.Date(2010, time.January, 1, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		file   string
+		checks []string
+	}{
+		{file: "good.wav"},
+		{file: "truncated.wav", checks: []string{VerifyCheckSizeMismatch}},
+		{file: "corrupt.wav", checks: []string{VerifyCheckHeader}},
+	}
+
+	validator := v10.New()
+	for _, test := range tests {
+		test := test
+		t.Run(test.file, func(t *testing.T) {
+			result := verifyRecording(filepath.Join(dir, test.file), test.file, validator, minTimestamp, time.Now())
+
+			checks := []string{}
+			for _, issue := range result.Issues {
+				assert.Equal(t, test.file, issue.File)
+				checks = append(checks, issue.Check)
+			}
+			assert.ElementsMatch(t, test.checks, checks)
+		})
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	output, status := runCommand(t, "verify", "-f", "csv", "-r", verifyDir(t, true))
+	assert.Contains(output, "corrupt.wav,"+VerifyCheckHeader+",")
+	assert.Contains(output, "truncated.wav,"+VerifyCheckSizeMismatch+",")
+	assert.NotContains(output, "good.wav")
+	assert.Equal(1, status, "Corrupt and truncated recordings should exit non-zero")
+
+	output, status = runCommand(t, "verify", "-f", "csv", "-r", verifyDir(t, false))
+	assert.Equal("File,Check,Message\n", output)
+	assert.Equal(0, status, "Good recordings should exit zero")
+}
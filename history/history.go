@@ -0,0 +1,232 @@
+// Package history archives the calls and recordings the server saw in an embedded bbolt database and searches them.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultLimit is how many entries a search returns unless it asks for a different number.
+	DefaultLimit = 50
+	// MaxLimit is the most entries a search returns at once.
+	MaxLimit = 500
+
+	// matchSlack is how far a recording may start outside of a call to still belong to it.
+	// The clock of the scanner is set by hand and rarely exactly right.
+	matchSlack = 10 * time.Second
+	// maxCallLength bounds how far back a recording is matched to calls.
+	maxCallLength = time.Hour
+)
+
+var (
+	bucketEntries = []byte("entries")
+	bucketIDs     = []byte("ids")
+)
+
+// ErrNotFound is returned for IDs that are not in the archive.
+var ErrNotFound = errors.New("entry not found")
+
+// Entry is a call, the recording the scanner made of it, or both once the recording was matched to its call.
+type Entry struct {
+	ID    string     `json:"id"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	// Duration in seconds
+	Duration   float64  `json:"duration"`
+	System     string   `json:"system,omitempty"`
+	Department string   `json:"department,omitempty"`
+	Channel    string   `json:"channel,omitempty"`
+	TGID       string   `json:"tgid,omitempty"`
+	Site       string   `json:"site,omitempty"`
+	Frequency  string   `json:"frequency,omitempty"`
+	Units      []string `json:"units,omitempty"`
+	// Call is the call as the server announced it
+	Call json.RawMessage `json:"call,omitempty"`
+	// Recording is the metadata of the WAV file saved at AudioPath
+	Recording *wavparse.Recording `json:"recording,omitempty"`
+	AudioPath string              `json:"audio_path,omitempty"`
+	// RecordingName is the name of the recording in the store it was saved to, if it was saved to one
+	RecordingName string `json:"recording_name,omitempty"`
+}
+
+// HasAudio reports whether a recording was saved for the entry.
+func (e *Entry) HasAudio() bool {
+	return e.AudioPath != ""
+}
+
+// until returns when the entry ended, or its start plus its duration if that is not known.
+func (e *Entry) until() time.Time {
+	if e.End != nil {
+		return *e.End
+	}
+	return e.Start.Add(time.Duration(e.Duration * float64(time.Second)))
+}
+
+// Store is the archive. It is safe for concurrent use.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the archive at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, openErr := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if openErr != nil {
+		return nil, fmt.Errorf("error when opening history %s: %w", path, openErr)
+	}
+
+	if updateErr := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketEntries, bucketIDs} {
+			if _, bucketErr := tx.CreateBucketIfNotExists(bucket); bucketErr != nil {
+				return bucketErr
+			}
+		}
+		return nil
+	}); updateErr != nil {
+		db.Close()
+		return nil, fmt.Errorf("error when preparing history %s: %w", path, updateErr)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// entryKey orders entries by their start time. The ID keeps entries starting at the same time apart.
+func entryKey(e *Entry) []byte {
+	key := make([]byte, 8, 8+len(e.ID))
+	binary.BigEndian.PutUint64(key, uint64(e.Start.UnixNano()))
+	return append(key, e.ID...)
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// keyTime returns the start time of an entry key.
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
+
+// Put adds an entry or replaces the entry with the same ID.
+func (s *Store) Put(e *Entry) error {
+	if e.ID == "" {
+		return errors.New("entry has no ID")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, e)
+	})
+}
+
+func put(tx *bolt.Tx, e *Entry) error {
+	marshalled, marshalErr := json.Marshal(e)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	entries, ids := tx.Bucket(bucketEntries), tx.Bucket(bucketIDs)
+	// The start of an entry may have moved, so its old key goes
+	if oldKey := ids.Get([]byte(e.ID)); oldKey != nil {
+		if deleteErr := entries.Delete(oldKey); deleteErr != nil {
+			return deleteErr
+		}
+	}
+
+	key := entryKey(e)
+	if putErr := entries.Put(key, marshalled); putErr != nil {
+		return putErr
+	}
+	return ids.Put([]byte(e.ID), key)
+}
+
+// Get returns the entry with the given ID.
+func (s *Store) Get(id string) (*Entry, error) {
+	e := &Entry{}
+	viewErr := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(bucketIDs).Get([]byte(id))
+		if key == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(tx.Bucket(bucketEntries).Get(key), e)
+	})
+	if viewErr != nil {
+		return nil, viewErr
+	}
+	return e, nil
+}
+
+// AddRecording joins a recording saved at audioPath as name to the call it was made of: the call on the same
+// talkgroup that was going on when the recording started. Without such a call the recording gets an entry of its own.
+func (s *Store) AddRecording(recording *wavparse.Recording, audioPath string, name string, start time.Time) (*Entry, error) {
+	tgid := recordingTGID(recording)
+
+	var matched *Entry
+	updateErr := s.db.Update(func(tx *bolt.Tx) error {
+		// Calls start before their recording, so look back from the latest one that could still match
+		latest := start.Add(matchSlack)
+		cursor := tx.Bucket(bucketEntries).Cursor()
+		k, v := cursor.Seek(timeKey(latest))
+		if k == nil {
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = cursor.Prev() {
+			if keyTime(k).After(latest) {
+				continue
+			}
+
+			e := &Entry{}
+			if unmarshalErr := json.Unmarshal(v, e); unmarshalErr != nil {
+				return unmarshalErr
+			}
+			if e.Start.Before(start.Add(-maxCallLength)) {
+				break
+			}
+			if tgid != "" && !e.HasAudio() && alias.NormalizeID(e.TGID) == tgid && !start.After(e.until().Add(matchSlack)) {
+				matched = e
+				break
+			}
+		}
+
+		if matched == nil {
+			matched = &Entry{ID: fmt.Sprintf("%d-%s", start.UnixNano(), filepath.Base(audioPath)), Start: start}
+			if recording.Public != nil {
+				matched.System = recording.Public.System
+				matched.Department = recording.Public.Department
+				matched.Channel = recording.Public.Channel
+				matched.TGID = recording.Public.TGIDFreq
+			}
+			matched.Duration = time.Duration(recording.Duration).Seconds()
+		}
+		matched.Recording = recording
+		matched.AudioPath = audioPath
+		matched.RecordingName = name
+		return put(tx, matched)
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return matched, nil
+}
+
+// recordingTGID returns the talkgroup of a recording without prefixes, or its frequency on conventional systems.
+func recordingTGID(recording *wavparse.Recording) string {
+	if recording.Private != nil && recording.Private.Metadata.TGID != "" {
+		return alias.NormalizeID(recording.Private.Metadata.TGID)
+	}
+	if recording.Public != nil {
+		return alias.NormalizeID(recording.Public.TGIDFreq)
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package history_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/history"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+const recordingFixture = "../wavparse/fixtures/2020-06-21_00-00-32.wav"
+
+func openStore(t *testing.T) *history.Store {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, openErr := history.Open(filepath.Join(dir, "history.db"))
+	if openErr != nil {
+		t.Fatalf("error when opening history: %v", openErr)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func callEntry(id string, start time.Time, seconds float64, system string, tgid string, units ...string) *history.Entry {
+	end := start.Add(time.Duration(seconds * float64(time.Second)))
+	return &history.Entry{
+		ID:         id,
+		Start:      start,
+		End:        &end,
+		Duration:   seconds,
+		System:     system,
+		Department: "Sheriff",
+		Channel:    "Dispatch " + tgid,
+		TGID:       "TGID:" + tgid,
+		Units:      units,
+	}
+}
+
+func TestAddRecording(t *testing.T) {
+	store := openStore(t)
+	recording, decodeErr := wavparse.DecodeRecording(recordingFixture)
+	if decodeErr != nil {
+		t.Fatalf("error when decoding recording: %v", decodeErr)
+	}
+	recorded := *recording.Public.Timestamp
+
+	assert := assert.New(t)
+	assert.NoError(store.Put(callEntry("1", recorded.Add(-time.Minute), 10, "EBRCS", "7715")))
+	assert.NoError(store.Put(callEntry("2", recorded.Add(-time.Second), 8, "EBRCS", "7715", "UID:4010013")))
+	assert.NoError(store.Put(callEntry("3", recorded, 5, "EBRCS", "1234")))
+
+	entry, addErr := store.AddRecording(recording, "/audio/2020-06-21_00-00-32.wav", "2020-06-21_00-00-32", recorded)
+	assert.NoError(addErr)
+	assert.Equal("2", entry.ID, "The recording should join the call on its talkgroup going on when it started")
+
+	stored, getErr := store.Get("2")
+	assert.NoError(getErr)
+	assert.True(stored.HasAudio())
+	assert.Equal("Dispatch East", stored.Recording.Public.Channel)
+	assert.Equal("2020-06-21_00-00-32", stored.RecordingName)
+
+	// A second recording of the talkgroup can not be joined to the same call
+	entry, addErr = store.AddRecording(recording, "/audio/copy.wav", "copy", recorded)
+	assert.NoError(addErr)
+	assert.NotEqual("2", entry.ID)
+	assert.Equal("East Bay Regional Communications System (EBRCS)", entry.System)
+	assert.Equal(recorded, entry.Start)
+
+	_, getErr = store.Get("missing")
+	assert.Equal(history.ErrNotFound, getErr)
+}
+
+func TestSearch(t *testing.T) {
+	store := openStore(t)
+	start := time.Date(2020, 6, 21, 18, 0, 0, 0, time.UTC)
+
+	assert := assert.New(t)
+	for i, system := range []string{"EBRCS", "EBRCS", "Howard County", "EBRCS", "Howard County"} {
+		tgid := "7715"
+		if i%2 == 1 {
+			tgid = "10961"
+		}
+		entry := callEntry(string(rune('a'+i)), start.Add(time.Duration(i)*time.Minute), 5, system, tgid, "UID:100"+string(rune('0'+i)))
+		assert.NoError(store.Put(entry))
+	}
+	// Replacing an entry with a new start moves it
+	moved := callEntry("a", start.Add(10*time.Minute), 5, "EBRCS", "7715", "UID:1000")
+	assert.NoError(store.Put(moved))
+
+	ids := func(q history.Query) []string {
+		result, searchErr := store.Search(q)
+		assert.NoError(searchErr)
+		var ids []string
+		for _, entry := range result.Entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+
+	assert.Equal([]string{"a", "e", "d", "c", "b"}, ids(history.Query{}), "Newest first")
+	assert.Equal([]string{"d", "b"}, ids(history.Query{System: "ebrcs", TGID: "10961"}))
+	assert.Equal([]string{"c"}, ids(history.Query{UnitID: "1002"}))
+	assert.Equal([]string{"e", "c"}, ids(history.Query{Text: "howard"}))
+	assert.Equal([]string{"d", "c", "b"}, ids(history.Query{From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}))
+	assert.Empty(ids(history.Query{AudioOnly: true}))
+
+	page, searchErr := store.Search(history.Query{Limit: 2, Offset: 2})
+	assert.NoError(searchErr)
+	assert.Equal(5, page.Total)
+	assert.Equal(2, page.Offset)
+	if assert.Len(page.Entries, 2) {
+		assert.Equal("d", page.Entries[0].ID)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	store := openStore(t)
+	recording, decodeErr := wavparse.DecodeRecording(recordingFixture)
+	if decodeErr != nil {
+		t.Fatalf("error when decoding recording: %v", decodeErr)
+	}
+	recorded := *recording.Public.Timestamp
+
+	assert := assert.New(t)
+	assert.NoError(store.Put(callEntry("1", recorded, 5, "EBRCS", "7715")))
+	assert.NoError(store.Put(callEntry("2", recorded.Add(time.Minute), 5, "EBRCS", "7716")))
+	_, addErr := store.AddRecording(recording, recordingFixture, "", recorded)
+	assert.NoError(addErr)
+
+	srv := httptest.NewServer(http.StripPrefix("/api/history", history.Handler(store, nil)))
+	defer srv.Close()
+
+	get := func(path string, header http.Header) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, getErr := http.DefaultClient.Do(req)
+		if getErr != nil {
+			t.Fatalf("error when getting %s: %v", path, getErr)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/api/history?audio=true&from="+recorded.Add(-time.Hour).Format(time.RFC3339), nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	result := history.Result{}
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	if assert.Len(result.Entries, 1) {
+		assert.Equal("1", result.Entries[0].ID)
+	}
+
+	assert.Equal(http.StatusBadRequest, get("/api/history?from=yesterday", nil).StatusCode)
+	assert.Equal(http.StatusNotFound, get("/api/history/missing", nil).StatusCode)
+	assert.Equal(http.StatusNotFound, get("/api/history/2/audio", nil).StatusCode, "Calls without a recording have no audio")
+
+	entry := history.Entry{}
+	assert.NoError(json.NewDecoder(get("/api/history/1", nil).Body).Decode(&entry))
+	assert.Equal(recordingFixture, entry.AudioPath)
+
+	original, readErr := ioutil.ReadFile(recordingFixture)
+	assert.NoError(readErr)
+	resp = get("/api/history/1/audio", nil)
+	assert.Equal("audio/wav", resp.Header.Get("Content-Type"))
+	audio, readErr := ioutil.ReadAll(resp.Body)
+	assert.NoError(readErr)
+	assert.Equal(original, audio)
+
+	resp = get("/api/history/1/audio", http.Header{"Range": {"bytes=4-7"}})
+	assert.Equal(http.StatusPartialContent, resp.StatusCode)
+	partial, readErr := ioutil.ReadAll(resp.Body)
+	assert.NoError(readErr)
+	assert.Equal(original[4:8], partial)
+
+	// Recordings in object storage are streamed through the opener instead of leaving the client with a URL that
+	// needs signing
+	uploaded := callEntry("3", recorded.Add(2*time.Minute), 5, "EBRCS", "7717")
+	uploaded.AudioPath = "https://s3.example.com/recordings/3.wav"
+	uploaded.RecordingName = "3"
+	assert.NoError(store.Put(uploaded))
+	opened := []string{}
+	stored := httptest.NewServer(http.StripPrefix("/api/history", history.Handler(store, func(e *history.Entry) (history.Audio, time.Time, error) {
+		opened = append(opened, e.RecordingName)
+		if e.RecordingName != "3" {
+			return nil, time.Time{}, history.ErrAudioNotFound
+		}
+		return nopCloser{bytes.NewReader(original)}, recorded, nil
+	})))
+	defer stored.Close()
+
+	resp, getErr := http.Get(stored.URL + "/api/history/3/audio")
+	if assert.NoError(getErr) {
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		audio, readErr = ioutil.ReadAll(resp.Body)
+		assert.NoError(readErr)
+		assert.Equal(original, audio)
+	}
+	resp, getErr = http.Get(stored.URL + "/api/history/1/audio")
+	if assert.NoError(getErr) {
+		resp.Body.Close()
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+	}
+	assert.Equal([]string{"3", ""}, opened)
+}
+
+// nopCloser is a bytes.Reader that can be closed.
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
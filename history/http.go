@@ -0,0 +1,160 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audio is the WAV file of a recording.
+type Audio interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// ErrAudioNotFound is returned by an AudioOpener for recordings that were removed.
+var ErrAudioNotFound = errors.New("recording was removed")
+
+// AudioOpener opens the recording of an entry and returns when it was saved. It returns ErrAudioNotFound for
+// recordings that are gone.
+type AudioOpener func(e *Entry) (Audio, time.Time, error)
+
+// OpenFile is the AudioOpener of recordings saved as files at their AudioPath.
+func OpenFile(e *Entry) (Audio, time.Time, error) {
+	audio, openErr := os.Open(e.AudioPath)
+	if os.IsNotExist(openErr) {
+		return nil, time.Time{}, ErrAudioNotFound
+	} else if openErr != nil {
+		return nil, time.Time{}, openErr
+	}
+
+	info, statErr := audio.Stat()
+	if statErr != nil {
+		audio.Close()
+		return nil, time.Time{}, statErr
+	}
+	return audio, info.ModTime(), nil
+}
+
+// Handler serves the archive over HTTP. Mount it with http.StripPrefix so paths start after the prefix.
+// Recordings are opened with open, OpenFile if nil.
+//
+//	GET /             searches with the from, to, system, department, tgid, unit, q, audio, limit and offset query parameters
+//	GET /{id}         returns an entry
+//	GET /{id}/audio   streams the recording of an entry, with range requests for seeking
+func Handler(s *Store, open AudioOpener) http.Handler {
+	if open == nil {
+		open = OpenFile
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.Trim(r.URL.Path, "/")
+		if path == "" {
+			search(s, w, r)
+			return
+		}
+
+		id := strings.TrimSuffix(path, "/audio")
+		e, getErr := s.Get(id)
+		if errors.Is(getErr, ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		} else if getErr != nil {
+			http.Error(w, getErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if id == path {
+			writeJSON(w, http.StatusOK, e)
+			return
+		}
+		serveAudio(w, r, e, open)
+	})
+}
+
+func search(s *Store, w http.ResponseWriter, r *http.Request) {
+	q, queryErr := parseQuery(r)
+	if queryErr != nil {
+		http.Error(w, queryErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, searchErr := s.Search(q)
+	if searchErr != nil {
+		http.Error(w, searchErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// parseQuery reads a Query from the query parameters. Times are RFC 3339.
+func parseQuery(r *http.Request) (Query, error) {
+	params := r.URL.Query()
+	q := Query{
+		System:     params.Get("system"),
+		Department: params.Get("department"),
+		TGID:       params.Get("tgid"),
+		UnitID:     params.Get("unit"),
+		Text:       params.Get("q"),
+		AudioOnly:  params.Get("audio") == "true",
+	}
+
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if raw := params.Get(name); raw != "" {
+			parsed, parseErr := time.Parse(time.RFC3339, raw)
+			if parseErr != nil {
+				return q, fmt.Errorf("invalid %s: %w", name, parseErr)
+			}
+			*t = parsed
+		}
+	}
+	for name, n := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if raw := params.Get(name); raw != "" {
+			parsed, parseErr := strconv.Atoi(raw)
+			if parseErr != nil {
+				return q, fmt.Errorf("invalid %s: %w", name, parseErr)
+			}
+			*n = parsed
+		}
+	}
+	return q, nil
+}
+
+// serveAudio streams the WAV file of an entry.
+func serveAudio(w http.ResponseWriter, r *http.Request, e *Entry, open AudioOpener) {
+	if !e.HasAudio() {
+		http.Error(w, "entry has no recording", http.StatusNotFound)
+		return
+	}
+
+	audio, modTime, openErr := open(e)
+	if errors.Is(openErr, ErrAudioNotFound) {
+		http.Error(w, openErr.Error(), http.StatusNotFound)
+		return
+	} else if openErr != nil {
+		http.Error(w, openErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer audio.Close()
+
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeContent(w, r, path.Base(e.AudioPath), modTime, audio)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,141 @@
+package history
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/alias"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Query selects entries. Empty fields match everything.
+type Query struct {
+	// From and To limit the start of the entries
+	From time.Time
+	To   time.Time
+	// System and Department match names, ignoring case
+	System     string
+	Department string
+	// TGID and UnitID match with or without their TGID: and UID: prefixes
+	TGID   string
+	UnitID string
+	// Text is searched for in the names of the system, department, channel, site and aliases
+	Text string
+	// AudioOnly leaves out calls without a recording
+	AudioOnly bool
+	Limit     int
+	Offset    int
+}
+
+// Result is a page of the entries matching a query, newest first.
+type Result struct {
+	// Total is the number of entries matching the query on all pages
+	Total   int      `json:"total"`
+	Offset  int      `json:"offset"`
+	Entries []*Entry `json:"entries"`
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if q.System != "" && !strings.EqualFold(q.System, e.System) {
+		return false
+	}
+	if q.Department != "" && !strings.EqualFold(q.Department, e.Department) {
+		return false
+	}
+	if q.TGID != "" && alias.NormalizeID(q.TGID) != alias.NormalizeID(e.TGID) {
+		return false
+	}
+	if q.UnitID != "" && !e.heard(alias.NormalizeID(q.UnitID)) {
+		return false
+	}
+	if q.AudioOnly && !e.HasAudio() {
+		return false
+	}
+	if q.Text != "" && !strings.Contains(e.text(), strings.ToLower(q.Text)) {
+		return false
+	}
+	return true
+}
+
+// heard reports whether a unit was heard during the entry, by the call or in the recording.
+func (e *Entry) heard(unitID string) bool {
+	for _, unit := range e.Units {
+		if alias.NormalizeID(unit) == unitID {
+			return true
+		}
+	}
+	if e.Recording == nil {
+		return false
+	}
+	if e.Recording.Public != nil && alias.NormalizeID(e.Recording.Public.UnitID) == unitID {
+		return true
+	}
+	return e.Recording.Private != nil && alias.NormalizeID(e.Recording.Private.Metadata.UnitID) == unitID
+}
+
+// text returns the names of an entry in lower case for free text search.
+func (e *Entry) text() string {
+	names := []string{e.System, e.Department, e.Channel, e.Site}
+	if e.Recording != nil {
+		if e.Recording.Public != nil {
+			names = append(names, e.Recording.Public.System, e.Recording.Public.Department, e.Recording.Public.Channel, e.Recording.Public.FavoriteListName)
+		}
+		if e.Recording.Aliases != nil {
+			names = append(names, e.Recording.Aliases.TGIDName, e.Recording.Aliases.TGIDTags, e.Recording.Aliases.UnitIDName, e.Recording.Aliases.UnitIDTags)
+		}
+	}
+	return strings.ToLower(strings.Join(names, "\n"))
+}
+
+// Search returns the entries matching the query, newest first.
+func (s *Store) Search(q Query) (*Result, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	result := &Result{Offset: q.Offset, Entries: []*Entry{}}
+	viewErr := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketEntries).Cursor()
+
+		var k, v []byte
+		if q.To.IsZero() {
+			k, v = cursor.Last()
+		} else if k, v = cursor.Seek(timeKey(q.To)); k == nil {
+			k, v = cursor.Last()
+		}
+
+		for ; k != nil; k, v = cursor.Prev() {
+			if !q.To.IsZero() && keyTime(k).After(q.To) {
+				continue
+			}
+			if !q.From.IsZero() && keyTime(k).Before(q.From) {
+				break
+			}
+
+			e := &Entry{}
+			if unmarshalErr := json.Unmarshal(v, e); unmarshalErr != nil {
+				return unmarshalErr
+			}
+			if !q.matches(e) {
+				continue
+			}
+
+			if result.Total >= q.Offset && len(result.Entries) < q.Limit {
+				result.Entries = append(result.Entries, e)
+			}
+			result.Total++
+		}
+		return nil
+	})
+	if viewErr != nil {
+		return nil, viewErr
+	}
+	return result, nil
+}
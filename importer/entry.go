@@ -0,0 +1,162 @@
+// Package importer reads recording logs exported by third party tools and merges them with wavparse decoded metadata.
+package importer
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+type Format string
+
+const (
+	FormatWavPlayer Format = "wavplayer"
+	FormatProScan   Format = "proscan"
+	FormatTheaton   Format = "theaton"
+)
+
+// Formats lists every supported import format.
+var Formats = []Format{FormatWavPlayer, FormatProScan, FormatTheaton}
+
+// ErrUnknownFormat is returned when asked to read a format that isn't supported.
+var ErrUnknownFormat = fmt.Errorf("unknown import format")
+
+// Entry is a single recording as described by a third party tool. Every format is converted into an Entry.
+type Entry struct {
+	FileName       string
+	Product        string
+	Timestamp      time.Time
+	Duration       time.Duration
+	ScanMode       string
+	SystemType     string
+	Frequency      float64
+	Code           string
+	FavoriteName   string
+	SystemName     string
+	DepartmentName string
+	ChannelName    string
+	SiteName       string
+	TGID           string
+	UnitID         string
+	UnitIDName     string
+	Latitude       float64
+	Longitude      float64
+}
+
+// Read reads every entry from an export in the given format.
+func Read(r io.Reader, format Format, delimiter rune) ([]*Entry, error) {
+	switch format {
+	case FormatWavPlayer:
+		return readEntries(r, delimiter, &[]*WavPlayerEntry{})
+	case FormatProScan:
+		return readEntries(r, delimiter, &[]*ProScanEntry{})
+	case FormatTheaton:
+		return readEntries(r, delimiter, &[]*TheatonEntry{})
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+// DefaultDelimiter returns the field delimiter the tool writes by default.
+func DefaultDelimiter(format Format) rune {
+	if format == FormatWavPlayer {
+		return ';'
+	}
+	return ','
+}
+
+// Recording converts the entry into a recording for entries without a matching WAV file.
+func (e *Entry) Recording() *wavparse.Recording {
+	rec := &wavparse.Recording{
+		File:     e.FileName,
+		Duration: wavparse.StopwatchDuration(e.Duration),
+		Public: &wavparse.ListChunk{
+			System:           e.SystemName,
+			Department:       e.DepartmentName,
+			Channel:          e.ChannelName,
+			TGIDFreq:         e.TGID,
+			Product:          e.Product,
+			Tone:             e.Code,
+			UnitID:           e.UnitID,
+			FavoriteListName: e.FavoriteName,
+		},
+		Private: &wavparse.UnidenChunk{},
+	}
+
+	if !e.Timestamp.IsZero() {
+		ts := e.Timestamp
+		rec.Public.Timestamp = &ts
+	}
+
+	rec.Private.Favorite.Name = e.FavoriteName
+	rec.Private.System.Name = e.SystemName
+	rec.Private.System.Type = e.SystemType
+	rec.Private.Department.Name = e.DepartmentName
+	rec.Private.Department.Latitude = e.Latitude
+	rec.Private.Department.Longitude = e.Longitude
+	rec.Private.Channel.Name = e.ChannelName
+	rec.Private.Channel.TGIDFrequency = e.TGID
+	rec.Private.Channel.ToneCode = e.Code
+	rec.Private.Site.Name = e.SiteName
+	rec.Private.Metadata.TGID = e.TGID
+	rec.Private.Metadata.Frequency = e.Frequency
+	rec.Private.Metadata.UnitID = e.UnitID
+
+	return rec
+}
+
+// fileName returns the base name of a file path written on any OS.
+func fileName(path string) string {
+	path = strings.ReplaceAll(path, `\`, "/")
+	return filepath.Base(path)
+}
+
+// parseFrequency parses frequencies written with or without a MHz suffix.
+func parseFrequency(raw string) (float64, error) {
+	raw = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(raw), "MHz"))
+	if raw == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+// parseClock parses durations written as hh:mm:ss or mm:ss.
+func parseClock(raw string) (time.Duration, error) {
+	split := strings.Split(strings.TrimSpace(raw), ":")
+	if len(split) == 2 {
+		split = append([]string{"0"}, split...)
+	}
+	if len(split) != 3 {
+		return 0, fmt.Errorf("duration %s is not formatted as hh:mm:ss", raw)
+	}
+	return time.ParseDuration(fmt.Sprintf("%sh%sm%ss", split[0], split[1], split[2]))
+}
+
+// timestampFormats are the layouts spreadsheet exports commonly use, in the order they are tried.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"1/2/2006 15:04:05",
+	"1/2/2006 3:04:05 PM",
+	"01/02/2006 15:04:05",
+	"20060102150405",
+}
+
+// parseTimestamp parses a local timestamp in any of the common spreadsheet layouts.
+func parseTimestamp(raw string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timestampFormats {
+		if ts, tsErr := time.ParseInLocation(layout, raw, time.Local); tsErr == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("timestamp %s is not in a known format", raw)
+}
@@ -0,0 +1,98 @@
+package importer_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/importer"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadWavPlayer(t *testing.T) {
+	exportFile, openErr := os.Open("../wavparse/fixtures.csv")
+	if openErr != nil {
+		t.Fatalf("error when opening WavPlayer export: %v", openErr)
+	}
+	defer exportFile.Close()
+
+	entries, readErr := importer.Read(exportFile, importer.FormatWavPlayer, importer.DefaultDelimiter(importer.FormatWavPlayer))
+	if readErr != nil {
+		t.Fatalf("error when reading WavPlayer export: %v", readErr)
+	}
+
+	assert := assert.New(t)
+	assert.NotEmpty(entries, "WavPlayer export should have entries")
+	assert.Equal("2020-06-21_18-06-38.wav", entries[0].FileName)
+	assert.Equal("Howard County (Project 25)", entries[0].SystemName)
+	assert.Equal("2468170", entries[0].UnitID)
+	assert.Equal(858.2375, entries[0].Frequency)
+	assert.Equal(time.Second, entries[0].Duration)
+}
+
+func TestReadProScan(t *testing.T) {
+	export := `Date,Time,Duration,Frequency,Mode,Tone,System,Department,Channel,Site,TGID,UID,UID Alias,File
+2020/06/21,18:06:38,00:04,858.2375 MHz,P25Standard,,Howard County (Project 25),Police,District 1 Dispatch,Site 2,10961,2468170,Engine 5,C:\Recordings\2020-06-21_18-06-38.wav
+`
+	entries, readErr := importer.Read(strings.NewReader(export), importer.FormatProScan, ',')
+	if readErr != nil {
+		t.Fatalf("error when reading ProScan export: %v", readErr)
+	}
+
+	assert := assert.New(t)
+	assert.Len(entries, 1)
+	assert.Equal("2020-06-21_18-06-38.wav", entries[0].FileName)
+	assert.Equal("Engine 5", entries[0].UnitIDName)
+	assert.Equal(858.2375, entries[0].Frequency)
+	assert.Equal(4*time.Second, entries[0].Duration)
+	assert.Equal(time.Date(2020, 6, 21, 18, 6, 38, 0, time.Local), entries[0].Timestamp)
+}
+
+func TestReadTheaton(t *testing.T) {
+	export := `Folder,File,Date/Time,Scanner,Favorite List,System,System Type,Department,Channel,Site,TGID,Frequency,Tone,Unit ID,Latitude,Longitude
+2020-06-21,2020-06-21_18-06-38.wav,6/21/2020 6:06:39 PM,BCDx36HP,HoCo,Howard County (Project 25),P25Standard,Police,District 1 Dispatch,Site 2,10961,858.2375,,2468170,39.2,-76.8
+`
+	entries, readErr := importer.Read(strings.NewReader(export), importer.FormatTheaton, ',')
+	if readErr != nil {
+		t.Fatalf("error when reading theaton export: %v", readErr)
+	}
+
+	assert := assert.New(t)
+	assert.Len(entries, 1)
+	assert.Equal("HoCo", entries[0].FavoriteName)
+	assert.Equal(39.2, entries[0].Latitude)
+	assert.Equal(time.Date(2020, 6, 21, 18, 6, 39, 0, time.Local), entries[0].Timestamp)
+}
+
+func TestMerge(t *testing.T) {
+	decoded, decodeErr := wavparse.DecodeRecording("../wavparse/fixtures/2020-06-21_18-06-38.wav")
+	if decodeErr != nil {
+		t.Fatalf("error when decoding fixture: %v", decodeErr)
+	}
+
+	entries := []*importer.Entry{
+		{FileName: "2020-06-21_18-06-38.wav", SystemName: "Imported", UnitIDName: "Engine 5"},
+		{FileName: "deleted.wav", SystemName: "Historical", TGID: "10961"},
+	}
+
+	merged := importer.Merge([]*wavparse.Recording{decoded}, entries)
+
+	assert := assert.New(t)
+	assert.Len(merged, 2)
+
+	assert.Equal(importer.SourceBoth, merged[0].Source)
+	assert.Equal("Engine 5", merged[0].UnitIDName)
+	assert.Equal(decoded.Public.System, merged[0].Public.System, "Decoded metadata should win over imported entries")
+
+	assert.Equal(importer.SourceImport, merged[1].Source)
+	assert.Equal("Historical", merged[1].Public.System)
+	assert.Equal("10961", merged[1].Private.Metadata.TGID)
+}
+
+func TestReadUnknownFormat(t *testing.T) {
+	_, readErr := importer.Read(strings.NewReader(""), importer.Format("nope"), ',')
+	assert.True(t, errors.Is(readErr, importer.ErrUnknownFormat), "Unknown formats should return ErrUnknownFormat")
+}
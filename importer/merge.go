@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"sort"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+const (
+	SourceWAV    = "wav"
+	SourceImport = "import"
+	SourceBoth   = "both"
+)
+
+// Record is a recording combined with the information only a third party tool knew about.
+type Record struct {
+	wavparse.Recording
+	ScanMode   string `csv:"Import_ScanMode" json:",omitempty"`
+	UnitIDName string `csv:"Import_UnitIDName" json:",omitempty"`
+	Source     string `csv:"Import_Source"`
+}
+
+// Merge combines decoded recordings with imported entries, matched by file name.
+// Decoded metadata always wins, imported entries only fill in chunks the WAV file was missing.
+// Entries without a matching recording are converted so historical logs can be carried over.
+func Merge(recordings []*wavparse.Recording, entries []*Entry) []*Record {
+	byFile := make(map[string]*Entry, len(entries))
+	for _, entry := range entries {
+		byFile[entry.FileName] = entry
+	}
+
+	merged := make([]*Record, 0, len(recordings)+len(entries))
+	matched := map[string]bool{}
+
+	for _, rec := range recordings {
+		record := &Record{
+			Recording: *rec,
+			Source:    SourceWAV,
+		}
+
+		if entry, ok := byFile[rec.File]; ok {
+			matched[rec.File] = true
+			record.Source = SourceBoth
+			record.ScanMode = entry.ScanMode
+			record.UnitIDName = entry.UnitIDName
+
+			converted := entry.Recording()
+			if record.Public == nil {
+				record.Public = converted.Public
+			}
+			if record.Private == nil {
+				record.Private = converted.Private
+			}
+			if record.Duration == 0 {
+				record.Duration = converted.Duration
+			}
+		}
+
+		merged = append(merged, record)
+	}
+
+	for _, entry := range entries {
+		if matched[entry.FileName] {
+			continue
+		}
+		merged = append(merged, &Record{
+			Recording:  *entry.Recording(),
+			ScanMode:   entry.ScanMode,
+			UnitIDName: entry.UnitIDName,
+			Source:     SourceImport,
+		})
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].File < merged[j].File
+	})
+
+	return merged
+}
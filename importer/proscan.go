@@ -0,0 +1,56 @@
+package importer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProScanEntry is a row of a ProScan audio recording log exported to CSV.
+type ProScanEntry struct {
+	Date        string `csv:"Date"`
+	Time        string `csv:"Time"`
+	Duration    string `csv:"Duration"`
+	Frequency   string `csv:"Frequency"`
+	Mode        string `csv:"Mode"`
+	Tone        string `csv:"Tone"`
+	System      string `csv:"System"`
+	Department  string `csv:"Department"`
+	Channel     string `csv:"Channel"`
+	Site        string `csv:"Site"`
+	TGID        string `csv:"TGID"`
+	UnitID      string `csv:"UID"`
+	UnitIDAlias string `csv:"UID Alias"`
+	FileName    string `csv:"File"`
+}
+
+func (p *ProScanEntry) Entry() (*Entry, error) {
+	entry := &Entry{
+		FileName:       fileName(p.FileName),
+		SystemType:     p.Mode,
+		Code:           p.Tone,
+		SystemName:     p.System,
+		DepartmentName: p.Department,
+		ChannelName:    p.Channel,
+		SiteName:       p.Site,
+		TGID:           p.TGID,
+		UnitID:         p.UnitID,
+		UnitIDName:     p.UnitIDAlias,
+	}
+
+	var parseErr error
+	if entry.Timestamp, parseErr = parseTimestamp(strings.TrimSpace(p.Date + " " + p.Time)); parseErr != nil {
+		return nil, parseErr
+	}
+
+	if strings.TrimSpace(p.Duration) != "" {
+		if entry.Duration, parseErr = parseClock(p.Duration); parseErr != nil {
+			return nil, parseErr
+		}
+	}
+
+	if entry.Frequency, parseErr = parseFrequency(p.Frequency); parseErr != nil {
+		return nil, fmt.Errorf("error when parsing frequency %s: %w", p.Frequency, parseErr)
+	}
+
+	return entry, nil
+}
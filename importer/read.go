@@ -0,0 +1,42 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/gocarina/gocsv"
+)
+
+// converter is implemented by every format specific row type.
+type converter interface {
+	Entry() (*Entry, error)
+}
+
+// readEntries unmarshals CSV rows into out, a pointer to a slice of converters, and converts every row to an Entry.
+func readEntries(r io.Reader, delimiter rune, out interface{}) ([]*Entry, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	if unmarshalErr := gocsv.UnmarshalCSV(reader, out); unmarshalErr != nil {
+		return nil, fmt.Errorf("error when unmarshalling csv: %w", unmarshalErr)
+	}
+
+	rows := reflect.ValueOf(out).Elem()
+	entries := make([]*Entry, 0, rows.Len())
+	for i := 0; i < rows.Len(); i++ {
+		row, ok := rows.Index(i).Interface().(converter)
+		if !ok || rows.Index(i).IsNil() {
+			continue
+		}
+		entry, entryErr := row.Entry()
+		if entryErr != nil {
+			return nil, fmt.Errorf("error when converting row %d: %w", i+1, entryErr)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
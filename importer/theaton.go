@@ -0,0 +1,67 @@
+package importer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TheatonEntry is a row of a sheet from theaton's BCD436HP WAV File Manager saved as CSV.
+// See wavparse/Specification/SpecNotes.md for the fields the spreadsheet extracts.
+type TheatonEntry struct {
+	Folder       string `csv:"Folder"`
+	FileName     string `csv:"File"`
+	DateTime     string `csv:"Date/Time"`
+	Scanner      string `csv:"Scanner"`
+	FavoriteList string `csv:"Favorite List"`
+	System       string `csv:"System"`
+	SystemType   string `csv:"System Type"`
+	Department   string `csv:"Department"`
+	Channel      string `csv:"Channel"`
+	Site         string `csv:"Site"`
+	TGID         string `csv:"TGID"`
+	Frequency    string `csv:"Frequency"`
+	Tone         string `csv:"Tone"`
+	UnitID       string `csv:"Unit ID"`
+	Latitude     string `csv:"Latitude"`
+	Longitude    string `csv:"Longitude"`
+}
+
+func (t *TheatonEntry) Entry() (*Entry, error) {
+	entry := &Entry{
+		FileName:       fileName(t.FileName),
+		Product:        t.Scanner,
+		SystemType:     t.SystemType,
+		Code:           t.Tone,
+		FavoriteName:   t.FavoriteList,
+		SystemName:     t.System,
+		DepartmentName: t.Department,
+		ChannelName:    t.Channel,
+		SiteName:       t.Site,
+		TGID:           t.TGID,
+		UnitID:         t.UnitID,
+	}
+
+	var parseErr error
+	if entry.Timestamp, parseErr = parseTimestamp(t.DateTime); parseErr != nil {
+		return nil, parseErr
+	}
+
+	if entry.Frequency, parseErr = parseFrequency(t.Frequency); parseErr != nil {
+		return nil, fmt.Errorf("error when parsing frequency %s: %w", t.Frequency, parseErr)
+	}
+
+	if strings.TrimSpace(t.Latitude) != "" {
+		if entry.Latitude, parseErr = strconv.ParseFloat(strings.TrimSpace(t.Latitude), 64); parseErr != nil {
+			return nil, fmt.Errorf("error when parsing latitude %s: %w", t.Latitude, parseErr)
+		}
+	}
+
+	if strings.TrimSpace(t.Longitude) != "" {
+		if entry.Longitude, parseErr = strconv.ParseFloat(strings.TrimSpace(t.Longitude), 64); parseErr != nil {
+			return nil, fmt.Errorf("error when parsing longitude %s: %w", t.Longitude, parseErr)
+		}
+	}
+
+	return entry, nil
+}
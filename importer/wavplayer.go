@@ -0,0 +1,95 @@
+package importer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WavPlayerTime is a timestamp as written by UniDen WavPlayer.
+type WavPlayerTime struct {
+	time.Time
+}
+
+const wavPlayerTimeFormat = "1/02/2006 3:04:05 PM"
+
+// Convert the internal date as CSV string.
+func (date *WavPlayerTime) MarshalCSV() (string, error) {
+	return date.Time.Format(wavPlayerTimeFormat), nil
+}
+
+// Convert the CSV string as internal date.
+func (date *WavPlayerTime) UnmarshalCSV(csv string) (err error) {
+	date.Time, err = time.ParseInLocation(wavPlayerTimeFormat, csv, time.Local)
+	return err
+}
+
+// WavPlayerDuration is a duration as written by UniDen WavPlayer.
+type WavPlayerDuration struct {
+	time.Duration
+}
+
+// Convert the internal duration as CSV string.
+func (clock *WavPlayerDuration) MarshalCSV() (string, error) {
+	return clock.Duration.String(), nil
+}
+
+// Convert the CSV string as internal duration.
+func (clock *WavPlayerDuration) UnmarshalCSV(csv string) (err error) {
+	split := strings.Split(csv, ":")
+	if len(split) != 3 {
+		return fmt.Errorf("duration %s is not formatted as hh:mm:ss", csv)
+	}
+	clock.Duration, err = time.ParseDuration(fmt.Sprintf("%sh%sm%ss", split[0], split[1], split[2]))
+	return err
+}
+
+// WavPlayerEntry is a row of the semicolon delimited CSV exported by UniDen WavPlayer.
+type WavPlayerEntry struct {
+	FilePath       string            `csv:"File path"`
+	FileName       string            `csv:"File name"`
+	Product        string            `csv:"Scanner type"`
+	DateAndTime    WavPlayerTime     `csv:"Date and time"`
+	Duration       WavPlayerDuration `csv:"Duration"`
+	ScanMode       string            `csv:"Scan mode"`
+	SystemType     string            `csv:"Type"`
+	Frequency      float64           `csv:"Frequency"`
+	Code           string            `csv:"Code"`
+	FavoriteName   string            `csv:"Favorite name"`
+	SystemName     string            `csv:"System name"`
+	DepartmentName string            `csv:"Department name"`
+	ChannelName    string            `csv:"Channel name"`
+	SiteName       string            `csv:"Site"`
+	TGID           string            `csv:"TGID"`
+	UnitID         string            `csv:"UID"`
+	UnitIDName     string            `csv:"UID Name"`
+	Latitude       float64           `csv:"Latitude"`
+	Longitude      float64           `csv:"Longitude"`
+}
+
+func (w *WavPlayerEntry) Entry() (*Entry, error) {
+	name := w.FileName
+	if name == "" {
+		name = fileName(w.FilePath)
+	}
+	return &Entry{
+		FileName:       name,
+		Product:        w.Product,
+		Timestamp:      w.DateAndTime.Time,
+		Duration:       w.Duration.Duration,
+		ScanMode:       w.ScanMode,
+		SystemType:     w.SystemType,
+		Frequency:      w.Frequency,
+		Code:           w.Code,
+		FavoriteName:   w.FavoriteName,
+		SystemName:     w.SystemName,
+		DepartmentName: w.DepartmentName,
+		ChannelName:    w.ChannelName,
+		SiteName:       w.SiteName,
+		TGID:           w.TGID,
+		UnitID:         w.UnitID,
+		UnitIDName:     w.UnitIDName,
+		Latitude:       w.Latitude,
+		Longitude:      w.Longitude,
+	}, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+
+	"github.com/Bearcatter/bearcatter/alias"
+)
+
+// nameAttr matches the Name attribute of an XML start element.
+var nameAttr = regexp.MustCompile(`\sName\s*=\s*("[^"]*"|'[^']*')`)
+
+// applyAliases names the unit and talkgroup of a GSI or PSI update from the alias store.
+// It returns true if anything was renamed.
+func applyAliases(store *alias.Store, si *ScannerInfo) bool {
+	if store == nil {
+		return false
+	}
+
+	applied := false
+
+	if unit := store.Unit(si.UnitID.UID, si.System.Name); unit != nil {
+		si.UnitID.Name = unit.Name
+		applied = true
+	}
+
+	if talkgroup := store.Talkgroup(si.TGID.TGID, si.System.Name); talkgroup != nil {
+		si.TGID.Name = talkgroup.Name
+		applied = true
+	}
+
+	return applied
+}
+
+// aliasedScannerInfo returns the XML to forward for a GSI or PSI update. If any alias was applied, the Name
+// attributes of the UnitID and TGID elements are rewritten in raw, so everything the scanner sent that ScannerInfo
+// does not model is forwarded as it was.
+func aliasedScannerInfo(store *alias.Store, si *ScannerInfo, raw []byte) []byte {
+	if !applyAliases(store, si) {
+		return raw
+	}
+	rewritten, rewriteErr := rewriteNames(raw, map[string]string{"UnitID": si.UnitID.Name, "TGID": si.TGID.Name})
+	if rewriteErr != nil {
+		return raw
+	}
+	return rewritten
+}
+
+// rewriteNames sets the Name attribute of the elements directly below the root of raw to the names by element,
+// leaving the rest of raw untouched.
+func rewriteNames(raw []byte, names map[string]string) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+
+	var out bytes.Buffer
+	written := int64(0)
+	depth := 0
+	for {
+		start := decoder.InputOffset()
+		token, tokenErr := decoder.RawToken()
+		if tokenErr == io.EOF {
+			break
+		}
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			depth++
+			name, ok := names[element.Name.Local]
+			if depth != 2 || !ok || name == "" {
+				continue
+			}
+			end := decoder.InputOffset()
+			out.Write(raw[written:start])
+			out.Write(setName(raw[start:end], name))
+			written = end
+		case xml.EndElement:
+			depth--
+		}
+	}
+	out.Write(raw[written:])
+	return out.Bytes(), nil
+}
+
+// setName sets the Name attribute of the start element tag, adding it after the element name if it has none.
+func setName(tag []byte, name string) []byte {
+	var escaped bytes.Buffer
+	escaped.WriteString(` Name="`)
+	xml.EscapeText(&escaped, []byte(name))
+	escaped.WriteString(`"`)
+
+	if loc := nameAttr.FindIndex(tag); loc != nil {
+		return append(append(append([]byte{}, tag[:loc[0]]...), escaped.Bytes()...), tag[loc[1]:]...)
+	}
+	at := 1 + bytes.IndexAny(tag[1:], " \t\r\n/>")
+	return append(append(append([]byte{}, tag[:at]...), escaped.Bytes()...), tag[at:]...)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/stretchr/testify/assert"
+)
+
+const aliasedGSI = `<?xml version="1.0" encoding="utf-8"?>
+<ScannerInfo Mode="Trunk Scan" V_Screen="trunk_scan" Firmware="1.23.05">
+	<System Name="Howard County (Project 25)" Index="1" />
+	<TGID Name="TGID 10961" TGID="10961" SvcType="Fire Dispatch" Color="Red" />
+	<UnitID U_Id="2468170" />
+	<ViewDescription>
+		<InfoArea1 Text="S0:12-*-5" />
+		<TGID Name="Not the talkgroup" />
+	</ViewDescription>
+</ScannerInfo>`
+
+func TestAliasedScannerInfoKeepsUnmodelledXML(t *testing.T) {
+	store := alias.NewStore()
+	assert := assert.New(t)
+	assert.NoError(store.Add(&alias.Alias{Kind: alias.KindTalkgroup, ID: "10961", Name: "Fire & Rescue"}))
+	assert.NoError(store.Add(&alias.Alias{Kind: alias.KindUnit, ID: "2468170", Name: "Engine 5"}))
+
+	si := ScannerInfo{}
+	assert.NoError(xml.Unmarshal([]byte(aliasedGSI), &si))
+
+	aliased := string(aliasedScannerInfo(store, &si, []byte(aliasedGSI)))
+	expected := strings.NewReplacer(
+		`<TGID Name="TGID 10961"`, `<TGID Name="Fire &amp; Rescue"`,
+		`<UnitID U_Id`, `<UnitID Name="Engine 5" U_Id`,
+	).Replace(aliasedGSI)
+	assert.Equal(expected, aliased, "Only the names of the talkgroup and unit should change")
+
+	assert.NoError(xml.Unmarshal([]byte(aliased), &si))
+	assert.Equal("Fire & Rescue", si.TGID.Name)
+	assert.Equal("Engine 5", si.UnitID.Name)
+
+	unaliased := []byte(`<?xml version="1.0" encoding="utf-8"?><ScannerInfo><TGID Name="Other" TGID="1" /></ScannerInfo>`)
+	other := ScannerInfo{}
+	assert.NoError(xml.Unmarshal(unaliased, &other))
+	assert.Equal(unaliased, aliasedScannerInfo(store, &other, unaliased))
+}
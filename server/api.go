@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiLists maps the list names of /api/lists/ to their GLT list type and the query parameter holding their index.
+var apiLists = map[string]struct {
+	listType GltXmlType
+	index    string
+}{
+	"favorites":   {GltXmlFL, ""},
+	"systems":     {GltXmlSYS, "favorite"},
+	"departments": {GltXmlDEPT, "system"},
+	"sites":       {GltXmlSITE, "system"},
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &apiError{Error: err.Error()})
+}
+
+// writeCommandError picks the status code for an error of a typed command.
+func writeCommandError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrCommandRejected), errors.Is(err, ErrInvalidParams):
+		writeError(w, http.StatusUnprocessableEntity, err)
+	case errors.Is(err, ErrUnsupportedList):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrLocked):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, err)
+	case errors.Is(err, ErrServerStopped), errors.Is(err, ErrQueueFull):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// writeResult writes the result of a typed command, or no content for commands without one.
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case err != nil:
+		writeCommandError(w, err)
+	case v == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if decodeErr := json.NewDecoder(r.Body).Decode(v); decodeErr != nil {
+		writeError(w, http.StatusBadRequest, decodeErr)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+}
+
+// apiHandler serves the REST API for controlling the scanner. It is documented by the OpenAPI document at /api/openapi.yaml.
+func apiHandler(ctrl *ScannerCtrl) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write([]byte(OpenAPI))
+	})
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+
+		// Without PSI running the snapshot may be old or empty, so ask the scanner on request
+		if r.URL.Query().Get("refresh") == "true" {
+			info, infoErr := ctrl.GetScannerInfo(r.Context())
+			if infoErr != nil {
+				writeCommandError(w, infoErr)
+				return
+			}
+			status, statusErr := ctrl.GetStatus(r.Context())
+			if statusErr != nil {
+				writeCommandError(w, statusErr)
+				return
+			}
+
+			// The replies may be answered before they made it into the snapshot
+			now := time.Now()
+			applyAliases(ctrl.aliases, info)
+			snapshot := ctrl.Snapshot()
+			snapshot.Info, snapshot.InfoTime = info, &now
+			snapshot.Status, snapshot.StatusTime = status, &now
+			writeJSON(w, http.StatusOK, snapshot)
+			return
+		}
+		writeJSON(w, http.StatusOK, ctrl.Snapshot())
+	})
+
+	mux.HandleFunc("/api/lists/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+
+		list, ok := apiLists[strings.TrimPrefix(r.URL.Path, "/api/lists/")]
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrUnsupportedList)
+			return
+		}
+
+		var index string
+		if list.index != "" {
+			if index = r.URL.Query().Get(list.index); index == "" {
+				writeError(w, http.StatusBadRequest, errors.New("the "+list.index+" query parameter is required"))
+				return
+			}
+		}
+
+		result, listErr := ctrl.GetList(r.Context(), list.listType, index)
+		writeResult(w, result, listErr)
+	})
+
+	mux.HandleFunc("/api/key", controlled(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+
+		key := &KeyPress{Mode: string(KEY_MODE_PRESS)}
+		if decodeBody(w, r, key) {
+			writeResult(w, nil, ctrl.PressKey(r.Context(), key))
+		}
+	}))
+
+	mux.HandleFunc("/api/volume", controlled(ctrl, levelHandler(ctrl.GetVolume, ctrl.SetVolume)))
+	mux.HandleFunc("/api/squelch", controlled(ctrl, levelHandler(ctrl.GetSquelch, ctrl.SetSquelch)))
+
+	mux.HandleFunc("/api/hold", controlled(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+
+		params := &holdParams{}
+		if decodeBody(w, r, params) {
+			writeResult(w, nil, ctrl.Hold(r.Context(), params.Target, params.Indexes...))
+		}
+	}))
+
+	mux.HandleFunc("/api/datetime", controlled(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			info, getErr := ctrl.GetDateTime(r.Context())
+			writeResult(w, info, getErr)
+		case http.MethodPut:
+			info := &DateTimeInfo{}
+			if decodeBody(w, r, info) {
+				writeResult(w, nil, ctrl.SetDateTime(r.Context(), info))
+			}
+		default:
+			methodNotAllowed(w, "GET, PUT")
+		}
+	}))
+
+	mux.HandleFunc("/api/location", controlled(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			info, getErr := ctrl.GetLocation(r.Context())
+			writeResult(w, info, getErr)
+		case http.MethodPut:
+			info := &LocationInfo{}
+			if decodeBody(w, r, info) {
+				writeResult(w, nil, ctrl.SetLocation(r.Context(), info))
+			}
+		default:
+			methodNotAllowed(w, "GET, PUT")
+		}
+	}))
+
+	mux.HandleFunc("/api/record", controlled(ctrl, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			status, getErr := ctrl.GetRecordStatus(r.Context())
+			writeResult(w, status, getErr)
+		case http.MethodPost:
+			params := &recordParams{}
+			if decodeBody(w, r, params) {
+				writeResult(w, nil, ctrl.SetRecording(r.Context(), params.Recording))
+			}
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	}))
+
+	if ctrl.recordingsPath != "" {
+		mux.HandleFunc("/api/recordings", recordingsHandler(ctrl.recordings))
+		mux.HandleFunc("/api/recordings/", recordingsHandler(ctrl.recordings))
+	}
+
+	return mux
+}
+
+// controlled refuses the requests of a handler that change the scanner while a WebSocket client took control of it,
+// see ErrLocked. GET requests only read and are always served.
+func controlled(ctrl *ScannerCtrl, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			handler(w, r)
+			return
+		}
+		if lockedErr := ctrl.hub.lockedExternally(); lockedErr != nil {
+			writeCommandError(w, lockedErr)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// levelHandler serves a level such as the volume, read with GET and changed with PUT.
+func levelHandler(get func(context.Context) (int, error), set func(context.Context, int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			level, getErr := get(r.Context())
+			writeResult(w, &levelParams{Level: level}, getErr)
+		case http.MethodPut:
+			params := &levelParams{}
+			if decodeBody(w, r, params) {
+				writeResult(w, nil, set(r.Context(), params.Level))
+			}
+		default:
+			methodNotAllowed(w, "GET, PUT")
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+// apiRequest sends a request with an optional JSON body and decodes the JSON response into v if given.
+func apiRequest(t *testing.T, ctrl *server.ScannerCtrl, method string, path string, body interface{}, v interface{}) int {
+	var reader *bytes.Reader
+	if body != nil {
+		marshalled, marshalErr := json.Marshal(body)
+		if marshalErr != nil {
+			t.Fatalf("error when marshalling body: %v", marshalErr)
+		}
+		reader = bytes.NewReader(marshalled)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, reqErr := http.NewRequest(method, "http://"+ctrl.Addr().String()+path, reader)
+	if reqErr != nil {
+		t.Fatalf("error when creating request: %v", reqErr)
+	}
+	resp, respErr := http.DefaultClient.Do(req)
+	if respErr != nil {
+		t.Fatalf("error when sending %s %s: %v", method, path, respErr)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if decodeErr := json.NewDecoder(resp.Body).Decode(v); decodeErr != nil {
+			t.Fatalf("error when decoding %s %s: %v", method, path, decodeErr)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	scenario := sim.DefaultScenario()
+	scenario.Steps = nil
+	ctrl, simulator := startSimulatedServer(t, scenario)
+	simulator.SetCall(&sim.Call{System: "Howard County (Project 25)", Department: "Police", TGID: "10961", Signal: 4})
+
+	assert := assert.New(t)
+
+	snapshot := server.Snapshot{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/status", nil, &snapshot))
+	assert.Nil(snapshot.Info, "Nothing was received from the scanner yet")
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/status?refresh=true", nil, &snapshot))
+	if assert.NotNil(snapshot.Info) && assert.NotNil(snapshot.Status) {
+		assert.Equal("TGID:10961", snapshot.Info.TGID.TGID)
+		assert.Equal(4, snapshot.Status.SignalLevel)
+	}
+
+	favorites := server.GltFLInfo{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/lists/favorites", nil, &favorites))
+	assert.Equal("HoCo", favorites.FL[0].Name)
+	systems := server.GltSysInfo{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/lists/systems?favorite="+favorites.FL[0].Index, nil, &systems))
+	departments := server.GltDeptInfo{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/lists/departments?system="+systems.SYS[0].Index, nil, &departments))
+	assert.Len(departments.DEPT, 3)
+	sites := server.GltSiteInfo{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/lists/sites?system="+systems.SYS[0].Index, nil, &sites))
+	assert.Len(sites.SITE, 2)
+	assert.Equal(http.StatusBadRequest, apiRequest(t, ctrl, http.MethodGet, "/api/lists/sites", nil, nil))
+	assert.Equal(http.StatusNotFound, apiRequest(t, ctrl, http.MethodGet, "/api/lists/bogus", nil, nil))
+
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPost, "/api/key", map[string]string{"key": "V"}, nil))
+	assert.Equal([]string{"V,P"}, simulator.State().Keys)
+
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/volume", map[string]int{"level": 12}, nil))
+	level := struct{ Level int }{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/volume", nil, &level))
+	assert.Equal(12, level.Level)
+	assert.Equal(http.StatusUnprocessableEntity, apiRequest(t, ctrl, http.MethodPut, "/api/squelch", map[string]int{"level": 20}, nil))
+	assert.Equal(http.StatusMethodNotAllowed, apiRequest(t, ctrl, http.MethodDelete, "/api/squelch", nil, nil))
+	assert.Equal(http.StatusBadRequest, apiRequest(t, ctrl, http.MethodPut, "/api/squelch", "loud", nil))
+
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPost, "/api/hold", map[string]interface{}{"target": "DEPT", "indexes": []string{departments.DEPT[0].Index}}, nil))
+	assert.Equal("DEPT,"+departments.DEPT[0].Index, simulator.State().Hold)
+
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/datetime", map[string]interface{}{"dst": true, "time": "2020-06-21T18:06:38Z"}, nil))
+	dateTime := server.DateTimeInfo{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/datetime", nil, &dateTime))
+	assert.True(dateTime.DaylightSavings)
+	assert.Equal(2020, dateTime.Time.Year())
+
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/location", &server.LocationInfo{Latitude: 39.1, Longitude: -76.9, Range: 5}, nil))
+	location := server.LocationInfo{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/location", nil, &location))
+	assert.Equal(-76.9, location.Longitude)
+
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPost, "/api/record", map[string]bool{"recording": true}, nil))
+	assert.True(simulator.State().Recording)
+
+	// Under the default policy the first WebSocket client is in control just by connecting, which does not lock out
+	// the API
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventHello, "")
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/volume", map[string]int{"level": 3}, nil))
+	assert.Equal(3, simulator.State().Volume)
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/volume", nil, &level))
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/status?refresh=true", nil, nil))
+}
+
+func TestAPITokenControl(t *testing.T) {
+	host, scanner := server.NewPipe()
+	simulator := sim.New(sim.DefaultScenario())
+	serveSimulator(t, simulator, scanner)
+	ctrl := startServer(t, &server.Config{Transport: host, ControlPolicy: server.ControlToken, CommandTimeout: 2 * time.Second})
+
+	assert := assert.New(t)
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventHello, "")
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/volume", map[string]int{"level": 3}, nil),
+		"Connecting does not take control")
+
+	// A client that took control locks out changes from the API, which may still read
+	assert.Empty(call(t, conn, "1", "control.request", nil).Error)
+	locked := struct{ Error string }{}
+	assert.Equal(http.StatusConflict, apiRequest(t, ctrl, http.MethodPut, "/api/volume", map[string]int{"level": 5}, &locked))
+	assert.True(strings.HasPrefix(locked.Error, "locked by "), locked.Error)
+	level := struct{ Level int }{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/volume", nil, &level))
+	assert.Equal(3, level.Level)
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/lists/favorites", nil, nil))
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/status?refresh=true", nil, nil))
+
+	assert.Empty(call(t, conn, "2", "control.release", nil).Error)
+	assert.Equal(http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/volume", map[string]int{"level": 5}, nil),
+		"The API should change the scanner again once control was released")
+	assert.Equal(5, simulator.State().Volume)
+}
+
+func TestAPISharedControl(t *testing.T) {
+	host, scanner := server.NewPipe()
+	simulator := sim.New(sim.DefaultScenario())
+	serveSimulator(t, simulator, scanner)
+	ctrl := startServer(t, &server.Config{Transport: host, ControlPolicy: server.ControlShared, CommandTimeout: 2 * time.Second})
+
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventHello, "")
+	assert.Equal(t, http.StatusNoContent, apiRequest(t, ctrl, http.MethodPut, "/api/volume", map[string]int{"level": 3}, nil))
+	assert.Equal(t, 3, simulator.State().Volume)
+}
+
+func TestOpenAPI(t *testing.T) {
+	recordingsPath := recordingsDir(t)
+	host, scanner := server.NewPipe()
+	serveSimulator(t, sim.New(&sim.Scenario{PageSize: 10}), scanner)
+	ctrl := startServer(t, &server.Config{Transport: host, CommandTimeout: 2 * time.Second, RecordingsPath: recordingsPath})
+
+	resp, getErr := http.Get("http://" + ctrl.Addr().String() + "/api/openapi.yaml")
+	if getErr != nil {
+		t.Fatalf("error when getting OpenAPI document: %v", getErr)
+	}
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, readErr)
+
+	doc := struct {
+		OpenAPI string                            `yaml:"openapi"`
+		Paths   map[string]map[string]interface{} `yaml:"paths"`
+	}{}
+	if unmarshalErr := yaml.Unmarshal(body, &doc); unmarshalErr != nil {
+		t.Fatalf("error when parsing OpenAPI document: %v", unmarshalErr)
+	}
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+
+	// Every documented operation should be served
+	for path, operations := range doc.Paths {
+		path = strings.Replace(path, "{list}", "favorites", 1)
+		path = strings.Replace(path, "{name}", "2020-06-21/00-00-32.wav", 1)
+		for method := range operations {
+			req, _ := http.NewRequest(strings.ToUpper(method), "http://"+ctrl.Addr().String()+path, strings.NewReader("{}"))
+			resp, respErr := http.DefaultClient.Do(req)
+			if !assert.NoError(t, respErr) {
+				continue
+			}
+			resp.Body.Close()
+			assert.NotEqual(t, http.StatusNotFound, resp.StatusCode, "%s %s should be served", method, path)
+			assert.NotEqual(t, http.StatusMethodNotAllowed, resp.StatusCode, "%s %s should be served", method, path)
+		}
+	}
+}
+
+// recordingsDir creates a recordings directory with a recording and its metadata in a subdirectory.
+func recordingsDir(t *testing.T) string {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	recording, readErr := ioutil.ReadFile(transferFixture)
+	if readErr != nil {
+		t.Fatalf("error when reading recording: %v", readErr)
+	}
+	metadata, decodeErr := wavparse.DecodeRecording(transferFixture)
+	if decodeErr != nil {
+		t.Fatalf("error when decoding recording: %v", decodeErr)
+	}
+	metadataJSON, _ := json.Marshal(metadata)
+
+	if mkdirErr := os.Mkdir(filepath.Join(dir, "2020-06-21"), 0755); mkdirErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", mkdirErr)
+	}
+	for name, data := range map[string][]byte{
+		"2020-06-21/00-00-32.wav":      recording,
+		"2020-06-21/00-00-32.wav.json": metadataJSON,
+		"notes.txt":                    []byte("not a recording"),
+	} {
+		if writeErr := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0644); writeErr != nil {
+			t.Fatalf("error when writing %s: %v", name, writeErr)
+		}
+	}
+	return dir
+}
+
+func TestRecordings(t *testing.T) {
+	recordingsPath := recordingsDir(t)
+	host, scanner := server.NewPipe()
+	serveSimulator(t, sim.New(&sim.Scenario{PageSize: 10}), scanner)
+	ctrl := startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath})
+
+	assert := assert.New(t)
+
+	recordings := []server.SavedRecording{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/recordings", nil, &recordings))
+	if assert.Len(recordings, 1) {
+		assert.Equal("2020-06-21/00-00-32.wav", recordings[0].Name)
+		if assert.NotNil(recordings[0].Metadata) {
+			assert.Equal("Dispatch East", recordings[0].Metadata.Public.Channel)
+		}
+	}
+
+	resp, getErr := http.Get("http://" + ctrl.Addr().String() + "/api/recordings/2020-06-21/00-00-32.wav")
+	if getErr != nil {
+		t.Fatalf("error when getting recording: %v", getErr)
+	}
+	defer resp.Body.Close()
+	assert.Equal("audio/wav", resp.Header.Get("Content-Type"))
+	audio, readErr := ioutil.ReadAll(resp.Body)
+	assert.NoError(readErr)
+	original, _ := ioutil.ReadFile(transferFixture)
+	assert.Equal(original, audio)
+
+	assert.Equal(http.StatusBadRequest, apiRequest(t, ctrl, http.MethodGet, "/api/recordings/notes.txt", nil, nil))
+	// The path is cleaned before it gets to the recordings, so this ends up at /secret.wav
+	assert.Equal(http.StatusNotFound, apiRequest(t, ctrl, http.MethodGet, "/api/recordings/..%2f..%2fsecret.wav", nil, nil))
+	assert.Equal(http.StatusNotFound, apiRequest(t, ctrl, http.MethodGet, "/api/recordings/missing.wav", nil, nil))
+}
+
+func TestWebUI(t *testing.T) {
+	ctrl, _ := startSimulatedServer(t, &sim.Scenario{PageSize: 10})
+
+	resp, getErr := http.Get("http://" + ctrl.Addr().String() + "/")
+	if getErr != nil {
+		t.Fatalf("error when getting web UI: %v", getErr)
+	}
+	defer resp.Body.Close()
+	page, readErr := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, readErr)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(page), `var protocol = "bearcatter.v1.json";`)
+	for _, key := range []server.SDSKeyType{server.KEY_MENU, server.KEY_ENTER, server.KEY_ROT_LEFT, server.KEY_VOL_PUSH} {
+		assert.Contains(t, string(page), `data-key="`+html.EscapeString(string(key))+`"`)
+	}
+
+	missing, missingErr := http.Get("http://" + ctrl.Addr().String() + "/missing")
+	assert.NoError(t, missingErr)
+	missing.Body.Close()
+	assert.Equal(t, http.StatusNotFound, missing.StatusCode)
+}
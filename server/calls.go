@@ -0,0 +1,298 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/history"
+	log "github.com/sirupsen/logrus"
+)
+
+// Call events, published to JSON WebSocket clients and streamed at /events.
+const (
+	EventCallStarted = "call.started"
+	EventCallEnded   = "call.ended"
+
+	// DefaultCallHangTime is how long the scanner may stay muted before a call ends,
+	// so the pauses between the transmissions of a conversation do not split it up.
+	DefaultCallHangTime = 2 * time.Second
+)
+
+// Call is a conversation on one channel, derived from the GSI and PSI updates of the scanner.
+// A call that has not ended yet has no End.
+type Call struct {
+	ID    string     `json:"id"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	// Duration in seconds from the first to the last update with the scanner unmuted
+	Duration float64 `json:"duration"`
+	Channel
+	// Units heard during the call, in the order they were first heard
+	Units []string `json:"units,omitempty"`
+	// Signal is the strongest signal level, 0 to 5
+	Signal int        `json:"signal"`
+	RSSI   *RSSIStats `json:"rssi,omitempty"`
+}
+
+// RSSIStats summarizes the RSSI of the updates during a call.
+type RSSIStats struct {
+	Min     int     `json:"min"`
+	Max     int     `json:"max"`
+	Mean    float64 `json:"mean"`
+	Samples int     `json:"samples"`
+}
+
+func (s *RSSIStats) add(rssi int) {
+	if s.Samples == 0 || rssi < s.Min {
+		s.Min = rssi
+	}
+	if s.Samples == 0 || rssi > s.Max {
+		s.Max = rssi
+	}
+	s.Mean = (s.Mean*float64(s.Samples) + float64(rssi)) / float64(s.Samples+1)
+	s.Samples++
+}
+
+// callKey identifies the channel of a call. The unit changes between the transmissions of a call, so it is left out.
+func callKey(channel *Channel) Channel {
+	key := *channel
+	key.UnitID = ""
+	return key
+}
+
+// unmuted reports whether a GSI or PSI update shows the scanner playing audio.
+// Without the Mute property a signal is taken as audio.
+func unmuted(si *ScannerInfo) bool {
+	switch si.Property.Mute {
+	case "Unmute":
+		return true
+	case "":
+		sig, _ := strconv.Atoi(si.Property.Sig)
+		return sig > 0
+	default:
+		return false
+	}
+}
+
+// callDetector is a state machine turning GSI and PSI updates into calls. A call starts with the first unmuted update
+// on a channel and ends once the scanner was muted for hangTime or moved to another channel.
+type callDetector struct {
+	sync.Mutex
+	hangTime time.Duration
+	current  *Call
+	// lastActive is the time of the last unmuted update of the current call
+	lastActive time.Time
+}
+
+func newCallDetector(hangTime time.Duration) *callDetector {
+	if hangTime <= 0 {
+		hangTime = DefaultCallHangTime
+	}
+	return &callDetector{hangTime: hangTime}
+}
+
+// update feeds a GSI or PSI update received at now to the detector. It returns the call that ended and the call that
+// started with the update, either of which may be nil.
+func (d *callDetector) update(si *ScannerInfo, now time.Time) (ended *Call, started *Call) {
+	d.Lock()
+	defer d.Unlock()
+
+	channel := channelOf(si)
+	if channel == nil || !unmuted(si) {
+		if d.current != nil && now.Sub(d.lastActive) >= d.hangTime {
+			ended = d.end()
+		}
+		return ended, nil
+	}
+
+	if d.current != nil && callKey(channel) != callKey(&d.current.Channel) {
+		ended = d.end()
+	}
+
+	isNew := d.current == nil
+	if isNew {
+		d.current = &Call{
+			ID:      strconv.FormatInt(now.UnixNano(), 10),
+			Start:   now,
+			Channel: callKey(channel),
+		}
+	}
+
+	d.lastActive = now
+	d.current.Duration = now.Sub(d.current.Start).Seconds()
+	if channel.UnitID != "" && !containsString(d.current.Units, channel.UnitID) {
+		d.current.Units = append(d.current.Units, channel.UnitID)
+	}
+	if sig, sigErr := strconv.Atoi(si.Property.Sig); sigErr == nil && sig > d.current.Signal {
+		d.current.Signal = sig
+	}
+	if rssi, rssiErr := strconv.Atoi(si.Property.Rssi); rssiErr == nil {
+		if d.current.RSSI == nil {
+			d.current.RSSI = &RSSIStats{}
+		}
+		d.current.RSSI.add(rssi)
+	}
+
+	if isNew {
+		started = d.snapshot()
+	}
+	return ended, started
+}
+
+// flush ends the current call, for example when the server stops. It returns nil without a call.
+func (d *callDetector) flush() *Call {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.current == nil {
+		return nil
+	}
+	return d.end()
+}
+
+// end finishes the current call at its last unmuted update. d must be locked.
+func (d *callDetector) end() *Call {
+	end := d.lastActive
+	d.current.End = &end
+	d.current.Duration = end.Sub(d.current.Start).Seconds()
+
+	ended := d.current
+	d.current = nil
+	return ended
+}
+
+// snapshot copies the current call so it can be published while the detector keeps updating it. d must be locked.
+func (d *callDetector) snapshot() *Call {
+	call := *d.current
+	call.Units = append([]string(nil), d.current.Units...)
+	if d.current.RSSI != nil {
+		rssi := *d.current.RSSI
+		call.RSSI = &rssi
+	}
+	return &call
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// callLog appends every ended call as a line of JSON to a file.
+type callLog struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openCallLog(path string) (*callLog, error) {
+	file, openErr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if openErr != nil {
+		return nil, openErr
+	}
+	return &callLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (l *callLog) write(call *Call) error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.encoder.Encode(call)
+}
+
+func (l *callLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.file.Close()
+}
+
+// trackCall passes a GSI or PSI update to the call detector and announces the calls that started or ended.
+func (s *ScannerCtrl) trackCall(si *ScannerInfo) {
+	ended, started := s.calls.update(si, time.Now())
+	if ended != nil {
+		s.endCall(ended)
+	}
+	if started != nil {
+		log.Infof("Call %s started on %s %s %s", started.ID, started.System, started.Department, started.Channel.Channel)
+		s.hub.publish(EventCallStarted, started)
+		s.events.append(EventCallStarted, started)
+	}
+}
+
+// endCall logs an ended call and announces it.
+func (s *ScannerCtrl) endCall(call *Call) {
+	log.Infof("Call %s ended after %.1fs with units %v", call.ID, call.Duration, call.Units)
+	if s.callLog != nil {
+		if writeErr := s.callLog.write(call); writeErr != nil {
+			log.Errorf("Call %s: Error when writing call log: %v", call.ID, writeErr)
+		}
+	}
+	s.hub.publish(EventCallEnded, call)
+	s.events.append(EventCallEnded, call)
+	s.metrics.calls.WithLabelValues(call.System, call.TGID).Inc()
+	s.metrics.callDuration.Observe(call.Duration)
+
+	if s.history != nil {
+		if putErr := s.history.Put(historyEntry(call)); putErr != nil {
+			log.Errorf("Call %s: Error when archiving call: %v", call.ID, putErr)
+		}
+	}
+}
+
+// historyEntry turns a call into an entry of the history.
+func historyEntry(call *Call) *history.Entry {
+	marshalled, _ := json.Marshal(call)
+	return &history.Entry{
+		ID:         call.ID,
+		Start:      call.Start,
+		End:        call.End,
+		Duration:   call.Duration,
+		System:     call.System,
+		Department: call.Department,
+		Channel:    call.Channel.Channel,
+		TGID:       call.TGID,
+		Site:       call.Site,
+		Frequency:  call.Frequency,
+		Units:      call.Units,
+		Call:       marshalled,
+	}
+}
+
+// openArchived opens the recording of a history entry from the recording store, so recordings kept in object
+// storage are streamed like local ones. Entries archived without the name of their recording are opened as files.
+func (s *ScannerCtrl) openArchived(e *history.Entry) (history.Audio, time.Time, error) {
+	if e.RecordingName == "" {
+		return history.OpenFile(e)
+	}
+	audio, modTime, openErr := s.recordings.Open(e.RecordingName)
+	if errors.Is(openErr, ErrRecordingNotFound) {
+		return nil, time.Time{}, history.ErrAudioNotFound
+	}
+	return audio, modTime, openErr
+}
+
+// archiveRecording adds a downloaded recording to the history, joined to the call it was made of.
+func (s *ScannerCtrl) archiveRecording(received *FileReceived) {
+	if s.history == nil || received.Metadata == nil {
+		return
+	}
+
+	start := time.Now()
+	if received.Metadata.Public != nil && received.Metadata.Public.Timestamp != nil {
+		start = *received.Metadata.Public.Timestamp
+	}
+	entry, addErr := s.history.AddRecording(received.Metadata, received.Path, received.Recording, start)
+	if addErr != nil {
+		log.Errorf("File %s: Error when archiving recording: %v", received.Name, addErr)
+		return
+	}
+	log.Infof("File %s: Archived as %s", received.Name, entry.ID)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// psiUpdate builds a PSI update on a talkgroup, unmuted when uid is not empty.
+func psiUpdate(tgid string, uid string, rssi string) *ScannerInfo {
+	si := &ScannerInfo{}
+	si.System.Name = "Howard County"
+	si.Department.Name = "Police"
+	si.TGID.Name = "Dispatch " + tgid
+	si.TGID.TGID = "TGID:" + tgid
+	si.SiteFrequency.Freq = "851.0125MHz"
+	si.UnitID.UID = uid
+	si.Property.Rssi = rssi
+	si.Property.Mute = "Mute"
+	if uid != "" {
+		si.Property.Mute = "Unmute"
+		si.Property.Sig = "4"
+	}
+	return si
+}
+
+func TestCallDetector(t *testing.T) {
+	assert := assert.New(t)
+
+	detector := newCallDetector(2 * time.Second)
+	start := time.Date(2020, 6, 21, 18, 6, 38, 0, time.UTC)
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	ended, started := detector.update(psiUpdate("10961", "", ""), at(0))
+	assert.Nil(ended)
+	assert.Nil(started, "A muted update is no call")
+
+	ended, started = detector.update(psiUpdate("10961", "UID:1001", "-80"), at(1))
+	assert.Nil(ended)
+	if assert.NotNil(started) {
+		assert.Equal(at(1), started.Start)
+		assert.Equal("TGID:10961", started.TGID)
+		assert.Equal("", started.UnitID)
+		assert.Equal([]string{"UID:1001"}, started.Units)
+		assert.Nil(started.End)
+	}
+
+	// A pause shorter than the hang time and another unit answering are the same call
+	ended, started = detector.update(psiUpdate("10961", "", ""), at(2))
+	assert.Nil(ended)
+	assert.Nil(started)
+	ended, started = detector.update(psiUpdate("10961", "UID:1002", "-70"), at(3.5))
+	assert.Nil(ended)
+	assert.Nil(started)
+	ended, started = detector.update(psiUpdate("10961", "UID:1001", "-90"), at(4))
+	assert.Nil(ended)
+	assert.Nil(started)
+
+	// Another talkgroup ends the call right away
+	ended, started = detector.update(psiUpdate("10993", "UID:2001", ""), at(5))
+	if assert.NotNil(ended) {
+		assert.Equal(at(4), *ended.End)
+		assert.Equal(3.0, ended.Duration)
+		assert.Equal([]string{"UID:1001", "UID:1002"}, ended.Units)
+		assert.Equal(4, ended.Signal)
+		assert.Equal(&RSSIStats{Min: -90, Max: -70, Mean: -80, Samples: 3}, ended.RSSI)
+	}
+	if assert.NotNil(started) {
+		assert.Equal("TGID:10993", started.TGID)
+		assert.Nil(started.RSSI)
+	}
+
+	// The muted updates only end the call once the hang time passed
+	ended, _ = detector.update(psiUpdate("10993", "", ""), at(6))
+	assert.Nil(ended)
+	ended, started = detector.update(&ScannerInfo{}, at(7))
+	assert.Nil(started)
+	if assert.NotNil(ended) {
+		assert.Equal(at(5), *ended.End)
+		assert.Equal(0.0, ended.Duration)
+	}
+
+	_, started = detector.update(psiUpdate("10993", "UID:2001", ""), at(8))
+	assert.NotNil(started)
+	if flushed := detector.flush(); assert.NotNil(flushed) {
+		assert.Equal(at(8), *flushed.End)
+	}
+	assert.Nil(detector.flush())
+}
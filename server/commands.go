@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCommandTimeout is how long a command waits for the scanner to reply unless the context ends sooner.
+const DefaultCommandTimeout = 5 * time.Second
+
+var (
+	// ErrCommandRejected is returned when the scanner replies NG or ERR to a command.
+	ErrCommandRejected = errors.New("scanner rejected the command")
+	// ErrServerStopped is returned for commands sent after Stop was called.
+	ErrServerStopped = errors.New("server was stopped")
+	// ErrQueueFull is returned when the command could not be queued for the scanner.
+	ErrQueueFull = errors.New("command queue is full")
+	// ErrUnsupportedList is returned by GetList for list types without a matching struct.
+	ErrUnsupportedList = errors.New("list type is not supported")
+	// ErrInvalidParams is returned for commands missing a parameter the scanner needs.
+	ErrInvalidParams = errors.New("invalid parameters")
+)
+
+// gltListNames are the GLT list types as the scanner spells them.
+var gltListNames = map[GltXmlType]string{
+	GltXmlFL:          "FL",
+	GltXmlSYS:         "SYS",
+	GltXmlDEPT:        "DEPT",
+	GltXmlSITE:        "SITE",
+	GltXmlCFREQ:       "CFREQ",
+	GltXmlTGID:        "TGID",
+	GltXmlSFREQ:       "SFREQ",
+	GltXmlAFREQ:       "AFREQ",
+	GltXmlATGID:       "ATGID",
+	GltXmlFTO:         "FTO",
+	GltXmlCSBANK:      "CS_BANK",
+	GltXmlUREC:        "UREC",
+	GltXmlIREC_FILE:   "IREC_FILE",
+	GltXmlUREC_FOLDER: "UREC_FOLDER",
+	GltXmlUREC_FILE:   "UREC_FILE",
+	GltXmlTRN_DISCOV:  "TRN_DISCOV",
+	GltXmlCNV_DISCOV:  "CNV_DISCOV",
+}
+
+// commandReply is one reply to a command. params holds everything after the command name,
+// xml the document of XML replies.
+type commandReply struct {
+	params []byte
+	xml    []byte
+}
+
+type pendingCommand struct {
+	name    string
+	replies chan commandReply
+}
+
+// pagedReply reads the footer the scanner puts on every page of a long list.
+type pagedReply struct {
+	Footer struct {
+		EOT string `xml:"EOT,attr"`
+	} `xml:"Footer"`
+}
+
+// isLastPage reports whether reply finishes its command. Only XML replies with a footer saying EOT="0" are followed by more pages.
+func isLastPage(reply commandReply) bool {
+	if len(reply.xml) == 0 {
+		return true
+	}
+	paged := pagedReply{}
+	if decodeErr := xml.Unmarshal(reply.xml, &paged); decodeErr != nil {
+		return true
+	}
+	return paged.Footer.EOT != "0"
+}
+
+// deliver hands a reply from the scanner to the oldest command waiting for it.
+// A bare ERR goes to the oldest command of all, as the scanner does not say which command it could not understand.
+func (c *ScannerCtrl) deliver(name string, params []byte, xmlBody []byte) {
+	bareErr := name == "ERR" && len(params) == 0
+	if !bytes.HasPrefix(params, []byte("<XML>")) {
+		xmlBody = nil
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	for i, p := range c.pending {
+		if p.name != name && !bareErr {
+			continue
+		}
+
+		// The transport may reuse its buffers once the reader moves on
+		reply := commandReply{
+			params: append([]byte(nil), params...),
+			xml:    append([]byte(nil), xmlBody...),
+		}
+		if bareErr || isLastPage(reply) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+		}
+
+		select {
+		case p.replies <- reply:
+		default:
+			log.Warnf("Dropping %s reply, nobody is reading them", name)
+		}
+		return
+	}
+}
+
+func (c *ScannerCtrl) forget(p *pendingCommand) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	for i, pending := range c.pending {
+		if pending == p {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// exchange sends a command and passes its replies to handle until handle says it is done.
+// The scanner answers commands in order, so replies are matched to the oldest command of the same name.
+func (c *ScannerCtrl) exchange(ctx context.Context, name string, args []string, handle func(commandReply) (bool, error)) error {
+	select {
+	case <-c.quit:
+		return ErrServerStopped
+	default:
+	}
+
+	timeout := c.CommandTimeout
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	p := &pendingCommand{name: name, replies: make(chan commandReply, 64)}
+
+	c.pendingMu.Lock()
+	c.pending = append(c.pending, p)
+	c.pendingMu.Unlock()
+	defer c.forget(p)
+
+	cmd := strings.Join(append([]string{name}, args...), ",")
+	if !c.SendToHostMsgChannel([]byte(cmd)) {
+		return ErrQueueFull
+	}
+
+	for {
+		select {
+		case reply := <-p.replies:
+			done, handleErr := handle(reply)
+			if handleErr != nil {
+				return fmt.Errorf("%s: %w", cmd, handleErr)
+			}
+			if done {
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", cmd, ctx.Err())
+		case <-c.quit:
+			return ErrServerStopped
+		}
+	}
+}
+
+// request sends a command that is answered with a single reply.
+func (c *ScannerCtrl) request(ctx context.Context, name string, args ...string) (commandReply, error) {
+	var reply commandReply
+	requestErr := c.exchange(ctx, name, args, func(r commandReply) (bool, error) {
+		reply = r
+		return true, checkReply(r)
+	})
+	return reply, requestErr
+}
+
+// checkReply returns ErrCommandRejected for NG and ERR replies.
+func checkReply(reply commandReply) error {
+	params := string(reply.params)
+	switch {
+	case params == "" && len(reply.xml) == 0, params == "NG", params == "ERR":
+		return ErrCommandRejected
+	case strings.HasPrefix(params, "ERR,"):
+		return fmt.Errorf("%w: %s", ErrCommandRejected, params[4:])
+	}
+	return nil
+}
+
+// set sends a command that changes a setting and is acknowledged with OK.
+func (c *ScannerCtrl) set(ctx context.Context, name string, args ...string) error {
+	reply, requestErr := c.request(ctx, name, args...)
+	if requestErr != nil {
+		return requestErr
+	}
+	if string(reply.params) != "OK" {
+		return fmt.Errorf("%s: unexpected reply %q", name, reply.params)
+	}
+	return nil
+}
+
+func (c *ScannerCtrl) getInt(ctx context.Context, name string) (int, error) {
+	reply, requestErr := c.request(ctx, name)
+	if requestErr != nil {
+		return 0, requestErr
+	}
+	value, parseErr := strconv.Atoi(string(reply.params))
+	if parseErr != nil {
+		return 0, fmt.Errorf("%s: unexpected reply %q", name, reply.params)
+	}
+	return value, nil
+}
+
+func (c *ScannerCtrl) getXML(ctx context.Context, name string, v interface{}) error {
+	reply, requestErr := c.request(ctx, name)
+	if requestErr != nil {
+		return requestErr
+	}
+	if decodeErr := xml.Unmarshal(reply.xml, v); decodeErr != nil {
+		return fmt.Errorf("%s: failed to decode XML: %w", name, decodeErr)
+	}
+	return nil
+}
+
+// GetModel returns the model name of the scanner, such as SDS200.
+func (c *ScannerCtrl) GetModel(ctx context.Context) (string, error) {
+	reply, requestErr := c.request(ctx, "MDL")
+	return string(reply.params), requestErr
+}
+
+// GetFirmwareVersion returns the firmware version, such as "Version 1.23.07".
+func (c *ScannerCtrl) GetFirmwareVersion(ctx context.Context) (string, error) {
+	reply, requestErr := c.request(ctx, "VER")
+	return string(reply.params), requestErr
+}
+
+// GetVolume returns the volume level, 0 to 29.
+func (c *ScannerCtrl) GetVolume(ctx context.Context) (int, error) {
+	return c.getInt(ctx, "VOL")
+}
+
+// SetVolume sets the volume level, 0 to 29.
+func (c *ScannerCtrl) SetVolume(ctx context.Context, level int) error {
+	return c.set(ctx, "VOL", strconv.Itoa(level))
+}
+
+// GetSquelch returns the squelch level, 0 to 19.
+func (c *ScannerCtrl) GetSquelch(ctx context.Context) (int, error) {
+	return c.getInt(ctx, "SQL")
+}
+
+// SetSquelch sets the squelch level, 0 to 19.
+func (c *ScannerCtrl) SetSquelch(ctx context.Context, level int) error {
+	return c.set(ctx, "SQL", strconv.Itoa(level))
+}
+
+// PressKey presses a key on the scanner.
+func (c *ScannerCtrl) PressKey(ctx context.Context, key *KeyPress) error {
+	return c.set(ctx, "KEY", key.Key, key.Mode)
+}
+
+// GetStatus returns what the scanner shows on its display.
+func (c *ScannerCtrl) GetStatus(ctx context.Context) (*ScannerStatus, error) {
+	reply, requestErr := c.request(ctx, "STS")
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if strings.Count(string(reply.params), ",") < 43 {
+		return nil, fmt.Errorf("STS: unexpected reply %q", reply.params)
+	}
+	return NewScannerStatus(string(reply.params)), nil
+}
+
+// GetScannerInfo returns what the scanner is currently receiving.
+func (c *ScannerCtrl) GetScannerInfo(ctx context.Context) (*ScannerInfo, error) {
+	si := &ScannerInfo{}
+	if getErr := c.getXML(ctx, "GSI", si); getErr != nil {
+		return nil, getErr
+	}
+	return si, nil
+}
+
+// GetMenuStatus returns the menu the scanner is showing.
+func (c *ScannerCtrl) GetMenuStatus(ctx context.Context) (*MsiInfo, error) {
+	msi := &MsiInfo{}
+	if getErr := c.getXML(ctx, "MSI", msi); getErr != nil {
+		return nil, getErr
+	}
+	return msi, nil
+}
+
+// GetDateTime returns the clock of the scanner.
+func (c *ScannerCtrl) GetDateTime(ctx context.Context) (*DateTimeInfo, error) {
+	reply, requestErr := c.request(ctx, "DTM")
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if strings.Count(string(reply.params), ",") != 7 {
+		return nil, fmt.Errorf("DTM: unexpected reply %q", reply.params)
+	}
+	return NewDateTimeInfo(string(reply.params)), nil
+}
+
+// SetDateTime sets the clock of the scanner to the local time of info. RTCOK is ignored as the scanner reports it but cannot be told.
+func (c *ScannerCtrl) SetDateTime(ctx context.Context, info *DateTimeInfo) error {
+	if info.Time == nil {
+		return fmt.Errorf("DTM: %w: no time given", ErrInvalidParams)
+	}
+	dst := "0"
+	if info.DaylightSavings {
+		dst = "1"
+	}
+	return c.set(ctx, "DTM", dst, info.Time.Local().Format(DateTimeFormat))
+}
+
+// Hold holds the scanner on a system, department or channel. target and indexes are the [tkw], [xxx1] and [xxx2]
+// of the HLD command, for example Hold(ctx, "TGID", index) with an index from GLT.
+func (c *ScannerCtrl) Hold(ctx context.Context, target string, indexes ...string) error {
+	if target == "" {
+		return fmt.Errorf("HLD: %w: no target given", ErrInvalidParams)
+	}
+	return c.set(ctx, "HLD", append([]string{target}, indexes...)...)
+}
+
+// GetLocation returns the location and range the scanner uses to select systems.
+func (c *ScannerCtrl) GetLocation(ctx context.Context) (*LocationInfo, error) {
+	reply, requestErr := c.request(ctx, "LCR")
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if strings.Count(string(reply.params), ",") != 2 {
+		return nil, fmt.Errorf("LCR: unexpected reply %q", reply.params)
+	}
+	return NewLocationInfo(string(reply.params)), nil
+}
+
+// SetLocation sets the location and range the scanner uses to select systems.
+func (c *ScannerCtrl) SetLocation(ctx context.Context, info *LocationInfo) error {
+	return c.set(ctx, "LCR", info.String())
+}
+
+// GetRecordStatus returns whether the scanner is recording.
+func (c *ScannerCtrl) GetRecordStatus(ctx context.Context) (*UserRecordStatus, error) {
+	reply, requestErr := c.request(ctx, "URC")
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	return NewUserRecordStatus(string(reply.params)), nil
+}
+
+// SetRecording starts or stops recording. Errors the scanner reports, such as LOW BATTERY, are wrapped in ErrCommandRejected.
+func (c *ScannerCtrl) SetRecording(ctx context.Context, recording bool) error {
+	status := &UserRecordStatus{Recording: recording}
+	reply, requestErr := c.request(ctx, "URC", status.String())
+	if errors.Is(requestErr, ErrCommandRejected) && strings.HasPrefix(string(reply.params), "ERR,") {
+		recStatus := NewUserRecordStatus("0," + string(reply.params[4:]))
+		return fmt.Errorf("URC: %w: %s", ErrCommandRejected, *recStatus.ErrorMessage)
+	}
+	if requestErr != nil {
+		return requestErr
+	}
+	if string(reply.params) != "OK" {
+		return fmt.Errorf("URC: unexpected reply %q", reply.params)
+	}
+	return nil
+}
+
+// newGltList returns the struct the pages of a list type are decoded into.
+func newGltList(listType GltXmlType) interface{} {
+	switch listType {
+	case GltXmlFL:
+		return &GltFLInfo{}
+	case GltXmlSYS:
+		return &GltSysInfo{}
+	case GltXmlDEPT:
+		return &GltDeptInfo{}
+	case GltXmlSITE:
+		return &GltSiteInfo{}
+	case GltXmlFTO:
+		return &GltFto{}
+	case GltXmlCSBANK:
+		return &GltCSBank{}
+	case GltXmlUREC_FOLDER:
+		return &GltUrecFolder{}
+	case GltXmlTRN_DISCOV:
+		return &GltTrnDiscovery{}
+	case GltXmlCNV_DISCOV:
+		return &GltCnvDiscovery{}
+	default:
+		return nil
+	}
+}
+
+// GetList returns a list such as the favorites lists, or the systems of the favorites list at index.
+// All pages are collected into one struct matching the list type, for example *GltSysInfo for GltXmlSYS.
+// index is left out for list types that do not take one, like GltXmlFL.
+func (c *ScannerCtrl) GetList(ctx context.Context, listType GltXmlType, index string) (interface{}, error) {
+	list := newGltList(listType)
+	if list == nil {
+		return nil, ErrUnsupportedList
+	}
+
+	args := []string{gltListNames[listType]}
+	if index != "" {
+		args = append(args, index)
+	}
+
+	exchangeErr := c.exchange(ctx, "GLT", args, func(reply commandReply) (bool, error) {
+		if checkErr := checkReply(reply); checkErr != nil {
+			return true, checkErr
+		}
+		if len(reply.xml) == 0 {
+			return true, fmt.Errorf("unexpected reply %q", reply.params)
+		}
+		// Decoding every page into the same struct appends the items of the page
+		if decodeErr := xml.Unmarshal(reply.xml, list); decodeErr != nil {
+			return true, fmt.Errorf("failed to decode XML: %w", decodeErr)
+		}
+		return isLastPage(reply), nil
+	})
+	if exchangeErr != nil {
+		return nil, exchangeErr
+	}
+	return list, nil
+}
@@ -0,0 +1,167 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// startSimulatedServer runs the server against a simulator over an in-memory pipe.
+func startSimulatedServer(t *testing.T, scenario *sim.Scenario) (*server.ScannerCtrl, *sim.Simulator) {
+	host, scanner := server.NewPipe()
+
+	simulator := sim.New(scenario)
+	serveSimulator(t, simulator, scanner)
+
+	return startServer(t, &server.Config{Transport: host, CommandTimeout: 2 * time.Second}), simulator
+}
+
+func TestCommands(t *testing.T) {
+	scenario := sim.DefaultScenario()
+	scenario.Steps = nil
+	ctrl, simulator := startSimulatedServer(t, scenario)
+
+	ctx := context.Background()
+	assert := assert.New(t)
+
+	model, modelErr := ctrl.GetModel(ctx)
+	assert.NoError(modelErr)
+	assert.Equal("SDS200", model)
+
+	version, versionErr := ctrl.GetFirmwareVersion(ctx)
+	assert.NoError(versionErr)
+	assert.Equal("Version 1.23.07", version)
+
+	assert.NoError(ctrl.SetVolume(ctx, 20))
+	volume, volumeErr := ctrl.GetVolume(ctx)
+	assert.NoError(volumeErr)
+	assert.Equal(20, volume)
+
+	rejectedErr := ctrl.SetSquelch(ctx, 42)
+	assert.True(errors.Is(rejectedErr, server.ErrCommandRejected), "Out of range levels should be rejected, got %v", rejectedErr)
+
+	assert.NoError(ctrl.PressKey(ctx, &server.KeyPress{Key: string(server.KEY_VOL_PUSH), Mode: string(server.KEY_MODE_PRESS)}))
+	assert.Equal([]string{"V,P"}, simulator.State().Keys)
+
+	assert.NoError(ctrl.SetLocation(ctx, &server.LocationInfo{Latitude: 39.1, Longitude: -76.9, Range: 5}))
+	location, locationErr := ctrl.GetLocation(ctx)
+	assert.NoError(locationErr)
+	assert.Equal(39.1, location.Latitude)
+
+	set := time.Date(2020, 6, 21, 18, 6, 38, 0, time.Local)
+	assert.NoError(ctrl.SetDateTime(ctx, &server.DateTimeInfo{DaylightSavings: true, Time: &set}))
+	dateTime, dateTimeErr := ctrl.GetDateTime(ctx)
+	assert.NoError(dateTimeErr)
+	assert.True(dateTime.DaylightSavings)
+	assert.Equal(2020, dateTime.Time.Year())
+
+	assert.NoError(ctrl.SetRecording(ctx, true))
+	recording, recordingErr := ctrl.GetRecordStatus(ctx)
+	assert.NoError(recordingErr)
+	assert.True(recording.Recording)
+
+	simulator.SetCall(&sim.Call{System: "Howard County (Project 25)", TGID: "10961", Signal: 3})
+	si, siErr := ctrl.GetScannerInfo(ctx)
+	assert.NoError(siErr)
+	assert.Equal("TGID:10961", si.TGID.TGID)
+
+	status, statusErr := ctrl.GetStatus(ctx)
+	assert.NoError(statusErr)
+	assert.Equal("Howard County (Project 25)", status.Line1)
+	assert.Equal(3, status.SignalLevel)
+}
+
+func TestCommandsConcurrent(t *testing.T) {
+	ctrl, _ := startSimulatedServer(t, &sim.Scenario{Model: "SDS100", Firmware: "Version 1.02.03", Volume: 7, Squelch: 3, PageSize: 10})
+
+	ctx := context.Background()
+	errs := make(chan error, 30)
+	for i := 0; i < 10; i++ {
+		go func() {
+			model, modelErr := ctrl.GetModel(ctx)
+			if modelErr == nil && model != "SDS100" {
+				modelErr = errors.New("unexpected model " + model)
+			}
+			errs <- modelErr
+		}()
+		go func() {
+			volume, volumeErr := ctrl.GetVolume(ctx)
+			if volumeErr == nil && volume != 7 {
+				volumeErr = errors.New("unexpected volume")
+			}
+			errs <- volumeErr
+		}()
+		go func() {
+			squelch, squelchErr := ctrl.GetSquelch(ctx)
+			if squelchErr == nil && squelch != 3 {
+				squelchErr = errors.New("unexpected squelch")
+			}
+			errs <- squelchErr
+		}()
+	}
+
+	for i := 0; i < 30; i++ {
+		assert.NoError(t, <-errs)
+	}
+}
+
+func TestGetList(t *testing.T) {
+	scenario := sim.DefaultScenario()
+	scenario.PageSize = 2
+	scenario.Steps = nil
+	ctrl, _ := startSimulatedServer(t, scenario)
+
+	ctx := context.Background()
+	assert := assert.New(t)
+
+	favorites, favoritesErr := ctrl.GetList(ctx, server.GltXmlFL, "")
+	if !assert.NoError(favoritesErr) {
+		return
+	}
+	fl := favorites.(*server.GltFLInfo)
+	assert.Equal("HoCo", fl.FL[0].Name)
+
+	systems, systemsErr := ctrl.GetList(ctx, server.GltXmlSYS, fl.FL[0].Index)
+	if !assert.NoError(systemsErr) {
+		return
+	}
+	sys := systems.(*server.GltSysInfo)
+	assert.Len(sys.SYS, 1)
+
+	// Three departments over pages of two are collected into one list
+	departments, departmentsErr := ctrl.GetList(ctx, server.GltXmlDEPT, sys.SYS[0].Index)
+	if !assert.NoError(departmentsErr) {
+		return
+	}
+	dept := departments.(*server.GltDeptInfo)
+	assert.Len(dept.DEPT, 3)
+	assert.Equal("Interop", dept.DEPT[2].Name)
+
+	_, missingErr := ctrl.GetList(ctx, server.GltXmlSITE, "999")
+	assert.True(errors.Is(missingErr, server.ErrCommandRejected), "Unknown indexes should be rejected, got %v", missingErr)
+
+	_, unsupportedErr := ctrl.GetList(ctx, server.GltXmlTGID, "1")
+	assert.Equal(server.ErrUnsupportedList, unsupportedErr)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	host, scanner := server.NewPipe()
+	t.Cleanup(func() { scanner.Close() })
+	// Nobody answers on the scanner end of the pipe
+	ctrl := startServer(t, &server.Config{Transport: host, CommandTimeout: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, modelErr := ctrl.GetModel(ctx)
+	assert.True(t, errors.Is(modelErr, context.DeadlineExceeded), "Commands should give up when the context ends, got %v", modelErr)
+
+	ctrl.Stop()
+	_, stoppedErr := ctrl.GetModel(context.Background())
+	assert.Equal(t, server.ErrServerStopped, stoppedErr)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the layout of a YAML file of webhooks, processors or uploaders. Preparing checks the entries and
+// fills in their defaults. It keeps prepared entries the same, so the entries given to the server are prepared
+// whether they were loaded from a file or not.
+type configFile interface {
+	prepare() error
+}
+
+// loadConfigFile reads a YAML file of kind, such as webhook, into file and prepares the entries.
+func loadConfigFile(path string, kind string, file configFile) error {
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return fmt.Errorf("error when opening %s file: %w", kind, openErr)
+	}
+	defer f.Close()
+
+	if decodeErr := yaml.NewDecoder(f).Decode(file); decodeErr != nil && decodeErr != io.EOF {
+		return fmt.Errorf("error when unmarshalling %s yaml: %w", kind, decodeErr)
+	}
+	return file.prepare()
+}
+
+// backoff returns how long to wait before the retry following a number of attempts that failed, doubling initial
+// with every failure up to max. There is no limit if max is zero.
+func backoff(initial time.Duration, attempts int, max time.Duration) time.Duration {
+	delay := initial
+	for i := 1; i < attempts && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	for _, delay := range []struct {
+		attempts int
+		max      time.Duration
+		delay    time.Duration
+	}{
+		{1, 0, time.Second},
+		{4, 0, 8 * time.Second},
+		{4, 5 * time.Second, 5 * time.Second},
+		{200, time.Hour, time.Hour},
+	} {
+		assert.Equal(delay.delay, backoff(time.Second, delay.attempts, delay.max), "%d attempts", delay.attempts)
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// UnidenVendorID is the USB vendor ID of Uniden scanners.
+	UnidenVendorID = "1965"
+	// DefaultSysfsPath is where sysfs is mounted.
+	DefaultSysfsPath = "/sys"
+	// DefaultDevPath is where the device nodes of serial ports are.
+	DefaultDevPath = "/dev"
+	// DefaultIdentifyTimeout is how long a scanner has to answer MDL and VER when it is discovered.
+	DefaultIdentifyTimeout = 2 * time.Second
+
+	// cdcACMDriver is the kernel driver of the serial ports of Uniden scanners.
+	cdcACMDriver = "cdc_acm"
+	// hotplugInterval is how often sysfs is checked for scanners that were plugged in.
+	hotplugInterval = 250 * time.Millisecond
+)
+
+// ErrNoScanner is returned by a DiscoveredTransport that found no scanner to open.
+var ErrNoScanner = errors.New("no scanner found over USB")
+
+// USBDevice is the serial port of a Uniden scanner plugged in over USB.
+type USBDevice struct {
+	// Name is the name of the serial port, such as ttyACM0
+	Name string `json:"name"`
+	// Path is the device node of the serial port, such as /dev/ttyACM0
+	Path      string `json:"path"`
+	VendorID  string `json:"vendor_id"`
+	ProductID string `json:"product_id"`
+	// Serial is the serial number of the USB device, which stays the same across reboots and ports
+	Serial string `json:"serial,omitempty"`
+	// Product is the name the USB device gives itself
+	Product string `json:"product,omitempty"`
+	// Model and Version are the answers of the scanner to MDL and VER once it was identified
+	Model   string `json:"model,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// USBDiscovery finds Uniden scanners among the CDC-ACM serial ports in sysfs and selects one by model or serial
+// number, so the server does not depend on the tty path the kernel happened to give the scanner.
+type USBDiscovery struct {
+	// SysfsPath is where sysfs is mounted, DefaultSysfsPath if empty
+	SysfsPath string
+	// DevPath is where the device nodes are, DefaultDevPath if empty
+	DevPath string
+	// Model selects scanners answering MDL with it, such as SDS100, any model if empty
+	Model string
+	// Serial selects the scanner with the USB serial number, any scanner if empty
+	Serial string
+	// IdentifyTimeout overrides DefaultIdentifyTimeout
+	IdentifyTimeout time.Duration
+
+	// open creates the transport of a serial port, a SerialTransport if nil
+	open func(path string) Transport
+}
+
+func (d *USBDiscovery) sysfs() string {
+	if d.SysfsPath == "" {
+		return DefaultSysfsPath
+	}
+	return d.SysfsPath
+}
+
+func (d *USBDiscovery) dev() string {
+	if d.DevPath == "" {
+		return DefaultDevPath
+	}
+	return d.DevPath
+}
+
+func (d *USBDiscovery) transport(path string) Transport {
+	if d.open == nil {
+		return NewSerialTransport(path)
+	}
+	return d.open(path)
+}
+
+// String describes which scanners are selected.
+func (d *USBDiscovery) String() string {
+	var selection []string
+	if d.Model != "" {
+		selection = append(selection, "model "+d.Model)
+	}
+	if d.Serial != "" {
+		selection = append(selection, "serial "+d.Serial)
+	}
+	if len(selection) == 0 {
+		return "any scanner"
+	}
+	return strings.Join(selection, " and ")
+}
+
+// Devices lists the serial ports of Uniden scanners plugged in, whatever their model and serial number.
+func (d *USBDiscovery) Devices() ([]*USBDevice, error) {
+	ttys := filepath.Join(d.sysfs(), "class", "tty")
+	entries, readErr := ioutil.ReadDir(ttys)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to list serial ports: %w", readErr)
+	}
+
+	devices := []*USBDevice{}
+	for _, entry := range entries {
+		// The device of a serial port is its USB interface, virtual terminals have none
+		iface, ifaceErr := filepath.EvalSymlinks(filepath.Join(ttys, entry.Name(), "device"))
+		if ifaceErr != nil {
+			continue
+		}
+		if driver, driverErr := filepath.EvalSymlinks(filepath.Join(iface, "driver")); driverErr != nil || filepath.Base(driver) != cdcACMDriver {
+			continue
+		}
+		usb := filepath.Dir(iface)
+		if !strings.EqualFold(readAttribute(usb, "idVendor"), UnidenVendorID) {
+			continue
+		}
+		devices = append(devices, &USBDevice{
+			Name:      entry.Name(),
+			Path:      filepath.Join(d.dev(), entry.Name()),
+			VendorID:  readAttribute(usb, "idVendor"),
+			ProductID: readAttribute(usb, "idProduct"),
+			Serial:    readAttribute(usb, "serial"),
+			Product:   readAttribute(usb, "product"),
+		})
+	}
+	return devices, nil
+}
+
+// readAttribute returns a sysfs attribute, empty if the device does not have it.
+func readAttribute(dir string, name string) string {
+	value, readErr := ioutil.ReadFile(filepath.Join(dir, name))
+	if readErr != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// Identify asks a scanner for its model and firmware version.
+func (d *USBDiscovery) Identify(device *USBDevice) error {
+	link := d.transport(device.Path)
+	if openErr := link.Open(); openErr != nil {
+		return openErr
+	}
+	defer link.Close()
+	return d.identify(link, device)
+}
+
+// identify asks the scanner on an opened link for its model and firmware version. The link is closed if the
+// scanner does not answer in time.
+func (d *USBDiscovery) identify(link Transport, device *USBDevice) error {
+	timeout := d.IdentifyTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdentifyTimeout
+	}
+	if flushErr := link.Flush(); flushErr != nil {
+		return flushErr
+	}
+
+	var askErr error
+	if device.Model, askErr = ask(link, "MDL", timeout); askErr != nil {
+		return askErr
+	}
+	device.Version, askErr = ask(link, "VER", timeout)
+	return askErr
+}
+
+// askReply is the reply of the scanner to ask.
+type askReply struct {
+	value string
+	err   error
+}
+
+// ask sends a command without parameters and returns the parameters of the reply.
+func ask(link Transport, cmd string, timeout time.Duration) (string, error) {
+	if writeErr := link.WriteMessage([]byte(cmd)); writeErr != nil {
+		return "", writeErr
+	}
+
+	replies := make(chan askReply, 1)
+	go func() {
+		for {
+			msg, readErr := link.ReadMessage()
+			if readErr != nil {
+				replies <- askReply{err: readErr}
+				return
+			}
+			if bytes.HasPrefix(msg, []byte(cmd+",")) {
+				replies <- askReply{value: string(msg[len(cmd)+1:])}
+				return
+			}
+		}
+	}()
+
+	select {
+	case reply := <-replies:
+		return reply.value, reply.err
+	case <-time.After(timeout):
+		// Closing the link ends the read
+		link.Close()
+		<-replies
+		return "", fmt.Errorf("no reply to %s within %s", cmd, timeout)
+	}
+}
+
+// DiscoveredTransport talks to a scanner found by a USBDiscovery. Every time it is opened the scanners are looked
+// for again, so a scanner plugged into another port or given another tty is found after reconnecting.
+type DiscoveredTransport struct {
+	discovery *USBDiscovery
+
+	mu     sync.Mutex
+	link   Transport
+	device *USBDevice
+}
+
+func NewDiscoveredTransport(discovery *USBDiscovery) *DiscoveredTransport {
+	return &DiscoveredTransport{discovery: discovery}
+}
+
+// Open opens the first scanner of the selected model and serial number.
+func (t *DiscoveredTransport) Open() error {
+	devices, devicesErr := t.discovery.Devices()
+	if devicesErr != nil {
+		return devicesErr
+	}
+
+	for _, device := range devices {
+		if t.discovery.Serial != "" && device.Serial != t.discovery.Serial {
+			continue
+		}
+
+		link := t.discovery.transport(device.Path)
+		if openErr := link.Open(); openErr != nil {
+			log.Warnf("Failed to open %s: %v", device.Path, openErr)
+			continue
+		}
+		if identifyErr := t.discovery.identify(link, device); identifyErr != nil {
+			log.Warnf("Failed to identify the scanner at %s: %v", device.Path, identifyErr)
+			link.Close()
+			continue
+		}
+		if t.discovery.Model != "" && !strings.EqualFold(device.Model, t.discovery.Model) {
+			log.Infof("Skipping %s at %s, looking for %s", device.Model, device.Path, t.discovery.Model)
+			link.Close()
+			continue
+		}
+
+		log.Infof("Found %s with firmware %s and serial %q at %s", device.Model, device.Version, device.Serial, device.Path)
+		t.mu.Lock()
+		t.link = link
+		t.device = device
+		t.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("%w: looked for %s", ErrNoScanner, t.discovery)
+}
+
+// Device returns the scanner that was opened last, nil if none was.
+func (t *DiscoveredTransport) Device() *USBDevice {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.device
+}
+
+func (t *DiscoveredTransport) current() Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.link
+}
+
+func (t *DiscoveredTransport) Close() error {
+	link := t.current()
+	if link == nil {
+		return ErrTransportClosed
+	}
+	return link.Close()
+}
+
+func (t *DiscoveredTransport) ReadMessage() ([]byte, error) {
+	link := t.current()
+	if link == nil {
+		return nil, ErrTransportClosed
+	}
+	return link.ReadMessage()
+}
+
+func (t *DiscoveredTransport) WriteMessage(msg []byte) error {
+	link := t.current()
+	if link == nil {
+		return ErrTransportClosed
+	}
+	return link.WriteMessage(msg)
+}
+
+func (t *DiscoveredTransport) Flush() error {
+	link := t.current()
+	if link == nil {
+		return ErrTransportClosed
+	}
+	return link.Flush()
+}
+
+// FileTransfer reports that recordings can be downloaded over USB.
+func (t *DiscoveredTransport) FileTransfer() bool {
+	return true
+}
+
+// Plugged returns a channel that is closed once a scanner of the selected serial number shows up on a port it
+// was not on when Plugged was called.
+func (t *DiscoveredTransport) Plugged(done <-chan struct{}) <-chan struct{} {
+	present := t.present()
+	plugged := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(hotplugInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for port := range t.present() {
+				if !present[port] {
+					close(plugged)
+					return
+				}
+			}
+		}
+	}()
+	return plugged
+}
+
+// present returns the ports and serial numbers of the scanners plugged in that may be selected.
+func (t *DiscoveredTransport) present() map[string]bool {
+	present := map[string]bool{}
+	devices, devicesErr := t.discovery.Devices()
+	if devicesErr != nil {
+		log.Debugln("Failed to look for scanners", devicesErr)
+		return present
+	}
+	for _, device := range devices {
+		if t.discovery.Serial == "" || device.Serial == t.discovery.Serial {
+			present[device.Name+"/"+device.Serial] = true
+		}
+	}
+	return present
+}
+
+func (t *DiscoveredTransport) String() string {
+	if device := t.Device(); device != nil {
+		return fmt.Sprintf("%s %s via USB", device.Model, device.Path)
+	}
+	return fmt.Sprintf("%s via USB", t.discovery)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSysfs is a sysfs tree with USB serial ports laid out like the kernel does.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	root, tempErr := ioutil.TempDir("", "sysfs")
+	if tempErr != nil {
+		t.Fatalf("error when creating sysfs: %v", tempErr)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	s := &fakeSysfs{t: t, root: root}
+	s.mkdir("class", "tty")
+	s.mkdir("bus", "usb", "drivers", cdcACMDriver)
+	s.mkdir("bus", "usb", "drivers", "ftdi_sio")
+	// Virtual terminals have no device
+	s.mkdir("devices", "virtual", "tty", "tty0")
+	s.symlink(filepath.Join(root, "devices", "virtual", "tty", "tty0"), "class", "tty", "tty0")
+	return s
+}
+
+func (s *fakeSysfs) mkdir(elem ...string) string {
+	dir := filepath.Join(append([]string{s.root}, elem...)...)
+	if mkdirErr := os.MkdirAll(dir, 0755); mkdirErr != nil {
+		s.t.Fatalf("error when creating %s: %v", dir, mkdirErr)
+	}
+	return dir
+}
+
+func (s *fakeSysfs) symlink(target string, elem ...string) {
+	name := filepath.Join(append([]string{s.root}, elem...)...)
+	if linkErr := os.Symlink(target, name); linkErr != nil {
+		s.t.Fatalf("error when linking %s: %v", name, linkErr)
+	}
+}
+
+// plug adds the USB device of a serial port on a port of the first bus.
+func (s *fakeSysfs) plug(tty string, port string, vendor string, serial string, driver string) {
+	usb := s.mkdir("devices", "usb1", port)
+	for name, value := range map[string]string{"idVendor": vendor, "idProduct": "001a", "serial": serial, "product": "Uniden Scanner"} {
+		if writeErr := ioutil.WriteFile(filepath.Join(usb, name), []byte(value+"\n"), 0644); writeErr != nil {
+			s.t.Fatalf("error when writing %s: %v", name, writeErr)
+		}
+	}
+	iface := s.mkdir("devices", "usb1", port, port+":1.0")
+	s.symlink(filepath.Join(s.root, "bus", "usb", "drivers", driver), "devices", "usb1", port, port+":1.0", "driver")
+	s.mkdir("devices", "usb1", port, port+":1.0", "tty", tty)
+	s.symlink("../..", "devices", "usb1", port, port+":1.0", "tty", tty, "device")
+	s.symlink(filepath.Join(iface, "tty", tty), "class", "tty", tty)
+}
+
+// unplug removes the USB device on a port with its serial port.
+func (s *fakeSysfs) unplug(tty string, port string) {
+	os.Remove(filepath.Join(s.root, "class", "tty", tty))
+	os.RemoveAll(filepath.Join(s.root, "devices", "usb1", port))
+}
+
+// fakeScanners serves a scanner of a model at every path that answers MDL and VER.
+func fakeScanners(models map[string]string) func(string) Transport {
+	return func(path string) Transport {
+		host, scanner := NewPipe()
+		go func() {
+			for {
+				msg, readErr := scanner.ReadMessage()
+				if readErr != nil {
+					return
+				}
+				switch string(msg) {
+				case "MDL":
+					if model := models[path]; model != "" {
+						scanner.WriteMessage([]byte("STS,011000"))
+						scanner.WriteMessage([]byte("MDL," + model))
+					}
+				case "VER":
+					scanner.WriteMessage([]byte("VER,Version 1.23.08"))
+				}
+			}
+		}()
+		return host
+	}
+}
+
+func TestUSBDevices(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.plug("ttyACM1", "1-2", "1965", "222", cdcACMDriver)
+	sysfs.plug("ttyACM0", "1-1", "1965", "111", cdcACMDriver)
+	sysfs.plug("ttyACM2", "1-3", "2341", "333", cdcACMDriver)
+	sysfs.plug("ttyUSB0", "1-4", "1965", "444", "ftdi_sio")
+
+	discovery := &USBDiscovery{SysfsPath: sysfs.root, DevPath: "/dev"}
+	devices, devicesErr := discovery.Devices()
+
+	assert := assert.New(t)
+	assert.NoError(devicesErr)
+	if assert.Len(devices, 2, "Only the CDC-ACM ports of Uniden devices should be found") {
+		assert.Equal(&USBDevice{Name: "ttyACM0", Path: "/dev/ttyACM0", VendorID: "1965", ProductID: "001a", Serial: "111", Product: "Uniden Scanner"}, devices[0])
+		assert.Equal("ttyACM1", devices[1].Name)
+		assert.Equal("222", devices[1].Serial)
+	}
+
+	discovery.open = fakeScanners(map[string]string{"/dev/ttyACM0": "SDS200"})
+	assert.NoError(discovery.Identify(devices[0]))
+	assert.Equal("SDS200", devices[0].Model)
+	assert.Equal("Version 1.23.08", devices[0].Version)
+
+	discovery.IdentifyTimeout = 50 * time.Millisecond
+	assert.Error(discovery.Identify(devices[1]), "A device not answering MDL is no scanner")
+
+	_, devicesErr = (&USBDiscovery{SysfsPath: filepath.Join(sysfs.root, "missing")}).Devices()
+	assert.Error(devicesErr)
+}
+
+func TestDiscoveredTransport(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.plug("ttyACM0", "1-1", "1965", "111", cdcACMDriver)
+	sysfs.plug("ttyACM1", "1-2", "1965", "222", cdcACMDriver)
+	open := fakeScanners(map[string]string{"/dev/ttyACM0": "SDS200", "/dev/ttyACM1": "SDS100", "/dev/ttyACM2": "SDS100"})
+
+	assert := assert.New(t)
+	for _, selection := range []struct {
+		discovery *USBDiscovery
+		path      string
+	}{
+		{&USBDiscovery{}, "/dev/ttyACM0"},
+		{&USBDiscovery{Model: "sds100"}, "/dev/ttyACM1"},
+		{&USBDiscovery{Serial: "111"}, "/dev/ttyACM0"},
+		{&USBDiscovery{Model: "SDS100", Serial: "222"}, "/dev/ttyACM1"},
+	} {
+		selection.discovery.SysfsPath = sysfs.root
+		selection.discovery.open = open
+		transport := NewDiscoveredTransport(selection.discovery)
+		if assert.NoError(transport.Open(), selection.discovery.String()) {
+			assert.Equal(selection.path, transport.Device().Path, selection.discovery.String())
+			assert.NoError(transport.WriteMessage([]byte("MDL")))
+			msg, readErr := transport.ReadMessage()
+			assert.NoError(readErr)
+			assert.True(strings.HasPrefix(string(msg), "STS") || strings.HasPrefix(string(msg), "MDL"))
+			assert.NoError(transport.Close())
+		}
+	}
+
+	missing := NewDiscoveredTransport(&USBDiscovery{SysfsPath: sysfs.root, Model: "SDS100", Serial: "111", open: open})
+	openErr := missing.Open()
+	assert.True(errors.Is(openErr, ErrNoScanner))
+	assert.Contains(openErr.Error(), "model SDS100 and serial 111")
+	assert.Equal(ErrTransportClosed, missing.WriteMessage([]byte("MDL")))
+
+	// The scanner comes back on another tty after it was unplugged
+	transport := NewDiscoveredTransport(&USBDiscovery{SysfsPath: sysfs.root, Serial: "222", open: open})
+	assert.NoError(transport.Open())
+	assert.Equal("SDS100 /dev/ttyACM1 via USB", transport.String())
+	sysfs.unplug("ttyACM1", "1-2")
+
+	done := make(chan struct{})
+	defer close(done)
+	plugged := transport.Plugged(done)
+	select {
+	case <-plugged:
+		t.Fatal("no scanner was plugged in yet")
+	case <-time.After(3 * hotplugInterval):
+	}
+
+	sysfs.plug("ttyACM2", "1-3", "1965", "222", cdcACMDriver)
+	select {
+	case <-plugged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scanner that was plugged in went unnoticed")
+	}
+	assert.NoError(transport.Close())
+	assert.NoError(transport.Open())
+	assert.Equal("/dev/ttyACM2", transport.Device().Path)
+}
+
+func TestDiscoveredTransportStartsUnplugged(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	discovery := &USBDiscovery{SysfsPath: sysfs.root, Serial: "111", open: fakeScanners(map[string]string{"/dev/ttyACM0": "SDS200"})}
+	cfg := &Config{
+		Transport:           NewDiscoveredTransport(discovery),
+		WebSocketHost:       "127.0.0.1",
+		ReconnectBackoff:    10 * time.Millisecond,
+		MaxReconnectBackoff: 50 * time.Millisecond,
+		ProbeInterval:       -1,
+	}
+	ctrl, startErr := cfg.Start()
+	if startErr != nil {
+		t.Fatalf("error when starting without a scanner: %v", startErr)
+	}
+	t.Cleanup(ctrl.Stop)
+
+	assert := assert.New(t)
+	link := ctrl.Link()
+	assert.Equal(LinkDisconnected, link.State)
+	assert.Contains(link.Error, ErrNoScanner.Error())
+
+	// The scanner is opened once it is plugged in
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(LinkReconnecting, ctrl.Link().State)
+	sysfs.plug("ttyACM0", "1-1", "1965", "111", cdcACMDriver)
+	assert.Eventually(func() bool {
+		return ctrl.Link().State == LinkConnected
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal("SDS200 /dev/ttyACM0 via USB", ctrl.Link().Link)
+}
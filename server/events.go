@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Activity events streamed at /events.
+const (
+	EventChannelChanged    = "channel.changed"
+	EventSquelchOpened     = "squelch.opened"
+	EventSquelchClosed     = "squelch.closed"
+	EventRecordingReceived = "recording.received"
+	EventLinkState         = "link.state"
+	// EventsMissed is sent to clients resuming with a Last-Event-ID older than the buffered events, in place of the
+	// events that are no longer buffered. Its ID is the one of the last missed event.
+	EventsMissed = "events.missed"
+
+	// DefaultEventBufferSize is how many events are kept for clients resuming with Last-Event-ID.
+	DefaultEventBufferSize = 1000
+
+	// eventSubscriberQueueSize is how many events are buffered for an /events client before it is disconnected.
+	eventSubscriberQueueSize = 100
+	// eventKeepAlive is how often an idle /events stream gets a comment so proxies keep it open.
+	eventKeepAlive = 15 * time.Second
+)
+
+// Event is an activity event. IDs increase by one with every event since the server started.
+type Event struct {
+	ID   uint64          `json:"id"`
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Channel is what the scanner is tuned to according to a GSI or PSI update.
+type Channel struct {
+	Favorite    string `json:"favorite,omitempty"`
+	System      string `json:"system,omitempty"`
+	Department  string `json:"department,omitempty"`
+	Channel     string `json:"channel,omitempty"`
+	TGID        string `json:"tgid,omitempty"`
+	UnitID      string `json:"unit_id,omitempty"`
+	ServiceType string `json:"service_type,omitempty"`
+	Site        string `json:"site,omitempty"`
+	Frequency   string `json:"frequency,omitempty"`
+}
+
+// MissedEvents is the data of the events.missed event, the IDs of the first and last event a client missed.
+type MissedEvents struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// channelOf returns the channel of a GSI or PSI update, or nil if the scanner is not on one.
+func channelOf(si *ScannerInfo) *Channel {
+	if si == nil || (si.TGID.Name == "" && si.TGID.TGID == "" && si.SiteFrequency.Freq == "") {
+		return nil
+	}
+	return &Channel{
+		Favorite:    si.MonitorList.Name,
+		System:      si.System.Name,
+		Department:  si.Department.Name,
+		Channel:     si.TGID.Name,
+		TGID:        si.TGID.TGID,
+		UnitID:      si.UnitID.UID,
+		ServiceType: si.TGID.SvcType,
+		Site:        si.Site.Name,
+		Frequency:   si.SiteFrequency.Freq,
+	}
+}
+
+// SquelchChange is the data of the squelch.opened and squelch.closed events.
+type SquelchChange struct {
+	Frequency float64  `json:"frequency,omitempty"`
+	Signal    int      `json:"signal"`
+	Channel   *Channel `json:"channel,omitempty"`
+}
+
+// eventLog keeps the last events in a ring buffer and passes new ones on to the /events clients.
+type eventLog struct {
+	sync.Mutex
+	// ring holds the events, the oldest at start once it is full
+	ring        []Event
+	start       int
+	lastID      uint64
+	subscribers map[chan Event]struct{}
+}
+
+func newEventLog(size int) *eventLog {
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+	return &eventLog{ring: make([]Event, 0, size), subscribers: make(map[chan Event]struct{})}
+}
+
+// append adds an event and queues it for every subscriber. Subscribers with a full queue are closed,
+// they catch up from the ring buffer when they reconnect.
+func (l *eventLog) append(eventType string, data interface{}) {
+	marshalled, marshalErr := json.Marshal(data)
+	if marshalErr != nil {
+		log.Errorf("Failed to marshal %s event: %v", eventType, marshalErr)
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.lastID++
+	event := Event{ID: l.lastID, Type: eventType, Time: time.Now(), Data: marshalled}
+	if len(l.ring) < cap(l.ring) {
+		l.ring = append(l.ring, event)
+	} else {
+		l.ring[l.start] = event
+		l.start = (l.start + 1) % len(l.ring)
+	}
+
+	for subscriber := range l.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			log.Warnf("Events Client Queue Full, Disconnecting at Event %d", event.ID)
+			delete(l.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// since returns the buffered events after lastID. l must be locked.
+func (l *eventLog) since(lastID uint64) []Event {
+	// IDs start over when the server restarts, so an unknown ID gets everything
+	if lastID > l.lastID {
+		lastID = 0
+	}
+
+	events := make([]Event, 0, len(l.ring)+1)
+	if len(l.ring) > 0 {
+		// Tell clients that missed more than the buffer holds, they could not tell otherwise
+		if oldest := l.ring[l.start].ID; lastID+1 < oldest {
+			missed, _ := json.Marshal(&MissedEvents{From: lastID + 1, To: oldest - 1})
+			events = append(events, Event{ID: oldest - 1, Type: EventsMissed, Time: time.Now(), Data: missed})
+		}
+	}
+	for i := range l.ring {
+		event := l.ring[(l.start+i)%len(l.ring)]
+		if event.ID > lastID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// subscribe returns the buffered events after lastID and a channel receiving the events after them.
+// The channel is closed if the subscriber falls behind.
+func (l *eventLog) subscribe(lastID uint64, resume bool) ([]Event, chan Event) {
+	l.Lock()
+	defer l.Unlock()
+
+	subscriber := make(chan Event, eventSubscriberQueueSize)
+	l.subscribers[subscriber] = struct{}{}
+	if !resume {
+		return nil, subscriber
+	}
+	return l.since(lastID), subscriber
+}
+
+func (l *eventLog) unsubscribe(subscriber chan Event) {
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.subscribers[subscriber]; ok {
+		delete(l.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// writeEvent writes an event in the Server-Sent Events format. The data is the whole event as JSON.
+func writeEvent(w http.ResponseWriter, event Event) error {
+	marshalled, marshalErr := json.Marshal(&event)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	_, writeErr := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, marshalled)
+	return writeErr
+}
+
+// eventsHandler streams activity events with Server-Sent Events. Clients resuming with Last-Event-ID first get
+// the events they missed that are still buffered, after an events.missed event if some are not.
+func eventsHandler(ctrl *ScannerCtrl) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+
+		var lastID uint64
+		lastEventID := r.Header.Get("Last-Event-ID")
+		resume := lastEventID != ""
+		if resume {
+			var parseErr error
+			if lastID, parseErr = strconv.ParseUint(lastEventID, 10, 64); parseErr != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID: %w", parseErr))
+				return
+			}
+		}
+
+		missed, subscriber := ctrl.events.subscribe(lastID, resume)
+		defer ctrl.events.unsubscribe(subscriber)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		log.Infof("Events Client [%s] connected, resuming with %d events", r.RemoteAddr, len(missed))
+		for _, event := range missed {
+			if writeErr := writeEvent(w, event); writeErr != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case event, open := <-subscriber:
+				if !open {
+					return
+				}
+				if writeErr := writeEvent(w, event); writeErr != nil {
+					log.Infof("Events Client [%s] disconnected: %v", r.RemoteAddr, writeErr)
+					return
+				}
+			case <-keepAlive.C:
+				if _, writeErr := fmt.Fprint(w, ": keep-alive\n\n"); writeErr != nil {
+					return
+				}
+			case <-r.Context().Done():
+				log.Infof("Events Client [%s] disconnected", r.RemoteAddr)
+				return
+			case <-ctrl.quit:
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// eventStream reads Server-Sent Events from /events.
+type eventStream struct {
+	resp   *http.Response
+	reader *bufio.Reader
+}
+
+// openEvents connects to /events, resuming after lastEventID unless it is empty.
+func openEvents(t *testing.T, ctrl *server.ScannerCtrl, lastEventID string) *eventStream {
+	req, reqErr := http.NewRequest(http.MethodGet, "http://"+ctrl.Addr().String()+"/events", nil)
+	if reqErr != nil {
+		t.Fatalf("error when creating request: %v", reqErr)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, respErr := http.DefaultClient.Do(req)
+	if respErr != nil {
+		t.Fatalf("error when opening events: %v", respErr)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	return &eventStream{resp: resp, reader: bufio.NewReader(resp.Body)}
+}
+
+// next returns the next event, checking that the SSE id and event fields match the JSON data.
+func (s *eventStream) next(t *testing.T) server.Event {
+	fields := map[string]string{}
+	for {
+		line, readErr := s.reader.ReadString('\n')
+		if readErr != nil {
+			t.Fatalf("error when reading event: %v", readErr)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(fields) > 0 {
+			break
+		}
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		fields[parts[0]] = parts[1]
+	}
+
+	event := server.Event{}
+	if unmarshalErr := json.Unmarshal([]byte(fields["data"]), &event); unmarshalErr != nil {
+		t.Fatalf("error when decoding event: %v", unmarshalErr)
+	}
+	assert.Equal(t, fields["id"], strconv.FormatUint(event.ID, 10))
+	assert.Equal(t, fields["event"], event.Type)
+	return event
+}
+
+// nextWithin fails the test unless an event arrives before the timeout.
+func (s *eventStream) nextWithin(t *testing.T, timeout time.Duration) server.Event {
+	timer := time.AfterFunc(timeout, func() { s.resp.Body.Close() })
+	defer timer.Stop()
+	return s.next(t)
+}
+
+func TestEvents(t *testing.T) {
+	host, scanner := server.NewPipe()
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	serveSimulator(t, simulator, scanner)
+	ctrl := startServer(t, &server.Config{Transport: host, CommandTimeout: 2 * time.Second, EventBufferSize: 4})
+
+	ctx := context.Background()
+	assert := assert.New(t)
+
+	// The squelch is closed and there is no channel yet, so nothing happened
+	_, statusErr := ctrl.GetStatus(ctx)
+	assert.NoError(statusErr)
+	_, infoErr := ctrl.GetScannerInfo(ctx)
+	assert.NoError(infoErr)
+
+	stream := openEvents(t, ctrl, "")
+
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Police", Channel: "Dispatch", TGID: "10961", Signal: 3})
+	_, infoErr = ctrl.GetScannerInfo(ctx)
+	assert.NoError(infoErr)
+	_, statusErr = ctrl.GetStatus(ctx)
+	assert.NoError(statusErr)
+	// Another update on the same channel does not change it
+	_, infoErr = ctrl.GetScannerInfo(ctx)
+	assert.NoError(infoErr)
+	simulator.SetCall(nil)
+	_, statusErr = ctrl.GetStatus(ctx)
+	assert.NoError(statusErr)
+
+	changed := stream.nextWithin(t, 5*time.Second)
+	assert.Equal(uint64(1), changed.ID)
+	assert.Equal(server.EventChannelChanged, changed.Type)
+	channel := server.Channel{}
+	assert.NoError(json.Unmarshal(changed.Data, &channel))
+	assert.Equal("Dispatch", channel.Channel)
+	assert.Equal("TGID:10961", channel.TGID)
+
+	assert.Equal(server.EventCallStarted, stream.nextWithin(t, 5*time.Second).Type)
+
+	opened := stream.nextWithin(t, 5*time.Second)
+	assert.Equal(uint64(3), opened.ID)
+	assert.Equal(server.EventSquelchOpened, opened.Type)
+	change := server.SquelchChange{}
+	assert.NoError(json.Unmarshal(opened.Data, &change))
+	assert.Equal(3, change.Signal)
+	if assert.NotNil(change.Channel) {
+		assert.Equal("Police", change.Channel.Department)
+	}
+
+	closed := stream.nextWithin(t, 5*time.Second)
+	assert.Equal(uint64(4), closed.ID)
+	assert.Equal(server.EventSquelchClosed, closed.Type)
+	stream.resp.Body.Close()
+
+	// Events while disconnected are replayed on resume
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Fire", Channel: "Fire Dispatch", TGID: "10993", Signal: 5})
+	_, infoErr = ctrl.GetScannerInfo(ctx)
+	assert.NoError(infoErr)
+	_, statusErr = ctrl.GetStatus(ctx)
+	assert.NoError(statusErr)
+
+	resumed := openEvents(t, ctrl, "4")
+	for _, eventType := range []string{server.EventChannelChanged, server.EventCallEnded, server.EventCallStarted, server.EventSquelchOpened} {
+		assert.Equal(eventType, resumed.nextWithin(t, 5*time.Second).Type)
+	}
+	resumed.resp.Body.Close()
+
+	// Only the last 4 events are kept, so a client that missed more is told so before it gets what is left
+	late := openEvents(t, ctrl, "2")
+	gap := late.nextWithin(t, 5*time.Second)
+	assert.Equal(server.EventsMissed, gap.Type)
+	assert.Equal(uint64(4), gap.ID, "The gap takes the ID of the last missed event, so resuming after it works")
+	missed := server.MissedEvents{}
+	assert.NoError(json.Unmarshal(gap.Data, &missed))
+	assert.Equal(server.MissedEvents{From: 3, To: 4}, missed)
+	for id := uint64(5); id <= 8; id++ {
+		assert.Equal(id, late.nextWithin(t, 5*time.Second).ID)
+	}
+}
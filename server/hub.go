@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// ControlPolicy decides which WebSocket clients may send commands to the scanner. Commands from the REST API and
+// MQTT are only held back while a client explicitly took control under ControlToken, see ErrLocked.
+// Every client receives the messages from the scanner regardless of the policy.
+type ControlPolicy string
+
+// ErrLocked is returned for commands from the REST API and MQTT that change the scanner while a WebSocket client
+// took control of it under ControlToken. The first client is in control under ControlSingle just by connecting,
+// which is often the web UI, so it does not lock out scripts and home automation.
+var ErrLocked = errors.New("locked")
+
+const (
+	// ControlSingle gives control to the first client. The others observe and take over in the order they connected.
+	ControlSingle ControlPolicy = "single"
+	// ControlToken lets clients ask for control with CONTROL and hand it to the next one waiting with RELEASE.
+	ControlToken ControlPolicy = "token"
+	// ControlShared lets every client send commands.
+	ControlShared ControlPolicy = "shared"
+
+	// DefaultClientQueueSize is how many messages are buffered for a client before messages to it are dropped.
+	DefaultClientQueueSize = 100
+
+	// CONTROL and RELEASE are sent by clients to take and give up control under ControlToken.
+	CONTROL = "CONTROL"
+	RELEASE = "RELEASE"
+)
+
+// ParseControlPolicy returns the policy with the given name.
+func ParseControlPolicy(name string) (ControlPolicy, error) {
+	switch policy := ControlPolicy(name); policy {
+	case ControlSingle, ControlToken, ControlShared:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown control policy %q, must be one of single, token or shared", name)
+}
+
+// wsClient is a WebSocket client of the hub. Messages to it are buffered in send so a slow client only holds up itself.
+type wsClient struct {
+	name string
+	// json clients negotiated JSONProtocol and get events instead of the raw scanner messages
+	json    bool
+	send    chan MsgPacket
+	dropped uint64
+}
+
+// hub fans out scanner messages to every connected client and arbitrates which of them is in control.
+type hub struct {
+	sync.Mutex
+	policy    ControlPolicy
+	queueSize int
+	// clients in the order they connected
+	clients    []*wsClient
+	controller *wsClient
+	// waiting for control, in the order they asked for it
+	waiting []*wsClient
+	// dropped counts the messages dropped for all clients, if set
+	dropped prometheus.Counter
+}
+
+func newHub(policy ControlPolicy, queueSize int) *hub {
+	if policy == "" {
+		policy = ControlSingle
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultClientQueueSize
+	}
+	return &hub{policy: policy, queueSize: queueSize}
+}
+
+// register adds a client. Under ControlSingle the first client takes control quietly, like it always did,
+// and the others are told who has it. JSON clients are greeted with the hello event first.
+func (h *hub) register(name string, json bool) *wsClient {
+	client := &wsClient{name: name, json: json, send: make(chan MsgPacket, h.queueSize)}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.clients = append(h.clients, client)
+	log.Infof("WS Client [%s] connected, %d clients", name, len(h.clients))
+
+	if json {
+		hello := &Hello{Version: ProtocolVersion, Control: h.policy}
+		if h.controller != nil {
+			hello.Controller = h.controller.name
+		}
+		h.queueMessage(client, Message{Type: EventHello, Data: hello})
+	}
+
+	if h.policy == ControlSingle {
+		if h.controller == nil {
+			h.controller = client
+			log.Infof("WS Client [%s] is in control of the scanner", client.name)
+		} else {
+			h.requestControl(client)
+		}
+	}
+	return client
+}
+
+// unregister removes a client and passes control on if it had it. It returns how many clients are left.
+func (h *hub) unregister(client *wsClient) int {
+	h.Lock()
+	defer h.Unlock()
+
+	h.clients = removeClient(h.clients, client)
+	h.waiting = removeClient(h.waiting, client)
+	if h.controller == client {
+		h.controller = nil
+		h.promote()
+	}
+
+	if client.dropped > 0 {
+		log.Warnf("WS Client [%s] disconnected after %d messages to it were dropped", client.name, client.dropped)
+	}
+	log.Infof("WS Client [%s] disconnected, %d clients", client.name, len(h.clients))
+	return len(h.clients)
+}
+
+func removeClient(clients []*wsClient, client *wsClient) []*wsClient {
+	for i, c := range clients {
+		if c == client {
+			return append(clients[:i], clients[i+1:]...)
+		}
+	}
+	return clients
+}
+
+// broadcast queues a raw scanner message for every raw client. Clients with a full queue miss the message.
+func (h *hub) broadcast(msg []byte) {
+	pkt := MsgPacket{msg: msg, ts: time.Now()}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.clients) == 0 {
+		log.Debugln("No WS Client to Receive Msg, Msg Not Sent")
+		return
+	}
+
+	for _, client := range h.clients {
+		if !client.json {
+			h.queue(client, pkt)
+		}
+	}
+}
+
+// publish queues an event for every JSON client.
+func (h *hub) publish(event string, data interface{}) {
+	h.Lock()
+	defer h.Unlock()
+
+	var pkt *MsgPacket
+	for _, client := range h.clients {
+		if !client.json {
+			continue
+		}
+		// Only marshal once somebody wants the event
+		if pkt == nil {
+			marshalled, marshalErr := json.Marshal(Message{Type: event, Data: data})
+			if marshalErr != nil {
+				log.Errorf("Failed to marshal %s event: %v", event, marshalErr)
+				return
+			}
+			pkt = &MsgPacket{msg: marshalled, ts: time.Now()}
+		}
+		h.queue(client, *pkt)
+	}
+}
+
+// reply queues a response for a JSON client.
+func (h *hub) reply(client *wsClient, msg Message) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.queueMessage(client, msg)
+}
+
+// queueMessage marshals msg and queues it for client. h must be locked.
+func (h *hub) queueMessage(client *wsClient, msg Message) {
+	marshalled, marshalErr := json.Marshal(msg)
+	if marshalErr != nil {
+		log.Errorf("Failed to marshal %s message: %v", msg.Type, marshalErr)
+		return
+	}
+	h.queue(client, MsgPacket{msg: marshalled, ts: time.Now()})
+}
+
+// queue puts pkt in the queue of client, or drops it if the queue is full. h must be locked.
+func (h *hub) queue(client *wsClient, pkt MsgPacket) {
+	select {
+	case client.send <- pkt:
+	default:
+		client.dropped++
+		if h.dropped != nil {
+			h.dropped.Inc()
+		}
+		log.Warnf("WS Client [%s] Queue Full, Dropped Msg: [%s]", client.name, crlfStrip(pkt.msg, LF|NL))
+	}
+}
+
+// notify queues a message from the server itself for client, as a notice event for JSON clients. h must be locked.
+func (h *hub) notify(client *wsClient, msg string) {
+	if client.json {
+		h.queueMessage(client, Message{Type: EventNotice, Data: &Notice{Message: msg}})
+		return
+	}
+	h.queue(client, MsgPacket{msg: []byte(msg), ts: time.Now()})
+}
+
+// mayControl reports whether client may send commands to the scanner. If not, it returns who is in control.
+func (h *hub) mayControl(client *wsClient) (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.controllerName(), h.policy == ControlShared || h.controller == client
+}
+
+// lockedExternally returns ErrLocked, naming the client in control, if commands that change the scanner and do not
+// come from a WebSocket client may not be sent to it.
+func (h *hub) lockedExternally() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.policy == ControlToken && h.controller != nil {
+		return fmt.Errorf("%w by %s", ErrLocked, h.controller.name)
+	}
+	return nil
+}
+
+// controllerName returns the name of the client in control, or nobody. h must be locked.
+func (h *hub) controllerName() string {
+	if h.controller == nil {
+		return "nobody"
+	}
+	return h.controller.name
+}
+
+// authorize reports whether client may send commands to the scanner and tells it who is in control if not.
+func (h *hub) authorize(client *wsClient) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.policy == ControlShared || h.controller == client {
+		return true
+	}
+
+	if h.controller == nil {
+		h.notify(client, "Locked by nobody, send "+CONTROL+" to take control")
+	} else {
+		h.notify(client, "Locked by "+h.controller.name)
+	}
+	return false
+}
+
+// requestControl gives control to client if nobody has it and queues it otherwise. h must be locked.
+func (h *hub) requestControl(client *wsClient) {
+	switch {
+	case h.policy == ControlShared, h.controller == client:
+		h.notify(client, "Control granted")
+	case h.controller == nil:
+		h.controller = client
+		log.Infof("WS Client [%s] is in control of the scanner", client.name)
+		h.notify(client, "Control granted")
+	default:
+		for _, waiting := range h.waiting {
+			if waiting == client {
+				return
+			}
+		}
+		h.waiting = append(h.waiting, client)
+		h.notify(client, fmt.Sprintf("Locked by %s, waiting for control (%d in line)", h.controller.name, len(h.waiting)))
+	}
+}
+
+// releaseControl passes control from client to the next one waiting. h must be locked.
+func (h *hub) releaseControl(client *wsClient) {
+	if h.controller != client {
+		h.waiting = removeClient(h.waiting, client)
+		return
+	}
+
+	h.controller = nil
+	h.notify(client, "Control released")
+	h.promote()
+}
+
+// promote gives control to the client waiting longest. h must be locked.
+func (h *hub) promote() {
+	if len(h.waiting) == 0 {
+		return
+	}
+
+	h.controller = h.waiting[0]
+	h.waiting = h.waiting[1:]
+	log.Infof("WS Client [%s] is in control of the scanner", h.controller.name)
+	h.notify(h.controller, "Control granted")
+}
+
+// handleControl handles the CONTROL and RELEASE commands of a client.
+func (h *hub) handleControl(client *wsClient, cmd string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if cmd == CONTROL {
+		h.requestControl(client)
+		return
+	}
+	h.releaseControl(client)
+}
+
+// count returns the number of connected clients.
+func (h *hub) count() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return len(h.clients)
+}
+
+// queued returns how many messages are waiting to be sent to all clients together.
+func (h *hub) queued() int {
+	h.Lock()
+	defer h.Unlock()
+
+	n := 0
+	for _, client := range h.clients {
+		n += len(client.send)
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// received returns the messages queued for client so far.
+func received(client *wsClient) []string {
+	var msgs []string
+	for {
+		select {
+		case pkt := <-client.send:
+			msgs = append(msgs, string(pkt.msg))
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestHubSingleControl(t *testing.T) {
+	h := newHub(ControlSingle, 10)
+	first := h.register("first", false)
+	second := h.register("second", false)
+	third := h.register("third", false)
+
+	assert := assert.New(t)
+	assert.True(h.authorize(first))
+	assert.False(h.authorize(second))
+	assert.Equal([]string{"Locked by first, waiting for control (1 in line)", "Locked by first"}, received(second))
+
+	h.unregister(first)
+	assert.True(h.authorize(second), "Control should pass on in the order clients connected")
+	assert.Equal([]string{"Control granted"}, received(second))
+	assert.False(h.authorize(third))
+
+	assert.Equal(1, h.unregister(second))
+	assert.True(h.authorize(third))
+}
+
+func TestHubTokenControl(t *testing.T) {
+	h := newHub(ControlToken, 10)
+	first := h.register("first", false)
+	second := h.register("second", false)
+
+	assert := assert.New(t)
+	assert.False(h.authorize(first), "Nobody should be in control until asking for it")
+
+	h.handleControl(second, CONTROL)
+	h.handleControl(first, CONTROL)
+	assert.True(h.authorize(second))
+	assert.False(h.authorize(first))
+
+	h.handleControl(second, RELEASE)
+	assert.True(h.authorize(first))
+	assert.False(h.authorize(second))
+	assert.Equal([]string{"Control granted", "Control released", "Locked by first"}, received(second))
+}
+
+func TestHubLockedExternally(t *testing.T) {
+	h := newHub(ControlToken, 10)
+	first := h.register("first", false)
+
+	assert := assert.New(t)
+	assert.NoError(h.lockedExternally(), "Nobody is in control yet")
+	h.handleControl(first, CONTROL)
+	lockedErr := h.lockedExternally()
+	assert.True(errors.Is(lockedErr, ErrLocked))
+	assert.EqualError(lockedErr, "locked by first")
+	h.handleControl(first, RELEASE)
+	assert.NoError(h.lockedExternally())
+
+	shared := newHub(ControlShared, 10)
+	shared.register("first", false)
+	assert.NoError(shared.lockedExternally())
+
+	single := newHub(ControlSingle, 10)
+	single.register("first", false)
+	assert.NoError(single.lockedExternally(), "Connecting first does not take control from the API")
+}
+
+func TestHubSharedControl(t *testing.T) {
+	h := newHub(ControlShared, 10)
+
+	assert.True(t, h.authorize(h.register("first", false)))
+	assert.True(t, h.authorize(h.register("second", false)))
+}
+
+func TestHubSlowClient(t *testing.T) {
+	h := newHub(ControlShared, 2)
+	slow := h.register("slow", false)
+	fast := h.register("fast", false)
+
+	assert := assert.New(t)
+	for _, msg := range []string{"one", "two", "three"} {
+		h.broadcast([]byte(msg))
+		if msg != "three" {
+			assert.Equal([]string{msg}, received(fast))
+		}
+	}
+	assert.Equal([]string{"three"}, received(fast))
+	assert.Equal([]string{"one", "two"}, received(slow), "A full queue should drop messages without blocking the others")
+	assert.Equal(uint64(1), slow.dropped)
+}
@@ -0,0 +1,242 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/history"
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const transferFixture = "../wavparse/fixtures/2020-06-21_00-00-32.wav"
+
+// serveSimulator runs a simulator on link until the test ends.
+func serveSimulator(t *testing.T, simulator *sim.Simulator, link server.Transport) {
+	served := make(chan error, 1)
+	go func() {
+		served <- simulator.Serve(link)
+	}()
+	t.Cleanup(func() {
+		link.Close()
+		<-served
+	})
+}
+
+func startServer(t *testing.T, cfg *server.Config) *server.ScannerCtrl {
+	cfg.WebSocketHost = "127.0.0.1"
+
+	ctrl, startErr := cfg.Start()
+	if startErr != nil {
+		t.Fatalf("error when starting server: %v", startErr)
+	}
+	t.Cleanup(ctrl.Stop)
+	return ctrl
+}
+
+func dialWebSocket(t *testing.T, addr net.Addr) net.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, _, dialErr := ws.Dial(ctx, "ws://"+addr.String()+"/")
+	if dialErr != nil {
+		t.Fatalf("error when dialing WebSocket server: %v", dialErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// request sends cmd to the server and returns the first message starting with prefix, skipping unrelated updates.
+func request(t *testing.T, conn net.Conn, cmd string, prefix string) string {
+	if writeErr := wsutil.WriteClientMessage(conn, ws.OpText, []byte(cmd+"\n")); writeErr != nil {
+		t.Fatalf("error when sending %s: %v", cmd, writeErr)
+	}
+	return expect(t, conn, prefix)
+}
+
+func expect(t *testing.T, conn net.Conn, prefix string) string {
+	if deadlineErr := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); deadlineErr != nil {
+		t.Fatalf("error when setting deadline: %v", deadlineErr)
+	}
+	for {
+		msg, _, readErr := wsutil.ReadServerData(conn)
+		if readErr != nil {
+			t.Fatalf("error when waiting for %s: %v", prefix, readErr)
+		}
+		if strings.HasPrefix(string(msg), prefix) {
+			return string(msg)
+		}
+	}
+}
+
+func TestIntegrationUDP(t *testing.T) {
+	scenario := sim.DefaultScenario()
+	scenario.PageSize = 2
+	scenario.Steps = nil
+
+	link, listenErr := sim.ListenUDP("127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("error when listening for simulator: %v", listenErr)
+	}
+	simulator := sim.New(scenario)
+	serveSimulator(t, simulator, link)
+
+	ctrl := startServer(t, &server.Config{UDPAddress: link.Addr()})
+	conn := dialWebSocket(t, ctrl.Addr())
+
+	assert := assert.New(t)
+	assert.Equal("MDL,SDS200", request(t, conn, "MDL", "MDL"))
+	assert.Equal("VER,Version 1.23.07", request(t, conn, "VER", "VER"))
+	assert.Equal("VOL,OK", request(t, conn, "VOL,20", "VOL"))
+	assert.Equal("KEY,OK", request(t, conn, "KEY,V,P", "KEY"))
+	assert.Equal(20, simulator.State().Volume)
+	assert.Equal([]string{"V,P"}, simulator.State().Keys)
+
+	assert.Contains(request(t, conn, "GLT,FL", "GLT,FL"), `Name="HoCo"`)
+
+	// Three departments over pages of two
+	assert.Contains(request(t, conn, "GLT,DEPT,2", "GLT,DEPT"), `<Footer No="1" EOT="0">`)
+	assert.Contains(expect(t, conn, "GLT,DEPT"), `<Footer No="2" EOT="1">`)
+
+	simulator.SetCall(&sim.Call{System: "Howard County (Project 25)", Department: "Police", TGID: "10961", UnitID: "2468170", Signal: 4})
+	assert.Contains(request(t, conn, "PSI,100", "PSI"), `TGID="TGID:10961"`)
+	assert.NoError(wsutil.WriteClientMessage(conn, ws.OpText, []byte("PSI,0\n")))
+	assert.Eventually(func() bool {
+		return simulator.State().PSIInterval == 0
+	}, 5*time.Second, 50*time.Millisecond, "PSI,0 should stop the updates")
+}
+
+func TestIntegrationFileTransfer(t *testing.T) {
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	store, openErr := history.Open(filepath.Join(recordingsPath, "history.db"))
+	if openErr != nil {
+		t.Fatalf("error when opening history: %v", openErr)
+	}
+	defer store.Close()
+
+	ctrl := startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath, History: store})
+	conn := dialJSON(t, ctrl.Addr())
+
+	savedPath := filepath.Join(recordingsPath, filepath.Base(transferFixture))
+
+	assert := assert.New(t)
+
+	received := server.FileReceived{}
+	assert.NoError(json.Unmarshal(expectJSON(t, conn, server.EventFileReceived, "").Data, &received))
+	assert.Equal(savedPath, received.Path)
+	assert.NotNil(received.Metadata)
+
+	// The recording is also an event for /events clients, replayed from the start with Last-Event-ID 0
+	recording := openEvents(t, ctrl, "0").nextWithin(t, 5*time.Second)
+	assert.Equal(server.EventRecordingReceived, recording.Type)
+	assert.Contains(string(recording.Data), savedPath)
+
+	assert.Eventually(func() bool {
+		_, statErr := os.Stat(savedPath + ".json")
+		return statErr == nil
+	}, 20*time.Second, 100*time.Millisecond, "Recording and its metadata should be downloaded")
+
+	saved, savedErr := ioutil.ReadFile(savedPath)
+	assert.NoError(savedErr)
+	original, originalErr := ioutil.ReadFile(transferFixture)
+	assert.NoError(originalErr)
+	assert.True(bytes.Equal(original, saved), "Downloaded recording should match the original")
+	assert.Equal(0, simulator.State().Pending)
+
+	// Without a call to join, the recording is archived on its own
+	archived := history.Result{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/history?audio=true", nil, &archived))
+	if assert.Len(archived.Entries, 1) {
+		assert.Equal(savedPath, archived.Entries[0].AudioPath)
+		assert.Equal("Dispatch East", archived.Entries[0].Channel)
+	}
+}
+
+func TestIntegrationSerial(t *testing.T) {
+	link, ptyErr := sim.OpenPTY()
+	if ptyErr != nil {
+		t.Skipf("pty not available: %v", ptyErr)
+	}
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", Firmware: "Version 1.02.03", PageSize: 10})
+	serveSimulator(t, simulator, link)
+
+	ctrl := startServer(t, &server.Config{USBPath: link.Path(), RecordingsPath: os.TempDir()})
+	conn := dialWebSocket(t, ctrl.Addr())
+
+	assert := assert.New(t)
+	assert.Equal("MDL,SDS100", request(t, conn, "MDL", "MDL"))
+	assert.Equal("LCR,OK", request(t, conn, "LCR,39.1,-76.9,5", "LCR"))
+	assert.Equal(39.1, simulator.State().Location.Latitude)
+}
+
+func TestIntegrationCalls(t *testing.T) {
+	callLogDir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating call log directory: %v", tempErr)
+	}
+	defer os.RemoveAll(callLogDir)
+	callLogPath := filepath.Join(callLogDir, "calls.ndjson")
+
+	host, scanner := server.NewPipe()
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{Transport: host, CallLogPath: callLogPath, CallHangTime: 300 * time.Millisecond})
+	conn := dialJSON(t, ctrl.Addr())
+
+	assert := assert.New(t)
+	assert.Empty(call(t, conn, "1", "psi.set", map[string]int{"interval": 100}).Error)
+
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Police", Channel: "Dispatch", TGID: "10961", UnitID: "1001", Frequency: 851.0125, Signal: 4, RSSI: -80})
+	started := server.Call{}
+	assert.NoError(json.Unmarshal(expectJSON(t, conn, server.EventCallStarted, "").Data, &started))
+	assert.Equal("TGID:10961", started.TGID)
+	assert.Equal([]string{"1001"}, started.Units)
+
+	simulator.SetCall(nil)
+	ended := server.Call{}
+	assert.NoError(json.Unmarshal(expectJSON(t, conn, server.EventCallEnded, "").Data, &ended))
+	assert.Equal(started.ID, ended.ID)
+	assert.NotNil(ended.End)
+	if assert.NotNil(ended.RSSI) {
+		assert.Equal(-80, ended.RSSI.Max)
+	}
+
+	ctrl.Stop()
+
+	callLog, readErr := ioutil.ReadFile(callLogPath)
+	assert.NoError(readErr)
+	lines := strings.Split(strings.TrimSpace(string(callLog)), "\n")
+	if assert.Len(lines, 1) {
+		logged := server.Call{}
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &logged))
+		assert.Equal(ended.ID, logged.ID)
+		assert.Equal("851.0125MHz", logged.Frequency)
+	}
+}
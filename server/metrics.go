@@ -0,0 +1,193 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Queues that drop messages when they are full.
+const (
+	queueHost     = "host"
+	queueClient   = "client"
+	queuePipeline = "pipeline"
+	queueUploads  = "uploads"
+	queueStore    = "store"
+)
+
+// Results of AUF transfers.
+const (
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+	transferCanceled  = "canceled"
+)
+
+// messageTypeRe matches the commands of the scanner protocol. Anything else is counted as "other" so garbage on the
+// line can not grow the number of series without bound.
+var messageTypeRe = regexp.MustCompile(`^[A-Z]{3,4}$`)
+
+// metrics are the Prometheus metrics of a ScannerCtrl. Every ScannerCtrl has a registry of its own so
+// several of them can run in one process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	packetsReceived  *prometheus.CounterVec
+	packetsSent      *prometheus.CounterVec
+	dropped          *prometheus.CounterVec
+	xmlFailures      *prometheus.CounterVec
+	transferBytes    prometheus.Counter
+	transferBlocks   prometheus.Counter
+	transfers        *prometheus.CounterVec
+	transferDuration prometheus.Histogram
+	calls            *prometheus.CounterVec
+	callDuration     prometheus.Histogram
+	processed        *prometheus.CounterVec
+	processDuration  *prometheus.HistogramVec
+	uploads          *prometheus.CounterVec
+	reconnects       *prometheus.CounterVec
+}
+
+func newMetrics(ctrl *ScannerCtrl) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		packetsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_packets_received_total",
+			Help: "Messages received from the scanner by message type.",
+		}, []string{"type"}),
+		packetsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_packets_sent_total",
+			Help: "Messages sent to the scanner by message type.",
+		}, []string{"type"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_dropped_messages_total",
+			Help: "Messages dropped because a queue was full, for the scanner (host), a WebSocket client (client), the processors of recordings (pipeline) or the recording store (store).",
+		}, []string{"queue"}),
+		xmlFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_xml_parse_failures_total",
+			Help: "XML replies of the scanner that could not be decoded by message type.",
+		}, []string{"type"}),
+		transferBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bearcatter_auf_transfer_bytes_total",
+			Help: "Bytes of audio files received from the scanner.",
+		}),
+		transferBlocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bearcatter_auf_transfer_blocks_total",
+			Help: "Blocks of audio files received from the scanner.",
+		}),
+		transfers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_auf_transfers_total",
+			Help: "Audio file transfers by result: completed, failed or canceled.",
+		}, []string{"result"}),
+		transferDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bearcatter_auf_transfer_duration_seconds",
+			Help:    "How long completed audio file transfers took.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+		}),
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_calls_total",
+			Help: "Calls heard by system and talkgroup.",
+		}, []string{"system", "tgid"}),
+		callDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bearcatter_call_duration_seconds",
+			Help:    "How long calls lasted.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		}),
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_pipeline_runs_total",
+			Help: "Recordings run through a processor by result: completed or failed.",
+		}, []string{"processor", "result"}),
+		processDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bearcatter_pipeline_duration_seconds",
+			Help:    "How long processors took on a recording, with their retries.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"processor"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_uploads_total",
+			Help: "Uploads of recordings to call sharing services by uploader and result: completed, retried or failed.",
+		}, []string{"uploader", "result"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bearcatter_link_reconnects_total",
+			Help: "Attempts to reconnect to the scanner by result: completed or failed.",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		m.packetsReceived,
+		m.packetsSent,
+		m.dropped,
+		m.xmlFailures,
+		m.transferBytes,
+		m.transferBlocks,
+		m.transfers,
+		m.transferDuration,
+		m.calls,
+		m.callDuration,
+		m.processed,
+		m.processDuration,
+		m.uploads,
+		m.reconnects,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "bearcatter_link_up",
+			Help: "Whether the link to the scanner is connected.",
+		}, func() float64 {
+			if ctrl.link.connected() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "bearcatter_queue_depth",
+			Help:        "Messages waiting in a queue: to the scanner (host), to all WebSocket clients together (client) or recordings waiting to be uploaded (uploads).",
+			ConstLabels: prometheus.Labels{"queue": queueHost},
+		}, func() float64 { return float64(len(ctrl.hostMsg)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "bearcatter_queue_depth",
+			Help:        "Messages waiting in a queue: to the scanner (host), to all WebSocket clients together (client) or recordings waiting to be uploaded (uploads).",
+			ConstLabels: prometheus.Labels{"queue": queueClient},
+		}, func() float64 { return float64(ctrl.hub.queued()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "bearcatter_queue_depth",
+			Help:        "Messages waiting in a queue: to the scanner (host), to all WebSocket clients together (client) or recordings waiting to be uploaded (uploads).",
+			ConstLabels: prometheus.Labels{"queue": queueUploads},
+		}, func() float64 { return float64(ctrl.uploads.pending()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "bearcatter_websocket_clients",
+			Help: "Connected WebSocket clients.",
+		}, func() float64 { return float64(ctrl.hub.count()) }),
+	)
+
+	// Every queue shows up from the start, not only after the first drop
+	m.dropped.WithLabelValues(queueHost)
+	m.dropped.WithLabelValues(queueClient)
+	m.dropped.WithLabelValues(queuePipeline)
+	m.dropped.WithLabelValues(queueStore)
+	m.reconnects.WithLabelValues(reconnectCompleted)
+	m.reconnects.WithLabelValues(reconnectFailed)
+	return m
+}
+
+// messageType returns the label of a message to or from the scanner.
+func messageType(msg []byte) string {
+	end := 0
+	for end < len(msg) && end < 5 && msg[end] != ',' && msg[end] != '\t' && msg[end] != '\r' && msg[end] != '\n' {
+		end++
+	}
+	if messageTypeRe.Match(msg[:end]) {
+		return string(msg[:end])
+	}
+	return "other"
+}
+
+// handler serves the metrics in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// xmlFailed logs and counts a reply of the scanner whose XML could not be decoded.
+func (s *ScannerCtrl) xmlFailed(msgType string, decodeErr error) {
+	s.metrics.xmlFailures.WithLabelValues(msgType).Inc()
+	log.Errorln("Failed to decode XML", decodeErr)
+}
@@ -0,0 +1,78 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// scrape returns the metrics of the server in the Prometheus text format.
+func scrape(t *testing.T, ctrl *server.ScannerCtrl) string {
+	resp, getErr := http.Get("http://" + ctrl.Addr().String() + "/metrics")
+	if getErr != nil {
+		t.Fatalf("error when scraping metrics: %v", getErr)
+	}
+	defer resp.Body.Close()
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		t.Fatalf("error when reading metrics: %v", readErr)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath, CallHangTime: 300 * time.Millisecond})
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventFileReceived, "")
+
+	assert := assert.New(t)
+	assert.Empty(call(t, conn, "1", "psi.set", map[string]int{"interval": 100}).Error)
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Police", Channel: "Dispatch", TGID: "10961", UnitID: "1001", Frequency: 851.0125, Signal: 4})
+	expectJSON(t, conn, server.EventCallStarted, "")
+	simulator.SetCall(nil)
+	expectJSON(t, conn, server.EventCallEnded, "")
+
+	metrics := scrape(t, ctrl)
+	for _, series := range []string{
+		`bearcatter_packets_sent_total{type="PSI"} 1`,
+		`bearcatter_packets_received_total{type="PSI"}`,
+		`bearcatter_packets_received_total{type="AUF"}`,
+		`bearcatter_auf_transfers_total{result="completed"} 1`,
+		`bearcatter_auf_transfer_duration_seconds_count 1`,
+		`bearcatter_calls_total{system="Howard County",tgid="TGID:10961"} 1`,
+		`bearcatter_call_duration_seconds_count 1`,
+		`bearcatter_dropped_messages_total{queue="client"} 0`,
+		`bearcatter_queue_depth{queue="host"}`,
+		`bearcatter_websocket_clients 1`,
+	} {
+		assert.Contains(metrics, series)
+	}
+
+	original, statErr := os.Stat(transferFixture)
+	if assert.NoError(statErr) {
+		assert.Contains(metrics, "bearcatter_auf_transfer_bytes_total "+strconv.FormatFloat(float64(original.Size()), 'g', -1, 64))
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMQTTTopic is the prefix of the MQTT topics unless MQTTConfig.Topic is set.
+	DefaultMQTTTopic = "bearcatter"
+	// DefaultMQTTClientID is the client ID the server connects to the broker with unless MQTTConfig.ClientID is set.
+	DefaultMQTTClientID = "bearcatter"
+
+	// mqttPublishTimeout is how long a publish may take before it is logged as failed.
+	mqttPublishTimeout = 5 * time.Second
+	// mqttDisconnectQuiesce is how long the client has to finish sending when the server stops, in milliseconds.
+	mqttDisconnectQuiesce = 250
+)
+
+// Topics below the prefix of MQTTConfig.
+const (
+	// MQTTTopicStatus is retained and either online or offline. The broker sets offline if the server goes away.
+	MQTTTopicStatus = "status"
+	// MQTTTopicChannel is retained and the Channel the scanner is on, as JSON.
+	MQTTTopicChannel = "channel"
+	// MQTTTopicSquelch is retained and either open or closed.
+	MQTTTopicSquelch = "squelch"
+	// MQTTTopicSignal is retained and the signal level when the squelch last opened or closed.
+	MQTTTopicSignal = "signal"
+	// MQTTTopicRecording is retained and the FileReceived of the last recording, as JSON.
+	MQTTTopicRecording = "recording"
+	// MQTTTopicLink is retained and the state of the link to the scanner: connected, disconnected or reconnecting.
+	MQTTTopicLink = "link"
+	// MQTTTopicCommand is subscribed to for commands, as JSON like the commands of the JSON protocol.
+	MQTTTopicCommand = "command"
+	// MQTTTopicResponse gets the responses to commands, as JSON like the responses of the JSON protocol.
+	MQTTTopicResponse = "response"
+)
+
+// Payloads of MQTTTopicStatus and MQTTTopicSquelch.
+const (
+	mqttOnline   = "online"
+	mqttOffline  = "offline"
+	mqttOpen     = "open"
+	mqttClosed   = "closed"
+	mqttNoSignal = "0"
+)
+
+// ErrNoBroker is returned when MQTT is configured without a broker.
+var ErrNoBroker = errors.New("no MQTT broker set")
+
+// MQTTConfig connects the server to an MQTT broker. The server publishes what the scanner is doing and takes
+// volume.set, squelch.set, scanner.hold and key.press commands.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, for example tcp://localhost:1883 or ssl://broker:8883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// Topic is the prefix of all topics, DefaultMQTTTopic if empty
+	Topic string
+	// QoS of the published messages and of the command subscription
+	QoS byte
+}
+
+// mqttBridge publishes the activity events of a ScannerCtrl to the broker and runs the commands it receives.
+type mqttBridge struct {
+	ctrl   *ScannerCtrl
+	cfg    MQTTConfig
+	client mqtt.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startMQTT connects to the broker in the background, retrying until it is reachable.
+func startMQTT(cfg *MQTTConfig, ctrl *ScannerCtrl) (*mqttBridge, error) {
+	if cfg.Broker == "" {
+		return nil, ErrNoBroker
+	}
+
+	b := &mqttBridge{ctrl: ctrl, cfg: *cfg, done: make(chan struct{})}
+	if b.cfg.Topic == "" {
+		b.cfg.Topic = DefaultMQTTTopic
+	}
+	b.cfg.Topic = strings.TrimSuffix(b.cfg.Topic, "/")
+	if b.cfg.ClientID == "" {
+		b.cfg.ClientID = DefaultMQTTClientID
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.cfg.Broker).
+		SetClientID(b.cfg.ClientID).
+		SetUsername(b.cfg.Username).
+		SetPassword(b.cfg.Password).
+		SetWill(b.topic(MQTTTopicStatus), mqttOffline, b.cfg.QoS, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(b.connected).
+		SetConnectionLostHandler(func(_ mqtt.Client, lostErr error) {
+			log.Warnln("Lost connection to MQTT broker, reconnecting", lostErr)
+		})
+	b.client = mqtt.NewClient(opts)
+
+	log.Infoln("Connecting to MQTT broker", b.cfg.Broker)
+	b.client.Connect()
+
+	_, events := ctrl.events.subscribe(0, false)
+	go b.run(events)
+	return b, nil
+}
+
+func (b *mqttBridge) topic(name string) string {
+	return b.cfg.Topic + "/" + name
+}
+
+// connected announces the server, publishes what the scanner is doing right now and subscribes to commands.
+// Sessions are clean, so this is done again after every reconnect.
+func (b *mqttBridge) connected(client mqtt.Client) {
+	log.Infoln("Connected to MQTT broker", b.cfg.Broker)
+	b.publish(MQTTTopicStatus, mqttOnline)
+
+	snapshot := b.ctrl.Snapshot()
+	if snapshot.Link != nil {
+		b.publish(MQTTTopicLink, snapshot.Link.State)
+	}
+	if channel := channelOf(snapshot.Info); channel != nil {
+		b.publishJSON(MQTTTopicChannel, channel)
+	}
+	if snapshot.Status != nil {
+		b.publishSquelch(snapshot.Status.Squelch, snapshot.Status.SignalLevel)
+	}
+
+	token := client.Subscribe(b.topic(MQTTTopicCommand), b.cfg.QoS, func(_ mqtt.Client, msg mqtt.Message) {
+		// Commands wait for the scanner, so they must not hold up the client
+		go b.command(msg.Payload())
+	})
+	go func() {
+		if token.WaitTimeout(mqttPublishTimeout) && token.Error() != nil {
+			log.Errorln("Failed to subscribe to MQTT commands", token.Error())
+		}
+	}()
+}
+
+// run publishes events until the bridge is stopped. If it falls behind, it catches up from the event log.
+func (b *mqttBridge) run(events chan Event) {
+	defer close(b.done)
+
+	var lastID uint64
+	for {
+		select {
+		case <-b.ctx.Done():
+			b.ctrl.events.unsubscribe(events)
+			return
+		case event, ok := <-events:
+			if !ok {
+				log.Warnf("MQTT fell behind, resuming after event %d", lastID)
+				var missed []Event
+				missed, events = b.ctrl.events.subscribe(lastID, true)
+				for _, event := range missed {
+					b.handle(event)
+					lastID = event.ID
+				}
+				continue
+			}
+			b.handle(event)
+			lastID = event.ID
+		}
+	}
+}
+
+func (b *mqttBridge) handle(event Event) {
+	switch event.Type {
+	case EventChannelChanged:
+		b.publish(MQTTTopicChannel, []byte(event.Data))
+	case EventSquelchOpened, EventSquelchClosed:
+		change := SquelchChange{}
+		if unmarshalErr := json.Unmarshal(event.Data, &change); unmarshalErr != nil {
+			log.Errorf("Failed to unmarshal %s event: %v", event.Type, unmarshalErr)
+			return
+		}
+		b.publishSquelch(event.Type == EventSquelchOpened, change.Signal)
+	case EventRecordingReceived:
+		b.publish(MQTTTopicRecording, []byte(event.Data))
+	case EventLinkState:
+		link := LinkState{}
+		if unmarshalErr := json.Unmarshal(event.Data, &link); unmarshalErr != nil {
+			log.Errorf("Failed to unmarshal %s event: %v", event.Type, unmarshalErr)
+			return
+		}
+		b.publish(MQTTTopicLink, link.State)
+	}
+}
+
+func (b *mqttBridge) publishSquelch(open bool, signal int) {
+	if open {
+		b.publish(MQTTTopicSquelch, mqttOpen)
+		b.publish(MQTTTopicSignal, strconv.Itoa(signal))
+		return
+	}
+	b.publish(MQTTTopicSquelch, mqttClosed)
+	b.publish(MQTTTopicSignal, mqttNoSignal)
+}
+
+func (b *mqttBridge) publishJSON(name string, v interface{}) {
+	marshalled, marshalErr := json.Marshal(v)
+	if marshalErr != nil {
+		log.Errorf("Failed to marshal MQTT %s message: %v", name, marshalErr)
+		return
+	}
+	b.publish(name, marshalled)
+}
+
+// publish publishes a retained message on a topic below the prefix without waiting for the broker.
+func (b *mqttBridge) publish(name string, payload interface{}) {
+	b.send(name, payload, true)
+}
+
+func (b *mqttBridge) send(name string, payload interface{}, retained bool) {
+	token := b.client.Publish(b.topic(name), b.cfg.QoS, retained, payload)
+	go func() {
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			log.Warnf("Timed out publishing MQTT %s message", name)
+		} else if token.Error() != nil {
+			log.Errorf("Failed to publish MQTT %s message: %v", name, token.Error())
+		}
+	}()
+}
+
+// command runs a command from the broker and publishes the response.
+func (b *mqttBridge) command(payload []byte) {
+	cmd := Command{}
+	if decodeErr := json.Unmarshal(payload, &cmd); decodeErr != nil {
+		log.Warnln("MQTT sent invalid JSON", decodeErr)
+		b.respond(Message{Type: MessageResponse, Error: "invalid command: " + decodeErr.Error()})
+		return
+	}
+
+	response := Message{Type: MessageResponse, ID: cmd.ID}
+	if cmdErr := b.runCommand(&cmd); cmdErr != nil {
+		log.Infof("MQTT command %s failed: %v", cmd.Command, cmdErr)
+		response.Error = cmdErr.Error()
+	}
+	b.respond(response)
+}
+
+func (b *mqttBridge) respond(response Message) {
+	marshalled, marshalErr := json.Marshal(&response)
+	if marshalErr != nil {
+		log.Errorln("Failed to marshal MQTT response", marshalErr)
+		return
+	}
+	b.send(MQTTTopicResponse, marshalled, false)
+}
+
+// runCommand runs the commands a home automation system needs. They take the params of the JSON protocol.
+func (b *mqttBridge) runCommand(cmd *Command) error {
+	if lockedErr := b.ctrl.hub.lockedExternally(); lockedErr != nil {
+		return lockedErr
+	}
+
+	switch cmd.Command {
+	case "volume.set":
+		params := levelParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return paramsErr
+		}
+		return b.ctrl.SetVolume(b.ctx, params.Level)
+	case "squelch.set":
+		params := levelParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return paramsErr
+		}
+		return b.ctrl.SetSquelch(b.ctx, params.Level)
+	case "scanner.hold":
+		params := holdParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return paramsErr
+		}
+		return b.ctrl.Hold(b.ctx, params.Target, params.Indexes...)
+	case "key.press":
+		params := KeyPress{Mode: string(KEY_MODE_PRESS)}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return paramsErr
+		}
+		return b.ctrl.PressKey(b.ctx, &params)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, cmd.Command)
+	}
+}
+
+// stop stops publishing events, announces that the server is offline and disconnects.
+func (b *mqttBridge) stop() {
+	b.cancel()
+	<-b.done
+
+	if b.client.IsConnected() {
+		token := b.client.Publish(b.topic(MQTTTopicStatus), b.cfg.QoS, true, mqttOffline)
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			log.Warnln("Timed out announcing MQTT offline status")
+		}
+	}
+	b.client.Disconnect(mqttDisconnectQuiesce)
+	log.Infoln("Disconnected from MQTT broker")
+}
@@ -0,0 +1,153 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	broker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/stretchr/testify/assert"
+)
+
+// startBroker runs an embedded MQTT broker until the test ends and returns its URL.
+func startBroker(t *testing.T) string {
+	// The listener of the broker does not tell which port it got, so pick a free one first
+	free, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("error when finding a free port: %v", listenErr)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	b := broker.New()
+	if addErr := b.AddListener(listeners.NewTCP("tcp", addr), nil); addErr != nil {
+		t.Fatalf("error when starting broker: %v", addErr)
+	}
+	if serveErr := b.Serve(); serveErr != nil {
+		t.Fatalf("error when starting broker: %v", serveErr)
+	}
+	t.Cleanup(func() { b.Close() })
+	return "tcp://" + addr
+}
+
+// subscribeMQTT connects to the broker and passes every message below topic on to the returned channel.
+func subscribeMQTT(t *testing.T, brokerURL string, clientID string, topic string) (mqtt.Client, chan mqtt.Message) {
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID(clientID))
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("error when connecting to broker: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	messages := make(chan mqtt.Message, 100)
+	token := client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		messages <- msg
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("error when subscribing to %s: %v", topic, token.Error())
+	}
+	return client, messages
+}
+
+// expectMQTT waits for a message on topic, skipping messages on other topics.
+func expectMQTT(t *testing.T, messages chan mqtt.Message, topic string) mqtt.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if msg.Topic() == topic {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a message on %s", topic)
+			return nil
+		}
+	}
+}
+
+func TestMQTT(t *testing.T) {
+	brokerURL := startBroker(t)
+	client, messages := subscribeMQTT(t, brokerURL, "test", "scanner/#")
+
+	host, scanner := server.NewPipe()
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{Transport: host, ControlPolicy: server.ControlToken, MQTT: &server.MQTTConfig{Broker: brokerURL, Topic: "scanner/"}})
+
+	assert := assert.New(t)
+	status := expectMQTT(t, messages, "scanner/"+server.MQTTTopicStatus)
+	assert.Equal("online", string(status.Payload()))
+	assert.Equal("connected", string(expectMQTT(t, messages, "scanner/"+server.MQTTTopicLink).Payload()))
+
+	conn := dialJSON(t, ctrl.Addr())
+	assert.Empty(call(t, conn, "1", "control.request", nil).Error)
+	assert.Empty(call(t, conn, "2", "psi.set", map[string]int{"interval": 100}).Error)
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Police", Channel: "Dispatch", TGID: "10961", UnitID: "1001", Frequency: 851.0125, Signal: 4})
+
+	channel := server.Channel{}
+	assert.NoError(json.Unmarshal(expectMQTT(t, messages, "scanner/"+server.MQTTTopicChannel).Payload(), &channel))
+	assert.Equal("Howard County", channel.System)
+	assert.Equal("TGID:10961", channel.TGID)
+
+	// Commands take the params of the JSON protocol and are answered on the response topic, once no WebSocket
+	// client is in control
+	client.Publish("scanner/"+server.MQTTTopicCommand, 1, false, `{"id": "locked", "command": "volume.set", "params": {"level": 7}}`)
+	response := server.Message{}
+	assert.NoError(json.Unmarshal(expectMQTT(t, messages, "scanner/"+server.MQTTTopicResponse).Payload(), &response))
+	assert.Equal("locked", response.ID)
+	assert.True(strings.HasPrefix(response.Error, "locked by "), response.Error)
+	assert.Empty(call(t, conn, "3", "control.release", nil).Error)
+
+	client.Publish("scanner/"+server.MQTTTopicCommand, 1, false, `{"id": "vol", "command": "volume.set", "params": {"level": 7}}`)
+	response = server.Message{}
+	assert.NoError(json.Unmarshal(expectMQTT(t, messages, "scanner/"+server.MQTTTopicResponse).Payload(), &response))
+	assert.Equal("vol", response.ID)
+	assert.Empty(response.Error)
+	assert.Equal(7, simulator.State().Volume)
+
+	client.Publish("scanner/"+server.MQTTTopicCommand, 1, false, `{"id": "list", "command": "list.get", "params": {"list": "FL"}}`)
+	assert.NoError(json.Unmarshal(expectMQTT(t, messages, "scanner/"+server.MQTTTopicResponse).Payload(), &response))
+	assert.Equal("list", response.ID)
+	assert.Contains(response.Error, "unknown command")
+
+	// The state is retained for clients subscribing later
+	_, late := subscribeMQTT(t, brokerURL, "late", "scanner/"+server.MQTTTopicChannel)
+	retained := server.Channel{}
+	assert.NoError(json.Unmarshal(expectMQTT(t, late, "scanner/"+server.MQTTTopicChannel).Payload(), &retained))
+	assert.Equal("Howard County", retained.System)
+
+	ctrl.Stop()
+	status = expectMQTT(t, messages, "scanner/"+server.MQTTTopicStatus)
+	assert.Equal("offline", string(status.Payload()))
+}
+
+func TestMQTTCommandsWithWebSocketClient(t *testing.T) {
+	brokerURL := startBroker(t)
+	client, messages := subscribeMQTT(t, brokerURL, "test", "scanner/#")
+
+	host, scanner := server.NewPipe()
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{Transport: host, MQTT: &server.MQTTConfig{Broker: brokerURL, Topic: "scanner/"}})
+
+	assert := assert.New(t)
+	assert.Equal("online", string(expectMQTT(t, messages, "scanner/"+server.MQTTTopicStatus).Payload()))
+
+	// Under the default policy the web UI or any other client is in control just by connecting
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventHello, "")
+
+	client.Publish("scanner/"+server.MQTTTopicCommand, 1, false, `{"id": "vol", "command": "volume.set", "params": {"level": 9}}`)
+	response := server.Message{}
+	assert.NoError(json.Unmarshal(expectMQTT(t, messages, "scanner/"+server.MQTTTopicResponse).Payload(), &response))
+	assert.Equal("vol", response.ID)
+	assert.Empty(response.Error)
+	assert.Equal(9, simulator.State().Volume)
+}
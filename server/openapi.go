@@ -0,0 +1,386 @@
+package server
+
+// OpenAPI documents the REST API served under /api/. It is served at /api/openapi.yaml.
+const OpenAPI = `openapi: 3.0.3
+info:
+  title: Bearcatter
+  description: Control a Uniden SDS100, SDS200 or HomePatrol scanner connected to the Bearcatter server.
+  version: "1"
+paths:
+  /api/status:
+    get:
+      summary: Last scanner information (GSI or PSI) and status (STS) the scanner sent
+      parameters:
+        - name: refresh
+          in: query
+          description: Ask the scanner for its information and status first
+          schema:
+            type: boolean
+      responses:
+        "200":
+          description: Snapshot of the scanner
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Snapshot"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/lists/{list}:
+    get:
+      summary: List the favorites lists, the systems of a favorites list or the departments or sites of a system
+      parameters:
+        - name: list
+          in: path
+          required: true
+          schema:
+            type: string
+            enum: [favorites, systems, departments, sites]
+        - name: favorite
+          in: query
+          description: Index of the favorites list, required for systems
+          schema:
+            type: string
+        - name: system
+          in: query
+          description: Index of the system, required for departments and sites
+          schema:
+            type: string
+      responses:
+        "200":
+          description: All pages of the list. Items are under FL, SYS, DEPT or SITE.
+          content:
+            application/json:
+              schema:
+                type: object
+        default:
+          $ref: "#/components/responses/Error"
+  /api/key:
+    post:
+      summary: Press a key
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/KeyPress"
+      responses:
+        "204":
+          description: Key pressed
+        default:
+          $ref: "#/components/responses/Error"
+  /api/volume:
+    get:
+      summary: Volume level
+      responses:
+        "200":
+          $ref: "#/components/responses/Level"
+        default:
+          $ref: "#/components/responses/Error"
+    put:
+      summary: Set the volume level, 0 to 29
+      requestBody:
+        $ref: "#/components/requestBodies/Level"
+      responses:
+        "204":
+          description: Volume set
+        default:
+          $ref: "#/components/responses/Error"
+  /api/squelch:
+    get:
+      summary: Squelch level
+      responses:
+        "200":
+          $ref: "#/components/responses/Level"
+        default:
+          $ref: "#/components/responses/Error"
+    put:
+      summary: Set the squelch level, 0 to 19
+      requestBody:
+        $ref: "#/components/requestBodies/Level"
+      responses:
+        "204":
+          description: Squelch set
+        default:
+          $ref: "#/components/responses/Error"
+  /api/hold:
+    post:
+      summary: Hold on a system, department or channel
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/Hold"
+      responses:
+        "204":
+          description: Holding
+        default:
+          $ref: "#/components/responses/Error"
+  /api/datetime:
+    get:
+      summary: Clock of the scanner
+      responses:
+        "200":
+          description: Date and time
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/DateTime"
+        default:
+          $ref: "#/components/responses/Error"
+    put:
+      summary: Set the clock of the scanner
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/DateTime"
+      responses:
+        "204":
+          description: Clock set
+        default:
+          $ref: "#/components/responses/Error"
+  /api/location:
+    get:
+      summary: Location and range used to select systems
+      responses:
+        "200":
+          description: Location
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Location"
+        default:
+          $ref: "#/components/responses/Error"
+    put:
+      summary: Set the location and range used to select systems
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/Location"
+      responses:
+        "204":
+          description: Location set
+        default:
+          $ref: "#/components/responses/Error"
+  /api/record:
+    get:
+      summary: Whether the scanner is recording
+      responses:
+        "200":
+          description: Recording status
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Record"
+        default:
+          $ref: "#/components/responses/Error"
+    post:
+      summary: Start or stop recording
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/Record"
+      responses:
+        "204":
+          description: Recording started or stopped
+        default:
+          $ref: "#/components/responses/Error"
+  /api/recordings:
+    get:
+      summary: Newest recordings downloaded from the scanner
+      parameters:
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            minimum: 1
+            default: 50
+      responses:
+        "200":
+          description: Recordings, newest first
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: "#/components/schemas/Recording"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/recordings/{name}:
+    get:
+      summary: Stream a recording, with range requests for seeking
+      parameters:
+        - name: name
+          in: path
+          required: true
+          description: Name of the recording as listed, relative to the recordings directory
+          schema:
+            type: string
+      responses:
+        "200":
+          description: The WAV file
+          content:
+            audio/wav:
+              schema:
+                type: string
+                format: binary
+        default:
+          $ref: "#/components/responses/Error"
+components:
+  schemas:
+    Recording:
+      type: object
+      properties:
+        name:
+          type: string
+        size:
+          type: integer
+          description: Bytes of the recording and its encodings
+        time:
+          type: string
+          format: date-time
+        metadata:
+          type: object
+          description: wavparse.Recording saved next to the recording
+        encodings:
+          type: array
+          items:
+            type: string
+          description: Files the pipeline encoded the recording to
+    Snapshot:
+      type: object
+      properties:
+        info:
+          type: object
+          description: ScannerInfo of the last GSI or PSI update
+        info_time:
+          type: string
+          format: date-time
+        status:
+          type: object
+          description: ScannerStatus of the last STS reply
+        status_time:
+          type: string
+          format: date-time
+        link:
+          $ref: "#/components/schemas/LinkState"
+    LinkState:
+      type: object
+      properties:
+        state:
+          type: string
+          enum: [connected, disconnected, reconnecting]
+        link:
+          type: string
+          description: The transport, such as /dev/ttyACM0 via USB
+        attempt:
+          type: integer
+          description: Attempts to reconnect since the link went down
+        error:
+          type: string
+          description: Why the link went down
+        since:
+          type: string
+          format: date-time
+    KeyPress:
+      type: object
+      required: [key]
+      properties:
+        key:
+          type: string
+          description: Key code such as V for the volume knob or 1 for the 1 key
+        mode:
+          type: string
+          enum: [P, L, H, R]
+          default: P
+          description: Press, long press, hold or release
+    Level:
+      type: object
+      required: [level]
+      properties:
+        level:
+          type: integer
+          minimum: 0
+    Hold:
+      type: object
+      required: [target]
+      properties:
+        target:
+          type: string
+          description: What to hold, the [tkw] of the HLD command such as SYS, DEPT or TGID
+          example: TGID
+        indexes:
+          type: array
+          description: The [xxx1] and [xxx2] of the HLD command, usually an index from /api/lists
+          items:
+            type: string
+    DateTime:
+      type: object
+      required: [time]
+      properties:
+        dst:
+          type: boolean
+          description: Daylight saving time
+        time:
+          type: string
+          format: date-time
+        rtc_ok:
+          type: boolean
+          description: Whether the clock of the scanner was set, read only
+    Location:
+      type: object
+      properties:
+        latitude:
+          type: number
+        longitude:
+          type: number
+        range:
+          type: number
+          description: Range in miles
+    Record:
+      type: object
+      required: [recording]
+      properties:
+        recording:
+          type: boolean
+        error_code:
+          type: integer
+          description: Set when the scanner could not record, read only
+        error_message:
+          type: string
+          description: FILE ACCESS ERROR, LOW BATTERY, SESSION OVER LIMIT or RTC LOST, read only
+    Error:
+      type: object
+      properties:
+        error:
+          type: string
+  requestBodies:
+    Level:
+      required: true
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Level"
+  responses:
+    Level:
+      description: Level
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Level"
+    Error:
+      description: >-
+        400 for invalid requests, 404 for unknown lists, 409 for changes while a WebSocket client took
+        control of the scanner under the token policy, 422 when the scanner rejected the command, 503 when
+        the server is stopping and 504 when the scanner did not answer in time
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Error"
+`
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+const pipeQueueSize = 100
+
+// PipeTransport is one end of an in-memory link created by NewPipe. It lets the server and a fake scanner
+// talk to each other in tests without any hardware.
+type PipeTransport struct {
+	// AllowFileTransfer makes the server poll for recordings over this end, like it does over USB.
+	AllowFileTransfer bool
+
+	name string
+
+	in  chan []byte
+	out chan []byte
+
+	closed     chan struct{}
+	closeOnce  *sync.Once
+	peerClosed chan struct{}
+}
+
+// NewPipe returns both ends of an in-memory link. Whatever is written to one end is read from the other.
+func NewPipe() (*PipeTransport, *PipeTransport) {
+	aToB := make(chan []byte, pipeQueueSize)
+	bToA := make(chan []byte, pipeQueueSize)
+	aClosed := make(chan struct{})
+	bClosed := make(chan struct{})
+
+	a := &PipeTransport{name: "pipe A", in: bToA, out: aToB, closed: aClosed, closeOnce: &sync.Once{}, peerClosed: bClosed}
+	b := &PipeTransport{name: "pipe B", in: aToB, out: bToA, closed: bClosed, closeOnce: &sync.Once{}, peerClosed: aClosed}
+	return a, b
+}
+
+func (p *PipeTransport) Open() error {
+	if p.isClosed() {
+		return ErrTransportClosed
+	}
+	return nil
+}
+
+func (p *PipeTransport) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func (p *PipeTransport) ReadMessage() ([]byte, error) {
+	if p.isClosed() {
+		return nil, ErrTransportClosed
+	}
+
+	select {
+	case msg := <-p.in:
+		return msg, nil
+	case <-p.closed:
+		return nil, ErrTransportClosed
+	case <-p.peerClosed:
+		// Deliver whatever the peer sent before it went away
+		select {
+		case msg := <-p.in:
+			return msg, nil
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (p *PipeTransport) WriteMessage(msg []byte) error {
+	msg = bytes.TrimRight(msg, "\r\n")
+	copied := make([]byte, len(msg))
+	copy(copied, msg)
+
+	if p.isClosed() {
+		return ErrTransportClosed
+	}
+
+	select {
+	case p.out <- copied:
+		return nil
+	case <-p.closed:
+		return ErrTransportClosed
+	case <-p.peerClosed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (p *PipeTransport) Flush() error {
+	for {
+		select {
+		case <-p.in:
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *PipeTransport) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// FileTransfer reports whether AllowFileTransfer was set.
+func (p *PipeTransport) FileTransfer() bool {
+	return p.AllowFileTransfer
+}
+
+func (p *PipeTransport) String() string {
+	return p.name
+}
@@ -0,0 +1,579 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of processors.
+const (
+	// ProcessorCommand runs a program with the recording as JSON on stdin.
+	ProcessorCommand = "command"
+	// ProcessorEncode transcodes the recording with an Encoder.
+	ProcessorEncode = "encode"
+	// ProcessorTag sets tags that later processors pass on, for example as the metadata of encoded files.
+	ProcessorTag = "tag"
+	// ProcessorUpload sends the recording to an HTTP endpoint.
+	ProcessorUpload = "upload"
+)
+
+const (
+	// DefaultProcessorTimeout limits an attempt of a processor unless it sets Timeout.
+	DefaultProcessorTimeout = time.Minute
+	// DefaultProcessorBackoff is how long the first retry waits unless the processor sets Backoff. Every retry waits twice as long.
+	DefaultProcessorBackoff = time.Second
+	// DefaultEncoder is the Encoder of encode processors that do not name one.
+	DefaultEncoder = "ffmpeg"
+
+	// pipelineQueueSize is how many recordings are processed at once before new ones are dropped.
+	pipelineQueueSize = 100
+)
+
+// Results of processors.
+const (
+	processCompleted = "completed"
+	processFailed    = "failed"
+)
+
+var (
+	// ErrInvalidProcessor is returned for processors that can not run.
+	ErrInvalidProcessor = errors.New("invalid processor")
+	// ErrNoLocalFile is returned by processors that need the recording as a file when it was stored elsewhere.
+	ErrNoLocalFile = errors.New("recording is not stored as a local file")
+)
+
+// Encoder transcodes recordings for encode processors. Encoders are registered by name with RegisterEncoder.
+type Encoder interface {
+	// Encode transcodes the WAV file src to dst, the format going by the extension of dst. tags are written
+	// as the metadata of dst where the format has any.
+	Encode(ctx context.Context, src string, dst string, tags map[string]string) error
+}
+
+var (
+	encodersMu sync.Mutex
+	encoders   = map[string]Encoder{DefaultEncoder: FFmpegEncoder{}}
+)
+
+// RegisterEncoder makes an Encoder available to encode processors by name, replacing one of the same name.
+func RegisterEncoder(name string, encoder Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	encoders[name] = encoder
+}
+
+func encoderNamed(name string) (Encoder, bool) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	encoder, ok := encoders[name]
+	return encoder, ok
+}
+
+// FFmpegEncoder transcodes with ffmpeg, found in the PATH unless Path is set.
+type FFmpegEncoder struct {
+	Path string
+}
+
+// Encode runs ffmpeg on src.
+func (e FFmpegEncoder) Encode(ctx context.Context, src string, dst string, tags map[string]string) error {
+	path := e.Path
+	if path == "" {
+		path = "ffmpeg"
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src}
+	for _, name := range sortedKeys(tags) {
+		args = append(args, "-metadata", name+"="+tags[name])
+	}
+	args = append(args, dst)
+
+	if output, runErr := exec.CommandContext(ctx, path, args...).CombinedOutput(); runErr != nil {
+		return fmt.Errorf("%v: %s", runErr, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Processor is a step of the pipeline recordings go through once they are saved. Every field besides the
+// ones of its Type is ignored.
+type Processor struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// Command is run for ProcessorCommand with Args, which are templates of the ProcessedRecording and only
+	// the path of the recording if empty. The ProcessedRecording is written to stdin as JSON.
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+
+	// Encoder transcodes the recording for ProcessorEncode to Format, such as mp3, DefaultEncoder if empty.
+	// The encoded file is saved next to the recording and is what later processors get.
+	Encoder string `yaml:"encoder"`
+	Format  string `yaml:"format"`
+
+	// Tags are templates of the ProcessedRecording for ProcessorTag.
+	Tags map[string]string `yaml:"tags"`
+
+	// URL is a template of the ProcessedRecording for ProcessorUpload. The recording is posted as the audio field
+	// of a form with its metadata and tags, or as the body with Method PUT.
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+
+	// Timeout limits each attempt, DefaultProcessorTimeout if zero
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries of failed attempts, none if zero
+	Retries int           `yaml:"retries"`
+	Backoff time.Duration `yaml:"backoff"`
+	// Concurrency is how many recordings the processor works on at once, one if zero
+	Concurrency int `yaml:"concurrency"`
+
+	args  []*template.Template
+	tags  map[string]*template.Template
+	url   *template.Template
+	slots chan struct{}
+}
+
+// ProcessedRecording is a recording going through the pipeline, as templates and commands see it.
+type ProcessedRecording struct {
+	// Name is the name the scanner gave the recording
+	Name string `json:"name"`
+	// Path is the file processors work on, the encoded file after an encode processor. It is empty for
+	// recordings kept in object storage.
+	Path string `json:"path,omitempty"`
+	// Location is where the recording was stored
+	Location string              `json:"location"`
+	Channel  *Channel            `json:"channel"`
+	Tags     map[string]string   `json:"tags,omitempty"`
+	Metadata *wavparse.Recording `json:"metadata,omitempty"`
+}
+
+// pipelineFile is the layout of a YAML pipeline file.
+type pipelineFile struct {
+	Processors []*Processor `yaml:"processors"`
+}
+
+func (f *pipelineFile) prepare() error {
+	for _, processor := range f.Processors {
+		if prepareErr := processor.prepare(); prepareErr != nil {
+			return prepareErr
+		}
+	}
+	return nil
+}
+
+// LoadPipeline reads the processors of a YAML file with a top level processors list.
+func LoadPipeline(path string) ([]*Processor, error) {
+	file := pipelineFile{}
+	if loadErr := loadConfigFile(path, "pipeline", &file); loadErr != nil {
+		return nil, loadErr
+	}
+	return file.Processors, nil
+}
+
+// prepare checks the processor, fills in the defaults and parses its templates.
+func (p *Processor) prepare() error {
+	if p.Name == "" {
+		p.Name = p.Type
+	}
+	parse := func(text string) (*template.Template, error) {
+		parsed, parseErr := template.New(p.Name).Funcs(webhookFuncs).Parse(text)
+		if parseErr != nil {
+			return nil, fmt.Errorf("%w %s: %v", ErrInvalidProcessor, p.Name, parseErr)
+		}
+		return parsed, nil
+	}
+
+	switch p.Type {
+	case ProcessorCommand:
+		if p.Command == "" {
+			return fmt.Errorf("%w %s: command must be set", ErrInvalidProcessor, p.Name)
+		}
+		args := p.Args
+		if len(args) == 0 {
+			args = []string{"{{.Path}}"}
+		}
+		p.args = make([]*template.Template, len(args))
+		for i, arg := range args {
+			var parseErr error
+			if p.args[i], parseErr = parse(arg); parseErr != nil {
+				return parseErr
+			}
+		}
+	case ProcessorEncode:
+		if p.Encoder == "" {
+			p.Encoder = DefaultEncoder
+		}
+		if _, ok := encoderNamed(p.Encoder); !ok {
+			return fmt.Errorf("%w %s: unknown encoder %q", ErrInvalidProcessor, p.Name, p.Encoder)
+		}
+		p.Format = strings.TrimPrefix(p.Format, ".")
+		if p.Format == "" || strings.ContainsAny(p.Format, `/\`) {
+			return fmt.Errorf("%w %s: format must be set to an extension such as mp3", ErrInvalidProcessor, p.Name)
+		}
+	case ProcessorTag:
+		p.tags = map[string]*template.Template{}
+		for name, text := range p.Tags {
+			var parseErr error
+			if p.tags[name], parseErr = parse(text); parseErr != nil {
+				return parseErr
+			}
+		}
+	case ProcessorUpload:
+		if p.URL == "" {
+			return fmt.Errorf("%w %s: url must be set", ErrInvalidProcessor, p.Name)
+		}
+		var parseErr error
+		if p.url, parseErr = parse(p.URL); parseErr != nil {
+			return parseErr
+		}
+		switch p.Method {
+		case "":
+			p.Method = http.MethodPost
+		case http.MethodPost, http.MethodPut:
+		default:
+			return fmt.Errorf("%w %s: method must be POST or PUT, got %q", ErrInvalidProcessor, p.Name, p.Method)
+		}
+	default:
+		return fmt.Errorf("%w %s: unknown type %q", ErrInvalidProcessor, p.Name, p.Type)
+	}
+
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultProcessorTimeout
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = DefaultProcessorBackoff
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = 1
+	}
+	return nil
+}
+
+// pipeline runs the processors on every saved recording in order, away from the reader so slow processors never
+// hold up the scanner. Recordings go through the pipeline side by side, as far as the Concurrency of each
+// processor allows.
+type pipeline struct {
+	processors []*Processor
+	queue      chan *ProcessedRecording
+	metrics    *metrics
+	client     *http.Client
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func startPipeline(processors []*Processor, m *metrics) (*pipeline, error) {
+	p := &pipeline{processors: processors, queue: make(chan *ProcessedRecording, pipelineQueueSize), metrics: m, client: &http.Client{}}
+	if prepareErr := (&pipelineFile{Processors: processors}).prepare(); prepareErr != nil {
+		return nil, prepareErr
+	}
+	for _, processor := range processors {
+		processor.slots = make(chan struct{}, processor.Concurrency)
+	}
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Add(1)
+	go p.run()
+	return p, nil
+}
+
+// process queues a saved recording for the processors.
+func (p *pipeline) process(received *FileReceived) {
+	if p == nil {
+		return
+	}
+
+	recording := &ProcessedRecording{
+		Name:     received.Name,
+		Location: received.Path,
+		Channel:  recordingChannel(received.Metadata),
+		Tags:     map[string]string{},
+		Metadata: received.Metadata,
+	}
+	select {
+	case p.queue <- recording:
+	default:
+		p.metrics.dropped.WithLabelValues(queuePipeline).Inc()
+		log.Warnf("Pipeline: Queue Full, Dropped Recording: [%s]", received.Name)
+	}
+}
+
+func (p *pipeline) run() {
+	defer p.wg.Done()
+
+	// The queue also limits how many recordings are in the pipeline, so a slow processor can not pile them up
+	inFlight := make(chan struct{}, pipelineQueueSize)
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case recording := <-p.queue:
+			select {
+			case inFlight <- struct{}{}:
+			case <-p.ctx.Done():
+				return
+			}
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				defer func() { <-inFlight }()
+				p.runProcessors(recording)
+			}()
+		}
+	}
+}
+
+// runProcessors takes a recording through the processors. A processor that fails ends the pipeline of the recording.
+func (p *pipeline) runProcessors(recording *ProcessedRecording) {
+	// Processors that need a file have one as long as the recording was stored locally
+	if info, statErr := os.Stat(recording.Location); statErr == nil && !info.IsDir() {
+		recording.Path = recording.Location
+	}
+
+	for _, processor := range p.processors {
+		select {
+		case processor.slots <- struct{}{}:
+		case <-p.ctx.Done():
+			return
+		}
+		started := time.Now()
+		attempts, processErr := p.runProcessor(processor, recording)
+		<-processor.slots
+
+		p.metrics.processDuration.WithLabelValues(processor.Name).Observe(time.Since(started).Seconds())
+		if processErr != nil {
+			p.metrics.processed.WithLabelValues(processor.Name, processFailed).Inc()
+			log.Errorf("Processor %s: Giving up on %s after %d attempts: %v", processor.Name, recording.Name, attempts, processErr)
+			return
+		}
+		p.metrics.processed.WithLabelValues(processor.Name, processCompleted).Inc()
+		log.Infof("Processor %s: Processed %s in %s", processor.Name, recording.Name, time.Since(started).Round(time.Millisecond))
+	}
+}
+
+// runProcessor runs a processor on a recording, retrying with exponential backoff. It returns the number of attempts.
+func (p *pipeline) runProcessor(processor *Processor, recording *ProcessedRecording) (int, error) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(p.ctx, processor.Timeout)
+		attemptErr := p.attempt(ctx, processor, recording)
+		cancel()
+		if attemptErr == nil || attempt > processor.Retries || errors.Is(attemptErr, ErrNoLocalFile) {
+			return attempt, attemptErr
+		}
+
+		delay := backoff(processor.Backoff, attempt, 0)
+		log.Warnf("Processor %s: Failed on %s, retrying in %s: %v", processor.Name, recording.Name, delay, attemptErr)
+		if !sleep(p.ctx, delay) {
+			return attempt, p.ctx.Err()
+		}
+	}
+}
+
+func (p *pipeline) attempt(ctx context.Context, processor *Processor, recording *ProcessedRecording) error {
+	switch processor.Type {
+	case ProcessorCommand:
+		return runCommand(ctx, processor, recording)
+	case ProcessorEncode:
+		return encode(ctx, processor, recording)
+	case ProcessorTag:
+		return tag(processor, recording)
+	case ProcessorUpload:
+		return p.upload(ctx, processor, recording)
+	}
+	return fmt.Errorf("%w %s: unknown type %q", ErrInvalidProcessor, processor.Name, processor.Type)
+}
+
+// runCommand runs the command of a processor with the recording as JSON on stdin.
+func runCommand(ctx context.Context, processor *Processor, recording *ProcessedRecording) error {
+	args := make([]string, len(processor.args))
+	for i, arg := range processor.args {
+		var renderErr error
+		if args[i], renderErr = renderTemplate(arg, recording); renderErr != nil {
+			return renderErr
+		}
+	}
+	stdin, marshalErr := json.Marshal(recording)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	// The output goes to a file rather than a pipe, which children of the command that outlive a timeout would keep open
+	output, outputErr := ioutil.TempFile("", "bearcatter-processor-*.log")
+	if outputErr != nil {
+		return outputErr
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	cmd := exec.CommandContext(ctx, processor.Command, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	runErr := cmd.Run()
+
+	printed, _ := ioutil.ReadFile(output.Name())
+	printed = bytes.TrimSpace(printed)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", processor.Timeout)
+	} else if runErr != nil {
+		return fmt.Errorf("%v: %s", runErr, printed)
+	}
+	if len(printed) > 0 {
+		log.Debugf("Processor %s: %s", processor.Name, printed)
+	}
+	return nil
+}
+
+// encode transcodes the file of a recording next to it and hands the encoded file on.
+func encode(ctx context.Context, processor *Processor, recording *ProcessedRecording) error {
+	if recording.Path == "" {
+		return ErrNoLocalFile
+	}
+	encoder, ok := encoderNamed(processor.Encoder)
+	if !ok {
+		return fmt.Errorf("%w %s: unknown encoder %q", ErrInvalidProcessor, processor.Name, processor.Encoder)
+	}
+
+	// Named like the recording, the encoded file is listed and removed with it by the LocalStore
+	dst := encodingName(recording.Path, processor.Format)
+	if encodeErr := encoder.Encode(ctx, recording.Path, dst, recording.Tags); encodeErr != nil {
+		os.Remove(dst)
+		return encodeErr
+	}
+	recording.Path = dst
+	return nil
+}
+
+// tag renders the tags of a processor onto a recording.
+func tag(processor *Processor, recording *ProcessedRecording) error {
+	for name, text := range processor.tags {
+		value, renderErr := renderTemplate(text, recording)
+		if renderErr != nil {
+			return fmt.Errorf("tag %s: %w", name, renderErr)
+		}
+		recording.Tags[name] = value
+	}
+	return nil
+}
+
+// upload sends the file of a recording to the URL of a processor.
+func (p *pipeline) upload(ctx context.Context, processor *Processor, recording *ProcessedRecording) error {
+	if recording.Path == "" {
+		return ErrNoLocalFile
+	}
+	target, renderErr := renderTemplate(processor.url, recording)
+	if renderErr != nil {
+		return renderErr
+	}
+	audio, readErr := ioutil.ReadFile(recording.Path)
+	if readErr != nil {
+		return readErr
+	}
+
+	body := &bytes.Buffer{}
+	contentType := mime.TypeByExtension(filepath.Ext(recording.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if processor.Method == http.MethodPut {
+		body.Write(audio)
+	} else {
+		form := multipart.NewWriter(body)
+		if formErr := writeRecordingForm(form, recording, audio); formErr != nil {
+			return formErr
+		}
+		contentType = form.FormDataContentType()
+	}
+
+	req, reqErr := http.NewRequestWithContext(ctx, processor.Method, target, body)
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "Bearcatter")
+	for name, value := range processor.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, doErr := p.client.Do(req)
+	if doErr != nil {
+		return doErr
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upload responded %s", resp.Status)
+	}
+	return nil
+}
+
+// writeRecordingForm writes the audio, metadata and tags of a recording as a multipart form.
+func writeRecordingForm(form *multipart.Writer, recording *ProcessedRecording, audio []byte) error {
+	part, partErr := form.CreateFormFile("audio", filepath.Base(recording.Path))
+	if partErr != nil {
+		return partErr
+	}
+	if _, writeErr := part.Write(audio); writeErr != nil {
+		return writeErr
+	}
+
+	metadata, marshalErr := json.Marshal(recording)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if fieldErr := form.WriteField("metadata", string(metadata)); fieldErr != nil {
+		return fieldErr
+	}
+	for _, name := range sortedKeys(recording.Tags) {
+		if fieldErr := form.WriteField("tag."+name, recording.Tags[name]); fieldErr != nil {
+			return fieldErr
+		}
+	}
+	return form.Close()
+}
+
+func renderTemplate(tmpl *template.Template, recording *ProcessedRecording) (string, error) {
+	rendered := &strings.Builder{}
+	if executeErr := tmpl.Execute(rendered, recording); executeErr != nil {
+		return "", executeErr
+	}
+	return rendered.String(), nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stop cancels the processors that are running and drops the recordings that were not processed yet.
+func (p *pipeline) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
@@ -0,0 +1,169 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// copyEncoder "encodes" by copying the file and remembers the tags it was given.
+type copyEncoder struct {
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+func (e *copyEncoder) Encode(ctx context.Context, src string, dst string, tags map[string]string) error {
+	e.mu.Lock()
+	e.tags = tags
+	e.mu.Unlock()
+
+	data, readErr := ioutil.ReadFile(src)
+	if readErr != nil {
+		return readErr
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
+
+func TestLoadPipeline(t *testing.T) {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	assert := assert.New(t)
+	path := filepath.Join(dir, "pipeline.yaml")
+	assert.NoError(ioutil.WriteFile(path, []byte(`processors:
+  - type: encode
+    format: .mp3
+  - name: archive
+    type: upload
+    url: https://example.com/{{.Channel.TGID}}
+    retries: 2
+    concurrency: 4
+  - type: command
+    command: /usr/local/bin/notify
+    timeout: 5s
+`), 0644))
+
+	processors, loadErr := server.LoadPipeline(path)
+	assert.NoError(loadErr)
+	if assert.Len(processors, 3) {
+		assert.Equal(server.ProcessorEncode, processors[0].Name)
+		assert.Equal(server.DefaultEncoder, processors[0].Encoder)
+		assert.Equal("mp3", processors[0].Format)
+		assert.Equal(server.DefaultProcessorTimeout, processors[0].Timeout)
+		assert.Equal("POST", processors[1].Method)
+		assert.Equal(4, processors[1].Concurrency)
+		assert.Equal(5*time.Second, processors[2].Timeout)
+		assert.Equal(1, processors[2].Concurrency)
+	}
+
+	for _, invalid := range []string{
+		"processors:\n  - type: transcribe\n",
+		"processors:\n  - type: encode\n",
+		"processors:\n  - type: encode\n    encoder: lame\n    format: mp3\n",
+		"processors:\n  - type: upload\n    url: https://example.com\n    method: DELETE\n",
+		"processors:\n  - type: tag\n    tags:\n      title: '{{.Channel'\n",
+	} {
+		assert.NoError(ioutil.WriteFile(path, []byte(invalid), 0644))
+		_, loadErr = server.LoadPipeline(path)
+		assert.True(errors.Is(loadErr, server.ErrInvalidProcessor), invalid)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	endpoint := startWebhookEndpoint(t, "", 0)
+	encoder := &copyEncoder{}
+	server.RegisterEncoder("copy", encoder)
+
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+	outputPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating output directory: %v", tempErr)
+	}
+	defer os.RemoveAll(outputPath)
+	stdinPath := filepath.Join(outputPath, "stdin.json")
+	attemptsPath := filepath.Join(outputPath, "attempts")
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	processors := []*server.Processor{
+		{Type: server.ProcessorTag, Tags: map[string]string{"title": "{{.Channel.Channel}}", "artist": "{{.Channel.System}}"}},
+		{Type: server.ProcessorEncode, Encoder: "copy", Format: "mp3"},
+		{Name: "save", Type: server.ProcessorCommand, Command: "sh", Args: []string{"-c", `cat > "$0"`, stdinPath}},
+		{Type: server.ProcessorUpload, URL: endpoint.URL + "/upload"},
+		// Slow never finishes in time, so it is given up on after one retry
+		{Name: "slow", Type: server.ProcessorCommand, Command: "sh", Args: []string{"-c", `echo attempt >> "$0"; sleep 5`, attemptsPath},
+			Timeout: 200 * time.Millisecond, Retries: 1, Backoff: 10 * time.Millisecond},
+	}
+	ctrl := startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath, Pipeline: processors})
+
+	assert := assert.New(t)
+	assert.Eventually(func() bool {
+		return strings.Contains(scrape(t, ctrl), `bearcatter_pipeline_runs_total{processor="slow",result="failed"} 1`)
+	}, 10*time.Second, 50*time.Millisecond)
+
+	encoded := filepath.Join(recordingsPath, "2020-06-21_00-00-32.mp3")
+	original, _ := ioutil.ReadFile(transferFixture)
+	copied, readErr := ioutil.ReadFile(encoded)
+	assert.NoError(readErr)
+	assert.Equal(original, copied)
+	encoder.mu.Lock()
+	assert.Equal(map[string]string{"title": "Dispatch East", "artist": "East Bay Regional Communications System (EBRCS)"}, encoder.tags)
+	encoder.mu.Unlock()
+
+	stdin, readErr := ioutil.ReadFile(stdinPath)
+	assert.NoError(readErr)
+	recording := server.ProcessedRecording{}
+	assert.NoError(json.Unmarshal(stdin, &recording))
+	assert.Equal(encoded, recording.Path, "Processors after an encoder get the encoded file")
+	assert.Equal(filepath.Join(recordingsPath, "2020-06-21_00-00-32.wav"), recording.Location)
+	assert.Equal("Dispatch East", recording.Tags["title"])
+	if assert.NotNil(recording.Metadata) {
+		assert.Equal("Dispatch East", recording.Metadata.Public.Channel)
+	}
+
+	if uploads := endpoint.received("/upload"); assert.Len(uploads, 1) {
+		_, params, parseErr := mime.ParseMediaType(uploads[0].header.Get("Content-Type"))
+		assert.NoError(parseErr)
+		form, formErr := multipart.NewReader(bytes.NewReader(uploads[0].body), params["boundary"]).ReadForm(1 << 20)
+		if assert.NoError(formErr) {
+			assert.Equal([]string{"Dispatch East"}, form.Value["tag.title"])
+			if assert.Len(form.File["audio"], 1) {
+				assert.Equal("2020-06-21_00-00-32.mp3", form.File["audio"][0].Filename)
+			}
+		}
+	}
+
+	attempts, _ := ioutil.ReadFile(attemptsPath)
+	assert.Equal("attempt\nattempt\n", string(attempts))
+	metrics := scrape(t, ctrl)
+	for _, name := range []string{"tag", "encode", "save", "upload"} {
+		assert.Contains(metrics, `bearcatter_pipeline_runs_total{processor="`+name+`",result="completed"} 1`)
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	log "github.com/sirupsen/logrus"
+)
+
+// JSONProtocol is the WebSocket subprotocol clients ask for to get JSON messages instead of the raw scanner protocol.
+// The version is part of the name so incompatible changes can be offered next to it.
+const JSONProtocol = "bearcatter.v1.json"
+
+// ProtocolVersion is the version of the JSON protocol, sent to clients in the hello event.
+const ProtocolVersion = 1
+
+// Message types sent to JSON clients. Everything but MessageResponse is an event.
+const (
+	MessageResponse = "response"
+
+	EventHello         = "hello"
+	EventNotice        = "server.notice"
+	EventScannerInfo   = "scanner.info"
+	EventScannerStatus = "scanner.status"
+	EventListResult    = "list.result"
+	EventFileReceived  = "file.received"
+)
+
+// ErrUnknownCommand is returned to JSON clients for commands the server does not know.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Message is sent to JSON clients. Responses carry the ID of their command and either Data or Error.
+type Message struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// Command is sent by JSON clients. The ID is chosen by the client and returned in the response.
+type Command struct {
+	ID      string          `json:"id"`
+	Command string          `json:"command"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Hello is the first event a JSON client receives.
+type Hello struct {
+	Version    int           `json:"version"`
+	Control    ControlPolicy `json:"control"`
+	Controller string        `json:"controller,omitempty"`
+}
+
+// Notice tells a JSON client about its connection, such as being granted control.
+type Notice struct {
+	Message string `json:"message"`
+}
+
+// ListResult is a page of a GLT list, for example List FL with a *GltFLInfo as Result.
+type ListResult struct {
+	List   string      `json:"list"`
+	Result interface{} `json:"result"`
+}
+
+// FileReceived announces a recording downloaded from the scanner.
+type FileReceived struct {
+	Name string `json:"name"`
+	// Path is where the recording was stored, a file or the URL of an object
+	Path string `json:"path"`
+	// Recording is the name of the recording in the store, as served at /api/recordings/{recording}
+	Recording string              `json:"recording,omitempty"`
+	Metadata  *wavparse.Recording `json:"metadata,omitempty"`
+}
+
+// levelParams are the params of volume.set and squelch.set.
+type levelParams struct {
+	Level int `json:"level"`
+}
+
+// holdParams are the params of scanner.hold. Target and indexes are the [tkw], [xxx1] and [xxx2] of the HLD command.
+type holdParams struct {
+	Target  string   `json:"target"`
+	Indexes []string `json:"indexes"`
+}
+
+// recordParams are the params of record.set.
+type recordParams struct {
+	Recording bool `json:"recording"`
+}
+
+// listParams are the params of list.get, for example {"list": "SYS", "index": "1"}.
+type listParams struct {
+	List  string `json:"list"`
+	Index string `json:"index"`
+}
+
+// psiParams are the params of psi.set. An interval of 0 stops the scanner.info events.
+type psiParams struct {
+	Interval int `json:"interval"`
+}
+
+// listType returns the type of a GLT list name such as SYS.
+func listType(name string) (GltXmlType, bool) {
+	for listType, listName := range gltListNames {
+		if listName == name {
+			return listType, true
+		}
+	}
+	return GltXmlUnknown, false
+}
+
+// handleJSONMessage runs a command from a JSON client and queues the response for it.
+func (c *ScannerCtrl) handleJSONMessage(ctx context.Context, client *wsClient, raw []byte) {
+	cmd := Command{}
+	if decodeErr := json.Unmarshal(raw, &cmd); decodeErr != nil {
+		log.Warnf("WS Client [%s] sent invalid JSON: %v", client.name, decodeErr)
+		c.hub.reply(client, Message{Type: MessageResponse, Error: "invalid command: " + decodeErr.Error()})
+		return
+	}
+
+	// Commands wait for the scanner, so the next ones are read meanwhile
+	go func() {
+		response := Message{Type: MessageResponse, ID: cmd.ID}
+		data, cmdErr := c.runJSONCommand(ctx, client, &cmd)
+		if cmdErr != nil {
+			log.Infof("WS Client [%s] command %s failed: %v", client.name, cmd.Command, cmdErr)
+			response.Error = cmdErr.Error()
+		} else {
+			response.Data = data
+		}
+		c.hub.reply(client, response)
+	}()
+}
+
+func decodeParams(cmd *Command, v interface{}) error {
+	if len(cmd.Params) == 0 {
+		return fmt.Errorf("%s needs params", cmd.Command)
+	}
+	if decodeErr := json.Unmarshal(cmd.Params, v); decodeErr != nil {
+		return fmt.Errorf("invalid params for %s: %w", cmd.Command, decodeErr)
+	}
+	return nil
+}
+
+// runJSONCommand runs a command with the typed commands of ScannerCtrl and returns the data of the response.
+func (c *ScannerCtrl) runJSONCommand(ctx context.Context, client *wsClient, cmd *Command) (interface{}, error) {
+	switch cmd.Command {
+	case "control.request":
+		c.hub.handleControl(client, CONTROL)
+		return nil, nil
+	case "control.release":
+		c.hub.handleControl(client, RELEASE)
+		return nil, nil
+	}
+
+	if controller, ok := c.hub.mayControl(client); !ok {
+		return nil, fmt.Errorf("locked by %s", controller)
+	}
+
+	switch cmd.Command {
+	case "scanner.model":
+		return c.GetModel(ctx)
+	case "scanner.version":
+		return c.GetFirmwareVersion(ctx)
+	case "scanner.info":
+		return c.GetScannerInfo(ctx)
+	case "scanner.status":
+		return c.GetStatus(ctx)
+	case "menu.status":
+		return c.GetMenuStatus(ctx)
+	case "volume.get":
+		return c.GetVolume(ctx)
+	case "volume.set":
+		params := levelParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.SetVolume(ctx, params.Level)
+	case "squelch.get":
+		return c.GetSquelch(ctx)
+	case "squelch.set":
+		params := levelParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.SetSquelch(ctx, params.Level)
+	case "key.press":
+		params := KeyPress{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.PressKey(ctx, &params)
+	case "datetime.get":
+		return c.GetDateTime(ctx)
+	case "datetime.set":
+		params := DateTimeInfo{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.SetDateTime(ctx, &params)
+	case "location.get":
+		return c.GetLocation(ctx)
+	case "location.set":
+		params := LocationInfo{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.SetLocation(ctx, &params)
+	case "scanner.hold":
+		params := holdParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.Hold(ctx, params.Target, params.Indexes...)
+	case "record.get":
+		return c.GetRecordStatus(ctx)
+	case "record.set":
+		params := recordParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		return nil, c.SetRecording(ctx, params.Recording)
+	case "list.get":
+		params := listParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		listType, ok := listType(params.List)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedList, params.List)
+		}
+		result, listErr := c.GetList(ctx, listType, params.Index)
+		if listErr != nil {
+			return nil, listErr
+		}
+		return &ListResult{List: params.List, Result: result}, nil
+	case "psi.set":
+		params := psiParams{}
+		if paramsErr := decodeParams(cmd, &params); paramsErr != nil {
+			return nil, paramsErr
+		}
+		if !c.SendToHostMsgChannel([]byte("PSI," + strconv.Itoa(params.Interval))) {
+			return nil, ErrQueueFull
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, cmd.Command)
+	}
+}
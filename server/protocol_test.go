@@ -0,0 +1,156 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// jsonMessage is a server.Message with the data left for the test to decode.
+type jsonMessage struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id"`
+	Data  json.RawMessage `json:"data"`
+	Error string          `json:"error"`
+}
+
+// bufferedConn reads what the dialer buffered during the handshake before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func dialJSON(t *testing.T, addr net.Addr) net.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialer := ws.Dialer{Protocols: []string{server.JSONProtocol}}
+	conn, br, hs, dialErr := dialer.Dial(ctx, "ws://"+addr.String()+"/")
+	if dialErr != nil {
+		t.Fatalf("error when dialing WebSocket server: %v", dialErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if hs.Protocol != server.JSONProtocol {
+		t.Fatalf("server did not agree to %s, got %q", server.JSONProtocol, hs.Protocol)
+	}
+
+	// The hello event may have arrived with the handshake
+	if br != nil {
+		return &bufferedConn{Conn: conn, r: br}
+	}
+	return conn
+}
+
+// expectJSON returns the first message of the given type, and for responses the given ID, skipping the others.
+func expectJSON(t *testing.T, conn net.Conn, msgType string, id string) jsonMessage {
+	if deadlineErr := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); deadlineErr != nil {
+		t.Fatalf("error when setting deadline: %v", deadlineErr)
+	}
+	for {
+		raw, op, readErr := wsutil.ReadServerData(conn)
+		if readErr != nil {
+			t.Fatalf("error when waiting for %s: %v", msgType, readErr)
+		}
+		if op != ws.OpText {
+			t.Fatalf("JSON clients should only get text messages, got %q", raw)
+		}
+
+		msg := jsonMessage{}
+		if decodeErr := json.Unmarshal(raw, &msg); decodeErr != nil {
+			t.Fatalf("error when decoding %s: %v", raw, decodeErr)
+		}
+		if msg.Type == msgType && msg.ID == id {
+			return msg
+		}
+	}
+}
+
+// call sends a command and returns its response.
+func call(t *testing.T, conn net.Conn, id string, command string, params interface{}) jsonMessage {
+	cmd := map[string]interface{}{"id": id, "command": command}
+	if params != nil {
+		cmd["params"] = params
+	}
+	marshalled, marshalErr := json.Marshal(cmd)
+	if marshalErr != nil {
+		t.Fatalf("error when marshalling %s: %v", command, marshalErr)
+	}
+	if writeErr := wsutil.WriteClientMessage(conn, ws.OpText, marshalled); writeErr != nil {
+		t.Fatalf("error when sending %s: %v", command, writeErr)
+	}
+	return expectJSON(t, conn, server.MessageResponse, id)
+}
+
+func TestJSONProtocol(t *testing.T) {
+	scenario := sim.DefaultScenario()
+	scenario.PageSize = 2
+	scenario.Steps = nil
+
+	host, scanner := server.NewPipe()
+	simulator := sim.New(scenario)
+	serveSimulator(t, simulator, scanner)
+	ctrl := startServer(t, &server.Config{Transport: host})
+
+	raw := dialWebSocket(t, ctrl.Addr())
+	conn := dialJSON(t, ctrl.Addr())
+
+	assert := assert.New(t)
+
+	hello := server.Hello{}
+	assert.NoError(json.Unmarshal(expectJSON(t, conn, server.EventHello, "").Data, &hello))
+	assert.Equal(server.ProtocolVersion, hello.Version)
+	assert.NotEmpty(hello.Controller, "The raw client connected first and should be in control")
+
+	locked := call(t, conn, "1", "scanner.model", nil)
+	assert.Contains(locked.Error, "locked by")
+
+	// The raw client hands over control
+	assert.NoError(wsutil.WriteClientMessage(raw, ws.OpText, []byte(server.RELEASE+"\n")))
+	assert.Equal("Control released", expect(t, raw, "Control"))
+	assert.Empty(call(t, conn, "2", "control.request", nil).Error)
+
+	model := call(t, conn, "3", "scanner.model", nil)
+	assert.Empty(model.Error)
+	assert.Equal(`"SDS200"`, string(model.Data))
+
+	assert.Empty(call(t, conn, "4", "volume.set", map[string]int{"level": 21}).Error)
+	assert.Equal(21, simulator.State().Volume)
+	assert.Contains(call(t, conn, "5", "volume.set", map[string]int{"level": 99}).Error, server.ErrCommandRejected.Error())
+
+	assert.Contains(call(t, conn, "6", "bogus", nil).Error, server.ErrUnknownCommand.Error())
+
+	departments := struct {
+		List   string
+		Result server.GltDeptInfo
+	}{}
+	list := call(t, conn, "7", "list.get", map[string]string{"list": "DEPT", "index": "2"})
+	assert.Empty(list.Error)
+	assert.NoError(json.Unmarshal(list.Data, &departments))
+	assert.Equal("DEPT", departments.List)
+	assert.Len(departments.Result.DEPT, 3)
+
+	// Updates from the scanner arrive as events, raw clients still get the raw messages
+	simulator.SetCall(&sim.Call{System: "Howard County (Project 25)", TGID: "10961", UnitID: "2468170"})
+	assert.Empty(call(t, conn, "8", "psi.set", map[string]int{"interval": 100}).Error)
+
+	si := server.ScannerInfo{}
+	assert.NoError(json.Unmarshal(expectJSON(t, conn, server.EventScannerInfo, "").Data, &si))
+	assert.Equal("TGID:10961", si.TGID.TGID)
+	assert.Contains(expect(t, raw, "PSI"), `TGID="TGID:10961"`)
+
+	assert.Empty(call(t, conn, "9", "psi.set", map[string]int{"interval": 0}).Error)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+// DefaultRecordingsLimit is how many recordings /api/recordings lists unless asked for a different number.
+const DefaultRecordingsLimit = 50
+
+// ErrInvalidRecording is returned for recording names that are not a WAV file inside of the recordings.
+var ErrInvalidRecording = errors.New("invalid recording name")
+
+// SavedRecording is a recording kept by a RecordingStore.
+type SavedRecording struct {
+	// Name is the path relative to the recordings, with forward slashes
+	Name     string              `json:"name"`
+	Size     int64               `json:"size"`
+	Time     time.Time           `json:"time"`
+	Metadata *wavparse.Recording `json:"metadata,omitempty"`
+	// Encodings are the names of the files the pipeline encoded the recording to. Their size is part of Size.
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// recordingsHandler lists the recordings of a store at /api/recordings and streams one at /api/recordings/{name}.
+func recordingsHandler(store RecordingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET, HEAD")
+			return
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/recordings"), "/")
+		if name == "" {
+			limit := DefaultRecordingsLimit
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				var limitErr error
+				if limit, limitErr = strconv.Atoi(raw); limitErr != nil || limit <= 0 {
+					writeError(w, http.StatusBadRequest, errors.New("limit must be a positive number"))
+					return
+				}
+			}
+
+			recordings, listErr := store.List()
+			if listErr != nil {
+				writeError(w, http.StatusInternalServerError, listErr)
+				return
+			}
+			if len(recordings) > limit {
+				recordings = recordings[:limit]
+			}
+			for _, recording := range recordings {
+				// Recordings without metadata are listed all the same
+				if metadata, metadataErr := store.Metadata(recording.Name); metadataErr == nil {
+					recording.Metadata = metadata
+				}
+			}
+			writeJSON(w, http.StatusOK, recordings)
+			return
+		}
+
+		if _, nameErr := cleanRecordingName(name); nameErr != nil {
+			writeError(w, http.StatusBadRequest, nameErr)
+			return
+		}
+		audio, modTime, openErr := store.Open(name)
+		if errors.Is(openErr, ErrRecordingNotFound) {
+			writeError(w, http.StatusNotFound, openErr)
+			return
+		} else if openErr != nil {
+			writeError(w, http.StatusInternalServerError, openErr)
+			return
+		}
+		defer audio.Close()
+
+		w.Header().Set("Content-Type", "audio/wav")
+		http.ServeContent(w, r, path.Base(name), modTime, audio)
+	}
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+const (
+	// DefaultS3Region is the region requests are signed for unless set otherwise. MinIO accepts it as well.
+	DefaultS3Region = "us-east-1"
+
+	// s3Timeout limits how long a request to the object storage may take.
+	s3Timeout = time.Minute
+	// s3Algorithm is the signature version requests are signed with.
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	// s3DateFormat is the format of the X-Amz-Date header.
+	s3DateFormat = "20060102T150405Z"
+)
+
+// ErrInvalidS3Config is returned by NewS3Store when the endpoint or bucket are missing.
+var ErrInvalidS3Config = errors.New("invalid S3 configuration")
+
+// S3Config is an S3 compatible object storage, such as AWS S3 or MinIO, to keep recordings in.
+type S3Config struct {
+	// Endpoint is the URL of the storage, for example https://s3.us-west-2.amazonaws.com or http://localhost:9000
+	Endpoint string
+	// Region is the region requests are signed for, DefaultS3Region if empty
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is put in front of the names of the recordings, such as "scanner/"
+	Prefix string
+}
+
+// S3Store keeps recordings as objects in a bucket, addressed path style as https://endpoint/bucket/key.
+// Requests are signed with AWS Signature Version 4.
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Store returns a store of the recordings in the bucket of cfg.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("%w: bucket must be set", ErrInvalidS3Config)
+	}
+	endpoint, parseErr := url.Parse(cfg.Endpoint)
+	if parseErr != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("%w: endpoint %q must be a http or https URL", ErrInvalidS3Config, cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+	return &S3Store{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: s3Timeout}}, nil
+}
+
+// s3Error is the body of a failed request.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3ListResult is a page of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// objectURL returns the URL of a key, or of the bucket if key is empty.
+func (s *S3Store) objectURL(key string) string {
+	segments := []string{s3Escape(s.cfg.Bucket)}
+	if key != "" {
+		for _, segment := range strings.Split(key, "/") {
+			segments = append(segments, s3Escape(segment))
+		}
+	}
+	return strings.TrimSuffix(s.endpoint.String(), "/") + "/" + strings.Join(segments, "/")
+}
+
+// do sends a signed request for a key and returns the response if it succeeded.
+func (s *S3Store) do(method string, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	req, reqErr := http.NewRequest(method, s.objectURL(key), bytes.NewReader(body))
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	req.URL.RawQuery = s3Query(query)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now())
+
+	resp, doErr := s.client.Do(req)
+	if doErr != nil {
+		return nil, doErr
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrRecordingNotFound
+	}
+	failure := s3Error{}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(respBody, &failure) != nil || failure.Code == "" {
+		return nil, fmt.Errorf("%s %s: %s", method, req.URL.Path, resp.Status)
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s %s", method, req.URL.Path, resp.Status, failure.Code, failure.Message)
+}
+
+// sign adds the AWS Signature Version 4 of a request to its headers.
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := strings.Join([]string{amzDate[:8], s.cfg.Region, "s3", "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, part := range []string{amzDate[:8], s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as signatures expect.
+func s3Escape(value string) string {
+	escaped := &strings.Builder{}
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Query encodes query parameters sorted by name, as signatures expect.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// key returns the object key of a recording name.
+func (s *S3Store) key(name string) (string, error) {
+	cleaned, nameErr := cleanRecordingName(name)
+	if nameErr != nil {
+		return "", nameErr
+	}
+	return s.cfg.Prefix + cleaned, nil
+}
+
+// Save uploads the WAV file and its sidecars and removes the local file. It returns the URL of the recording.
+func (s *S3Store) Save(name string, audioPath string, sidecars map[string][]byte) (string, error) {
+	key, keyErr := s.key(name)
+	if keyErr != nil {
+		return "", keyErr
+	}
+
+	audio, readErr := ioutil.ReadFile(audioPath)
+	if readErr != nil {
+		return "", readErr
+	}
+	// The sidecars go up first, so a listed recording always has them
+	for format, sidecar := range sidecars {
+		sidecarResp, sidecarErr := s.do(http.MethodPut, wavparse.SidecarName(key, format), nil, sidecar, "application/json")
+		if sidecarErr != nil {
+			return "", sidecarErr
+		}
+		sidecarResp.Body.Close()
+	}
+	audioResp, audioErr := s.do(http.MethodPut, key, nil, audio, "audio/wav")
+	if audioErr != nil {
+		return "", audioErr
+	}
+	audioResp.Body.Close()
+
+	if removeErr := os.Remove(audioPath); removeErr != nil {
+		return "", removeErr
+	}
+	return s.objectURL(key), nil
+}
+
+// List returns the WAV objects below the prefix.
+func (s *S3Store) List() ([]*SavedRecording, error) {
+	recordings := []*SavedRecording{}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+	for {
+		resp, listErr := s.do(http.MethodGet, "", query, nil, "")
+		if listErr != nil {
+			return nil, listErr
+		}
+		page := s3ListResult{}
+		decodeErr := xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if decodeErr != nil {
+			return nil, fmt.Errorf("failed to decode object list: %w", decodeErr)
+		}
+
+		for _, object := range page.Contents {
+			if !strings.EqualFold(path.Ext(object.Key), ".wav") {
+				continue
+			}
+			name := strings.TrimPrefix(object.Key, s.cfg.Prefix)
+			recordings = append(recordings, &SavedRecording{Name: name, Size: object.Size, Time: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Time.After(recordings[j].Time)
+	})
+	return recordings, nil
+}
+
+// Metadata downloads the metadata of a recording, or the recording to decode it if it was saved without.
+func (s *S3Store) Metadata(name string) (*wavparse.Recording, error) {
+	key, keyErr := s.key(name)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	resp, getErr := s.do(http.MethodGet, wavparse.SidecarName(key, wavparse.SidecarBearcatter), nil, nil, "")
+	if errors.Is(getErr, ErrRecordingNotFound) {
+		return s.decode(name)
+	} else if getErr != nil {
+		return nil, getErr
+	}
+	defer resp.Body.Close()
+
+	metadata := &wavparse.Recording{}
+	if decodeErr := json.NewDecoder(resp.Body).Decode(metadata); decodeErr != nil {
+		return nil, decodeErr
+	}
+	return metadata, nil
+}
+
+// decode downloads a recording to decode its metadata.
+func (s *S3Store) decode(name string) (*wavparse.Recording, error) {
+	audio, _, openErr := s.Open(name)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer audio.Close()
+
+	temp, tempErr := ioutil.TempFile("", "bearcatter-*.wav")
+	if tempErr != nil {
+		return nil, tempErr
+	}
+	defer os.Remove(temp.Name())
+	_, copyErr := io.Copy(temp, audio)
+	if closeErr := temp.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	return decodeSaved(temp.Name(), name)
+}
+
+// Open downloads the WAV file of a recording.
+func (s *S3Store) Open(name string) (RecordingAudio, time.Time, error) {
+	key, keyErr := s.key(name)
+	if keyErr != nil {
+		return nil, time.Time{}, keyErr
+	}
+
+	resp, getErr := s.do(http.MethodGet, key, nil, nil, "")
+	if getErr != nil {
+		return nil, time.Time{}, getErr
+	}
+	defer resp.Body.Close()
+
+	audio, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, time.Time{}, readErr
+	}
+	// Without a Last-Modified header the time stays zero, which http.ServeContent ignores
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return nopCloser{bytes.NewReader(audio)}, modTime, nil
+}
+
+// Remove deletes the objects of a recording.
+func (s *S3Store) Remove(name string) error {
+	key, keyErr := s.key(name)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	objects := []string{key}
+	for _, format := range wavparse.SidecarFormats {
+		objects = append(objects, wavparse.SidecarName(key, format))
+	}
+	for _, object := range objects {
+		resp, deleteErr := s.do(http.MethodDelete, object, nil, nil, "")
+		if errors.Is(deleteErr, ErrRecordingNotFound) {
+			continue
+		} else if deleteErr != nil {
+			return deleteErr
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// nopCloser is a downloaded recording, which has nothing to close.
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -2,12 +2,17 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"text/template"
 	"time"
 
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/history"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,150 +22,250 @@ type MsgPacket struct {
 	homePatrol bool
 }
 
-type Locker struct {
+// PacketCounter counts the messages exchanged with the scanner.
+type PacketCounter struct {
 	sync.Mutex
-	state   bool
-	name    string
 	pktSent uint64
 	pktRecv uint64
 }
 
+// Snapshot holds the last scanner information and status the scanner sent.
+type Snapshot struct {
+	Info       *ScannerInfo   `json:"info,omitempty"`
+	InfoTime   *time.Time     `json:"info_time,omitempty"`
+	Status     *ScannerStatus `json:"status,omitempty"`
+	StatusTime *time.Time     `json:"status_time,omitempty"`
+	Link       *LinkState     `json:"link,omitempty"`
+}
+
 type APRModeType string
 type ASTModeType string
 
 type Modal struct {
-	PSI               bool // PSI Mode on/Off
-	WSClientConnected bool
-	ASTMode           ASTModeType
-	APRMode           APRModeType
+	PSI     bool // PSI Mode on/Off
+	ASTMode ASTModeType
+	APRMode APRModeType
 }
 
 type ScannerCtrl struct {
-	locker           Locker
-	rq               chan bool
-	wq               chan bool
-	drained          chan bool
-	radioMsg         chan MsgPacket
+	counter          PacketCounter
+	hub              *hub
+	events           *eventLog
+	calls            *callDetector
+	metrics          *metrics
+	mqtt             *mqttBridge
+	webhooks         *webhookDispatcher
+	pipeline         *pipeline
+	uploads          *uploadDispatcher
+	callLog          *callLog
+	quit             chan struct{}
+	stopOnce         sync.Once
+	wg               sync.WaitGroup
 	hostMsg          chan MsgPacket
-	conn             *ScannerConn
+	conn             Transport
+	link             *linkSupervisor
 	s                *http.Server
+	listener         net.Listener
 	c                chan os.Signal
 	GoProcDelay      time.Duration
 	GoProcMultiplier time.Duration
 	mode             Modal
 	incomingFile     *AudioFeedFile
+	aliases          *alias.Store
+	history          *history.Store
+	recordingsPath   string
+	recordings       RecordingStore
+	storeQueue       chan *pendingRecording
+	recordingsLayout *template.Template
+	sidecars         []string
+	shortName        string
+	// CommandTimeout limits how long the typed commands such as GetModel wait for a reply
+	CommandTimeout time.Duration
+	pendingMu      sync.Mutex
+	pending        []*pendingCommand
+	snapshotMu     sync.Mutex
+	snapshot       Snapshot
 }
 
-func (s *ScannerCtrl) IsLocked() bool {
-	var locked bool
-	s.locker.Lock()
-	if s.locker.state {
-		locked = true
-		log.Tracef("UDP Packets Sent: [%d] UDP Packets Recv: [%d]", s.locker.pktSent, s.locker.pktRecv)
-	} else {
-		locked = false
+// Snapshot returns the last GSI or PSI update and STS reply and the state of the link.
+func (s *ScannerCtrl) Snapshot() Snapshot {
+	s.snapshotMu.Lock()
+	snapshot := s.snapshot
+	s.snapshotMu.Unlock()
+
+	if link := s.Link(); link.State != "" {
+		snapshot.Link = &link
 	}
-	s.locker.Unlock()
-	return locked
+	return snapshot
 }
 
-func (s *ScannerCtrl) ReceiveFromRadioMsgChannel() (MsgPacket, bool) {
-	select {
-	case msgToHost := <-s.radioMsg:
-		elapsed := time.Since(msgToHost.ts)
-		log.Infof("Received Message: [%s] To Send To Host: %s", elapsed, msgToHost.msg)
-		return msgToHost, true
-	default:
-		time.Sleep(time.Millisecond * 50)
+// updateInfo keeps a GSI or PSI update for the snapshot and logs a channel.changed event when the scanner moved.
+// Activity webhooks are notified when the scanner moved, or when an emergency shows up on the same channel.
+func (s *ScannerCtrl) updateInfo(si *ScannerInfo) {
+	now := time.Now()
+	s.snapshotMu.Lock()
+	previous := channelOf(s.snapshot.Info)
+	wasEmergency := s.snapshot.Info != nil && emergencyOf(s.snapshot.Info)
+	s.snapshot.Info = si
+	s.snapshot.InfoTime = &now
+	s.snapshotMu.Unlock()
+
+	if channel := channelOf(si); channel != nil {
+		switch {
+		case previous == nil || *channel != *previous:
+			s.events.append(EventChannelChanged, channel)
+			s.webhooks.activity(si, channel, false)
+		case !wasEmergency && emergencyOf(si):
+			s.webhooks.activity(si, channel, true)
+		}
 	}
-	return MsgPacket{}, false
+	s.trackCall(si)
 }
 
-func (s *ScannerCtrl) SendToRadioMsgChannel(msg []byte) bool {
-	if !s.IsLocked() {
-		log.Debugln("RadioMsgChannel: No Listener to Receive Msg, Msg Not Sent")
-		// return false
-	}
+// updateStatus keeps an STS reply for the snapshot and logs squelch.opened and squelch.closed events.
+func (s *ScannerCtrl) updateStatus(sts *ScannerStatus) {
+	now := time.Now()
+	s.snapshotMu.Lock()
+	// Before the first reply the squelch is taken as closed
+	wasOpen := s.snapshot.Status != nil && s.snapshot.Status.Squelch
+	s.snapshot.Status = sts
+	s.snapshot.StatusTime = &now
+	channel := channelOf(s.snapshot.Info)
+	s.snapshotMu.Unlock()
 
-	pkt := MsgPacket{
-		msg:        msg,
-		ts:         time.Now(),
-		homePatrol: bytes.Contains(msg, []byte("\t")),
+	if sts.Squelch == wasOpen {
+		return
 	}
-
-	select {
-	case s.radioMsg <- pkt:
-		log.Debugf("Send Msg[ql=%d]: [%s] to Radio Msg Channel", len(s.radioMsg), msg)
-		return true
-	default:
-		log.Warnf("Queue Full, No Message Sent: %d", len(s.radioMsg))
-		time.Sleep(time.Millisecond * 50)
+	change := &SquelchChange{Frequency: sts.Frequency, Signal: sts.SignalLevel, Channel: channel}
+	if sts.Squelch {
+		s.events.append(EventSquelchOpened, change)
+	} else {
+		s.events.append(EventSquelchClosed, change)
 	}
-	return false
 }
 
-func (s *ScannerCtrl) SendToHostMsgChannel(msg []byte) bool {
-	if !s.IsLocked() {
-		log.Debugln("HostMsgChannel: No Listener to Receive Msg, Msg Not Sent")
-		// return false
-	}
+// SendToRadioMsgChannel passes a message from the scanner on to every WebSocket client.
+func (s *ScannerCtrl) SendToRadioMsgChannel(msg []byte) bool {
+	s.hub.broadcast(msg)
+	return true
+}
 
+// forwardList passes a page of a GLT list on, raw to raw clients and as a list.result event to JSON clients.
+func (s *ScannerCtrl) forwardList(name string, list interface{}, xmlBody []byte) {
+	s.SendToRadioMsgChannel([]byte("GLT," + name + string(xmlBody)))
+	s.hub.publish(EventListResult, &ListResult{List: name, Result: list})
+}
+
+func (s *ScannerCtrl) SendToHostMsgChannel(msg []byte) bool {
 	pkt := MsgPacket{
 		msg:        msg,
 		ts:         time.Now(),
 		homePatrol: bytes.Contains(msg, []byte("\t")),
 	}
 
-	if s.conn.Type == ConnTypeNetwork && !pkt.homePatrol && !bytes.HasSuffix(pkt.msg, []byte("\r")) {
-		pkt.msg = bytes.ReplaceAll(pkt.msg, []byte("\n"), []byte("\r"))
-	}
-
 	select {
 	case s.hostMsg <- pkt:
 		return true
 	default:
-		log.Warnf("Queue Full, No Message Sent: %d", len(s.radioMsg))
+		s.metrics.dropped.WithLabelValues(queueHost).Inc()
+		log.Warnf("Queue Full, No Message Sent: %d", len(s.hostMsg))
 		time.Sleep(time.Millisecond * 50)
 	}
 	return false
 }
 
 func (c *ScannerCtrl) drain() {
-	if c.conn.Type == ConnTypeUSB {
-		if flushErr := c.conn.usbConn.Flush(); flushErr != nil {
-			log.Fatalln("Error while flushing USB", flushErr)
-		}
+	if flushErr := c.conn.Flush(); flushErr != nil {
+		log.Errorln("Error while draining scanner connection", flushErr)
 		return
 	}
+	log.Infoln("Drained...")
+}
 
-	buffer := make([]byte, 8192)
-	for {
-		// c.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		_, err := c.conn.Read(buffer)
+// Addr returns the address the WebSocket server is listening on.
+func (c *ScannerCtrl) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
 
-		if err != nil {
-			if e, ok := err.(net.Error); !ok || !e.Timeout() {
-			} else {
-				log.Infoln("Drained...")
-				return
+// Stop ends the file transfer session, shuts down the WebSocket server and closes the scanner connection.
+// It waits for the reader and writer to finish.
+func (c *ScannerCtrl) Stop() {
+	c.stopOnce.Do(func() {
+		if supportsFileTransfer(c.conn) {
+			if c.incomingFile != nil && !c.incomingFile.Finished {
+				log.Infoln("Terminating file transfer session")
+				c.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "INFO", "CAN"})))
+				c.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA", "CAN"})))
 			}
-		} else {
-			log.Infoln("Packet Draining on WS Close...")
+
+			c.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "STS", "OFF"})))
+			time.Sleep(50 * time.Millisecond)
 		}
-	}
+
+		close(c.quit)
+
+		if c.s != nil {
+			const timeout = 5 * time.Second
+
+			log.Infoln("Shutting down WebSocket server")
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := c.s.Shutdown(ctx); err != nil {
+				log.Errorln("Failed to Shutdown", err)
+			}
+			cancel()
+		}
+
+		// A link that is down, or never came up, is closed already
+		if closeErr := c.conn.Close(); closeErr != nil && !errors.Is(closeErr, ErrTransportClosed) {
+			log.Errorln("Failed to close scanner connection", closeErr)
+		}
+
+		c.wg.Wait()
+
+		// A file still being transferred is offered again by the scanner next time
+		if c.incomingFile != nil && !c.incomingFile.Finished {
+			c.incomingFile.Abort()
+		}
+
+		// No more updates are coming, so a call in progress is over
+		if call := c.calls.flush(); call != nil {
+			c.endCall(call)
+		}
+		if c.callLog != nil {
+			if closeErr := c.callLog.Close(); closeErr != nil {
+				log.Errorln("Failed to close call log", closeErr)
+			}
+		}
+		if c.mqtt != nil {
+			c.mqtt.stop()
+		}
+		c.webhooks.stop()
+		c.pipeline.stop()
+		c.uploads.stop()
+		log.Infoln("Server Terminated.")
+	})
 }
 
 func CreateScannerCtrl() *ScannerCtrl {
 	ctrl := &ScannerCtrl{}
 
-	ctrl.rq = make(chan bool, 1)
-	ctrl.wq = make(chan bool, 1)
-	ctrl.drained = make(chan bool, 1)
+	ctrl.quit = make(chan struct{})
+	ctrl.link = newLinkSupervisor()
+	ctrl.storeQueue = make(chan *pendingRecording, storeQueueSize)
 
-	ctrl.radioMsg = make(chan MsgPacket, 100)
+	ctrl.hub = newHub(ControlSingle, DefaultClientQueueSize)
+	ctrl.metrics = newMetrics(ctrl)
+	ctrl.hub.dropped = ctrl.metrics.dropped.WithLabelValues(queueClient)
+	ctrl.events = newEventLog(DefaultEventBufferSize)
+	ctrl.calls = newCallDetector(DefaultCallHangTime)
 	ctrl.hostMsg = make(chan MsgPacket, 100)
 	ctrl.c = make(chan os.Signal)
 	ctrl.GoProcDelay = DefaultGoProcDelay
 	ctrl.GoProcMultiplier = DefaultGoProcMultiplier
+	ctrl.CommandTimeout = DefaultCommandTimeout
 	return ctrl
 }
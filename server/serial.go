@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// serialReadTimeout bounds how long a read blocks so Close doesn't wait on a quiet scanner.
+const serialReadTimeout = 500 * time.Millisecond
+
+// deadReadLimit is how many reads in a row may come back empty long before serialReadTimeout. The port of an
+// unplugged scanner returns from every read at once, which would otherwise spin forever.
+const deadReadLimit = 50
+
+// serialPort is the part of a serial.Port the transport uses, so tests can stand in for the port.
+type serialPort interface {
+	io.ReadWriteCloser
+	Flush() error
+}
+
+// SerialTransport talks to a scanner over its USB serial port, such as the SDS100. Messages are separated by CRs.
+type SerialTransport struct {
+	path     string
+	config   *serial.Config
+	openPort func(*serial.Config) (serialPort, error)
+
+	// mu guards the port, reader and closed, which are replaced every time the transport is opened
+	mu     sync.Mutex
+	port   serialPort
+	reader *bufio.Scanner
+	closed chan struct{}
+}
+
+func NewSerialTransport(path string) *SerialTransport {
+	return &SerialTransport{
+		path:   path,
+		config: &serial.Config{Name: path, Baud: 115200, ReadTimeout: serialReadTimeout},
+		openPort: func(config *serial.Config) (serialPort, error) {
+			return serial.OpenPort(config)
+		},
+	}
+}
+
+func (t *SerialTransport) Open() error {
+	port, portErr := t.openPort(t.config)
+	if portErr != nil {
+		return portErr
+	}
+	closed := make(chan struct{})
+	reader := bufio.NewScanner(&portReader{port: port, closed: closed})
+	reader.Buffer(make([]byte, 16384), bufio.MaxScanTokenSize*4)
+	reader.Split(ScanLinesWithCR)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.port = port
+	t.closed = closed
+	t.reader = reader
+	return nil
+}
+
+func (t *SerialTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.port == nil {
+		return ErrTransportClosed
+	}
+	select {
+	case <-t.closed:
+		return ErrTransportClosed
+	default:
+		close(t.closed)
+	}
+	return t.port.Close()
+}
+
+// portReader retries reads that timed out without data until the port is closed or found dead.
+type portReader struct {
+	port   serialPort
+	closed chan struct{}
+}
+
+func (r *portReader) Read(b []byte) (int, error) {
+	empty := 0
+	for {
+		started := time.Now()
+		n, readErr := r.port.Read(b)
+		if n > 0 || (readErr != nil && readErr != io.EOF) {
+			return n, readErr
+		}
+		select {
+		case <-r.closed:
+			return 0, ErrTransportClosed
+		default:
+		}
+		if time.Since(started) >= serialReadTimeout/2 {
+			// A quiet scanner, the read waited for the timeout
+			empty = 0
+			continue
+		}
+		if empty++; empty >= deadReadLimit {
+			return 0, ErrLinkDead
+		}
+	}
+}
+
+func (t *SerialTransport) ReadMessage() ([]byte, error) {
+	t.mu.Lock()
+	reader := t.reader
+	t.mu.Unlock()
+	if reader == nil {
+		return nil, ErrTransportClosed
+	}
+	if !reader.Scan() {
+		if scanErr := reader.Err(); scanErr != nil {
+			return nil, scanErr
+		}
+		return nil, io.EOF
+	}
+	scanned := reader.Bytes()
+	msg := make([]byte, len(scanned))
+	copy(msg, scanned)
+	return msg, nil
+}
+
+func (t *SerialTransport) WriteMessage(msg []byte) error {
+	port := t.openedPort()
+	if port == nil {
+		return ErrTransportClosed
+	}
+	_, writeErr := port.Write(terminateCR(msg))
+	return writeErr
+}
+
+func (t *SerialTransport) Flush() error {
+	port := t.openedPort()
+	if port == nil {
+		return ErrTransportClosed
+	}
+	return port.Flush()
+}
+
+// openedPort returns the port unless the transport was not opened or is closed.
+func (t *SerialTransport) openedPort() serialPort {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.port == nil {
+		return nil
+	}
+	select {
+	case <-t.closed:
+		return nil
+	default:
+		return t.port
+	}
+}
+
+// FileTransfer reports that recordings can be downloaded over USB.
+func (t *SerialTransport) FileTransfer() bool {
+	return true
+}
+
+func (t *SerialTransport) String() string {
+	return fmt.Sprintf("%s via USB", t.path)
+}
@@ -2,118 +2,306 @@ package server
 
 import (
 	"bytes"
-	"context"
-	"encoding/hex"
-	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/history"
+	"github.com/Bearcatter/bearcatter/wavparse"
 	"github.com/davecgh/go-spew/spew"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrNoTransport is returned when neither a Transport, UDP address, USB path nor USB discovery was configured.
+var ErrNoTransport = errors.New("IP address, USB path or USB discovery must be set")
+
 type Config struct {
-	UDPAddress     *net.UDPAddr
-	USBPath        string
-	WebSocketPort  int
+	UDPAddress *net.UDPAddr
+	USBPath    string
+	// USBDiscovery finds the scanner over USB when neither UDPAddress nor USBPath are set
+	USBDiscovery *USBDiscovery
+	// Transport overrides UDPAddress and USBPath, for example with a PipeTransport in tests.
+	Transport     Transport
+	WebSocketHost string
+	WebSocketPort int
+	// RecordingsPath is where recordings are downloaded to, and kept unless Recordings is set
 	RecordingsPath string
+	// Recordings keeps the downloaded recordings, a LocalStore of RecordingsPath if nil
+	Recordings RecordingStore
+	// RecordingsLayout is the template recordings are named with, DefaultRecordingsLayout if empty
+	RecordingsLayout string
+	// Retention prunes the recordings, they are kept forever if it is zero
+	Retention Retention
+	// Sidecars are the formats of the JSON saved next to every recording, wavparse.SidecarBearcatter if empty
+	Sidecars []string
+	// ShortName names the system in trunk-recorder sidecars and layouts, made of the system name if empty
+	ShortName string
+	Aliases   *alias.Store
+	// CommandTimeout overrides DefaultCommandTimeout for the typed commands of ScannerCtrl
+	CommandTimeout time.Duration
+	// ControlPolicy decides which WebSocket clients may send commands, ControlSingle if empty
+	ControlPolicy ControlPolicy
+	// ClientQueueSize is how many messages are buffered for each WebSocket client, DefaultClientQueueSize if zero
+	ClientQueueSize int
+	// EventBufferSize is how many events /events keeps for clients resuming with Last-Event-ID, DefaultEventBufferSize if zero
+	EventBufferSize int
+	// CallLogPath is a file every call is appended to as a line of JSON, no call log if empty
+	CallLogPath string
+	// History archives every call and recording, not archived if nil
+	History *history.Store
+	// CallHangTime is how long the scanner may stay muted before a call ends, DefaultCallHangTime if zero
+	CallHangTime time.Duration
+	// MQTT publishes the scanner state to a broker and takes commands from it, no MQTT if nil
+	MQTT *MQTTConfig
+	// Webhooks are notified about activity and recordings matching their rules
+	Webhooks []*Webhook
+	// Pipeline are the processors every saved recording goes through in order
+	Pipeline []*Processor
+	// Uploaders post saved recordings to call sharing services
+	Uploaders []*Uploader
+	// UploadQueuePath keeps the uploads that did not succeed yet, DefaultUploadQueue below RecordingsPath if empty
+	UploadQueuePath string
+	// ProbeInterval is how long the scanner may stay quiet before it is probed, DefaultProbeInterval if zero and
+	// never if negative
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a probe may go unanswered before reconnecting, DefaultProbeTimeout if zero
+	ProbeTimeout time.Duration
+	// ReconnectBackoff is the wait before reconnecting, doubled after every failure, DefaultReconnectBackoff if zero
+	ReconnectBackoff time.Duration
+	// MaxReconnectBackoff caps the wait before reconnecting, DefaultMaxReconnectBackoff if zero
+	MaxReconnectBackoff time.Duration
 }
 
+// Serve runs the server until it is interrupted.
 func (c *Config) Serve() {
+	ctrl, startErr := c.Start()
+	if startErr != nil {
+		log.Fatalln("Failed to start server", startErr)
+	}
+
+	signal.Notify(ctrl.c, os.Interrupt)
+	<-ctrl.c
+
+	// gracefully terminate go routines
+	log.Infoln("Terminating on signal...")
+
+	ctrl.Stop()
+}
+
+// transport returns the configured Transport or creates one for the UDP address, USB path or USB discovery.
+func (c *Config) transport() (Transport, error) {
+	switch {
+	case c.Transport != nil:
+		return c.Transport, nil
+	case c.UDPAddress != nil:
+		return NewUDPTransport(c.UDPAddress), nil
+	case c.USBPath != "":
+		return NewSerialTransport(c.USBPath), nil
+	case c.USBDiscovery != nil:
+		return NewDiscoveredTransport(c.USBDiscovery), nil
+	default:
+		return nil, ErrNoTransport
+	}
+}
+
+// Start connects to the scanner and starts the reader, writer and WebSocket server.
+// The returned ScannerCtrl keeps running until Stop is called.
+func (c *Config) Start() (*ScannerCtrl, error) {
 	ctrl := CreateScannerCtrl()
-	var connCreateErr error
-
-	if c.UDPAddress != nil {
-		ctrl.conn, connCreateErr = NewUDPConn(c.UDPAddress)
-	} else if c.USBPath != "" {
-		ctrl.conn, connCreateErr = NewUSBConn(c.USBPath)
-	} else {
-		log.Fatal("IP address or USB path must be set!")
+	ctrl.aliases = c.Aliases
+	ctrl.history = c.History
+	ctrl.recordingsPath = c.RecordingsPath
+	ctrl.recordings = c.Recordings
+	if ctrl.recordings == nil {
+		ctrl.recordings = NewLocalStore(c.RecordingsPath)
+	}
+	var layoutErr error
+	if ctrl.recordingsLayout, layoutErr = ParseRecordingsLayout(c.RecordingsLayout); layoutErr != nil {
+		return nil, fmt.Errorf("invalid recordings layout: %w", layoutErr)
+	}
+	ctrl.sidecars = c.Sidecars
+	if len(ctrl.sidecars) == 0 {
+		ctrl.sidecars = []string{wavparse.SidecarBearcatter}
+	}
+	if sidecarsErr := wavparse.CheckSidecars(ctrl.sidecars); sidecarsErr != nil {
+		return nil, sidecarsErr
+	}
+	ctrl.shortName = c.ShortName
+	if c.CommandTimeout > 0 {
+		ctrl.CommandTimeout = c.CommandTimeout
+	}
+	ctrl.hub = newHub(c.ControlPolicy, c.ClientQueueSize)
+	ctrl.hub.dropped = ctrl.metrics.dropped.WithLabelValues(queueClient)
+	ctrl.events = newEventLog(c.EventBufferSize)
+	ctrl.calls = newCallDetector(c.CallHangTime)
+	if c.ProbeInterval != 0 {
+		ctrl.link.probeInterval = c.ProbeInterval
+	}
+	if c.ProbeTimeout > 0 {
+		ctrl.link.probeTimeout = c.ProbeTimeout
+	}
+	if c.ReconnectBackoff > 0 {
+		ctrl.link.backoff = c.ReconnectBackoff
+	}
+	if c.MaxReconnectBackoff > 0 {
+		ctrl.link.maxBackoff = c.MaxReconnectBackoff
 	}
 
-	if connCreateErr != nil {
-		log.Fatalln("Failed to create connection", connCreateErr)
+	var transportErr error
+	ctrl.conn, transportErr = c.transport()
+	if transportErr != nil {
+		return nil, transportErr
 	}
 
-	if connOpenErr := ctrl.conn.Open(); connOpenErr != nil {
-		log.Fatalln("Failed to open connection", connOpenErr)
+	if len(c.Webhooks) > 0 {
+		var webhooksErr error
+		if ctrl.webhooks, webhooksErr = startWebhooks(c.Webhooks); webhooksErr != nil {
+			return nil, fmt.Errorf("failed to start webhooks: %w", webhooksErr)
+		}
 	}
 
-	log.Infoln(ctrl.conn.String())
-	if ctrl.conn.Type == ConnTypeNetwork {
-		log.Infoln("Remote UDP address", ctrl.conn.udpConn.RemoteAddr().String())
-		log.Infoln("Local UDP client address", ctrl.conn.udpConn.LocalAddr().String())
+	if len(c.Pipeline) > 0 {
+		var pipelineErr error
+		if ctrl.pipeline, pipelineErr = startPipeline(c.Pipeline, ctrl.metrics); pipelineErr != nil {
+			ctrl.webhooks.stop()
+			return nil, fmt.Errorf("failed to start pipeline: %w", pipelineErr)
+		}
 	}
 
-	defer ctrl.conn.Close()
+	if len(c.Uploaders) > 0 {
+		queuePath := c.UploadQueuePath
+		if queuePath == "" {
+			queuePath = filepath.Join(c.RecordingsPath, DefaultUploadQueue)
+		}
+		var uploadersErr error
+		if ctrl.uploads, uploadersErr = startUploaders(c.Uploaders, queuePath, ctrl.recordings, ctrl.metrics); uploadersErr != nil {
+			ctrl.webhooks.stop()
+			ctrl.pipeline.stop()
+			return nil, fmt.Errorf("failed to start uploaders: %w", uploadersErr)
+		}
+	}
+
+	if c.CallLogPath != "" {
+		var callLogErr error
+		if ctrl.callLog, callLogErr = openCallLog(c.CallLogPath); callLogErr != nil {
+			ctrl.webhooks.stop()
+			ctrl.pipeline.stop()
+			ctrl.uploads.stop()
+			return nil, fmt.Errorf("failed to open call log: %w", callLogErr)
+		}
+	}
+
+	// A scanner that is not plugged in yet is waited for like one that was unplugged
+	connOpenErr := ctrl.conn.Open()
+	switch {
+	case errors.Is(connOpenErr, ErrNoScanner):
+		log.Warnf("%v, waiting for one to be plugged in", connOpenErr)
+		ctrl.link.state = LinkState{State: LinkDisconnected, Link: ctrl.conn.String(), Error: connOpenErr.Error(), Since: time.Now()}
+	case connOpenErr != nil:
+		if ctrl.callLog != nil {
+			ctrl.callLog.Close()
+		}
+		ctrl.webhooks.stop()
+		ctrl.pipeline.stop()
+		ctrl.uploads.stop()
+		return nil, fmt.Errorf("failed to open connection: %w", connOpenErr)
+	default:
+		log.Infoln("Connected to", ctrl.conn.String())
+		ctrl.link.received()
+		ctrl.link.state = LinkState{State: LinkConnected, Link: ctrl.conn.String(), Since: time.Now()}
+	}
 
 	// write a message to Scanner
+	ctrl.wg.Add(1)
 	go func(ctrl *ScannerCtrl) {
+		defer ctrl.wg.Done()
 		for {
 			select {
-			case <-ctrl.wq:
+			case <-ctrl.quit:
 				log.Infoln("Shutting down writer...")
 				return
 			case msgToRadio := <-ctrl.hostMsg:
 				elapsed := time.Since(msgToRadio.ts)
 				log.Debugf("Host->Scanner:[ql=%d]: [%s]: [%#q]", len(ctrl.hostMsg), elapsed, msgToRadio.msg)
-				if _, writeErr := ctrl.conn.Write(msgToRadio.msg); writeErr != nil {
+				if !ctrl.link.connected() {
+					log.Debugf("Dropping [%#q] while the scanner is disconnected", msgToRadio.msg)
+					continue
+				}
+				if writeErr := ctrl.conn.WriteMessage(msgToRadio.msg); writeErr != nil {
 					log.Errorln("Error Writing to scanner", writeErr)
 					continue
 				}
-				ctrl.locker.pktSent++
+				ctrl.link.sent(msgToRadio.msg)
+				ctrl.counter.Lock()
+				ctrl.counter.pktSent++
+				ctrl.counter.Unlock()
+				ctrl.metrics.packetsSent.WithLabelValues(messageType(msgToRadio.msg)).Inc()
 
-			default:
-				time.Sleep(time.Millisecond * ctrl.GoProcDelay * ctrl.GoProcMultiplier)
+			case <-time.After(time.Millisecond * ctrl.GoProcDelay * ctrl.GoProcMultiplier):
 			}
 		}
 	}(ctrl)
 
+	// store the recordings downloaded by the reader
+	ctrl.wg.Add(1)
+	go ctrl.storeRecordings()
+
 	// receive message from server
+	ctrl.wg.Add(1)
 	go func(ctrl *ScannerCtrl) {
-		var do_quit bool = false
+		defer ctrl.wg.Done()
+		defer close(ctrl.storeQueue)
 
 		xmlMessage := make([]byte, 0)
 		isXML := false
 		var xmlMessageType string
 
+		if connOpenErr != nil && !ctrl.reconnect(connOpenErr) {
+			log.Infoln("Shutting down reader...")
+			return
+		}
+
 		for {
-			// ctrl.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			buffer := make([]byte, 16384)
-			n, readErr := ctrl.conn.Read(buffer)
-			log.Debugf("Scanner->Host:[ql=%d]: [%#q]\n", len(ctrl.hostMsg), buffer[0:n])
+			buffer, readErr := ctrl.conn.ReadMessage()
 			if readErr != nil {
-				log.Errorln("Error on read!", readErr)
-				if e, ok := readErr.(net.Error); !ok || !e.Timeout() {
-					log.Errorln("Error on read", e, n)
-				} else {
-					log.Errorln("Unknown error, quitting!")
-					// so we timedout - and if we've received a quit then exit after draining the upd packets
-					if do_quit {
-						select {
-						case ctrl.drained <- true:
-							log.Infoln("Draining Packets")
-						default:
-							time.Sleep(time.Millisecond * 50)
-						}
-						return
-					}
+				select {
+				case <-ctrl.quit:
+					log.Infoln("Shutting down reader...")
+					return
+				default:
 				}
+				if !ctrl.link.failed(readErr) {
+					log.Errorln("Error on read!", readErr)
+					continue
+				}
+				if !ctrl.reconnect(readErr) {
+					log.Infoln("Shutting down reader...")
+					return
+				}
+				// A message cut off by the failure never ends
+				isXML = false
+				xmlMessageType = ""
+				xmlMessage = make([]byte, 0)
+				continue
 			}
+			ctrl.link.received()
+			log.Debugf("Scanner->Host:[ql=%d]: [%#q]\n", len(ctrl.hostMsg), buffer)
 
-			if ctrl.conn.Type == ConnTypeNetwork {
-				buffer = []byte(crlfStrip(buffer, LF|NL))
+			if len(buffer) < 3 {
+				continue
 			}
 
-			if bytes.Equal(buffer[4:9], []byte(`<XML>`)) {
+			if bytes.HasPrefix(messageFrom(buffer, 4), []byte(`<XML>`)) {
 				xmlMessageType = string(buffer[0:3])
-				copy(xmlMessage, buffer[0:n])
+				copy(xmlMessage, buffer)
 				if !IsValidXMLMessage(xmlMessageType, xmlMessage) {
 					isXML = true
 					continue
@@ -125,7 +313,7 @@ func (c *Config) Serve() {
 			}
 
 			if isXML {
-				xmlMessage = append(xmlMessage, buffer[0:n]...)
+				xmlMessage = append(xmlMessage, buffer...)
 				if !IsValidXMLMessage(xmlMessageType, xmlMessage) {
 					continue
 				}
@@ -141,34 +329,44 @@ func (c *Config) Serve() {
 			}
 
 			msgType := string(buffer[:3])
+			params := messageFrom(buffer, 4)
+			xmlBody := messageFrom(buffer, 11)
+
+			ctrl.counter.Lock()
+			ctrl.counter.pktRecv++
+			ctrl.counter.Unlock()
+			ctrl.metrics.packetsReceived.WithLabelValues(messageType(buffer)).Inc()
 
-			ctrl.locker.pktRecv++
+			ctrl.deliver(msgType, params, xmlBody)
 
 			switch msgType {
 			case "APR":
-				log.Infoln("APR", string(buffer[4:]))
+				log.Infoln("APR", string(params))
 			case "AST":
-				log.Infoln("AST", string(buffer[4:]))
+				log.Infoln("AST", string(params))
 			case "MDL":
-				log.Infoln("MDL: Model", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("MDL," + string(buffer[4:])))
+				log.Infoln("MDL: Model", string(params))
+				// Replies to probes are not for the clients
+				if !ctrl.link.probeReply() {
+					ctrl.SendToRadioMsgChannel([]byte("MDL," + string(params)))
+				}
 			case "VER":
-				log.Infoln("VER: Firmare", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("VER," + string(buffer[4:])))
+				log.Infoln("VER: Firmare", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("VER," + string(params)))
 			case "MSB":
-				log.Infoln("MSB: Params", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("MSB," + string(buffer[4:])))
+				log.Infoln("MSB: Params", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("MSB," + string(params)))
 			case "MSV":
-				log.Infoln("MSV: Param", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("MSV," + string(buffer[4:])))
+				log.Infoln("MSV: Param", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("MSV," + string(params)))
 			case "MNU":
-				log.Infoln("MNU: Params", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("MNU," + string(buffer[4:])))
+				log.Infoln("MNU: Params", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("MNU," + string(params)))
 			case "MSI":
 				msiInfo := MsiInfo{}
-				log.Infoln("MSI", string(buffer[4:]))
-				if decodeErr := xml.Unmarshal(buffer[11:], &msiInfo); decodeErr != nil {
-					log.Errorln("Failed to decode XML", decodeErr)
+				log.Infoln("MSI", string(params))
+				if decodeErr := xml.Unmarshal(xmlBody, &msiInfo); decodeErr != nil {
+					ctrl.xmlFailed(msgType, decodeErr)
 				} else {
 					log.Infof("MSI: Name: %s, Index: %s, MenuType: %s Value: %s Selected %s ",
 						msiInfo.Name, msiInfo.Index, msiInfo.MenuType, msiInfo.Value, msiInfo.Selected)
@@ -177,129 +375,141 @@ func (c *Config) Serve() {
 							mi, msiInfo.MenuItem[mi].Name, msiInfo.MenuItem[mi].Index, msiInfo.MenuItem[mi].Text)
 					}
 				}
-				ctrl.SendToRadioMsgChannel([]byte("MSI," + string(buffer[4:])))
+				ctrl.SendToRadioMsgChannel([]byte("MSI," + string(params)))
 			case "DTM":
-				log.Infoln("DTM:", string(buffer[4:]))
-				timeInfo := NewDateTimeInfo(string(buffer[4:n]))
-				log.Infof("DTM: DST?: %t, Time: %s, RTC OK? %t\n", timeInfo.DaylightSavings, timeInfo.Time, timeInfo.RTCOK)
-				ctrl.SendToRadioMsgChannel([]byte("DTM," + string(buffer[4:])))
+				log.Infoln("DTM:", string(params))
+				if !isAcknowledgement(params) {
+					timeInfo := NewDateTimeInfo(string(params))
+					log.Infof("DTM: DST?: %t, Time: %s, RTC OK? %t\n", timeInfo.DaylightSavings, timeInfo.Time, timeInfo.RTCOK)
+				}
+				ctrl.SendToRadioMsgChannel([]byte("DTM," + string(params)))
 			case "LCR":
-				log.Infoln("LCR:", string(buffer[4:]))
-				locInfo := NewLocationInfo(string(buffer[4:n]))
-				log.Infof("LCR: Latitude: %f, Longitude: %f, Range: %f\n", locInfo.Latitude, locInfo.Longitude, locInfo.Range)
-				ctrl.SendToRadioMsgChannel([]byte("LCR," + string(buffer[4:])))
+				log.Infoln("LCR:", string(params))
+				if !isAcknowledgement(params) {
+					locInfo := NewLocationInfo(string(params))
+					log.Infof("LCR: Latitude: %f, Longitude: %f, Range: %f\n", locInfo.Latitude, locInfo.Longitude, locInfo.Range)
+				}
+				ctrl.SendToRadioMsgChannel([]byte("LCR," + string(params)))
 			case "URC":
-				log.Infoln("URC:", string(buffer[4:]))
-				recStatus := NewUserRecordStatus(string(buffer[4:n]))
-				log.Infof("URC: Recording? %t, ErrorCode: %d, ErrorMessage: %s\n", recStatus.Recording, recStatus.ErrorCode, *recStatus.ErrorMessage)
-				ctrl.SendToRadioMsgChannel([]byte("URC," + string(buffer[4:])))
+				log.Infoln("URC:", string(params))
+				if !isAcknowledgement(params) {
+					recStatus := NewUserRecordStatus(string(params))
+					if recStatus.ErrorCode != nil {
+						log.Infof("URC: Recording? %t, ErrorCode: %d, ErrorMessage: %s\n", recStatus.Recording, *recStatus.ErrorCode, *recStatus.ErrorMessage)
+					} else {
+						log.Infof("URC: Recording? %t\n", recStatus.Recording)
+					}
+				}
+				ctrl.SendToRadioMsgChannel([]byte("URC," + string(params)))
 			case "STS":
-				log.Infoln("STS", string(buffer[4:]))
-				stsInfo := NewScannerStatus(string(buffer[4:]))
+				log.Infoln("STS", string(params))
+				stsInfo := NewScannerStatus(string(params))
 				log.Infof("STS: Line 1: %s, Line 2: %s, Line 3: %s, Line 4: %s, SQL: %t, Signal Level: %d\n",
 					stsInfo.Line1, stsInfo.Line2, stsInfo.Line3, stsInfo.Line4, stsInfo.Squelch, stsInfo.SignalLevel)
-				ctrl.SendToRadioMsgChannel([]byte("STS," + string(buffer[4:])))
+				ctrl.SendToRadioMsgChannel([]byte("STS," + string(params)))
+				ctrl.updateStatus(stsInfo)
+				ctrl.hub.publish(EventScannerStatus, stsInfo)
 			case "GLG":
 			case "GLT":
-				switch getXmlGLTFormatType(buffer[11:]) {
+				switch getXmlGLTFormatType(xmlBody) {
 				case GltXmlFL:
 					gltFl := GltFLInfo{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltFl); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltFl); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for fl := 0; fl < len(gltFl.FL); fl++ {
 							log.Infof("GLT,FL[%d]: Name: %s, Index: %s, Monitor: %s",
 								fl+1, gltFl.FL[fl].Name, gltFl.FL[fl].Index, gltFl.FL[fl].Monitor)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,FL" + string(buffer[11:])))
+						ctrl.forwardList("FL", &gltFl, xmlBody)
 					}
 				case GltXmlSYS:
 					gltSys := GltSysInfo{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltSys); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltSys); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for sys := 0; sys < len(gltSys.SYS); sys++ {
 							log.Infof("GLT,SYS[%d]: Name: %s, Index: %s, TrunkID: %s, Type: %s",
 								sys+1, gltSys.SYS[sys].Name, gltSys.SYS[sys].Index, gltSys.SYS[sys].TrunkId, gltSys.SYS[sys].Type)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,SYS" + string(buffer[11:])))
+						ctrl.forwardList("SYS", &gltSys, xmlBody)
 					}
 
 				case GltXmlDEPT:
 					gltDept := GltDeptInfo{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltDept); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltDept); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for dpt := 0; dpt < len(gltDept.DEPT); dpt++ {
 							log.Infof("GLT,DEPT[%d]: Name: %s, Index: %s, TGroupID: %s",
 								dpt+1, gltDept.DEPT[dpt].Name, gltDept.DEPT[dpt].Index, gltDept.DEPT[dpt].TGroupId)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,DEPT" + string(buffer[11:])))
+						ctrl.forwardList("DEPT", &gltDept, xmlBody)
 					}
 				case GltXmlSITE:
 					gltSite := GltSiteInfo{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltSite); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltSite); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for site := 0; site < len(gltSite.SITE); site++ {
 							log.Infof("GLT,SITE[%d]: Name: %s, Index: %s, SiteId: %s",
 								site+1, gltSite.SITE[site].Name, gltSite.SITE[site].Index, gltSite.SITE[site].SiteId)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,SITE" + string(buffer[11:])))
+						ctrl.forwardList("SITE", &gltSite, xmlBody)
 					}
 				case GltXmlFTO:
 					gltFTO := GltFto{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltFTO); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltFTO); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for fto := 0; fto < len(gltFTO.FTO); fto++ {
 							log.Infof("GLT,FTO[%d]: Name: %s, Index: %s, Freq: %s, Mod: %s, ToneA: %s, ToneB: %s",
 								fto+1, gltFTO.FTO[fto].Name, gltFTO.FTO[fto].Index, gltFTO.FTO[fto].Freq, gltFTO.FTO[fto].Mod, gltFTO.FTO[fto].ToneA, gltFTO.FTO[fto].ToneB)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,FTO" + string(buffer[11:])))
+						ctrl.forwardList("FTO", &gltFTO, xmlBody)
 					}
 				case GltXmlCSBANK:
 					gltCSBank := GltCSBank{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltCSBank); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltCSBank); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for csb := 0; csb < len(gltCSBank.CSBANK); csb++ {
 							log.Infof("GLT,CSBANK[%d]: Name: %s, Index: %s, Lower: %s, Upper: %s, Mod: %s, Step: %s",
 								csb+1, gltCSBank.CSBANK[csb].Name, gltCSBank.CSBANK[csb].Index, gltCSBank.CSBANK[csb].Lower, gltCSBank.CSBANK[csb].Upper, gltCSBank.CSBANK[csb].Mod, gltCSBank.CSBANK[csb].Step)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,CS_BANK" + string(buffer[11:])))
+						ctrl.forwardList("CS_BANK", &gltCSBank, xmlBody)
 					}
 				case GltXmlTRN_DISCOV:
 					gltTrnDisc := GltTrnDiscovery{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltTrnDisc); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltTrnDisc); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for td := 0; td < len(gltTrnDisc.TRNDISCOV); td++ {
 							log.Infof("GLT,TRN_DISCOV: Name: %s, Delay: %s, Logging: %s, Duration: %s, CompareDB: %s, SystemName: %s SystemType: %s SiteName: %s, TimeOutTimer: %s, AutoStore: %s",
 								gltTrnDisc.TRNDISCOV[td].Name, gltTrnDisc.TRNDISCOV[td].Delay, gltTrnDisc.TRNDISCOV[td].Logging, gltTrnDisc.TRNDISCOV[td].Duration, gltTrnDisc.TRNDISCOV[td].CompareDB, gltTrnDisc.TRNDISCOV[td].SystemName, gltTrnDisc.TRNDISCOV[td].SystemType, gltTrnDisc.TRNDISCOV[td].SiteName, gltTrnDisc.TRNDISCOV[td].TimeOutTimer, gltTrnDisc.TRNDISCOV[td].AutoStore)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,TRN_DISCOV" + string(buffer[11:])))
+						ctrl.forwardList("TRN_DISCOV", &gltTrnDisc, xmlBody)
 					}
 				case GltXmlCNV_DISCOV:
 					gltCnvDisc := GltCnvDiscovery{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltCnvDisc); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltCnvDisc); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for cd := 0; cd < len(gltCnvDisc.CNVDISCOV); cd++ {
 							log.Infof("GLT,CNV_DISCOV: Name: %s, Lower: %s, Upper: %s, Mod: %s, Step: %s, Delay: %s Logging: %s CompareDB: %s, Duration: %s, TimeOutTimer: %s, AutoStore: %s", gltCnvDisc.CNVDISCOV[cd].Name, gltCnvDisc.CNVDISCOV[cd].Lower, gltCnvDisc.CNVDISCOV[cd].Upper, gltCnvDisc.CNVDISCOV[cd].Mod, gltCnvDisc.CNVDISCOV[cd].Step, gltCnvDisc.CNVDISCOV[cd].Delay, gltCnvDisc.CNVDISCOV[cd].Logging, gltCnvDisc.CNVDISCOV[cd].CompareDB, gltCnvDisc.CNVDISCOV[cd].Duration, gltCnvDisc.CNVDISCOV[cd].TimeOutTimer, gltCnvDisc.CNVDISCOV[cd].AutoStore)
-							ctrl.SendToRadioMsgChannel([]byte("GLT,CNV_DISCOV" + string(buffer[11:])))
 						}
+						ctrl.forwardList("CNV_DISCOV", &gltCnvDisc, xmlBody)
 					}
 				case GltXmlUREC_FOLDER:
 					gltUrecFolder := GltUrecFolder{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &gltUrecFolder); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &gltUrecFolder); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						for fi := 0; fi < len(gltUrecFolder.URECFOLDER); fi++ {
 							log.Infof("GLT,UREC_FOLDER: Name: %s, Index: %s, Text: %s",
 								gltUrecFolder.URECFOLDER[fi].Name, gltUrecFolder.URECFOLDER[fi].Index, gltUrecFolder.URECFOLDER[fi].Text)
 						}
-						ctrl.SendToRadioMsgChannel([]byte("GLT,UREC_FOLDER" + string(buffer[11:])))
+						ctrl.forwardList("UREC_FOLDER", &gltUrecFolder, xmlBody)
 					}
 
 				default:
@@ -307,56 +517,61 @@ func (c *Config) Serve() {
 					spew.Dump(buffer)
 				}
 			case "VOL":
-				log.Infoln("VOL: Volume", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("VOL," + string(buffer[4:])))
+				log.Infoln("VOL: Volume", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("VOL," + string(params)))
 			case "SQL":
-				log.Infoln("SQL: Squelch", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("SQL," + string(buffer[4:])))
+				log.Infoln("SQL: Squelch", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("SQL," + string(params)))
 			case "PWR":
-				log.Infoln("PWR: Power", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("PWR," + string(buffer[4:])))
+				log.Infoln("PWR: Power", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("PWR," + string(params)))
 			case "GSI":
 				si := ScannerInfo{}
-				if decodeErr := xml.Unmarshal(buffer[11:], &si); decodeErr != nil {
-					log.Errorln("Failed to decode XML", decodeErr)
+				if decodeErr := xml.Unmarshal(xmlBody, &si); decodeErr != nil {
+					ctrl.xmlFailed(msgType, decodeErr)
 				} else {
 					log.Infof("GSI: System: %s, Department: %s, Site: %s, Freq: [%s] Mon: [%s] Mode: [%s]",
 						si.System.Name, si.Department.Name, si.Site.Name, si.SiteFrequency.Freq, si.MonitorList.Name, si.Mode)
-					ctrl.SendToRadioMsgChannel([]byte("GSI," + string(buffer[11:])))
+					ctrl.SendToRadioMsgChannel([]byte("GSI," + string(aliasedScannerInfo(ctrl.aliases, &si, xmlBody))))
+					ctrl.updateInfo(&si)
+					ctrl.hub.publish(EventScannerInfo, &si)
 				}
 			case "PSI":
 				switch {
-				case string(buffer[4:6]) == "OK":
+				case bytes.HasPrefix(params, []byte("OK")):
 					ctrl.mode.PSI = false
 					log.Infoln("PSI: Stopped")
-				case string(buffer[4:9]) == "<XML>":
+				case bytes.HasPrefix(params, []byte("<XML>")):
 					ctrl.mode.PSI = true
 					si := ScannerInfo{}
-					if decodeErr := xml.Unmarshal(buffer[11:], &si); decodeErr != nil {
-						log.Errorln("Failed to decode XML", decodeErr)
+					if decodeErr := xml.Unmarshal(xmlBody, &si); decodeErr != nil {
+						ctrl.xmlFailed(msgType, decodeErr)
 					} else {
 						log.Infof("GSI: System: %s, Department: %s, Site: %s, Freq: [%s] Mon: [%s] Mode: [%s]",
 							si.System.Name, si.Department.Name, si.Site.Name, si.SiteFrequency.Freq, si.MonitorList.Name, si.Mode)
-						ctrl.SendToRadioMsgChannel([]byte("PSI," + string(buffer[11:])))
+						ctrl.SendToRadioMsgChannel([]byte("PSI," + string(aliasedScannerInfo(ctrl.aliases, &si, xmlBody))))
+						ctrl.updateInfo(&si)
+						ctrl.hub.publish(EventScannerInfo, &si)
 					}
 				default:
-					log.Infoln("PSI: Invalid Mode::", string(buffer[4:]))
+					log.Infoln("PSI: Invalid Mode::", string(params))
 					continue
 				}
 			case "KEY":
-				log.Infoln("KEY", string(buffer[4:]))
-				ctrl.SendToRadioMsgChannel([]byte("KEY," + string(buffer[4:])))
+				log.Infoln("KEY", string(params))
+				ctrl.SendToRadioMsgChannel([]byte("KEY," + string(params)))
 			// HomePatrol Commands
 			case "RMT":
 				log.Infoln(msgType, string(buffer))
 				ctrl.SendToRadioMsgChannel(buffer)
 			case "AUF":
-				split := strings.Split(string(buffer[0:n]), "\t")
+				split := strings.Split(string(buffer), "\t")
 
 				hpCmd := split[1]
 
 				if len(split) > 2 {
 					if split[2] == "ERR" {
+						ctrl.metrics.transfers.WithLabelValues(transferFailed).Inc()
 						log.Warnln("Scanner threw ERR during file transfer!")
 						continue
 					} else if split[2] == "NG" {
@@ -367,15 +582,16 @@ func (c *Config) Serve() {
 
 				switch hpCmd {
 				case "ERR":
-					log.Errorf("File %s: Scanner threw DATA ERR during file transfer!\n", ctrl.incomingFile.Name)
+					ctrl.metrics.transfers.WithLabelValues(transferFailed).Inc()
+					log.Errorf("File %s: Scanner threw DATA ERR during file transfer!\n", ctrl.incomingFile)
 					continue
 				case "NG":
-					log.Warnf("File %s: Scanner said last command was invalid during DATA\n", ctrl.incomingFile.Name)
+					log.Warnf("File %s: Scanner said last command was invalid during DATA\n", ctrl.incomingFile)
 					continue
 				case "STS":
 					ctrl.SendToRadioMsgChannel(buffer)
 				case "INFO":
-					ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "INFO", "ACK"})))
+					ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "INFO", "ACK"})))
 
 					newFile, newFileErr := NewAudioFeedFile(split[2:])
 					if newFileErr != nil {
@@ -384,58 +600,99 @@ func (c *Config) Serve() {
 						}
 						continue
 					}
+					if ctrl.incomingFile != nil && !ctrl.incomingFile.Finished {
+						log.Warnf("File %s: Abandoned for %s\n", ctrl.incomingFile.Name, newFile.Name)
+						ctrl.incomingFile.Abort()
+					}
+					if openErr := newFile.Open(c.RecordingsPath); openErr != nil {
+						log.Errorf("File %s: Error when creating temporary file: %v\n", newFile.Name, openErr)
+						ctrl.incomingFile = nil
+						continue
+					}
 					log.Infof("File %s: Beginning to transfer: Size: %d, ExpectedBlocks: %d, Timestamp: %v\n", newFile.Name, newFile.Size, newFile.ExpectedBlocks, newFile.Timestamp)
 					ctrl.incomingFile = newFile
 
-					ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "DATA"})))
+					ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA"})))
 				case "DATA":
+					if len(split) < 4 {
+						log.Warnf("AUF DATA without a block: %q\n", buffer)
+						continue
+					}
+					if ctrl.incomingFile == nil {
+						log.Warnln("AUF DATA without a file being transferred")
+						continue
+					}
+
 					dataSubCmd := split[2]
 					switch dataSubCmd {
 					case "EOT":
 						// End of transmission
-						log.Infof("File %s: Finished receiving with file length %d\n", ctrl.incomingFile.Name, ctrl.incomingFile.Size)
-
-						ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "DATA", "ACK"})))
-
-						ctrl.incomingFile.Finished = true
+						log.Infof("File %s: Finished receiving %d of %d bytes in %d blocks\n", ctrl.incomingFile.Name, ctrl.incomingFile.Received, ctrl.incomingFile.Size, ctrl.incomingFile.Blocks)
 
-						filePath := fmt.Sprintf("%s/%s", c.RecordingsPath, ctrl.incomingFile.Name)
+						filePath := filepath.Join(c.RecordingsPath, ctrl.incomingFile.Name)
 
-						if saveAudioErr := ioutil.WriteFile(filePath, ctrl.incomingFile.Data, 0777); saveAudioErr != nil {
+						if saveAudioErr := ctrl.incomingFile.Finish(filePath); saveAudioErr != nil {
 							log.Errorf("File %s: Error when saving audio file: %v\n", ctrl.incomingFile.Name, saveAudioErr)
+							ctrl.cancelTransfer()
 							continue
 						}
 
+						ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA", "ACK"})))
+
 						if metadataErr := ctrl.incomingFile.ParseMetadata(filePath); metadataErr != nil {
+							ctrl.metrics.transfers.WithLabelValues(transferFailed).Inc()
 							log.Errorf("File %s: Error when parsing metadata: %v\n", ctrl.incomingFile.Name, metadataErr)
 							continue
 						}
 
-						metadataJSON, metadataJSONErr := json.MarshalIndent(&ctrl.incomingFile.Metadata, "", "    ")
-						if metadataJSONErr != nil {
-							log.Errorf("File %s: Error when marshalling metadata: %v\n", ctrl.incomingFile.Name, metadataJSONErr)
+						ctrl.aliases.Apply(ctrl.incomingFile.Metadata)
+
+						sidecars, sidecarsErr := ctrl.incomingFile.Metadata.Sidecars(ctrl.sidecars, ctrl.shortName)
+						if sidecarsErr != nil {
+							ctrl.metrics.transfers.WithLabelValues(transferFailed).Inc()
+							log.Errorf("File %s: Error when marshalling metadata: %v\n", ctrl.incomingFile.Name, sidecarsErr)
 							continue
 						}
 
-						if saveMetadataErr := ioutil.WriteFile(fmt.Sprintf("%s.json", filePath), metadataJSON, 0777); saveMetadataErr != nil {
-							log.Errorf("File %s: Error when saving metadata file: %v\n", ctrl.incomingFile.Name, saveMetadataErr)
+						name, nameErr := recordingName(ctrl.recordingsLayout, ctrl.incomingFile, ctrl.shortName)
+						if nameErr != nil {
+							ctrl.metrics.transfers.WithLabelValues(transferFailed).Inc()
+							log.Errorf("File %s: Error when naming recording: %v\n", ctrl.incomingFile.Name, nameErr)
 							continue
 						}
+
+						ctrl.store(&pendingRecording{file: ctrl.incomingFile, path: filePath, name: name, sidecars: sidecars})
 					case "CAN":
+						ctrl.metrics.transfers.WithLabelValues(transferCanceled).Inc()
 						log.Warnf("File %s: Transfer canceled by scanner!\n", ctrl.incomingFile.Name)
+						ctrl.incomingFile.Abort()
+						ctrl.incomingFile = nil
 					default: // Receiving data
-						blockNum := split[2]
-						fileData := split[3]
-						log.Debugf("File %s: Received block %s of %d with file length %d\n", ctrl.incomingFile.Name, blockNum, ctrl.incomingFile.ExpectedBlocks, len(fileData))
-						hexData, hexDataErr := hex.DecodeString(fileData)
-						if hexDataErr != nil {
-							// TODO: If we hit an error here we should DATA NAK so block gets re-delivered.
-							// Need to limit those attempts tho a sensible amount though
-							log.Errorf("File %s: Error when converting incoming file chunk to hex: %v\n", ctrl.incomingFile.Name, hexDataErr)
+						blockNum, blockNumErr := strconv.ParseInt(split[2], 10, 64)
+						if blockNumErr != nil {
+							log.Warnf("File %s: Invalid block number %q\n", ctrl.incomingFile.Name, split[2])
+							continue
+						}
+						log.Debugf("File %s: Received block %d of %d with %d hex digits\n", ctrl.incomingFile.Name, blockNum, ctrl.incomingFile.ExpectedBlocks, len(split[3]))
+
+						written, blockErr := ctrl.incomingFile.WriteBlock(blockNum, split[3])
+						switch {
+						case blockErr == nil:
+							ctrl.metrics.transferBlocks.Inc()
+							ctrl.metrics.transferBytes.Add(float64(written))
+							ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA", "ACK"})))
+						case errors.Is(blockErr, ErrDuplicateBlock):
+							// The ACK of the block was lost, so it is acknowledged again
+							log.Debugf("File %s: %v\n", ctrl.incomingFile.Name, blockErr)
+							ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA", "ACK"})))
+						case ctrl.incomingFile.Retries < MaxBlockRetries:
+							ctrl.incomingFile.Retries++
+							log.Warnf("File %s: %v, asking again (%d of %d)\n", ctrl.incomingFile.Name, blockErr, ctrl.incomingFile.Retries, MaxBlockRetries)
+							ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA", "NAK"})))
+						default:
+							log.Errorf("File %s: %v, giving up after %d retries\n", ctrl.incomingFile.Name, blockErr, MaxBlockRetries)
+							ctrl.cancelTransfer()
 						}
-						ctrl.incomingFile.Data = append(ctrl.incomingFile.Data, hexData...)
-
-						ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "DATA", "ACK"})))
 					}
 				}
 
@@ -447,33 +704,47 @@ func (c *Config) Serve() {
 			}
 
 			select {
-			case <-ctrl.rq:
+			case <-ctrl.quit:
 				log.Infoln("Shutting down reader...")
-				do_quit = true
-			default:
-				time.Sleep(time.Millisecond * ctrl.GoProcDelay)
+				return
+			case <-time.After(time.Millisecond * ctrl.GoProcDelay):
 			}
 		}
 	}(ctrl)
 
-	if ctrl.conn.Type == ConnTypeUSB {
+	if ctrl.link.probeInterval > 0 {
+		ctrl.wg.Add(1)
+		go ctrl.probe()
+	}
+
+	if c.Retention.enabled() {
+		ctrl.wg.Add(1)
+		go ctrl.pruneRecordings(c.Retention)
+	}
+
+	if supportsFileTransfer(ctrl.conn) {
 		ticker := time.NewTicker(1 * time.Second)
+		ctrl.wg.Add(1)
 		go func(ctrl *ScannerCtrl) {
-			time.Sleep(1 * time.Second)
+			defer ctrl.wg.Done()
+			defer ticker.Stop()
 
-			ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "STS", "ON"})))
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctrl.quit:
+				return
+			}
 
-			time.Sleep(1 * time.Second)
+			ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "STS", "ON"})))
 
 			for {
 				select {
 				case <-ticker.C:
 					if ctrl.incomingFile == nil || ctrl.incomingFile.Finished {
-						ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "INFO"})))
+						ctrl.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "INFO"})))
 					}
-				case <-ctrl.rq:
+				case <-ctrl.quit:
 					log.Infoln("Shutting down file polling")
-					ticker.Stop()
 					return
 				}
 			}
@@ -481,44 +752,19 @@ func (c *Config) Serve() {
 	}
 
 	var wsErr error
-	ctrl.s, wsErr = startWSServer("", c.WebSocketPort, ctrl)
+	ctrl.s, ctrl.listener, wsErr = startWSServer(c.WebSocketHost, c.WebSocketPort, ctrl)
 	if wsErr != nil {
-		log.Fatalln("Failed to start WebSocket server", wsErr)
+		ctrl.Stop()
+		return nil, fmt.Errorf("failed to start WebSocket server: %w", wsErr)
 	}
 
-	signal.Notify(ctrl.c, os.Interrupt)
-	<-ctrl.c
-
-	// gracefully terminate go routines
-	log.Infoln("Terminating on signal...")
-
-	if ctrl.conn.Type == ConnTypeUSB {
-		if ctrl.incomingFile != nil && ctrl.incomingFile.Finished {
-			log.Infoln("Terminating file transfer session")
-			ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "INFO", "CAN"})))
-			ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "DATA", "CAN"})))
+	if c.MQTT != nil {
+		var mqttErr error
+		if ctrl.mqtt, mqttErr = startMQTT(c.MQTT, ctrl); mqttErr != nil {
+			ctrl.Stop()
+			return nil, fmt.Errorf("failed to start MQTT: %w", mqttErr)
 		}
-
-		ctrl.SendToHostMsgChannel([]byte(homepatrolCommand([]string{"AUF", "STS", "OFF"})))
-		time.Sleep(50 * time.Millisecond)
 	}
 
-	ctrl.rq <- true
-	ctrl.wq <- true
-
-	// log.Infoln("Waiting to drain...")
-	// <-ctrl.drained
-	// ctrl.drain()
-	// log.Infoln("Drained UDP, Closing Connection...")
-	// ctrl.conn.Close()
-	const timeout = 5 * time.Second
-
-	log.Infoln("Shutting down WebSocket server")
-
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	if err := ctrl.s.Shutdown(ctx); err != nil {
-		log.Errorln("Failed to Shutdown", err)
-	}
-	cancel()
-	log.Infoln("UDPServer Terminated.")
+	return ctrl, nil
 }
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGSI = `<?xml version="1.0" encoding="utf-8"?><ScannerInfo Mode="Trunk Scan" V_Screen="conventional_scan"><System Name="Howard County (Project 25)" Index="1" /><TGID Name="Dispatch" TGID="10961" /></ScannerInfo>`
+
+// startTestServer runs the server against an in-memory pipe and returns the scanner end of it.
+func startTestServer(t *testing.T) (*ScannerCtrl, *PipeTransport) {
+	host, scanner := NewPipe()
+
+	cfg := &Config{
+		Transport:     host,
+		WebSocketHost: "127.0.0.1",
+	}
+
+	ctrl, startErr := cfg.Start()
+	if startErr != nil {
+		t.Fatalf("error when starting server: %v", startErr)
+	}
+	t.Cleanup(ctrl.Stop)
+
+	return ctrl, scanner
+}
+
+// dialTestServer connects a WebSocket client and waits for the hub to register it,
+// so it does not miss messages the test makes the scanner send right away.
+func dialTestServer(t *testing.T, ctrl *ScannerCtrl) net.Conn {
+	clients := ctrl.hub.count()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, _, dialErr := ws.Dial(ctx, "ws://"+ctrl.Addr().String()+"/")
+	if dialErr != nil {
+		t.Fatalf("error when dialing WebSocket server: %v", dialErr)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if deadlineErr := conn.SetDeadline(time.Now().Add(10 * time.Second)); deadlineErr != nil {
+		t.Fatalf("error when setting deadline: %v", deadlineErr)
+	}
+
+	assert.Eventually(t, func() bool {
+		return ctrl.hub.count() > clients
+	}, 5*time.Second, 10*time.Millisecond, "WebSocket client should be registered")
+	return conn
+}
+
+func TestServeCommandRoundTrip(t *testing.T) {
+	ctrl, scanner := startTestServer(t)
+	client := dialTestServer(t, ctrl)
+
+	assert := assert.New(t)
+	assert.NoError(wsutil.WriteClientMessage(client, ws.OpText, []byte("MDL\n")))
+
+	cmd, readErr := scanner.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("MDL", string(cmd))
+
+	assert.NoError(scanner.WriteMessage([]byte("MDL,SDS200")))
+
+	reply, _, replyErr := wsutil.ReadServerData(client)
+	assert.NoError(replyErr)
+	assert.Equal("MDL,SDS200", string(reply))
+}
+
+func TestServeXMLReassembly(t *testing.T) {
+	ctrl, scanner := startTestServer(t)
+	client := dialTestServer(t, ctrl)
+
+	assert := assert.New(t)
+	assert.NoError(scanner.WriteMessage([]byte("GSI,<XML>,")))
+	assert.NoError(scanner.WriteMessage([]byte(testGSI[:60])))
+	assert.NoError(scanner.WriteMessage([]byte(testGSI[60:])))
+
+	reply, _, replyErr := wsutil.ReadServerData(client)
+	assert.NoError(replyErr)
+	assert.Equal("GSI,"+testGSI, string(reply))
+}
+
+func TestServeMultipleClients(t *testing.T) {
+	ctrl, scanner := startTestServer(t)
+	controller := dialTestServer(t, ctrl)
+	observer := dialTestServer(t, ctrl)
+
+	assert := assert.New(t)
+
+	// Both clients get what the scanner sends
+	assert.NoError(scanner.WriteMessage([]byte("VOL,15")))
+	for _, client := range []net.Conn{controller, observer} {
+		reply, _, replyErr := wsutil.ReadServerData(client)
+		assert.NoError(replyErr)
+		assert.Equal("VOL,15", string(reply))
+	}
+
+	// Only the first client may send commands
+	assert.NoError(wsutil.WriteClientMessage(observer, ws.OpText, []byte("VOL,20\n")))
+	locked, _, lockedErr := wsutil.ReadServerData(observer)
+	assert.NoError(lockedErr)
+	assert.Contains(string(locked), "Locked by")
+
+	assert.NoError(wsutil.WriteClientMessage(controller, ws.OpText, []byte("VOL,10\n")))
+	cmd, readErr := scanner.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("VOL,10", string(cmd))
+
+	// The observer takes over once the controller leaves
+	assert.NoError(wsutil.WriteClientMessage(controller, ws.OpText, []byte(TERMINATE)))
+	granted, _, grantedErr := wsutil.ReadServerData(observer)
+	assert.NoError(grantedErr)
+	assert.Equal("Control granted", string(granted))
+
+	assert.NoError(wsutil.WriteClientMessage(observer, ws.OpText, []byte("MDL\n")))
+	cmd, readErr = scanner.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("MDL", string(cmd))
+}
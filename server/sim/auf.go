@@ -0,0 +1,179 @@
+package sim
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// BlockSize is the number of bytes of a recording sent in each AUF DATA block.
+const BlockSize = 2048
+
+const aufTimestampFormat = "01/02/2006 15:04:05"
+
+type recordingFile struct {
+	name      string
+	data      []byte
+	timestamp time.Time
+}
+
+type transfer struct {
+	file *recordingFile
+	// sent is the number of blocks sent so far
+	sent    int
+	eotSent bool
+}
+
+func (t *transfer) blocks() int {
+	return (len(t.file.data) + BlockSize - 1) / BlockSize
+}
+
+// Queue makes a recording available for the server to download with AUF.
+func (s *Simulator) Queue(path string) error {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return readErr
+	}
+
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return statErr
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, &recordingFile{
+		name:      filepath.Base(path),
+		data:      data,
+		timestamp: info.ModTime(),
+	})
+	s.mu.Unlock()
+
+	log.Infof("Simulator queued recording %s (%d bytes)\n", filepath.Base(path), len(data))
+	return nil
+}
+
+// Corrupt damages the hex data of a block the next times it is sent, like a noisy link would.
+// Blocks are numbered from 1 like in the AUF DATA replies.
+func (s *Simulator) Corrupt(block int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.corrupt == nil {
+		s.corrupt = make(map[int]int)
+	}
+	s.corrupt[block] += times
+}
+
+func (s *Simulator) sendAUF(args ...string) {
+	s.send(server.HomePatrolCommand(append([]string{"AUF"}, args...)))
+}
+
+// handleAUF answers the HomePatrol file transfer commands. fields is the tab separated command including its checksum.
+func (s *Simulator) handleAUF(fields []string) {
+	if len(fields) < 3 || fields[0] != "AUF" {
+		s.send(server.HomePatrolCommand([]string{fields[0], "NG"}))
+		return
+	}
+
+	args := fields[1 : len(fields)-1]
+	checksum := fields[len(fields)-1]
+	if expected := server.HomePatrolCommand(fields[:len(fields)-1]); strings.TrimSuffix(expected, "\r") != strings.Join(fields, "\t") {
+		log.Warnf("Simulator received AUF command with bad checksum %s\n", checksum)
+		s.sendAUF(args[0], "NG")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch args[0] {
+	case "STS":
+		s.sendAUF("STS", "OK")
+	case "INFO":
+		if len(args) > 1 {
+			if args[1] == "CAN" {
+				s.transfer = nil
+			}
+			// ACKs need no answer
+			return
+		}
+
+		if s.transfer == nil && len(s.pending) > 0 {
+			s.transfer = &transfer{file: s.pending[0]}
+		}
+		if s.transfer == nil {
+			s.sendAUF("INFO", "", "", "")
+			return
+		}
+
+		file := s.transfer.file
+		s.transfer.sent = 0
+		s.transfer.eotSent = false
+		s.sendAUF("INFO", file.name, strconv.Itoa(len(file.data)), file.timestamp.Format(aufTimestampFormat))
+	case "DATA":
+		if s.transfer == nil {
+			s.sendAUF("DATA", "NG")
+			return
+		}
+
+		switch {
+		case len(args) == 1:
+			s.sendBlock()
+		case args[1] == "ACK":
+			if s.transfer.eotSent {
+				log.Infof("Simulator finished sending %s\n", s.transfer.file.name)
+				s.pending = s.pending[1:]
+				s.transfer = nil
+				return
+			}
+			s.sendBlock()
+		case args[1] == "NAK":
+			if s.transfer.eotSent {
+				s.sendAUF("DATA", "EOT")
+				return
+			}
+			if s.transfer.sent > 0 {
+				s.transfer.sent--
+			}
+			s.sendBlock()
+		case args[1] == "CAN":
+			s.transfer = nil
+		default:
+			s.sendAUF("DATA", "NG")
+		}
+	default:
+		s.sendAUF(args[0], "NG")
+	}
+}
+
+// sendBlock sends the next block of the current transfer or EOT once all of them were sent. s.mu must be held.
+func (s *Simulator) sendBlock() {
+	t := s.transfer
+	if t.sent >= t.blocks() {
+		t.eotSent = true
+		s.sendAUF("DATA", "EOT")
+		return
+	}
+
+	from := t.sent * BlockSize
+	to := from + BlockSize
+	if to > len(t.file.data) {
+		to = len(t.file.data)
+	}
+
+	t.sent++
+	data := strings.ToUpper(hex.EncodeToString(t.file.data[from:to]))
+	if s.corrupt[t.sent] > 0 {
+		s.corrupt[t.sent]--
+		log.Infof("Simulator corrupting block %d of %s\n", t.sent, t.file.name)
+		data = "XY" + data[2:]
+	}
+	s.sendAUF("DATA", strconv.Itoa(t.sent), data)
+}
@@ -0,0 +1,111 @@
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Bearcatter/bearcatter/server"
+)
+
+// ErrNoPeer is returned when replying before the server sent anything.
+var ErrNoPeer = errors.New("no server has talked to the simulator yet")
+
+// UDPLink listens on a UDP port like the SDS200 does and replies to whoever sent the last command.
+type UDPLink struct {
+	conn    *net.UDPConn
+	buffer  []byte
+	pending [][]byte
+
+	mu     sync.Mutex
+	peer   *net.UDPAddr
+	closed bool
+}
+
+// ListenUDP starts listening on address, for example 127.0.0.1:50536. Use port 0 to pick a free one.
+func ListenUDP(address string) (*UDPLink, error) {
+	udpAddr, resolveErr := net.ResolveUDPAddr("udp", address)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+
+	conn, listenErr := net.ListenUDP("udp", udpAddr)
+	if listenErr != nil {
+		return nil, listenErr
+	}
+
+	return &UDPLink{conn: conn, buffer: make([]byte, 16384)}, nil
+}
+
+// Addr is the address the simulator is listening on.
+func (l *UDPLink) Addr() *net.UDPAddr {
+	return l.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (l *UDPLink) Open() error {
+	return nil
+}
+
+func (l *UDPLink) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	return l.conn.Close()
+}
+
+// ReadMessage returns the next command. Datagrams carrying several CR separated commands are split up.
+func (l *UDPLink) ReadMessage() ([]byte, error) {
+	for len(l.pending) == 0 {
+		n, peer, readErr := l.conn.ReadFromUDP(l.buffer)
+		l.mu.Lock()
+		closed := l.closed
+		if readErr == nil {
+			l.peer = peer
+		}
+		l.mu.Unlock()
+
+		if closed {
+			return nil, server.ErrTransportClosed
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		datagram := bytes.TrimRight(l.buffer[:n], "\r\n")
+		if bytes.Contains(datagram, []byte("\t")) {
+			l.pending = append(l.pending, append([]byte{}, datagram...))
+			continue
+		}
+		for _, line := range bytes.FieldsFunc(datagram, func(r rune) bool { return r == '\r' || r == '\n' }) {
+			l.pending = append(l.pending, append([]byte{}, line...))
+		}
+	}
+
+	msg := l.pending[0]
+	l.pending = l.pending[1:]
+	return msg, nil
+}
+
+func (l *UDPLink) WriteMessage(msg []byte) error {
+	l.mu.Lock()
+	peer := l.peer
+	l.mu.Unlock()
+
+	if peer == nil {
+		return ErrNoPeer
+	}
+
+	framed := append(append([]byte{}, bytes.TrimRight(msg, "\r\n")...), '\r')
+	_, writeErr := l.conn.WriteToUDP(framed, peer)
+	return writeErr
+}
+
+func (l *UDPLink) Flush() error {
+	return nil
+}
+
+func (l *UDPLink) String() string {
+	return fmt.Sprintf("%s via UDP", l.Addr())
+}
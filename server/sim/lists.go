@@ -0,0 +1,197 @@
+package sim
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+type footer struct {
+	No  string `xml:"No,attr"`
+	EOT string `xml:"EOT,attr"`
+}
+
+// The GLT item attributes start with Index, the server tells the list types apart by "FL Index", "SYS Index" and so on.
+
+type flItem struct {
+	Index   string `xml:"Index,attr"`
+	Name    string `xml:"Name,attr"`
+	Monitor string `xml:"Monitor,attr"`
+}
+
+type sysItem struct {
+	Index   string `xml:"Index,attr"`
+	TrunkID string `xml:"TrunkId,attr"`
+	Name    string `xml:"Name,attr"`
+	Avoid   string `xml:"Avoid,attr"`
+	Type    string `xml:"Type,attr"`
+}
+
+type deptItem struct {
+	Index    string `xml:"Index,attr"`
+	TGroupID string `xml:"TGroupId,attr"`
+	Name     string `xml:"Name,attr"`
+	Avoid    string `xml:"Avoid,attr"`
+}
+
+type siteItem struct {
+	Index  string `xml:"Index,attr"`
+	SiteID string `xml:"SiteId,attr"`
+	Name   string `xml:"Name,attr"`
+	Avoid  string `xml:"Avoid,attr"`
+}
+
+type gltFL struct {
+	XMLName xml.Name `xml:"GLT"`
+	FL      []flItem `xml:"FL"`
+	Footer  footer   `xml:"Footer"`
+}
+
+type gltSys struct {
+	XMLName xml.Name  `xml:"GLT"`
+	SYS     []sysItem `xml:"SYS"`
+	Footer  footer    `xml:"Footer"`
+}
+
+type gltDept struct {
+	XMLName xml.Name   `xml:"GLT"`
+	DEPT    []deptItem `xml:"DEPT"`
+	Footer  footer     `xml:"Footer"`
+}
+
+type gltSite struct {
+	XMLName xml.Name   `xml:"GLT"`
+	SITE    []siteItem `xml:"SITE"`
+	Footer  footer     `xml:"Footer"`
+}
+
+// lists numbers the favorites lists, systems, departments and sites of a scenario the way GLT refers to them.
+type lists struct {
+	favorites   []flItem
+	systems     map[string][]sysItem
+	departments map[string][]deptItem
+	sites       map[string][]siteItem
+}
+
+func newLists(favorites []Favorite) *lists {
+	l := &lists{
+		systems:     map[string][]sysItem{},
+		departments: map[string][]deptItem{},
+		sites:       map[string][]siteItem{},
+	}
+
+	next := 0
+	index := func() string {
+		next++
+		return strconv.Itoa(next)
+	}
+
+	for _, favorite := range favorites {
+		flIndex := index()
+		l.favorites = append(l.favorites, flItem{Index: flIndex, Name: favorite.Name, Monitor: "On"})
+
+		for _, system := range favorite.Systems {
+			sysIndex := index()
+			l.systems[flIndex] = append(l.systems[flIndex], sysItem{Index: sysIndex, TrunkID: sysIndex, Name: system.Name, Avoid: "Off", Type: system.Type})
+
+			for _, department := range system.Departments {
+				deptIndex := index()
+				l.departments[sysIndex] = append(l.departments[sysIndex], deptItem{Index: deptIndex, TGroupID: deptIndex, Name: department.Name, Avoid: "Off"})
+			}
+
+			for _, site := range system.Sites {
+				l.sites[sysIndex] = append(l.sites[sysIndex], siteItem{Index: index(), SiteID: site.ID, Name: site.Name, Avoid: "Off"})
+			}
+		}
+	}
+
+	return l
+}
+
+// pages splits count items into pages of size, returning the [from, to) bounds of each. There is always one page.
+func pages(count, size int) [][2]int {
+	bounds := [][2]int{}
+	for from := 0; from < count; from += size {
+		to := from + size
+		if to > count {
+			to = count
+		}
+		bounds = append(bounds, [2]int{from, to})
+	}
+	if len(bounds) == 0 {
+		bounds = append(bounds, [2]int{0, 0})
+	}
+	return bounds
+}
+
+func pageFooter(page, total int) footer {
+	eot := "0"
+	if page == total-1 {
+		eot = "1"
+	}
+	return footer{No: strconv.Itoa(page + 1), EOT: eot}
+}
+
+func (s *Simulator) handleGLT(args []string) {
+	if len(args) == 0 {
+		s.send("GLT,NG")
+		return
+	}
+
+	index := ""
+	if len(args) > 1 {
+		index = args[1]
+	}
+
+	size := s.scenario.PageSize
+	if size < 1 {
+		size = 1
+	}
+
+	var docs []interface{}
+
+	switch args[0] {
+	case "FL":
+		items := s.lists.favorites
+		bounds := pages(len(items), size)
+		for page, b := range bounds {
+			docs = append(docs, &gltFL{FL: items[b[0]:b[1]], Footer: pageFooter(page, len(bounds))})
+		}
+	case "SYS":
+		items, ok := s.lists.systems[index]
+		if !ok {
+			s.send("GLT,NG")
+			return
+		}
+		bounds := pages(len(items), size)
+		for page, b := range bounds {
+			docs = append(docs, &gltSys{SYS: items[b[0]:b[1]], Footer: pageFooter(page, len(bounds))})
+		}
+	case "DEPT":
+		items, ok := s.lists.departments[index]
+		if !ok {
+			s.send("GLT,NG")
+			return
+		}
+		bounds := pages(len(items), size)
+		for page, b := range bounds {
+			docs = append(docs, &gltDept{DEPT: items[b[0]:b[1]], Footer: pageFooter(page, len(bounds))})
+		}
+	case "SITE":
+		items, ok := s.lists.sites[index]
+		if !ok {
+			s.send("GLT,NG")
+			return
+		}
+		bounds := pages(len(items), size)
+		for page, b := range bounds {
+			docs = append(docs, &gltSite{SITE: items[b[0]:b[1]], Footer: pageFooter(page, len(bounds))})
+		}
+	default:
+		s.send("GLT,NG")
+		return
+	}
+
+	for _, doc := range docs {
+		s.sendXML("GLT", doc)
+	}
+}
@@ -0,0 +1,131 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/Bearcatter/bearcatter/server"
+)
+
+// PTYLink is a pseudo terminal standing in for the SDS100 USB serial port. Point the server at Path.
+type PTYLink struct {
+	master *os.File
+	// slave is held open so reads on master don't fail before the server opens the port
+	slave  *os.File
+	path   string
+	reader *bufio.Scanner
+}
+
+// OpenPTY creates a new pseudo terminal in raw mode.
+func OpenPTY() (*PTYLink, error) {
+	master, openErr := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	var ptyNumber uint32
+	unlock := int32(0)
+	if ioctlErr := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); ioctlErr != nil {
+		master.Close()
+		return nil, fmt.Errorf("error when unlocking pty: %w", ioctlErr)
+	}
+	if ioctlErr := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&ptyNumber)); ioctlErr != nil {
+		master.Close()
+		return nil, fmt.Errorf("error when getting pty number: %w", ioctlErr)
+	}
+
+	path := fmt.Sprintf("/dev/pts/%d", ptyNumber)
+
+	slave, slaveErr := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if slaveErr != nil {
+		master.Close()
+		return nil, slaveErr
+	}
+
+	if rawErr := makeRaw(slave); rawErr != nil {
+		slave.Close()
+		master.Close()
+		return nil, fmt.Errorf("error when switching pty to raw mode: %w", rawErr)
+	}
+
+	reader := bufio.NewScanner(master)
+	reader.Split(server.ScanLinesWithCR)
+
+	return &PTYLink{master: master, slave: slave, path: path, reader: reader}, nil
+}
+
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	rawConn, rawConnErr := f.SyscallConn()
+	if rawConnErr != nil {
+		return rawConnErr
+	}
+
+	var errno syscall.Errno
+	if controlErr := rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	}); controlErr != nil {
+		return controlErr
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func makeRaw(f *os.File) error {
+	var termios syscall.Termios
+	if getErr := ioctl(f, syscall.TCGETS, unsafe.Pointer(&termios)); getErr != nil {
+		return getErr
+	}
+
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+
+	return ioctl(f, syscall.TCSETS, unsafe.Pointer(&termios))
+}
+
+// Path is the serial port to give the server, for example /dev/pts/3.
+func (l *PTYLink) Path() string {
+	return l.path
+}
+
+func (l *PTYLink) Open() error {
+	return nil
+}
+
+func (l *PTYLink) Close() error {
+	l.slave.Close()
+	return l.master.Close()
+}
+
+func (l *PTYLink) ReadMessage() ([]byte, error) {
+	if !l.reader.Scan() {
+		if scanErr := l.reader.Err(); scanErr != nil {
+			return nil, scanErr
+		}
+		return nil, server.ErrTransportClosed
+	}
+	scanned := l.reader.Bytes()
+	msg := make([]byte, len(scanned))
+	copy(msg, scanned)
+	return msg, nil
+}
+
+func (l *PTYLink) WriteMessage(msg []byte) error {
+	_, writeErr := l.master.Write(append(append([]byte{}, msg...), '\r'))
+	return writeErr
+}
+
+func (l *PTYLink) Flush() error {
+	return nil
+}
+
+func (l *PTYLink) String() string {
+	return fmt.Sprintf("%s via USB", l.path)
+}
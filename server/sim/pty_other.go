@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package sim
+
+import (
+	"errors"
+)
+
+// ErrPTYUnsupported is returned by OpenPTY on platforms without the Linux pty ioctls.
+var ErrPTYUnsupported = errors.New("simulating the USB serial port is only supported on Linux")
+
+// PTYLink is a pseudo terminal standing in for the SDS100 USB serial port. It is only available on Linux.
+type PTYLink struct{}
+
+func OpenPTY() (*PTYLink, error) {
+	return nil, ErrPTYUnsupported
+}
+
+func (l *PTYLink) Path() string                  { return "" }
+func (l *PTYLink) Open() error                   { return ErrPTYUnsupported }
+func (l *PTYLink) Close() error                  { return ErrPTYUnsupported }
+func (l *PTYLink) ReadMessage() ([]byte, error)  { return nil, ErrPTYUnsupported }
+func (l *PTYLink) WriteMessage(msg []byte) error { return ErrPTYUnsupported }
+func (l *PTYLink) Flush() error                  { return ErrPTYUnsupported }
+func (l *PTYLink) String() string                { return "unsupported pty" }
@@ -0,0 +1,192 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Duration is a time.Duration written like 1.5s or 500ms in scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if unmarshalErr := unmarshal(&raw); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	parsed, parseErr := time.ParseDuration(raw)
+	if parseErr != nil {
+		return parseErr
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Scenario describes the scanner the simulator pretends to be and what it hears.
+type Scenario struct {
+	Model     string     `yaml:"model"`
+	Firmware  string     `yaml:"firmware"`
+	Volume    int        `yaml:"volume"`
+	Squelch   int        `yaml:"squelch"`
+	Location  Location   `yaml:"location"`
+	Favorites []Favorite `yaml:"favorites"`
+	// PageSize is the number of items sent per GLT page before the next Footer.
+	PageSize int `yaml:"page_size"`
+	// Loop restarts the steps once the last one ran.
+	Loop  bool   `yaml:"loop"`
+	Steps []Step `yaml:"steps"`
+}
+
+type Location struct {
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
+	Range     float64 `yaml:"range"`
+}
+
+type Favorite struct {
+	Name    string   `yaml:"name"`
+	Systems []System `yaml:"systems"`
+}
+
+type System struct {
+	Name        string       `yaml:"name"`
+	Type        string       `yaml:"type"`
+	Departments []Department `yaml:"departments"`
+	Sites       []Site       `yaml:"sites"`
+}
+
+type Department struct {
+	Name string `yaml:"name"`
+}
+
+type Site struct {
+	Name string `yaml:"name"`
+	ID   string `yaml:"id"`
+}
+
+// Step is a single event in a scenario. After is how long to wait before running it.
+// A step either starts a call, ends the current one or makes a recording available for download.
+type Step struct {
+	After     Duration `yaml:"after"`
+	Call      *Call    `yaml:"call"`
+	End       bool     `yaml:"end"`
+	Recording string   `yaml:"recording"`
+}
+
+// Call is what the scanner is receiving, reported through GSI and PSI.
+type Call struct {
+	Favorite    string  `yaml:"favorite"`
+	System      string  `yaml:"system"`
+	SystemType  string  `yaml:"system_type"`
+	Department  string  `yaml:"department"`
+	Channel     string  `yaml:"channel"`
+	TGID        string  `yaml:"tgid"`
+	UnitID      string  `yaml:"unit_id"`
+	Site        string  `yaml:"site"`
+	Frequency   float64 `yaml:"frequency"`
+	ServiceType string  `yaml:"service_type"`
+	Signal      int     `yaml:"signal"`
+	RSSI        int     `yaml:"rssi"`
+	// Emergency shows an emergency on the display
+	Emergency bool `yaml:"emergency"`
+}
+
+// LoadScenario reads a YAML scenario, filling anything left out from DefaultScenario.
+func LoadScenario(path string) (*Scenario, error) {
+	scenarioFile, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer scenarioFile.Close()
+
+	return ReadScenario(scenarioFile)
+}
+
+// ReadScenario reads a YAML scenario, filling anything left out from DefaultScenario.
+func ReadScenario(r io.Reader) (*Scenario, error) {
+	scenario := DefaultScenario()
+	scenario.Steps = nil
+
+	if decodeErr := yaml.NewDecoder(r).Decode(scenario); decodeErr != nil {
+		return nil, fmt.Errorf("error when decoding scenario: %w", decodeErr)
+	}
+
+	if scenario.PageSize < 1 {
+		return nil, fmt.Errorf("page_size must be at least 1, got %d", scenario.PageSize)
+	}
+
+	var loopTime Duration
+	for i, step := range scenario.Steps {
+		if step.Call == nil && !step.End && step.Recording == "" {
+			return nil, fmt.Errorf("step %d needs a call, end or recording", i+1)
+		}
+		loopTime += step.After
+	}
+
+	// Looping steps that all run right away would never wait
+	if scenario.Loop && len(scenario.Steps) > 0 && loopTime <= 0 {
+		return nil, errors.New("steps that loop must wait, at least one needs an after")
+	}
+
+	return scenario, nil
+}
+
+// DefaultScenario is a SDS200 scanning a single P25 system with a couple of calls.
+func DefaultScenario() *Scenario {
+	call := func(department, channel, tgid, unitID string) *Call {
+		return &Call{
+			Favorite:    "HoCo",
+			System:      "Howard County (Project 25)",
+			SystemType:  "P25 Trunk",
+			Department:  department,
+			Channel:     channel,
+			TGID:        tgid,
+			UnitID:      unitID,
+			Site:        "Site 2",
+			Frequency:   858.2375,
+			ServiceType: "Law Dispatch",
+			Signal:      4,
+			RSSI:        -62,
+		}
+	}
+
+	return &Scenario{
+		Model:    "SDS200",
+		Firmware: "Version 1.23.07",
+		Volume:   15,
+		Squelch:  2,
+		Location: Location{Latitude: 39.2, Longitude: -76.8, Range: 10},
+		Favorites: []Favorite{{
+			Name: "HoCo",
+			Systems: []System{{
+				Name: "Howard County (Project 25)",
+				Type: "P25Standard",
+				Departments: []Department{
+					{Name: "Police"},
+					{Name: "Fire"},
+					{Name: "Interop"},
+				},
+				Sites: []Site{
+					{Name: "Site 1", ID: "1"},
+					{Name: "Site 2", ID: "2"},
+				},
+			}},
+		}},
+		PageSize: 10,
+		Loop:     true,
+		Steps: []Step{
+			{After: Duration(2 * time.Second), Call: call("Police", "District 1 Dispatch", "10961", "2468170")},
+			{After: Duration(4 * time.Second), End: true},
+			{After: Duration(3 * time.Second), Call: call("Fire", "Fire Dispatch", "10005", "109")},
+			{After: Duration(5 * time.Second), End: true},
+		},
+	}
+}
@@ -0,0 +1,494 @@
+// Package sim emulates a Uniden SDS100/SDS200 well enough to run the server without a radio on the desk.
+package sim
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MaxVolume  = 29
+	MaxSquelch = 19
+
+	xmlDeclaration = `<?xml version="1.0" encoding="utf-8"?>`
+)
+
+// State is a snapshot of the simulated scanner settings.
+type State struct {
+	Volume      int
+	Squelch     int
+	Location    Location
+	Recording   bool
+	PSIInterval time.Duration
+	Call        *Call
+	Keys        []string
+	Hold        string
+	Pending     int
+}
+
+// Simulator answers the remote commands of a scanner over a link and plays back a Scenario.
+type Simulator struct {
+	scenario *Scenario
+	lists    *lists
+
+	mu          sync.Mutex
+	volume      int
+	squelch     int
+	location    Location
+	clockOffset time.Duration
+	dst         bool
+	recording   bool
+	call        *Call
+	keys        []string
+	hold        string
+	psiInterval time.Duration
+	psiChanged  chan struct{}
+	pending     []*recordingFile
+	transfer    *transfer
+	// corrupt counts how many more times a block number is sent damaged
+	corrupt map[int]int
+
+	writeMu sync.Mutex
+	link    server.Transport
+}
+
+func New(scenario *Scenario) *Simulator {
+	if scenario == nil {
+		scenario = DefaultScenario()
+	}
+	return &Simulator{
+		scenario:   scenario,
+		lists:      newLists(scenario.Favorites),
+		volume:     scenario.Volume,
+		squelch:    scenario.Squelch,
+		location:   scenario.Location,
+		psiChanged: make(chan struct{}, 1),
+	}
+}
+
+// State returns the current settings of the simulated scanner.
+func (s *Simulator) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, len(s.keys))
+	copy(keys, s.keys)
+
+	return State{
+		Volume:      s.volume,
+		Squelch:     s.squelch,
+		Location:    s.location,
+		Recording:   s.recording,
+		PSIInterval: s.psiInterval,
+		Call:        s.call,
+		Keys:        keys,
+		Hold:        s.hold,
+		Pending:     len(s.pending),
+	}
+}
+
+// SetCall changes what the scanner is receiving. A nil call means it went back to scanning.
+func (s *Simulator) SetCall(call *Call) {
+	s.mu.Lock()
+	s.call = call
+	s.mu.Unlock()
+}
+
+// Serve answers commands read from link and plays the scenario until the link is closed.
+func (s *Simulator) Serve(link server.Transport) error {
+	s.writeMu.Lock()
+	s.link = link
+	s.writeMu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go s.runSteps(done)
+	go s.pushStatus(done)
+
+	log.Infoln("Simulating", s.scenario.Model, "on", link.String())
+
+	for {
+		msg, readErr := link.ReadMessage()
+		if readErr != nil {
+			if readErr == io.EOF || readErr == server.ErrTransportClosed {
+				return nil
+			}
+			return readErr
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		log.Debugf("Sim<-Host: [%#q]", msg)
+		s.handle(string(msg))
+	}
+}
+
+func (s *Simulator) send(msg string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	log.Debugf("Sim->Host: [%#q]", msg)
+	if writeErr := s.link.WriteMessage([]byte(msg)); writeErr != nil {
+		log.Errorln("Simulator failed to write", writeErr)
+	}
+}
+
+// sendXML sends an XML reply the way the scanner does, a header line followed by the document.
+func (s *Simulator) sendXML(cmd string, doc interface{}) {
+	marshalled, marshalErr := xml.Marshal(doc)
+	if marshalErr != nil {
+		log.Errorln("Simulator failed to marshal XML", marshalErr)
+		s.send(cmd + ",NG")
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	for _, msg := range []string{cmd + ",<XML>,", xmlDeclaration + "\r" + string(marshalled)} {
+		if writeErr := s.link.WriteMessage([]byte(msg)); writeErr != nil {
+			log.Errorln("Simulator failed to write", writeErr)
+			return
+		}
+	}
+}
+
+func (s *Simulator) handle(msg string) {
+	if strings.Contains(msg, "\t") {
+		s.handleAUF(strings.Split(msg, "\t"))
+		return
+	}
+
+	split := strings.Split(msg, ",")
+	cmd, args := split[0], split[1:]
+
+	switch cmd {
+	case "MDL":
+		s.send("MDL," + s.scenario.Model)
+	case "VER":
+		s.send("VER," + s.scenario.Firmware)
+	case "STS":
+		s.send("STS," + s.status())
+	case "GSI":
+		s.sendXML("GSI", s.scannerInfo())
+	case "PSI":
+		s.handlePSI(args)
+	case "GLT":
+		s.handleGLT(args)
+	case "KEY":
+		s.handleKey(args)
+	case "VOL":
+		s.handleLevel("VOL", args, &s.volume, MaxVolume)
+	case "SQL":
+		s.handleLevel("SQL", args, &s.squelch, MaxSquelch)
+	case "DTM":
+		s.handleDateTime(args)
+	case "LCR":
+		s.handleLocation(args)
+	case "URC":
+		s.handleRecord(args)
+	case "HLD":
+		s.handleHold(args)
+	default:
+		log.Infoln("Simulator does not know command", cmd)
+		s.send("ERR")
+	}
+}
+
+func (s *Simulator) handlePSI(args []string) {
+	if len(args) != 1 {
+		s.send("PSI,NG")
+		return
+	}
+
+	interval, intervalErr := strconv.Atoi(args[0])
+	if intervalErr != nil || interval < 0 {
+		s.send("PSI,NG")
+		return
+	}
+
+	s.mu.Lock()
+	s.psiInterval = time.Duration(interval) * time.Millisecond
+	s.mu.Unlock()
+
+	select {
+	case s.psiChanged <- struct{}{}:
+	default:
+	}
+
+	if interval == 0 {
+		s.send("PSI,OK")
+	}
+}
+
+func (s *Simulator) handleKey(args []string) {
+	if len(args) != 2 {
+		s.send("KEY,NG")
+		return
+	}
+
+	s.mu.Lock()
+	s.keys = append(s.keys, args[0]+","+args[1])
+	s.hold = ""
+	s.mu.Unlock()
+
+	s.send("KEY,OK")
+}
+
+// handleHold holds on whatever the arguments point to. Like the scanner the hold only lasts until a key is pressed.
+func (s *Simulator) handleHold(args []string) {
+	if len(args) < 2 || args[0] == "" {
+		s.send("HLD,NG")
+		return
+	}
+
+	s.mu.Lock()
+	s.hold = strings.Join(args, ",")
+	s.mu.Unlock()
+
+	s.send("HLD,OK")
+}
+
+func (s *Simulator) handleLevel(cmd string, args []string, level *int, max int) {
+	if len(args) == 0 || args[0] == "" {
+		s.mu.Lock()
+		current := *level
+		s.mu.Unlock()
+		s.send(fmt.Sprintf("%s,%d", cmd, current))
+		return
+	}
+
+	value, valueErr := strconv.Atoi(args[0])
+	if valueErr != nil || value < 0 || value > max {
+		s.send(cmd + ",NG")
+		return
+	}
+
+	s.mu.Lock()
+	*level = value
+	s.mu.Unlock()
+
+	s.send(cmd + ",OK")
+}
+
+func (s *Simulator) handleDateTime(args []string) {
+	if len(args) == 0 {
+		s.mu.Lock()
+		now := time.Now().Add(s.clockOffset)
+		info := server.DateTimeInfo{DaylightSavings: s.dst, Time: &now, RTCOK: true}
+		s.mu.Unlock()
+		s.send("DTM," + info.String())
+		return
+	}
+
+	if len(args) != 7 {
+		s.send("DTM,NG")
+		return
+	}
+
+	dst, dstErr := strconv.ParseBool(args[0])
+	set, setErr := time.ParseInLocation(server.DateTimeFormat, strings.Join(args[1:], ","), time.Local)
+	if dstErr != nil || setErr != nil {
+		s.send("DTM,NG")
+		return
+	}
+
+	s.mu.Lock()
+	s.dst = dst
+	s.clockOffset = time.Until(set)
+	s.mu.Unlock()
+
+	s.send("DTM,OK")
+}
+
+func (s *Simulator) handleLocation(args []string) {
+	if len(args) == 0 {
+		s.mu.Lock()
+		info := server.LocationInfo{Latitude: s.location.Latitude, Longitude: s.location.Longitude, Range: s.location.Range}
+		s.mu.Unlock()
+		s.send("LCR," + info.String())
+		return
+	}
+
+	if len(args) != 3 {
+		s.send("LCR,NG")
+		return
+	}
+
+	values := make([]float64, 3)
+	for i, arg := range args {
+		value, valueErr := strconv.ParseFloat(arg, 64)
+		if valueErr != nil {
+			s.send("LCR,NG")
+			return
+		}
+		values[i] = value
+	}
+
+	s.mu.Lock()
+	s.location = Location{Latitude: values[0], Longitude: values[1], Range: values[2]}
+	s.mu.Unlock()
+
+	s.send("LCR,OK")
+}
+
+func (s *Simulator) handleRecord(args []string) {
+	if len(args) == 0 {
+		s.mu.Lock()
+		status := server.UserRecordStatus{Recording: s.recording}
+		s.mu.Unlock()
+		s.send("URC," + status.String())
+		return
+	}
+
+	recording, recordingErr := strconv.ParseBool(args[0])
+	if recordingErr != nil {
+		s.send("URC,NG")
+		return
+	}
+
+	s.mu.Lock()
+	s.recording = recording
+	s.mu.Unlock()
+
+	s.send("URC,OK")
+}
+
+// status builds the STS reply: the display form, 20 pairs of line text and mode, then 9 reserved fields.
+// The squelch, signal and backlight values go where server.NewScannerStatus reads them.
+func (s *Simulator) status() string {
+	s.mu.Lock()
+	call := s.call
+	s.mu.Unlock()
+
+	fields := make([]string, 50)
+	fields[0] = "11111111"
+
+	lines := []string{s.scenario.Model, "Scan"}
+	if call != nil {
+		lines = []string{call.System, call.Department, call.Channel, fmt.Sprintf("TGID:%s UID:%s", call.TGID, call.UnitID)}
+	}
+	for i, line := range lines {
+		fields[i*2+1] = line
+	}
+
+	fields[36] = "1"
+	fields[41] = "0"
+	if call != nil {
+		fields[36] = "0"
+		fields[41] = strconv.Itoa(call.Signal)
+	}
+	fields[43] = "3"
+
+	return strings.Join(fields, ",")
+}
+
+// scannerInfo builds the GSI and PSI reply from the current call.
+func (s *Simulator) scannerInfo() *server.ScannerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	si := &server.ScannerInfo{Mode: "Trunk Scan", VScreen: "trunk_scan"}
+	si.Property.VOL = strconv.Itoa(s.volume)
+	si.Property.SQL = strconv.Itoa(s.squelch)
+	si.Property.Rec = "Off"
+	if s.recording {
+		si.Property.Rec = "On"
+	}
+
+	if s.call == nil {
+		si.Property.Sig = "0"
+		si.Property.Mute = "Mute"
+		return si
+	}
+
+	si.MonitorList.Name = s.call.Favorite
+	si.System.Name = s.call.System
+	si.System.SystemType = s.call.SystemType
+	si.Department.Name = s.call.Department
+	si.TGID.Name = s.call.Channel
+	si.TGID.TGID = "TGID:" + s.call.TGID
+	si.TGID.SvcType = s.call.ServiceType
+	si.UnitID.UID = s.call.UnitID
+	si.Site.Name = s.call.Site
+	si.SiteFrequency.Freq = fmt.Sprintf("%.4fMHz", s.call.Frequency)
+	si.Property.Sig = strconv.Itoa(s.call.Signal)
+	si.Property.Rssi = strconv.Itoa(s.call.RSSI)
+	si.Property.Mute = "Unmute"
+	if s.call.Emergency {
+		si.ViewDescription.PopupScreen.AttrText = "EMERGENCY"
+	}
+	return si
+}
+
+func (s *Simulator) pushStatus(done chan struct{}) {
+	for {
+		s.mu.Lock()
+		interval := s.psiInterval
+		s.mu.Unlock()
+
+		if interval == 0 {
+			select {
+			case <-s.psiChanged:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+			s.sendXML("PSI", s.scannerInfo())
+		case <-s.psiChanged:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Simulator) runSteps(done chan struct{}) {
+	if len(s.scenario.Steps) == 0 {
+		return
+	}
+
+	for {
+		for _, step := range s.scenario.Steps {
+			select {
+			case <-time.After(time.Duration(step.After)):
+			case <-done:
+				return
+			}
+			s.runStep(step)
+		}
+
+		if !s.scenario.Loop {
+			return
+		}
+	}
+}
+
+func (s *Simulator) runStep(step Step) {
+	switch {
+	case step.Call != nil:
+		log.Infof("Simulator call on %s TGID %s from %s", step.Call.System, step.Call.TGID, step.Call.UnitID)
+		s.SetCall(step.Call)
+	case step.End:
+		log.Infoln("Simulator call ended")
+		s.SetCall(nil)
+	}
+
+	if step.Recording != "" {
+		if queueErr := s.Queue(step.Recording); queueErr != nil {
+			log.Errorf("Simulator failed to queue recording %s: %v\n", step.Recording, queueErr)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package sim_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+const testScenario = `model: SDS100
+firmware: Version 1.02.03
+volume: 5
+page_size: 2
+loop: false
+steps:
+  - after: 10ms
+    call:
+      system: Howard County (Project 25)
+      department: Police
+      tgid: "10961"
+      unit_id: "2468170"
+      frequency: 858.2375
+      signal: 3
+`
+
+// startSimulator serves a simulator on one end of a pipe and returns the other end for the test to talk on.
+func startSimulator(t *testing.T, scenario *sim.Scenario) (*sim.Simulator, *server.PipeTransport) {
+	host, scanner := server.NewPipe()
+	simulator := sim.New(scenario)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- simulator.Serve(scanner)
+	}()
+
+	t.Cleanup(func() {
+		scanner.Close()
+		if serveErr := <-served; serveErr != nil {
+			t.Errorf("error when serving simulator: %v", serveErr)
+		}
+	})
+
+	return simulator, host
+}
+
+func command(t *testing.T, host *server.PipeTransport, cmd string) string {
+	if writeErr := host.WriteMessage([]byte(cmd)); writeErr != nil {
+		t.Fatalf("error when writing %s: %v", cmd, writeErr)
+	}
+	reply, readErr := host.ReadMessage()
+	if readErr != nil {
+		t.Fatalf("error when reading reply to %s: %v", cmd, readErr)
+	}
+	return string(reply)
+}
+
+// readXML reads an XML reply, the header line and the document following it.
+func readXML(t *testing.T, host *server.PipeTransport, cmd string, v interface{}) {
+	header, headerErr := host.ReadMessage()
+	if headerErr != nil {
+		t.Fatalf("error when reading XML header: %v", headerErr)
+	}
+	assert.Equal(t, cmd+",<XML>,", string(header))
+
+	body, bodyErr := host.ReadMessage()
+	if bodyErr != nil {
+		t.Fatalf("error when reading XML body: %v", bodyErr)
+	}
+	if unmarshalErr := xml.Unmarshal(body, v); unmarshalErr != nil {
+		t.Fatalf("error when unmarshalling %s: %v", body, unmarshalErr)
+	}
+}
+
+func TestReadScenario(t *testing.T) {
+	scenario, readErr := sim.ReadScenario(strings.NewReader(testScenario))
+	if readErr != nil {
+		t.Fatalf("error when reading scenario: %v", readErr)
+	}
+
+	assert := assert.New(t)
+	assert.Equal("SDS100", scenario.Model)
+	assert.Equal(sim.Duration(10*time.Millisecond), scenario.Steps[0].After)
+	assert.Equal("10961", scenario.Steps[0].Call.TGID)
+	assert.NotEmpty(scenario.Favorites, "Favorites should default to the built in scenario")
+
+	_, invalidErr := sim.ReadScenario(strings.NewReader("steps:\n  - after: 1s\n"))
+	assert.Error(invalidErr, "Steps without anything to do should be rejected")
+
+	_, spinErr := sim.ReadScenario(strings.NewReader("loop: true\nsteps:\n  - end: true\n  - after: 0s\n    end: true\n"))
+	assert.Error(spinErr, "Steps that loop without waiting should be rejected")
+}
+
+func TestCommands(t *testing.T) {
+	simulator, host := startSimulator(t, &sim.Scenario{Model: "SDS200", Firmware: "Version 1.23.07", Volume: 15, PageSize: 10})
+
+	assert := assert.New(t)
+	assert.Equal("MDL,SDS200", command(t, host, "MDL\r"))
+	assert.Equal("VER,Version 1.23.07", command(t, host, "VER"))
+
+	assert.Equal("VOL,15", command(t, host, "VOL"))
+	assert.Equal("VOL,OK", command(t, host, "VOL,20"))
+	assert.Equal("VOL,NG", command(t, host, "VOL,30"))
+	assert.Equal("SQL,OK", command(t, host, "SQL,4"))
+	assert.Equal("KEY,OK", command(t, host, "KEY,V,P"))
+	assert.Equal("URC,OK", command(t, host, "URC,1"))
+	assert.Equal("URC,1", command(t, host, "URC"))
+	assert.Equal("LCR,OK", command(t, host, "LCR,39.1,-76.9,5"))
+	assert.Equal("LCR,39.100000,-76.900000,5.000000", command(t, host, "LCR"))
+	assert.Equal("DTM,OK", command(t, host, "DTM,1,2020,6,21,18,6,38"))
+
+	dtm := server.NewDateTimeInfo(strings.TrimPrefix(command(t, host, "DTM"), "DTM,"))
+	assert.True(dtm.DaylightSavings)
+	assert.Equal(2020, dtm.Time.Year())
+
+	assert.Equal("ERR", command(t, host, "XYZ"))
+
+	state := simulator.State()
+	assert.Equal(20, state.Volume)
+	assert.Equal(4, state.Squelch)
+	assert.True(state.Recording)
+	assert.Equal([]string{"V,P"}, state.Keys)
+
+	sts := server.NewScannerStatus(strings.TrimPrefix(command(t, host, "STS"), "STS,"))
+	assert.Equal("SDS200", sts.Line1)
+}
+
+func TestScannerInfo(t *testing.T) {
+	scenario, readErr := sim.ReadScenario(strings.NewReader(testScenario))
+	if readErr != nil {
+		t.Fatalf("error when reading scenario: %v", readErr)
+	}
+
+	simulator, host := startSimulator(t, scenario)
+
+	assert := assert.New(t)
+	assert.Eventually(func() bool {
+		return simulator.State().Call != nil
+	}, time.Second, 10*time.Millisecond, "Scenario should start a call")
+
+	assert.NoError(host.WriteMessage([]byte("GSI")))
+	si := server.ScannerInfo{}
+	readXML(t, host, "GSI", &si)
+	assert.Equal("Howard County (Project 25)", si.System.Name)
+	assert.Equal("TGID:10961", si.TGID.TGID)
+	assert.Equal("858.2375MHz", si.SiteFrequency.Freq)
+	assert.Equal("3", si.Property.Sig)
+
+	assert.NoError(host.WriteMessage([]byte("PSI,20")))
+	pushed := server.ScannerInfo{}
+	readXML(t, host, "PSI", &pushed)
+	assert.Equal("2468170", pushed.UnitID.UID)
+
+	assert.NoError(host.WriteMessage([]byte("PSI,0")))
+	assert.Eventually(func() bool {
+		reply, _ := host.ReadMessage()
+		return string(reply) == "PSI,OK"
+	}, time.Second, time.Millisecond, "PSI,0 should stop the updates")
+}
+
+func TestListPaging(t *testing.T) {
+	scenario := sim.DefaultScenario()
+	scenario.PageSize = 2
+	scenario.Steps = nil
+	_, host := startSimulator(t, scenario)
+
+	assert := assert.New(t)
+
+	assert.NoError(host.WriteMessage([]byte("GLT,FL")))
+	favorites := server.GltFLInfo{}
+	readXML(t, host, "GLT", &favorites)
+	assert.Equal("HoCo", favorites.FL[0].Name)
+	assert.Equal("1", favorites.Footer.EOT)
+
+	assert.NoError(host.WriteMessage([]byte("GLT,SYS," + favorites.FL[0].Index)))
+	systems := server.GltSysInfo{}
+	readXML(t, host, "GLT", &systems)
+	assert.Len(systems.SYS, 1)
+
+	assert.NoError(host.WriteMessage([]byte("GLT,DEPT," + systems.SYS[0].Index)))
+	first := server.GltDeptInfo{}
+	readXML(t, host, "GLT", &first)
+	assert.Len(first.DEPT, 2)
+	assert.Equal("1", first.Footer.No)
+	assert.Equal("0", first.Footer.EOT)
+
+	second := server.GltDeptInfo{}
+	readXML(t, host, "GLT", &second)
+	assert.Len(second.DEPT, 1)
+	assert.Equal("2", second.Footer.No)
+	assert.Equal("1", second.Footer.EOT)
+
+	assert.Equal("GLT,NG", command(t, host, "GLT,SITE,999"))
+}
+
+func TestFileTransfer(t *testing.T) {
+	simulator, host := startSimulator(t, &sim.Scenario{PageSize: 10})
+
+	assert := assert.New(t)
+	noFile := strings.TrimSuffix(server.HomePatrolCommand([]string{"AUF", "INFO", "", "", ""}), "\r")
+	assert.Equal(noFile, command(t, host, server.HomePatrolCommand([]string{"AUF", "INFO"})), "No file should be announced before one is queued")
+
+	assert.NoError(simulator.Queue("../../wavparse/fixtures/2020-06-21_00-00-32.wav"))
+
+	info := strings.Split(command(t, host, server.HomePatrolCommand([]string{"AUF", "INFO"})), "\t")
+	assert.Equal("2020-06-21_00-00-32.wav", info[2])
+	assert.Equal("10680", info[3])
+
+	blocks := 0
+	reply := command(t, host, server.HomePatrolCommand([]string{"AUF", "DATA"}))
+	for !strings.HasPrefix(reply, "AUF\tDATA\tEOT") {
+		blocks++
+		if blocks > 10 {
+			t.Fatalf("too many blocks, last reply %q", reply)
+		}
+		reply = command(t, host, server.HomePatrolCommand([]string{"AUF", "DATA", "ACK"}))
+	}
+	assert.Equal(6, blocks)
+
+	assert.NoError(host.WriteMessage([]byte(server.HomePatrolCommand([]string{"AUF", "DATA", "ACK"}))))
+	assert.Eventually(func() bool {
+		return simulator.State().Pending == 0
+	}, time.Second, 10*time.Millisecond, "Finished transfers should be removed from the queue")
+
+	assert.Equal("AUF\tSTS\tNG", strings.Join(strings.Split(command(t, host, "AUF\tSTS\tON\t1"), "\t")[:3], "\t"), "Bad checksums should be rejected")
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRecordingsLayout saves recordings under the name the scanner gave them.
+	DefaultRecordingsLayout = "{{.Name}}"
+	// TrunkRecorderLayout saves recordings the way trunk-recorder does, by system and day, named by
+	// talkgroup, start time and frequency.
+	TrunkRecorderLayout = `{{.ShortName}}/{{.Time.Year}}/{{printf "%d" .Time.Month}}/{{.Time.Day}}/{{.TGID}}-{{.Time.Unix}}_{{.Frequency}}.wav`
+	// DefaultPruneInterval is how often recordings are checked against the retention policy unless set otherwise.
+	DefaultPruneInterval = time.Hour
+
+	// recordingsDirMode is the permission of the directories recordings are saved in.
+	recordingsDirMode = 0755
+)
+
+// ErrRecordingNotFound is returned by a RecordingStore for recordings it does not have.
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// RecordingStore keeps the recordings downloaded from the scanner. Recordings are named by a relative path with
+// forward slashes ending in .wav, their metadata is kept next to them as JSON sidecars.
+type RecordingStore interface {
+	// Save stores the WAV file at audioPath with its sidecars, keyed by format, under name and returns where it
+	// was stored. The file at audioPath belongs to the store afterwards.
+	Save(name string, audioPath string, sidecars map[string][]byte) (string, error)
+	// List returns every recording, newest first, without the metadata.
+	List() ([]*SavedRecording, error)
+	// Metadata returns the metadata saved with a recording.
+	Metadata(name string) (*wavparse.Recording, error)
+	// Open returns the audio of a recording and when it was saved.
+	Open(name string) (RecordingAudio, time.Time, error)
+	// Remove deletes a recording and its sidecars.
+	Remove(name string) error
+}
+
+// RecordingAudio is the WAV file of a stored recording.
+type RecordingAudio interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Retention is how long and how many recordings are kept. Recordings older than MaxAge are removed, then the
+// oldest ones until all of them fit in MaxBytes. Zero keeps recordings forever.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	// Interval is how often the recordings are pruned, DefaultPruneInterval if zero
+	Interval time.Duration
+}
+
+// enabled tells if recordings are ever removed.
+func (r Retention) enabled() bool {
+	return r.MaxAge > 0 || r.MaxBytes > 0
+}
+
+// PruneRecordings removes the recordings the retention policy does not keep and returns how many were removed.
+func PruneRecordings(store RecordingStore, retention Retention) (int, error) {
+	recordings, listErr := store.List()
+	if listErr != nil {
+		return 0, listErr
+	}
+
+	removed := 0
+	var total int64
+	overLimit := false
+	for _, recording := range recordings {
+		expired := retention.MaxAge > 0 && time.Since(recording.Time) > retention.MaxAge
+		// Recordings are listed newest first, so once one does not fit it and every older one is over the limit
+		if !expired && retention.MaxBytes > 0 && total+recording.Size > retention.MaxBytes {
+			overLimit = true
+		}
+		if !expired && !overLimit {
+			total += recording.Size
+			continue
+		}
+		if removeErr := store.Remove(recording.Name); removeErr != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", recording.Name, removeErr)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// pruneRecordings applies the retention policy now and then until the server stops.
+func (s *ScannerCtrl) pruneRecordings(retention Retention) {
+	defer s.wg.Done()
+
+	interval := retention.Interval
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, pruneErr := PruneRecordings(s.recordings, retention)
+		if pruneErr != nil {
+			log.Errorln("Error when pruning recordings", pruneErr)
+		} else if removed > 0 {
+			log.Infof("Pruned %d recordings\n", removed)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// storeQueueSize is how many downloaded recordings wait to be stored before new ones are dropped.
+const storeQueueSize = 100
+
+// pendingRecording is a downloaded recording waiting to be stored.
+type pendingRecording struct {
+	file     *AudioFeedFile
+	path     string
+	name     string
+	sidecars map[string][]byte
+}
+
+// store queues a downloaded recording for the store, so the reader does not wait for a slow upload to object
+// storage. A recording dropped because the queue is full stays at its path below RecordingsPath.
+func (s *ScannerCtrl) store(recording *pendingRecording) {
+	select {
+	case s.storeQueue <- recording:
+	default:
+		s.metrics.transfers.WithLabelValues(transferFailed).Inc()
+		s.metrics.dropped.WithLabelValues(queueStore).Inc()
+		log.Warnf("File %s: Store Queue Full, Left at %s\n", recording.file.Name, recording.path)
+	}
+}
+
+// storeRecordings saves the queued recordings to the store and passes them on, until the reader closes the
+// queue. Recordings queued before the server stopped are still stored.
+func (s *ScannerCtrl) storeRecordings() {
+	defer s.wg.Done()
+
+	for recording := range s.storeQueue {
+		file := recording.file
+		location, saveErr := s.recordings.Save(recording.name, recording.path, recording.sidecars)
+		if saveErr != nil {
+			s.metrics.transfers.WithLabelValues(transferFailed).Inc()
+			log.Errorf("File %s: Error when storing recording as %s: %v\n", file.Name, recording.name, saveErr)
+			continue
+		}
+		log.Infof("File %s: Stored as %s\n", file.Name, location)
+
+		received := &FileReceived{
+			Name:      file.Name,
+			Path:      location,
+			Recording: recording.name,
+			Metadata:  file.Metadata,
+		}
+		s.hub.publish(EventFileReceived, received)
+		s.events.append(EventRecordingReceived, received)
+		s.archiveRecording(received)
+		s.webhooks.recording(received)
+		s.pipeline.process(received)
+		s.uploads.recording(received)
+
+		s.metrics.transfers.WithLabelValues(transferCompleted).Inc()
+		s.metrics.transferDuration.Observe(time.Since(file.started).Seconds())
+	}
+}
+
+// recordingLayout is what the template of the recordings layout is executed with.
+type recordingLayout struct {
+	// Name is the file name the scanner gave the recording
+	Name        string
+	Time        time.Time
+	Favorite    string
+	System      string
+	Department  string
+	Channel     string
+	TGID        string
+	UnitID      string
+	ServiceType string
+	Site        string
+	// ShortName is the system as trunk-recorder names it
+	ShortName string
+	// Frequency in Hz
+	Frequency int64
+}
+
+// ParseRecordingsLayout parses the template recordings are named with, such as
+// {{.Time.Format "2006/01/02"}}/{{.System}}/{{.Name}}.
+func ParseRecordingsLayout(layout string) (*template.Template, error) {
+	if layout == "" {
+		layout = DefaultRecordingsLayout
+	}
+	return template.New("layout").Option("missingkey=error").Parse(layout)
+}
+
+// recordingName names a downloaded recording with the layout. The fields are made safe to use as a directory name,
+// so only the layout itself decides about directories.
+func recordingName(layout *template.Template, file *AudioFeedFile, shortName string) (string, error) {
+	channel := recordingChannel(file.Metadata)
+	if shortName == "" {
+		shortName = wavparse.ShortName(channel.System)
+	}
+	data := recordingLayout{
+		Name:        pathSegment(filepath.Base(file.Name)),
+		Time:        file.started,
+		Favorite:    pathSegment(channel.Favorite),
+		System:      pathSegment(channel.System),
+		Department:  pathSegment(channel.Department),
+		Channel:     pathSegment(channel.Channel),
+		TGID:        pathSegment(channel.TGID),
+		UnitID:      pathSegment(channel.UnitID),
+		ServiceType: pathSegment(channel.ServiceType),
+		Site:        pathSegment(channel.Site),
+		ShortName:   pathSegment(shortName),
+	}
+	if file.Metadata != nil && file.Metadata.Private != nil {
+		data.Frequency = int64(math.Round(file.Metadata.Private.Metadata.Frequency * 1e6))
+	}
+	if file.Timestamp != nil {
+		data.Time = *file.Timestamp
+	}
+	if file.Metadata != nil && file.Metadata.Public != nil && file.Metadata.Public.Timestamp != nil {
+		data.Time = *file.Metadata.Public.Timestamp
+	}
+
+	name := &bytes.Buffer{}
+	if executeErr := layout.Execute(name, data); executeErr != nil {
+		return "", executeErr
+	}
+	if !strings.EqualFold(path.Ext(name.String()), ".wav") {
+		name.WriteString(".wav")
+	}
+	return cleanRecordingName(name.String())
+}
+
+// pathSegment replaces the characters that cannot be part of a file name. Empty values become "unknown".
+func pathSegment(value string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	cleaned = strings.Trim(cleaned, " .")
+	if cleaned == "" {
+		return "unknown"
+	}
+	return cleaned
+}
+
+// cleanRecordingName checks that a recording name is a relative path to a WAV file and returns it cleaned.
+func cleanRecordingName(name string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(name))
+	if name == "" || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", ErrInvalidRecording
+	}
+	if !strings.EqualFold(path.Ext(cleaned), ".wav") {
+		return "", ErrInvalidRecording
+	}
+	return cleaned, nil
+}
+
+// LocalStore keeps recordings in a directory.
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore returns a store of the recordings in dir.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+// path returns the file of a recording name, refusing names that lead outside of the directory.
+func (l *LocalStore) path(name string) (string, error) {
+	cleaned, nameErr := cleanRecordingName(name)
+	if nameErr != nil {
+		return "", nameErr
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(cleaned)), nil
+}
+
+// Save moves the WAV file into the directory and writes the sidecars next to it.
+func (l *LocalStore) Save(name string, audioPath string, sidecars map[string][]byte) (string, error) {
+	dest, pathErr := l.path(name)
+	if pathErr != nil {
+		return "", pathErr
+	}
+
+	if mkdirErr := os.MkdirAll(filepath.Dir(dest), recordingsDirMode); mkdirErr != nil {
+		return "", mkdirErr
+	}
+	if dest != audioPath {
+		if renameErr := os.Rename(audioPath, dest); renameErr != nil {
+			return "", renameErr
+		}
+	}
+	for format, sidecar := range sidecars {
+		if writeErr := ioutil.WriteFile(wavparse.SidecarName(dest, format), sidecar, recordingMode); writeErr != nil {
+			return "", writeErr
+		}
+	}
+	return dest, nil
+}
+
+// List returns the WAV files in the directory and its subdirectories. The size of a recording includes its
+// encodings.
+func (l *LocalStore) List() ([]*SavedRecording, error) {
+	recordings := []*SavedRecording{}
+	// encodings are the files that may be encodings of a recording, by the path of the recording without extension
+	encodings := map[string][]os.FileInfo{}
+	walkErr := filepath.Walk(l.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if isEncoding(path) {
+			stem := strings.TrimSuffix(path, filepath.Ext(path))
+			encodings[stem] = append(encodings[stem], info)
+			return nil
+		}
+		if !strings.EqualFold(filepath.Ext(path), ".wav") {
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(l.dir, path)
+		if relErr != nil {
+			return relErr
+		}
+		recordings = append(recordings, &SavedRecording{Name: filepath.ToSlash(rel), Size: info.Size(), Time: info.ModTime()})
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	for _, recording := range recordings {
+		stem := filepath.Join(l.dir, filepath.FromSlash(strings.TrimSuffix(recording.Name, path.Ext(recording.Name))))
+		for _, encoding := range encodings[stem] {
+			recording.Size += encoding.Size()
+			recording.Encodings = append(recording.Encodings, path.Join(path.Dir(recording.Name), encoding.Name()))
+		}
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Time.After(recordings[j].Time)
+	})
+	return recordings, nil
+}
+
+// encodingName returns the file an encode processor of the pipeline writes a recording to in a format.
+func encodingName(audioPath string, format string) string {
+	return strings.TrimSuffix(audioPath, filepath.Ext(audioPath)) + "." + format
+}
+
+// isEncoding reports whether a file may be the encoding of the recording named like it with the extension .wav.
+// The sidecars of trunk-recorder, named like the recording as well, and hidden files such as downloads in
+// progress are not.
+func isEncoding(file string) bool {
+	ext := filepath.Ext(file)
+	return ext != "" && !strings.EqualFold(ext, ".wav") && !strings.EqualFold(ext, ".json") && !strings.HasPrefix(filepath.Base(file), ".")
+}
+
+// Metadata reads the JSON saved next to a recording, or decodes the recording if it was saved without.
+func (l *LocalStore) Metadata(name string) (*wavparse.Recording, error) {
+	audioPath, pathErr := l.path(name)
+	if pathErr != nil {
+		return nil, pathErr
+	}
+
+	metadataJSON, readErr := ioutil.ReadFile(wavparse.SidecarName(audioPath, wavparse.SidecarBearcatter))
+	if os.IsNotExist(readErr) {
+		if _, statErr := os.Stat(audioPath); os.IsNotExist(statErr) {
+			return nil, ErrRecordingNotFound
+		}
+		return decodeSaved(audioPath, name)
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	metadata := &wavparse.Recording{}
+	if unmarshalErr := json.Unmarshal(metadataJSON, metadata); unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return metadata, nil
+}
+
+// decodeSaved decodes the metadata of a recording saved without it. The file is named like the recording.
+func decodeSaved(audioPath string, name string) (*wavparse.Recording, error) {
+	metadata, decodeErr := wavparse.DecodeRecording(audioPath)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	metadata.File = path.Base(name)
+	return metadata, nil
+}
+
+// Open opens the WAV file of a recording.
+func (l *LocalStore) Open(name string) (RecordingAudio, time.Time, error) {
+	audioPath, pathErr := l.path(name)
+	if pathErr != nil {
+		return nil, time.Time{}, pathErr
+	}
+
+	audio, openErr := os.Open(audioPath)
+	if os.IsNotExist(openErr) {
+		return nil, time.Time{}, ErrRecordingNotFound
+	} else if openErr != nil {
+		return nil, time.Time{}, openErr
+	}
+	info, statErr := audio.Stat()
+	if statErr != nil {
+		audio.Close()
+		return nil, time.Time{}, statErr
+	}
+	return audio, info.ModTime(), nil
+}
+
+// Remove deletes a recording with its metadata and encodings, and the directories of the layout left empty.
+func (l *LocalStore) Remove(name string) error {
+	audioPath, pathErr := l.path(name)
+	if pathErr != nil {
+		return pathErr
+	}
+
+	if removeErr := os.Remove(audioPath); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	for _, format := range wavparse.SidecarFormats {
+		if removeErr := os.Remove(wavparse.SidecarName(audioPath, format)); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+	}
+	dir, stem := filepath.Split(strings.TrimSuffix(audioPath, filepath.Ext(audioPath)))
+	files, readErr := ioutil.ReadDir(dir)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return readErr
+	}
+	for _, file := range files {
+		if !isEncoding(file.Name()) || strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())) != stem {
+			continue
+		}
+		if removeErr := os.Remove(filepath.Join(dir, file.Name())); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+	}
+
+	root := filepath.Clean(l.dir)
+	for dir := filepath.Dir(audioPath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Removing a directory that is not empty fails, which ends the walk up
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package server_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an in-memory stand-in for S3 compatible storage. It checks that requests are signed with the access key
+// and that the payload hash matches the body. Object lists are paged two keys at a time.
+type fakeS3 struct {
+	*httptest.Server
+	accessKey string
+	mu        sync.Mutex
+	objects   map[string]*fakeObject
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+}
+
+type fakeListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+func startFakeS3(t *testing.T, accessKey string) *fakeS3 {
+	fake := &fakeS3{accessKey: accessKey, objects: map[string]*fakeObject{}}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	payload := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+f.accessKey+"/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payload[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>SignatureDoesNotMatch</Code><Message>bad signature</Message></Error>"))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, key+"/", r.URL.Query())
+	case r.Method == http.MethodPut:
+		f.objects[key] = &fakeObject{data: body, modified: time.Now()}
+	case r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+			return
+		}
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		w.Write(object.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, query map[string][]string) {
+	prefix := bucket + strings.Join(query["prefix"], "")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := strings.Join(query["continuation-token"], ""); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	result := fakeListResult{}
+	for i := start; i < len(keys) && i < start+2; i++ {
+		object := f.objects[keys[i]]
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			LastModified time.Time
+			Size         int64
+		}{strings.TrimPrefix(keys[i], bucket), object.modified, int64(len(object.data))})
+	}
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// keys returns the keys of the objects stored.
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// age makes an object older.
+func (f *fakeS3) age(key string, by time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[key].modified = f.objects[key].modified.Add(-by)
+}
+
+// download copies the recording fixture to a file in dir, like a finished transfer.
+func download(t *testing.T, dir string, name string) string {
+	recording, readErr := ioutil.ReadFile(transferFixture)
+	if readErr != nil {
+		t.Fatalf("error when reading recording: %v", readErr)
+	}
+	path := filepath.Join(dir, name)
+	if writeErr := ioutil.WriteFile(path, recording, 0644); writeErr != nil {
+		t.Fatalf("error when writing recording: %v", writeErr)
+	}
+	return path
+}
+
+// metadataSidecar is a bearcatter sidecar that names the recording.
+func metadataSidecar(name string) map[string][]byte {
+	return map[string][]byte{wavparse.SidecarBearcatter: []byte(`{"File": "` + name + `"}`)}
+}
+
+func TestLocalStore(t *testing.T) {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	assert := assert.New(t)
+	store := server.NewLocalStore(dir)
+	for i, name := range []string{"2020/06/19/old.wav", "2020/06/20/middle.wav", "2020/06/21/new.wav"} {
+		location, saveErr := store.Save(name, download(t, dir, "download.wav"), metadataSidecar(name))
+		assert.NoError(saveErr)
+		assert.Equal(filepath.Join(dir, filepath.FromSlash(name)), location)
+
+		info, statErr := os.Stat(location + ".json")
+		assert.NoError(statErr)
+		assert.Equal(os.FileMode(0644), info.Mode().Perm())
+		// Each recording is a day older than the next one
+		modified := time.Now().Add(time.Duration(i-2) * 24 * time.Hour)
+		assert.NoError(os.Chtimes(location, modified, modified))
+	}
+	_, saveErr := store.Save("../outside.wav", filepath.Join(dir, "download.wav"), nil)
+	assert.True(errors.Is(saveErr, server.ErrInvalidRecording))
+
+	// An encode processor of the pipeline wrote the middle recording as MP3 next to it
+	encoded := filepath.Join(dir, "2020", "06", "20", "middle.mp3")
+	assert.NoError(ioutil.WriteFile(encoded, make([]byte, 100), 0644))
+
+	recordings, listErr := store.List()
+	assert.NoError(listErr)
+	if assert.Len(recordings, 3) {
+		assert.Equal("2020/06/21/new.wav", recordings[0].Name)
+		assert.Empty(recordings[0].Encodings)
+		assert.Equal([]string{"2020/06/20/middle.mp3"}, recordings[1].Encodings)
+		assert.Equal(recordings[0].Size+100, recordings[1].Size, "Encodings count towards the size of a recording")
+		assert.Equal("2020/06/19/old.wav", recordings[2].Name)
+	}
+	metadata, metadataErr := store.Metadata("2020/06/20/middle.wav")
+	assert.NoError(metadataErr)
+	assert.Equal("2020/06/20/middle.wav", metadata.File)
+	_, _, openErr := store.Open("missing.wav")
+	assert.True(errors.Is(openErr, server.ErrRecordingNotFound))
+	_, metadataErr = store.Metadata("missing.wav")
+	assert.True(errors.Is(metadataErr, server.ErrRecordingNotFound))
+
+	// Without its own sidecar the metadata is decoded from the recording
+	location, saveErr := store.Save("trunk-recorder/7715-1592697633_852925000.wav", download(t, dir, "download.wav"),
+		map[string][]byte{wavparse.SidecarTrunkRecorder: []byte(`{"talkgroup": 7715}`)})
+	assert.NoError(saveErr)
+	sidecar := filepath.Join(dir, "trunk-recorder", "7715-1592697633_852925000.json")
+	assert.FileExists(sidecar)
+	metadata, metadataErr = store.Metadata("trunk-recorder/7715-1592697633_852925000.wav")
+	if assert.NoError(metadataErr) {
+		assert.Equal("7715-1592697633_852925000.wav", metadata.File)
+		assert.Equal("Dispatch East", metadata.Public.Channel)
+	}
+	assert.NoError(store.Remove("trunk-recorder/7715-1592697633_852925000.wav"))
+	_, statErr := os.Stat(location)
+	assert.True(os.IsNotExist(statErr))
+	_, statErr = os.Stat(sidecar)
+	assert.True(os.IsNotExist(statErr), "Sidecars of every format are removed")
+
+	removed, pruneErr := server.PruneRecordings(store, server.Retention{MaxAge: 36 * time.Hour})
+	assert.NoError(pruneErr)
+	assert.Equal(1, removed)
+	_, statErr = os.Stat(filepath.Join(dir, "2020", "06", "19"))
+	assert.True(os.IsNotExist(statErr), "Directories left empty are removed")
+
+	info, statErr := os.Stat(filepath.Join(dir, "2020", "06", "21", "new.wav"))
+	assert.NoError(statErr)
+	removed, pruneErr = server.PruneRecordings(store, server.Retention{MaxBytes: info.Size() + 1})
+	assert.NoError(pruneErr)
+	assert.Equal(1, removed)
+	recordings, _ = store.List()
+	if assert.Len(recordings, 1, "Only the newest recording fits") {
+		assert.Equal("2020/06/21/new.wav", recordings[0].Name)
+	}
+	_, statErr = os.Stat(encoded)
+	assert.True(os.IsNotExist(statErr), "Encodings are removed with their recording")
+}
+
+// listedStore is a store of recordings that only exist in its list.
+type listedStore struct {
+	server.RecordingStore
+	recordings []*server.SavedRecording
+}
+
+func (s *listedStore) List() ([]*server.SavedRecording, error) {
+	return s.recordings, nil
+}
+
+func (s *listedStore) Remove(name string) error {
+	for i, recording := range s.recordings {
+		if recording.Name == name {
+			s.recordings = append(s.recordings[:i:i], s.recordings[i+1:]...)
+			return nil
+		}
+	}
+	return server.ErrRecordingNotFound
+}
+
+func TestPruneRecordingsMaxBytes(t *testing.T) {
+	now := time.Now()
+	store := &listedStore{recordings: []*server.SavedRecording{
+		{Name: "new.wav", Size: 60, Time: now},
+		{Name: "middle.wav", Size: 50, Time: now.Add(-time.Hour)},
+		{Name: "old.wav", Size: 30, Time: now.Add(-2 * time.Hour)},
+	}}
+
+	removed, pruneErr := server.PruneRecordings(store, server.Retention{MaxBytes: 100})
+
+	assert := assert.New(t)
+	assert.NoError(pruneErr)
+	assert.Equal(2, removed)
+	if assert.Len(store.recordings, 1, "Older recordings that would fit are removed with the first one that does not") {
+		assert.Equal("new.wav", store.recordings[0].Name)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake := startFakeS3(t, "AKIDEXAMPLE")
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	assert := assert.New(t)
+	_, configErr := server.NewS3Store(server.S3Config{Endpoint: "localhost:9000", Bucket: "recordings"})
+	assert.True(errors.Is(configErr, server.ErrInvalidS3Config))
+
+	store, storeErr := server.NewS3Store(server.S3Config{Endpoint: fake.URL, Bucket: "recordings", Prefix: "scanner/", AccessKey: "AKIDEXAMPLE", SecretKey: "secret"})
+	assert.NoError(storeErr)
+	escaped := strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29")
+	names := []string{"Fire (Main)/a.wav", "Fire (Main)/b.wav", "Police/c.wav"}
+	for _, name := range names {
+		audioPath := download(t, dir, "download.wav")
+		location, saveErr := store.Save(name, audioPath, metadataSidecar(name))
+		assert.NoError(saveErr)
+		assert.Equal(fake.URL+"/recordings/scanner/"+escaped.Replace(name), location)
+		_, statErr := os.Stat(audioPath)
+		assert.True(os.IsNotExist(statErr), "Uploaded recordings are removed locally")
+	}
+	assert.Len(fake.keys(), 6)
+	fake.age("recordings/scanner/Fire (Main)/a.wav", 2*time.Hour)
+	fake.age("recordings/scanner/Police/c.wav", time.Hour)
+
+	// The three recordings and their metadata take more than one page of the object list
+	recordings, listErr := store.List()
+	assert.NoError(listErr)
+	if assert.Len(recordings, 3) {
+		assert.Equal([]string{"Fire (Main)/b.wav", "Police/c.wav", "Fire (Main)/a.wav"}, []string{recordings[0].Name, recordings[1].Name, recordings[2].Name})
+	}
+
+	metadata, metadataErr := store.Metadata("Police/c.wav")
+	assert.NoError(metadataErr)
+	assert.Equal("Police/c.wav", metadata.File)
+
+	audio, modified, openErr := store.Open("Fire (Main)/b.wav")
+	if assert.NoError(openErr) {
+		data, _ := ioutil.ReadAll(audio)
+		original, _ := ioutil.ReadFile(transferFixture)
+		assert.Equal(original, data)
+		assert.WithinDuration(time.Now(), modified, time.Minute)
+		audio.Close()
+	}
+	_, _, openErr = store.Open("missing.wav")
+	assert.True(errors.Is(openErr, server.ErrRecordingNotFound))
+
+	removed, pruneErr := server.PruneRecordings(store, server.Retention{MaxAge: 90 * time.Minute})
+	assert.NoError(pruneErr)
+	assert.Equal(1, removed)
+	assert.Equal([]string{
+		"recordings/scanner/Fire (Main)/b.wav", "recordings/scanner/Fire (Main)/b.wav.json",
+		"recordings/scanner/Police/c.wav", "recordings/scanner/Police/c.wav.json",
+	}, fake.keys())
+
+	wrongKey, _ := server.NewS3Store(server.S3Config{Endpoint: fake.URL, Bucket: "recordings", AccessKey: "wrong"})
+	_, listErr = wrongKey.List()
+	if assert.Error(listErr) {
+		assert.Contains(listErr.Error(), "SignatureDoesNotMatch")
+	}
+}
+
+func TestIntegrationRecordingStore(t *testing.T) {
+	fake := startFakeS3(t, "AKIDEXAMPLE")
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	store, storeErr := server.NewS3Store(server.S3Config{Endpoint: fake.URL, Bucket: "recordings", AccessKey: "AKIDEXAMPLE", SecretKey: "secret"})
+	if storeErr != nil {
+		t.Fatalf("error when creating store: %v", storeErr)
+	}
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{
+		Transport:        host,
+		RecordingsPath:   recordingsPath,
+		Recordings:       store,
+		RecordingsLayout: `{{.Time.Format "2006/01/02"}}/{{.System}}/{{.Name}}`,
+	})
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventFileReceived, "")
+
+	assert := assert.New(t)
+	name := "2020/06/21/East Bay Regional Communications System (EBRCS)/2020-06-21_00-00-32.wav"
+	assert.Contains(fake.keys(), "recordings/"+name)
+	assert.Contains(fake.keys(), "recordings/"+name+".json")
+	downloads, _ := ioutil.ReadDir(recordingsPath)
+	assert.Empty(downloads, "Nothing is left in the download directory")
+
+	recordings := []server.SavedRecording{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/recordings", nil, &recordings))
+	if assert.Len(recordings, 1) {
+		assert.Equal(name, recordings[0].Name)
+		if assert.NotNil(recordings[0].Metadata) {
+			assert.Equal("East Bay Regional Communications System (EBRCS)", recordings[0].Metadata.Public.System)
+		}
+	}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodHead, "/api/recordings/"+name, nil, nil))
+}
+
+func TestIntegrationTrunkRecorderSidecars(t *testing.T) {
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{
+		Transport:        host,
+		RecordingsPath:   recordingsPath,
+		RecordingsLayout: server.TrunkRecorderLayout,
+		Sidecars:         []string{wavparse.SidecarTrunkRecorder},
+	})
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventFileReceived, "")
+
+	assert := assert.New(t)
+	name := "ebrcs/2020/6/21/7715-1592697633_852925000.wav"
+	assert.FileExists(filepath.Join(recordingsPath, filepath.FromSlash(name)))
+	_, statErr := os.Stat(filepath.Join(recordingsPath, filepath.FromSlash(name)+".json"))
+	assert.True(os.IsNotExist(statErr), "Only the trunk-recorder sidecar is saved")
+
+	sidecar, readErr := ioutil.ReadFile(filepath.Join(recordingsPath, "ebrcs", "2020", "6", "21", "7715-1592697633_852925000.json"))
+	assert.NoError(readErr)
+	call := wavparse.TrunkRecorderCall{}
+	assert.NoError(json.Unmarshal(sidecar, &call))
+	assert.EqualValues(7715, call.Talkgroup)
+	assert.EqualValues(852925000, call.Freq)
+	assert.Equal("ebrcs", call.ShortName)
+
+	// The API decodes the recording for its metadata
+	recordings := []server.SavedRecording{}
+	assert.Equal(http.StatusOK, apiRequest(t, ctrl, http.MethodGet, "/api/recordings", nil, &recordings))
+	if assert.Len(recordings, 1) && assert.NotNil(recordings[0].Metadata) {
+		assert.Equal("Dispatch East", recordings[0].Metadata.Public.Channel)
+	}
+
+	_, startErr := (&server.Config{Transport: host, Sidecars: []string{"sdrtrunk"}}).Start()
+	assert.True(errors.Is(startErr, wavparse.ErrInvalidSidecar))
+}
+
+// slowStore is a LocalStore that holds every save until it is released, like an upload to object storage on a
+// slow connection.
+type slowStore struct {
+	*server.LocalStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Save(name string, audioPath string, sidecars map[string][]byte) (string, error) {
+	close(s.saving)
+	<-s.release
+	return s.LocalStore.Save(name, audioPath, sidecars)
+}
+
+func TestIntegrationSlowRecordingStore(t *testing.T) {
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	store := &slowStore{LocalStore: server.NewLocalStore(recordingsPath), saving: make(chan struct{}), release: make(chan struct{})}
+	ctrl := startServer(t, &server.Config{
+		Transport:      host,
+		RecordingsPath: recordingsPath,
+		Recordings:     store,
+		ProbeInterval:  50 * time.Millisecond,
+		ProbeTimeout:   200 * time.Millisecond,
+	})
+	released := false
+	defer func() {
+		if !released {
+			close(store.release)
+		}
+	}()
+	conn := dialJSON(t, ctrl.Addr())
+
+	select {
+	case <-store.saving:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the recording was never saved")
+	}
+
+	// The reader keeps answering probes while the recording is being saved
+	assert := assert.New(t)
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(server.LinkConnected, ctrl.Link().State)
+	assert.Contains(scrape(t, ctrl), `bearcatter_link_reconnects_total{result="failed"} 0`)
+
+	released = true
+	close(store.release)
+	received := server.FileReceived{}
+	assert.NoError(json.Unmarshal(expectJSON(t, conn, server.EventFileReceived, "").Data, &received))
+	assert.Equal("2020-06-21_00-00-32.wav", received.Recording)
+	assert.FileExists(filepath.Join(recordingsPath, "2020-06-21_00-00-32.wav"))
+}
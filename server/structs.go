@@ -6,8 +6,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/Bearcatter/bearcatter/wavparse"
 )
 
 type SDSKeyType string
@@ -533,9 +531,9 @@ func NewScannerStatus(raw string) *ScannerStatus {
 const DateTimeFormat = "2006,1,2,15,4,5"
 
 type DateTimeInfo struct {
-	DaylightSavings bool
-	Time            *time.Time
-	RTCOK           bool
+	DaylightSavings bool       `json:"dst"`
+	Time            *time.Time `json:"time"`
+	RTCOK           bool       `json:"rtc_ok"`
 }
 
 func (d *DateTimeInfo) String() string {
@@ -562,9 +560,9 @@ func NewDateTimeInfo(raw string) *DateTimeInfo {
 }
 
 type LocationInfo struct {
-	Latitude  float64
-	Longitude float64
-	Range     float64
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Range     float64 `json:"range"`
 }
 
 func (l *LocationInfo) String() string {
@@ -584,9 +582,9 @@ func NewLocationInfo(raw string) *LocationInfo {
 }
 
 type UserRecordStatus struct {
-	Recording    bool
-	ErrorCode    *int
-	ErrorMessage *string
+	Recording    bool    `json:"recording"`
+	ErrorCode    *int    `json:"error_code,omitempty"`
+	ErrorMessage *string `json:"error_message,omitempty"`
 }
 
 func (u *UserRecordStatus) String() string {
@@ -661,56 +659,10 @@ func (m *MenuSetValue) String() string {
 }
 
 type KeyPress struct {
-	Key  string
-	Mode string
+	Key  string `json:"key"`
+	Mode string `json:"mode"`
 }
 
 func (k *KeyPress) String() string {
 	return fmt.Sprintf("%s,%s", k.Key, k.Mode)
 }
-
-type AudioFeedFile struct {
-	Name           string
-	Size           int64
-	ExpectedBlocks int64
-	Timestamp      *time.Time
-	Data           []byte
-	Finished       bool
-	Metadata       *wavparse.Recording
-}
-
-func (a *AudioFeedFile) ParseMetadata(file string) error {
-	var metadataErr error
-	a.Metadata, metadataErr = wavparse.DecodeRecording(file)
-	return metadataErr
-}
-
-var ErrNoFile = fmt.Errorf("no file name was set, probably waiting for info")
-
-func NewAudioFeedFile(pieces []string) (*AudioFeedFile, error) {
-	if pieces[0] == "" {
-		return nil, ErrNoFile
-	}
-	file := &AudioFeedFile{
-		Name: pieces[0],
-	}
-
-	size, sizeErr := strconv.ParseInt(pieces[1], 10, 64)
-	if sizeErr != nil {
-		return nil, sizeErr
-	}
-
-	file.Size = size
-
-	file.ExpectedBlocks = (size / 4096) * 2
-
-	// 06/20/2020 20:31:24
-	ts, tsErr := time.ParseInLocation("01/02/2006 15:04:05", pieces[2], time.Local)
-	if tsErr != nil {
-		return nil, tsErr
-	}
-
-	file.Timestamp = &ts
-
-	return file, nil
-}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// States of the link to the scanner in the link.state event.
+const (
+	LinkConnected    = "connected"
+	LinkDisconnected = "disconnected"
+	LinkReconnecting = "reconnecting"
+)
+
+const (
+	// DefaultProbeInterval is how long the scanner may stay quiet before it is asked for its model.
+	DefaultProbeInterval = 10 * time.Second
+	// DefaultProbeTimeout is how long the scanner has to answer a probe before the link is taken as dead.
+	DefaultProbeTimeout = 5 * time.Second
+	// DefaultReconnectBackoff is how long to wait before the first attempt to reconnect, doubled with every failure.
+	DefaultReconnectBackoff = time.Second
+	// DefaultMaxReconnectBackoff caps the wait between attempts to reconnect.
+	DefaultMaxReconnectBackoff = time.Minute
+
+	// readErrorLimit is how many read errors in a row are taken as a dead link.
+	readErrorLimit = 5
+	// minProbeTick keeps short probe intervals in tests from spinning.
+	minProbeTick = 10 * time.Millisecond
+)
+
+// Results of attempts to reconnect.
+const (
+	reconnectCompleted = "completed"
+	reconnectFailed    = "failed"
+)
+
+// LinkState is the data of the link.state event, sent whenever the link to the scanner goes down or comes back.
+type LinkState struct {
+	State string `json:"state"`
+	// Link describes the transport, such as "/dev/ttyACM0 via USB"
+	Link string `json:"link"`
+	// Attempt counts the attempts to reconnect since the link went down
+	Attempt int `json:"attempt,omitempty"`
+	// Error is why the link went down
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+// linkSupervisor keeps track of whether the link to the scanner is alive and of the session state that has to be
+// restored after reconnecting.
+type linkSupervisor struct {
+	// lastRead is when the last message arrived and probeSent when the outstanding probe was sent, in Unix
+	// nanoseconds, zero without a probe
+	lastRead  int64
+	probeSent int64
+	// probes counts the MDL probes whose replies are not passed on to the clients
+	probes int32
+
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+	backoff       time.Duration
+	maxBackoff    time.Duration
+
+	// readErrors is only used by the reader
+	readErrors int
+
+	mu          sync.Mutex
+	state       LinkState
+	psiInterval int
+}
+
+func newLinkSupervisor() *linkSupervisor {
+	return &linkSupervisor{
+		probeInterval: DefaultProbeInterval,
+		probeTimeout:  DefaultProbeTimeout,
+		backoff:       DefaultReconnectBackoff,
+		maxBackoff:    DefaultMaxReconnectBackoff,
+	}
+}
+
+// received notes that the scanner sent a message, which answers any probe.
+func (l *linkSupervisor) received() {
+	atomic.StoreInt64(&l.lastRead, time.Now().UnixNano())
+	atomic.StoreInt64(&l.probeSent, 0)
+	l.readErrors = 0
+}
+
+// probeReply reports whether an MDL reply answers a probe rather than a client.
+func (l *linkSupervisor) probeReply() bool {
+	for {
+		probes := atomic.LoadInt32(&l.probes)
+		if probes <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&l.probes, probes, probes-1) {
+			return true
+		}
+	}
+}
+
+// failed reports whether a read error means the link is dead. Other errors are only taken as such when
+// readErrorLimit of them happen in a row.
+func (l *linkSupervisor) failed(readErr error) bool {
+	if readErr == io.EOF || errors.Is(readErr, ErrTransportClosed) || errors.Is(readErr, ErrLinkDead) {
+		return true
+	}
+	l.readErrors++
+	return l.readErrors >= readErrorLimit
+}
+
+// sent keeps the PSI interval of a message written to the scanner to restore it after reconnecting.
+func (l *linkSupervisor) sent(msg []byte) {
+	if !bytes.HasPrefix(msg, []byte("PSI,")) {
+		return
+	}
+	interval, parseErr := strconv.Atoi(string(bytes.TrimRight(msg[4:], "\r\n")))
+	if parseErr != nil {
+		return
+	}
+	l.mu.Lock()
+	l.psiInterval = interval
+	l.mu.Unlock()
+}
+
+// delay returns how long to wait before an attempt to reconnect.
+func (l *linkSupervisor) delay(attempt int) time.Duration {
+	return backoff(l.backoff, attempt, l.maxBackoff)
+}
+
+// probeTick is how often the prober checks the link.
+func (l *linkSupervisor) probeTick() time.Duration {
+	tick := l.probeInterval
+	if l.probeTimeout < tick {
+		tick = l.probeTimeout
+	}
+	if tick /= 4; tick < minProbeTick {
+		tick = minProbeTick
+	}
+	return tick
+}
+
+// connected reports whether the link is up.
+func (l *linkSupervisor) connected() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.State == LinkConnected
+}
+
+// Link returns the state of the link to the scanner.
+func (s *ScannerCtrl) Link() LinkState {
+	s.link.mu.Lock()
+	defer s.link.mu.Unlock()
+	return s.link.state
+}
+
+// setLinkState changes the state of the link and tells the clients about it.
+func (s *ScannerCtrl) setLinkState(state string, attempt int, cause error) {
+	link := LinkState{State: state, Link: s.conn.String(), Attempt: attempt, Since: time.Now()}
+	if cause != nil {
+		link.Error = cause.Error()
+	}
+	s.link.mu.Lock()
+	s.link.state = link
+	s.link.mu.Unlock()
+
+	s.hub.publish(EventLinkState, &link)
+	s.events.append(EventLinkState, &link)
+}
+
+// reconnect opens the link again after it failed, or for the first time when no scanner was plugged in at the
+// start, waiting longer after every failed attempt, and restores the session. It returns false if the server is
+// stopped before the link is back.
+func (s *ScannerCtrl) reconnect(cause error) bool {
+	if s.link.connected() {
+		log.Errorf("Lost connection to %s: %v", s.conn, cause)
+	}
+	s.setLinkState(LinkDisconnected, 0, cause)
+
+	// The scanner offers a file cut off again from its first block, and no more updates are coming for a call in
+	// progress
+	if s.incomingFile != nil && !s.incomingFile.Finished {
+		s.incomingFile.Abort()
+	}
+	s.incomingFile = nil
+	if call := s.calls.flush(); call != nil {
+		s.endCall(call)
+	}
+
+	for attempt := 1; ; attempt++ {
+		// A scanner that is plugged in again does not have to wait for the backoff
+		done := make(chan struct{})
+		select {
+		case <-s.quit:
+			close(done)
+			return false
+		case <-time.After(s.link.delay(attempt)):
+		case <-pluggedIn(s.conn, done):
+			log.Infoln("Scanner plugged in")
+		}
+		close(done)
+
+		s.setLinkState(LinkReconnecting, attempt, nil)
+		_ = s.conn.Close()
+		if openErr := s.conn.Open(); openErr != nil {
+			s.metrics.reconnects.WithLabelValues(reconnectFailed).Inc()
+			log.Warnf("Failed to reconnect to %s (attempt %d): %v", s.conn, attempt, openErr)
+			continue
+		}
+
+		select {
+		case <-s.quit:
+			// Stop closed the link while it was being opened
+			_ = s.conn.Close()
+			return false
+		default:
+		}
+
+		s.metrics.reconnects.WithLabelValues(reconnectCompleted).Inc()
+		log.Infof("Reconnected to %s after %d attempts", s.conn, attempt)
+		s.link.received()
+		s.setLinkState(LinkConnected, attempt, nil)
+		s.restoreSession()
+		return true
+	}
+}
+
+// restoreSession asks a scanner that was reconnected, and maybe rebooted, for what it was asked before.
+func (s *ScannerCtrl) restoreSession() {
+	s.link.mu.Lock()
+	interval := s.link.psiInterval
+	s.link.mu.Unlock()
+
+	if interval > 0 {
+		s.SendToHostMsgChannel([]byte("PSI," + strconv.Itoa(interval)))
+	}
+	if supportsFileTransfer(s.conn) {
+		s.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "STS", "ON"})))
+	}
+}
+
+// probe asks a quiet scanner for its model and closes the link if it does not answer in time, which makes
+// the reader reconnect.
+func (s *ScannerCtrl) probe() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.link.probeTick())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		// Holding the lock keeps the link from being reconnected while it is closed here
+		s.link.mu.Lock()
+		if s.link.state.State != LinkConnected {
+			s.link.mu.Unlock()
+			continue
+		}
+		probeSent := atomic.LoadInt64(&s.link.probeSent)
+		switch {
+		case probeSent != 0 && now.Sub(time.Unix(0, probeSent)) > s.link.probeTimeout:
+			log.Warnf("No reply from %s within %s, closing the link", s.conn, s.link.probeTimeout)
+			atomic.StoreInt64(&s.link.probeSent, 0)
+			atomic.StoreInt32(&s.link.probes, 0)
+			_ = s.conn.Close()
+		case probeSent == 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&s.link.lastRead))) >= s.link.probeInterval:
+			atomic.StoreInt64(&s.link.probeSent, now.UnixNano())
+			atomic.AddInt32(&s.link.probes, 1)
+			s.link.mu.Unlock()
+			log.Debugln("Probing", s.conn)
+			s.SendToHostMsgChannel([]byte("MDL"))
+			continue
+		}
+		s.link.mu.Unlock()
+	}
+}
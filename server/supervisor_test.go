@@ -0,0 +1,212 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// rebootingLink is a Transport to a simulated scanner that starts afresh every time the link is opened, like a
+// scanner that was rebooted. The link can be cut or made to go silent.
+type rebootingLink struct {
+	mu         sync.Mutex
+	host       *server.PipeTransport
+	scanner    *server.PipeTransport
+	simulators []*sim.Simulator
+	// written are the messages written in every generation of the link
+	written [][]string
+	silent  bool
+	// failOpens is how many of the next attempts to open the link fail
+	failOpens int
+}
+
+func newRebootingLink(t *testing.T) *rebootingLink {
+	l := &rebootingLink{}
+	t.Cleanup(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.scanner != nil {
+			l.scanner.Close()
+		}
+	})
+	return l
+}
+
+func (l *rebootingLink) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failOpens > 0 {
+		l.failOpens--
+		return errors.New("no such device")
+	}
+	if l.scanner != nil {
+		l.scanner.Close()
+	}
+
+	host, scanner := server.NewPipe()
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	go simulator.Serve(scanner)
+
+	l.host, l.scanner, l.silent = host, scanner, false
+	l.simulators = append(l.simulators, simulator)
+	l.written = append(l.written, nil)
+	return nil
+}
+
+func (l *rebootingLink) current() *server.PipeTransport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.host
+}
+
+func (l *rebootingLink) Close() error {
+	return l.current().Close()
+}
+
+func (l *rebootingLink) ReadMessage() ([]byte, error) {
+	return l.current().ReadMessage()
+}
+
+func (l *rebootingLink) WriteMessage(msg []byte) error {
+	l.mu.Lock()
+	host, silent := l.host, l.silent
+	if !silent {
+		l.written[len(l.written)-1] = append(l.written[len(l.written)-1], strings.TrimRight(string(msg), "\r"))
+	}
+	l.mu.Unlock()
+	if silent {
+		return nil
+	}
+	return host.WriteMessage(msg)
+}
+
+func (l *rebootingLink) Flush() error {
+	return l.current().Flush()
+}
+
+func (l *rebootingLink) FileTransfer() bool {
+	return true
+}
+
+func (l *rebootingLink) String() string {
+	return "rebooting link"
+}
+
+// unplug cuts the link from the scanner's end.
+func (l *rebootingLink) unplug() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.scanner.Close()
+}
+
+// hang keeps the link open but lets nothing reach the scanner anymore.
+func (l *rebootingLink) hang() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.silent = true
+}
+
+func (l *rebootingLink) simulator(generation int) *sim.Simulator {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if generation >= len(l.simulators) {
+		return nil
+	}
+	return l.simulators[generation]
+}
+
+func (l *rebootingLink) wrote(generation int, msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if generation >= len(l.written) {
+		return false
+	}
+	for _, written := range l.written[generation] {
+		if written == strings.TrimRight(msg, "\r") {
+			return true
+		}
+	}
+	return false
+}
+
+func expectLinkState(t *testing.T, conn net.Conn, state string) server.LinkState {
+	t.Helper()
+	link := server.LinkState{}
+	msg := expectJSON(t, conn, server.EventLinkState, "")
+	if unmarshalErr := json.Unmarshal(msg.Data, &link); unmarshalErr != nil {
+		t.Fatalf("error when decoding link state: %v", unmarshalErr)
+	}
+	if link.State != state {
+		t.Fatalf("link should be %s, got %+v", state, link)
+	}
+	return link
+}
+
+func TestLinkReconnect(t *testing.T) {
+	link := newRebootingLink(t)
+	ctrl := startServer(t, &server.Config{Transport: link, ReconnectBackoff: 10 * time.Millisecond})
+
+	assert := assert.New(t)
+	assert.Equal(server.LinkConnected, ctrl.Snapshot().Link.State)
+
+	conn := dialJSON(t, ctrl.Addr())
+	assert.Empty(call(t, conn, "1", "psi.set", map[string]int{"interval": 250}).Error)
+	assert.Eventually(func() bool {
+		return link.simulator(0).State().PSIInterval == 250*time.Millisecond
+	}, 5*time.Second, 10*time.Millisecond)
+
+	link.mu.Lock()
+	link.failOpens = 2
+	link.mu.Unlock()
+	link.unplug()
+
+	down := expectLinkState(t, conn, server.LinkDisconnected)
+	assert.Equal("rebooting link", down.Link)
+	assert.Contains(down.Error, "EOF")
+	for attempt := 1; attempt <= 3; attempt++ {
+		assert.Equal(attempt, expectLinkState(t, conn, server.LinkReconnecting).Attempt)
+	}
+	assert.Equal(3, expectLinkState(t, conn, server.LinkConnected).Attempt)
+
+	// The rebooted scanner is asked for what the scanner was asked before
+	assert.Eventually(func() bool {
+		return link.simulator(1).State().PSIInterval == 250*time.Millisecond && link.wrote(1, server.HomePatrolCommand([]string{"AUF", "STS", "ON"}))
+	}, 5*time.Second, 10*time.Millisecond)
+	expectJSON(t, conn, server.EventScannerInfo, "")
+
+	assert.Equal(server.LinkConnected, ctrl.Snapshot().Link.State)
+	metrics := scrape(t, ctrl)
+	assert.Contains(metrics, `bearcatter_link_reconnects_total{result="completed"} 1`)
+	assert.Contains(metrics, `bearcatter_link_reconnects_total{result="failed"} 2`)
+	assert.Contains(metrics, "bearcatter_link_up 1")
+}
+
+func TestLinkProbe(t *testing.T) {
+	link := newRebootingLink(t)
+	ctrl := startServer(t, &server.Config{
+		Transport:        link,
+		ProbeInterval:    50 * time.Millisecond,
+		ProbeTimeout:     200 * time.Millisecond,
+		ReconnectBackoff: 10 * time.Millisecond,
+	})
+	conn := dialJSON(t, ctrl.Addr())
+
+	assert := assert.New(t)
+	assert.Eventually(func() bool {
+		return link.wrote(0, "MDL")
+	}, 5*time.Second, 10*time.Millisecond, "a quiet scanner should be probed")
+
+	link.hang()
+	assert.Equal(server.ErrTransportClosed.Error(), expectLinkState(t, conn, server.LinkDisconnected).Error)
+	expectLinkState(t, conn, server.LinkReconnecting)
+	expectLinkState(t, conn, server.LinkConnected)
+	assert.NotNil(link.simulator(1))
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+const (
+	// AUFBlockSize is how many bytes of a file the scanner sends in each AUF DATA block. Only the last block is shorter.
+	AUFBlockSize = 2048
+	// MaxBlockRetries is how often a bad or missing block is asked for again with DATA NAK before the transfer is canceled.
+	MaxBlockRetries = 3
+
+	// recordingMode is the permission of saved recordings.
+	recordingMode = 0644
+)
+
+var ErrNoFile = fmt.Errorf("no file name was set, probably waiting for info")
+
+// Errors of AudioFeedFile.WriteBlock and AudioFeedFile.Finish.
+var (
+	// ErrBadBlock is returned for blocks that are not hex or have the wrong length.
+	ErrBadBlock = errors.New("bad block")
+	// ErrMissingBlock is returned for blocks arriving before the ones in front of them.
+	ErrMissingBlock = errors.New("missing block")
+	// ErrDuplicateBlock is returned for blocks that were received already, for example after a lost ACK.
+	ErrDuplicateBlock = errors.New("duplicate block")
+	// ErrSizeMismatch is returned when the blocks of a file do not add up to the size the scanner announced.
+	ErrSizeMismatch = errors.New("received size does not match announced size")
+)
+
+// AudioFeedFile is a recording being downloaded with AUF. Its blocks are written to a temporary file in the
+// recordings directory, which is renamed once the whole file arrived so a partial file is never seen under its name.
+type AudioFeedFile struct {
+	Name           string
+	Size           int64
+	ExpectedBlocks int64
+	Timestamp      *time.Time
+	// Blocks is the number of the last block received, blocks are numbered from 1
+	Blocks int64
+	// Received is the number of bytes received so far
+	Received int64
+	// Retries is how often the current block was asked for again
+	Retries  int
+	Finished bool
+	Metadata *wavparse.Recording
+	// Path is where the file was saved once it is finished
+	Path string
+	// started is when the scanner announced the file
+	started time.Time
+	temp    *os.File
+}
+
+func (a *AudioFeedFile) ParseMetadata(file string) error {
+	var metadataErr error
+	a.Metadata, metadataErr = wavparse.DecodeRecording(file)
+	return metadataErr
+}
+
+func NewAudioFeedFile(pieces []string) (*AudioFeedFile, error) {
+	if len(pieces) == 0 || pieces[0] == "" {
+		return nil, ErrNoFile
+	}
+	if len(pieces) < 3 {
+		return nil, fmt.Errorf("file notification has %d fields instead of 3", len(pieces))
+	}
+	file := &AudioFeedFile{
+		started: time.Now(),
+	}
+
+	size, sizeErr := strconv.ParseInt(pieces[1], 10, 64)
+	if sizeErr != nil {
+		return nil, sizeErr
+	}
+
+	file.Size = size
+
+	file.ExpectedBlocks = (size + AUFBlockSize - 1) / AUFBlockSize
+
+	// 06/20/2020 20:31:24
+	ts, tsErr := time.ParseInLocation("01/02/2006 15:04:05", pieces[2], time.Local)
+	if tsErr != nil {
+		return nil, tsErr
+	}
+
+	file.Timestamp = &ts
+	file.Name = transferName(pieces[0], ts)
+
+	return file, nil
+}
+
+// transferName returns the file name a recording is downloaded to. The scanner may send names with directories,
+// which are dropped so the file stays in the recordings directory. A name that is no file name at all, such as
+// "..", is replaced by the timestamp, the way the scanner names its recordings.
+func transferName(name string, ts time.Time) string {
+	base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if base == "." || base == ".." || base == "/" {
+		return ts.Format("2006-01-02_15-04-05") + ".wav"
+	}
+	return base
+}
+
+// Open creates the temporary file in dir the blocks are written to.
+func (a *AudioFeedFile) Open(dir string) error {
+	temp, tempErr := ioutil.TempFile(dir, "."+a.Name+".*.part")
+	if tempErr != nil {
+		return tempErr
+	}
+	a.temp = temp
+	return nil
+}
+
+// WriteBlock checks a block of hex data and writes it if it is the next one. Blocks received already
+// return ErrDuplicateBlock and are not written again.
+func (a *AudioFeedFile) WriteBlock(number int64, hexData string) (int, error) {
+	switch {
+	case number <= a.Blocks:
+		return 0, fmt.Errorf("%w %d, expecting %d", ErrDuplicateBlock, number, a.Blocks+1)
+	case number > a.Blocks+1:
+		return 0, fmt.Errorf("%w %d, received block %d", ErrMissingBlock, a.Blocks+1, number)
+	}
+
+	data, hexErr := hex.DecodeString(hexData)
+	if hexErr != nil {
+		return 0, fmt.Errorf("%w %d: %v", ErrBadBlock, number, hexErr)
+	}
+	if a.Received+int64(len(data)) > a.Size {
+		return 0, fmt.Errorf("%w %d: %d bytes overrun the size of %d", ErrBadBlock, number, len(data), a.Size)
+	}
+	if number < a.ExpectedBlocks && len(data) != AUFBlockSize {
+		return 0, fmt.Errorf("%w %d: %d bytes instead of %d", ErrBadBlock, number, len(data), AUFBlockSize)
+	}
+
+	if _, writeErr := a.temp.Write(data); writeErr != nil {
+		return 0, writeErr
+	}
+	a.Blocks = number
+	a.Received += int64(len(data))
+	a.Retries = 0
+	return len(data), nil
+}
+
+// Finish checks that the whole file arrived and moves it to path.
+func (a *AudioFeedFile) Finish(path string) error {
+	if a.Received != a.Size {
+		return fmt.Errorf("%w: received %d of %d bytes", ErrSizeMismatch, a.Received, a.Size)
+	}
+
+	if syncErr := a.temp.Sync(); syncErr != nil {
+		return syncErr
+	}
+	if chmodErr := a.temp.Chmod(recordingMode); chmodErr != nil {
+		return chmodErr
+	}
+	if closeErr := a.temp.Close(); closeErr != nil {
+		return closeErr
+	}
+	if renameErr := os.Rename(a.temp.Name(), path); renameErr != nil {
+		return renameErr
+	}
+	a.temp = nil
+	a.Path = path
+	a.Finished = true
+	return nil
+}
+
+// Abort removes the temporary file of a transfer that did not finish. Transfers are not resumed, as the scanner
+// sends a file it offers again from the first block and AUF cannot ask it for any other.
+func (a *AudioFeedFile) Abort() {
+	if a.temp == nil {
+		return
+	}
+	a.temp.Close()
+	os.Remove(a.temp.Name())
+	a.temp = nil
+}
+
+// String returns the name of the file, also while no file is being transferred.
+func (a *AudioFeedFile) String() string {
+	if a == nil {
+		return "(none)"
+	}
+	return a.Name
+}
+
+// cancelTransfer gives up on the file being transferred. The scanner keeps canceled files and offers them again.
+func (s *ScannerCtrl) cancelTransfer() {
+	s.metrics.transfers.WithLabelValues(transferFailed).Inc()
+	s.SendToHostMsgChannel([]byte(HomePatrolCommand([]string{"AUF", "DATA", "CAN"})))
+	s.incomingFile.Abort()
+	s.incomingFile = nil
+}
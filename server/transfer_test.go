@@ -0,0 +1,150 @@
+package server_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// tempFiles returns the names of the partial downloads in dir.
+func tempFiles(t *testing.T, dir string) []string {
+	parts, globErr := filepath.Glob(filepath.Join(dir, ".*.part"))
+	if globErr != nil {
+		t.Fatalf("error when listing temporary files: %v", globErr)
+	}
+	return parts
+}
+
+func TestAudioFeedFile(t *testing.T) {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 2*server.AUFBlockSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	block := func(n int) string {
+		to := n * server.AUFBlockSize
+		if to > len(data) {
+			to = len(data)
+		}
+		return hex.EncodeToString(data[(n-1)*server.AUFBlockSize : to])
+	}
+
+	assert := assert.New(t)
+	file, newErr := server.NewAudioFeedFile([]string{"test.wav", strconv.Itoa(len(data)), "06/20/2020 20:31:24"})
+	assert.NoError(newErr)
+	assert.Equal(int64(3), file.ExpectedBlocks)
+	assert.NoError(file.Open(dir))
+	assert.Len(tempFiles(t, dir), 1)
+
+	written, writeErr := file.WriteBlock(1, block(1))
+	assert.NoError(writeErr)
+	assert.Equal(server.AUFBlockSize, written)
+
+	_, writeErr = file.WriteBlock(1, block(1))
+	assert.True(errors.Is(writeErr, server.ErrDuplicateBlock))
+	_, writeErr = file.WriteBlock(3, block(3))
+	assert.True(errors.Is(writeErr, server.ErrMissingBlock))
+	_, writeErr = file.WriteBlock(2, "XY"+block(2)[2:])
+	assert.True(errors.Is(writeErr, server.ErrBadBlock), "Blocks must be hex")
+	_, writeErr = file.WriteBlock(2, block(2)[:100])
+	assert.True(errors.Is(writeErr, server.ErrBadBlock), "Only the last block may be short")
+
+	_, writeErr = file.WriteBlock(2, block(2))
+	assert.NoError(writeErr)
+	path := filepath.Join(dir, "test.wav")
+	assert.True(errors.Is(file.Finish(path), server.ErrSizeMismatch), "Files missing blocks must not be saved")
+
+	_, writeErr = file.WriteBlock(3, block(3)+"00")
+	assert.True(errors.Is(writeErr, server.ErrBadBlock), "Blocks must not overrun the size")
+	_, writeErr = file.WriteBlock(3, block(3))
+	assert.NoError(writeErr)
+	assert.Equal(int64(len(data)), file.Received)
+
+	assert.NoError(file.Finish(path))
+	assert.Equal(path, file.Path)
+	assert.Empty(tempFiles(t, dir))
+	saved, readErr := ioutil.ReadFile(path)
+	assert.NoError(readErr)
+	assert.Equal(data, saved)
+	info, statErr := os.Stat(path)
+	assert.NoError(statErr)
+	assert.Equal(os.FileMode(0644), info.Mode().Perm())
+
+	aborted, newErr := server.NewAudioFeedFile([]string{"aborted.wav", "10", "06/20/2020 20:31:24"})
+	assert.NoError(newErr)
+	assert.NoError(aborted.Open(dir))
+	aborted.Abort()
+	assert.Empty(tempFiles(t, dir), "Aborted transfers leave nothing behind")
+}
+
+func TestAudioFeedFileName(t *testing.T) {
+	assert := assert.New(t)
+	for _, names := range []struct {
+		sent string
+		name string
+	}{
+		{"2020-06-21_00-00-32.wav", "2020-06-21_00-00-32.wav"},
+		{"AUDIO/2020-06-21_00-00-32.wav", "2020-06-21_00-00-32.wav"},
+		{`\AUDIO\2020-06-21_00-00-32.wav`, "2020-06-21_00-00-32.wav"},
+		{"../../etc/cron.d/evil.wav", "evil.wav"},
+		{"..", "2020-06-20_20-31-24.wav"},
+		{"/", "2020-06-20_20-31-24.wav"},
+	} {
+		file, newErr := server.NewAudioFeedFile([]string{names.sent, "10", "06/20/2020 20:31:24"})
+		if assert.NoError(newErr, names.sent) {
+			assert.Equal(names.name, file.Name, names.sent)
+		}
+	}
+}
+
+func TestIntegrationFileTransferRetries(t *testing.T) {
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	// Block 2 is damaged once and recovers with a NAK. Block 4 stays damaged until the transfer is canceled,
+	// after which the scanner offers the file again
+	simulator.Corrupt(2, 1)
+	simulator.Corrupt(4, server.MaxBlockRetries+1)
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	serveSimulator(t, simulator, scanner)
+
+	ctrl := startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath})
+	conn := dialJSON(t, ctrl.Addr())
+	expectJSON(t, conn, server.EventFileReceived, "")
+
+	assert := assert.New(t)
+	saved, savedErr := ioutil.ReadFile(filepath.Join(recordingsPath, filepath.Base(transferFixture)))
+	assert.NoError(savedErr)
+	original, originalErr := ioutil.ReadFile(transferFixture)
+	assert.NoError(originalErr)
+	assert.Equal(original, saved, "Downloaded recording should match the original")
+	assert.Empty(tempFiles(t, recordingsPath))
+	assert.Eventually(func() bool { return simulator.State().Pending == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	metrics := scrape(t, ctrl)
+	assert.Contains(metrics, `bearcatter_auf_transfers_total{result="failed"} 1`)
+	assert.Contains(metrics, `bearcatter_auf_transfers_total{result="completed"} 1`)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrTransportClosed is returned by a Transport that was used after Close.
+var ErrTransportClosed = errors.New("transport is closed")
+
+// ErrLinkDead is returned by a Transport whose link went away without being closed, such as an unplugged USB cable.
+var ErrLinkDead = errors.New("link to the scanner is dead")
+
+// Transport carries messages between the server and a scanner.
+// ReadMessage returns messages without their line terminator and WriteMessage adds whatever framing the link needs.
+type Transport interface {
+	// Open connects to the scanner. It may be called again after Close to reconnect.
+	Open() error
+	// Close disconnects from the scanner and unblocks any pending ReadMessage.
+	Close() error
+	// ReadMessage blocks until the next message from the scanner arrives.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a single message to the scanner.
+	WriteMessage(msg []byte) error
+	// Flush discards anything the scanner sent that was not read yet.
+	Flush() error
+	// String describes the link for logging.
+	String() string
+}
+
+// fileTransferer is implemented by transports that can pull recordings off the scanner with the AUF commands.
+type fileTransferer interface {
+	FileTransfer() bool
+}
+
+func supportsFileTransfer(t Transport) bool {
+	if ft, ok := t.(fileTransferer); ok {
+		return ft.FileTransfer()
+	}
+	return false
+}
+
+// hotplugger is implemented by transports that notice when a scanner is plugged in.
+type hotplugger interface {
+	// Plugged returns a channel that is closed when a scanner shows up, checking until done is closed.
+	Plugged(done <-chan struct{}) <-chan struct{}
+}
+
+// pluggedIn returns a channel that is closed when a scanner is plugged in, nil if the transport does not notice.
+func pluggedIn(t Transport, done <-chan struct{}) <-chan struct{} {
+	if h, ok := t.(hotplugger); ok {
+		return h.Plugged(done)
+	}
+	return nil
+}
+
+// terminateCR converts LFs to the CRs the scanner expects and makes sure the message ends with one.
+// HomePatrol commands are tab separated and already carry their own CR.
+func terminateCR(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\t")) {
+		msg = bytes.ReplaceAll(msg, []byte("\n"), []byte("\r"))
+	}
+	if !bytes.HasSuffix(msg, []byte("\r")) {
+		msg = append(msg[:len(msg):len(msg)], '\r')
+	}
+	return msg
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tarm/serial"
+)
+
+func TestPipeTransport(t *testing.T) {
+	host, scanner := NewPipe()
+
+	assert := assert.New(t)
+	assert.NoError(host.Open())
+
+	assert.NoError(host.WriteMessage([]byte("MDL\r")))
+	msg, readErr := scanner.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("MDL", string(msg), "Line terminators should be stripped")
+
+	assert.NoError(scanner.WriteMessage([]byte("MDL,SDS200")))
+	assert.NoError(scanner.WriteMessage([]byte("VER,Version 1.00.00")))
+	assert.NoError(host.Flush())
+
+	assert.NoError(scanner.WriteMessage([]byte("STS,011000")))
+	assert.NoError(scanner.Close())
+
+	msg, readErr = host.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("STS,011000", string(msg), "Messages sent before the peer closed should still be delivered")
+
+	_, readErr = host.ReadMessage()
+	assert.Equal(io.EOF, readErr)
+
+	assert.NoError(host.Close())
+	_, readErr = host.ReadMessage()
+	assert.Equal(ErrTransportClosed, readErr)
+	assert.Equal(ErrTransportClosed, host.WriteMessage([]byte("MDL")))
+}
+
+func TestTerminateCR(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("MDL\r", string(terminateCR([]byte("MDL"))))
+	assert.Equal("MDL\r", string(terminateCR([]byte("MDL\n"))))
+	assert.Equal("MDL\rVER\r", string(terminateCR([]byte("MDL\nVER\n"))))
+	assert.Equal("AUF\tINFO\t1064\r", string(terminateCR([]byte("AUF\tINFO\t1064\r"))))
+}
+
+// unpluggedPort is a serialPort that returns what it holds and then, like the port of an unplugged scanner,
+// returns from every read at once without data.
+type unpluggedPort struct {
+	data    *bytes.Buffer
+	written bytes.Buffer
+}
+
+func (p *unpluggedPort) Read(b []byte) (int, error) {
+	if p.data.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.data.Read(b)
+}
+
+func (p *unpluggedPort) Write(b []byte) (int, error) {
+	return p.written.Write(b)
+}
+
+func (p *unpluggedPort) Close() error {
+	return nil
+}
+
+func (p *unpluggedPort) Flush() error {
+	return nil
+}
+
+func TestSerialTransportReconnect(t *testing.T) {
+	ports := []*unpluggedPort{
+		{data: bytes.NewBufferString("MDL,SDS100\r")},
+		{data: bytes.NewBufferString("VER,Version 1.23.08\r")},
+	}
+	opened := 0
+	transport := NewSerialTransport("/dev/ttyACM0")
+	transport.openPort = func(*serial.Config) (serialPort, error) {
+		opened++
+		return ports[opened-1], nil
+	}
+
+	assert := assert.New(t)
+	assert.NoError(transport.Open())
+	msg, readErr := transport.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("MDL,SDS100", string(msg))
+	_, readErr = transport.ReadMessage()
+	assert.Equal(ErrLinkDead, readErr, "Reads returning at once should not spin forever")
+
+	assert.NoError(transport.Close())
+	assert.NoError(transport.Open())
+	msg, readErr = transport.ReadMessage()
+	assert.NoError(readErr)
+	assert.Equal("VER,Version 1.23.08", string(msg))
+	assert.NoError(transport.WriteMessage([]byte("STS")))
+	assert.Equal("STS\r", ports[1].written.String())
+	assert.Empty(ports[0].written.String())
+
+	assert.NoError(transport.Close())
+	_, readErr = transport.ReadMessage()
+	assert.Equal(ErrTransportClosed, readErr)
+	assert.Equal(ErrTransportClosed, transport.WriteMessage([]byte("STS")))
+	assert.Equal(ErrTransportClosed, transport.Close())
+}
+
+func TestUDPTransportFlushWhileReading(t *testing.T) {
+	scanner, listenErr := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if listenErr != nil {
+		t.Fatalf("error when listening: %v", listenErr)
+	}
+	defer scanner.Close()
+
+	transport := NewUDPTransport(scanner.LocalAddr().(*net.UDPAddr))
+	assert := assert.New(t)
+	assert.NoError(transport.Open())
+	assert.NoError(transport.WriteMessage([]byte("MDL")))
+	buffer := make([]byte, 64)
+	_, host, readErr := scanner.ReadFromUDP(buffer)
+	if readErr != nil {
+		t.Fatalf("error when reading from host: %v", readErr)
+	}
+
+	// The reader keeps its messages while a drain reads the datagrams that arrive meanwhile
+	messages := make(chan []byte, 100)
+	go func() {
+		for {
+			msg, readErr := transport.ReadMessage()
+			if readErr != nil {
+				close(messages)
+				return
+			}
+			messages <- msg
+		}
+	}()
+	sent := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		msg := "VER," + strings.Repeat("1", 20-i)
+		sent[msg] = true
+		scanner.WriteToUDP([]byte(msg+"\r"), host)
+		assert.NoError(transport.Flush())
+	}
+	assert.NoError(transport.Close())
+	for msg := range messages {
+		assert.True(sent[string(msg)], "Message %q was overwritten by a drain", msg)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	udpFlushTimeout = 50 * time.Millisecond
+	// udpBufferSize is the largest datagram the scanner is expected to send.
+	udpBufferSize = 16384
+)
+
+// UDPTransport talks to a networked scanner such as the SDS200. Every datagram is one message.
+type UDPTransport struct {
+	address *net.UDPAddr
+
+	// mu guards conn and closed, conn is replaced every time the transport is opened
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	closed bool
+}
+
+func NewUDPTransport(addr *net.UDPAddr) *UDPTransport {
+	return &UDPTransport{address: addr}
+}
+
+func (t *UDPTransport) Open() error {
+	conn, connErr := net.DialUDP("udp", nil, t.address)
+	if connErr != nil {
+		return connErr
+	}
+	t.mu.Lock()
+	t.conn = conn
+	t.closed = false
+	t.mu.Unlock()
+	log.Infoln("Remote UDP address", conn.RemoteAddr().String())
+	log.Infoln("Local UDP client address", conn.LocalAddr().String())
+	return nil
+}
+
+func (t *UDPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil || t.closed {
+		return ErrTransportClosed
+	}
+	t.closed = true
+	return t.conn.Close()
+}
+
+// connection returns the connection unless the transport was not opened or is closed.
+func (t *UDPTransport) connection() *net.UDPConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	return t.conn
+}
+
+func (t *UDPTransport) ReadMessage() ([]byte, error) {
+	conn := t.connection()
+	if conn == nil {
+		return nil, ErrTransportClosed
+	}
+	// Flush reads while the reader is waiting, so every read has its own buffer
+	buffer := make([]byte, udpBufferSize)
+	n, readErr := conn.Read(buffer)
+	if readErr != nil {
+		if t.connection() != conn {
+			// Close interrupted the read
+			return nil, ErrTransportClosed
+		}
+		return nil, readErr
+	}
+	msg := bytes.ReplaceAll(buffer[:n], []byte("\n"), nil)
+	return bytes.TrimSuffix(msg, []byte("\r")), nil
+}
+
+func (t *UDPTransport) WriteMessage(msg []byte) error {
+	conn := t.connection()
+	if conn == nil {
+		return ErrTransportClosed
+	}
+	_, writeErr := conn.Write(terminateCR(msg))
+	return writeErr
+}
+
+func (t *UDPTransport) Flush() error {
+	conn := t.connection()
+	if conn == nil {
+		return ErrTransportClosed
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, udpBufferSize)
+	for {
+		if deadlineErr := conn.SetReadDeadline(time.Now().Add(udpFlushTimeout)); deadlineErr != nil {
+			return deadlineErr
+		}
+		if _, readErr := conn.Read(buffer); readErr != nil {
+			if e, ok := readErr.(net.Error); ok && e.Timeout() {
+				return nil
+			}
+			return readErr
+		}
+		log.Infoln("Packet Draining on WS Close...")
+	}
+}
+
+func (t *UDPTransport) String() string {
+	return fmt.Sprintf("%s via UDP", t.address)
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// uiKey is a button of the key pad of the web UI.
+type uiKey struct {
+	Label string     `json:"label"`
+	Key   SDSKeyType `json:"key"`
+}
+
+// uiKeyPad lays out the keys of the scanner, row by row.
+var uiKeyPad = [][]uiKey{
+	{{"System", KEY_SYSTEM}, {"Dept", KEY_DEPT}, {"Channel", KEY_CHANNEL}},
+	{{"1", KEY_1}, {"2", KEY_2}, {"3", KEY_3}},
+	{{"4", KEY_4}, {"5", KEY_5}, {"6", KEY_6}},
+	{{"7", KEY_7}, {"8", KEY_8}, {"9", KEY_9}},
+	{{".", KEY_DOT}, {"0", KEY_0}, {"E", KEY_ENTER}},
+	{{"Menu", KEY_MENU}, {"Func", KEY_F}, {"Replay", KEY_REPLAY}},
+	{{"Zip", KEY_ZIP}, {"Serv", KEY_SERV}, {"Range", KEY_RANGE}},
+	{{"◀", KEY_ROT_LEFT}, {"Push", KEY_ROT_PUSH}, {"▶", KEY_ROT_RIGHT}},
+	{{"Vol", KEY_VOL_PUSH}, {"Sql", KEY_SQL_PUSH}},
+}
+
+// uiPage is what the web UI template is rendered with.
+type uiPage struct {
+	KeyPad   [][]uiKey
+	Protocol string
+	// Hold presses the key of a system, department or channel, Avoid presses Func first
+	Hold  map[string]SDSKeyType
+	Func  SDSKeyType
+	Press SDSKeyModeType
+}
+
+var uiTemplate = template.Must(template.New("ui").Parse(uiHTML))
+
+// uiHandler serves the web UI. It talks to the server over the JSON protocol and the REST API.
+func uiHandler() http.Handler {
+	page := &uiPage{
+		KeyPad:   uiKeyPad,
+		Protocol: JSONProtocol,
+		Hold:     map[string]SDSKeyType{"system": KEY_SYSTEM, "department": KEY_DEPT, "channel": KEY_CHANNEL},
+		Func:     KEY_F,
+		Press:    KEY_MODE_PRESS,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET, HEAD")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if renderErr := uiTemplate.Execute(w, page); renderErr != nil {
+			log.Errorln("Failed to render web UI", renderErr)
+		}
+	})
+}
+
+// uiHTML is the single page of the web UI, with its styles and script inline so the binary carries everything.
+const uiHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Bearcatter</title>
+<style>
+  body { font-family: sans-serif; margin: 0; background: #1d1f21; color: #e0e0e0; }
+  header { padding: 0.5em 1em; background: #111; display: flex; justify-content: space-between; }
+  main { display: flex; flex-wrap: wrap; gap: 1em; padding: 1em; }
+  section { background: #282a2e; border-radius: 4px; padding: 0.5em 1em; flex: 1 1 320px; }
+  h2 { font-size: 1em; text-transform: uppercase; color: #8abeb7; }
+  #display { background: #0b2030; color: #f0c674; font-family: monospace; padding: 0.5em; min-height: 8em; white-space: pre; }
+  #properties span { margin-right: 1em; }
+  .keys { display: grid; grid-template-columns: repeat(3, 1fr); gap: 4px; margin: 0.5em 0; }
+  button { background: #373b41; color: #e0e0e0; border: 1px solid #555; border-radius: 3px; padding: 0.4em; cursor: pointer; }
+  button:hover { background: #4a4e55; }
+  label { display: block; margin: 0.5em 0; }
+  input[type=range] { width: 100%; }
+  table { width: 100%; border-collapse: collapse; font-size: 0.9em; }
+  td, th { text-align: left; padding: 2px 4px; border-bottom: 1px solid #373b41; }
+  tr.active { color: #b5bd68; }
+  tr.recording { cursor: pointer; }
+  audio { width: 100%; }
+</style>
+</head>
+<body>
+<header><strong>Bearcatter</strong><span id="status">Connecting...</span></header>
+<main>
+  <section>
+    <h2>Scanner</h2>
+    <div id="display"></div>
+    <p id="properties"><span id="vol"></span><span id="sql"></span><span id="sig"></span></p>
+    <label>Volume <input id="volume" type="range" min="0" max="29"></label>
+    <label>Squelch <input id="squelch" type="range" min="0" max="19"></label>
+    <div class="keys">
+      <button data-hold="system">Hold System</button><button data-hold="department">Hold Dept</button><button data-hold="channel">Hold Channel</button>
+      <button data-avoid="system">Avoid System</button><button data-avoid="department">Avoid Dept</button><button data-avoid="channel">Avoid Channel</button>
+    </div>
+    <div class="keys">
+      {{range .KeyPad}}{{range .}}<button data-key="{{.Key}}">{{.Label}}</button>{{end}}{{end}}
+    </div>
+  </section>
+  <section>
+    <h2>Calls</h2>
+    <table><thead><tr><th>Time</th><th>System</th><th>Channel</th><th>Units</th><th>Length</th></tr></thead><tbody id="calls"></tbody></table>
+  </section>
+  <section>
+    <h2>Recordings</h2>
+    <audio id="player" controls></audio>
+    <table><thead><tr><th>Time</th><th>System</th><th>Channel</th><th>Length</th></tr></thead><tbody id="recordings"></tbody></table>
+  </section>
+</main>
+<script>
+(function () {
+  var protocol = {{.Protocol}};
+  var holdKeys = {{.Hold}};
+  var funcKey = {{.Func}};
+  var press = {{.Press}};
+  var maxCalls = 50;
+  var socket = null;
+  var nextID = 1;
+
+  function $(id) { return document.getElementById(id); }
+
+  function cell(row, text) {
+    var td = document.createElement("td");
+    td.textContent = text === undefined ? "" : text;
+    row.appendChild(td);
+  }
+
+  // Commands run concurrently on the server, so commands that depend on each other wait for the response
+  var waiting = {};
+
+  function send(command, params, done) {
+    if (!socket || socket.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    var id = String(nextID++);
+    if (done) { waiting[id] = done; }
+    socket.send(JSON.stringify({id: id, command: command, params: params}));
+  }
+
+  function pressKey(key, done) {
+    send("key.press", {key: key, mode: press}, done);
+  }
+
+  function showInfo(info) {
+    var lines = [];
+    var plain = (info.ViewDescription && info.ViewDescription.PlainText) || [];
+    plain.forEach(function (line) { lines.push(line.AttrText); });
+    if (lines.length === 0) {
+      lines = [info.System.Name, info.Department.Name, info.TGID.Name, info.TGID.TGID, info.UnitID.UID];
+    }
+    $("display").textContent = lines.filter(function (line) { return line; }).join("\n");
+    $("vol").textContent = "VOL " + info.Property.VOL;
+    $("sql").textContent = "SQL " + info.Property.SQL;
+    $("sig").textContent = "Sig " + info.Property.Sig;
+    if (document.activeElement !== $("volume")) { $("volume").value = info.Property.VOL; }
+    if (document.activeElement !== $("squelch")) { $("squelch").value = info.Property.SQL; }
+  }
+
+  function showCall(call) {
+    var row = document.getElementById("call-" + call.id);
+    if (!row) {
+      row = document.createElement("tr");
+      row.id = "call-" + call.id;
+      $("calls").insertBefore(row, $("calls").firstChild);
+      while ($("calls").children.length > maxCalls) {
+        $("calls").removeChild($("calls").lastChild);
+      }
+    }
+    row.innerHTML = "";
+    row.className = call.end ? "" : "active";
+    cell(row, new Date(call.start).toLocaleTimeString());
+    cell(row, call.system);
+    cell(row, call.channel || call.tgid);
+    cell(row, (call.units || []).join(", "));
+    cell(row, call.end ? call.duration.toFixed(1) + "s" : "live");
+  }
+
+  function loadRecordings() {
+    fetch("/api/recordings?limit=" + maxCalls).then(function (resp) {
+      return resp.ok ? resp.json() : [];
+    }).then(function (recordings) {
+      $("recordings").innerHTML = "";
+      recordings.forEach(function (recording) {
+        var row = document.createElement("tr");
+        var pub = (recording.metadata && recording.metadata.Public) || {};
+        row.className = "recording";
+        cell(row, new Date(recording.time).toLocaleString());
+        cell(row, pub.System);
+        cell(row, pub.Channel || recording.name);
+        cell(row, recording.metadata ? recording.metadata.Duration : "");
+        row.onclick = function () {
+          $("player").src = "/api/recordings/" + recording.name.split("/").map(encodeURIComponent).join("/");
+          $("player").play();
+        };
+        $("recordings").appendChild(row);
+      });
+    });
+  }
+
+  function connect() {
+    socket = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/", protocol);
+    socket.onopen = function () {
+      $("status").textContent = "Connected";
+      send("psi.set", {interval: 500});
+    };
+    socket.onclose = function () {
+      $("status").textContent = "Disconnected, reconnecting...";
+      setTimeout(connect, 2000);
+    };
+    socket.onmessage = function (event) {
+      var msg = JSON.parse(event.data);
+      switch (msg.type) {
+      case "scanner.info":
+        showInfo(msg.data);
+        break;
+      case "call.started":
+      case "call.ended":
+        showCall(msg.data);
+        break;
+      case "file.received":
+        loadRecordings();
+        break;
+      case "server.notice":
+        $("status").textContent = msg.data.message;
+        break;
+      case "response":
+        if (msg.error) { $("status").textContent = msg.error; }
+        if (waiting[msg.id]) {
+          if (!msg.error) { waiting[msg.id](); }
+          delete waiting[msg.id];
+        }
+        break;
+      }
+    };
+  }
+
+  document.querySelectorAll("[data-key]").forEach(function (button) {
+    button.onclick = function () { pressKey(button.getAttribute("data-key")); };
+  });
+  document.querySelectorAll("[data-hold]").forEach(function (button) {
+    button.onclick = function () { pressKey(holdKeys[button.getAttribute("data-hold")]); };
+  });
+  document.querySelectorAll("[data-avoid]").forEach(function (button) {
+    button.onclick = function () {
+      pressKey(funcKey, function () { pressKey(holdKeys[button.getAttribute("data-avoid")]); });
+    };
+  });
+  $("volume").onchange = function () { send("volume.set", {level: Number($("volume").value)}); };
+  $("squelch").onchange = function () { send("squelch.set", {level: Number($("squelch").value)}); };
+
+  connect();
+  loadRecordings();
+})();
+</script>
+</body>
+</html>
+`
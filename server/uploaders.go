@@ -0,0 +1,566 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/alias"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of uploaders, named after the call sharing services they feed.
+const (
+	UploaderRdioScanner  = "rdio-scanner"
+	UploaderOpenMHz      = "openmhz"
+	UploaderBroadcastify = "broadcastify"
+)
+
+const (
+	// DefaultOpenMHzURL is the API of OpenMHz uploaders that do not set a URL.
+	DefaultOpenMHzURL = "https://api.openmhz.com"
+	// DefaultBroadcastifyURL is the API of Broadcastify Calls uploaders that do not set a URL.
+	DefaultBroadcastifyURL = "https://api.broadcastify.com/call-upload"
+
+	// DefaultUploadAttempts is how often a recording is tried to be uploaded unless the uploader sets MaxAttempts.
+	DefaultUploadAttempts = 10
+	// DefaultUploadBackoff is how long the first retry waits unless the uploader sets Backoff. Every retry waits
+	// twice as long, up to an hour.
+	DefaultUploadBackoff = 30 * time.Second
+	// DefaultUploadTimeout limits an upload unless the uploader sets Timeout.
+	DefaultUploadTimeout = 30 * time.Second
+	// DefaultUploadQueue is the directory below the recordings where uploads wait until they succeeded.
+	DefaultUploadQueue = ".uploads"
+
+	// uploadMaxBackoff is the longest a retry waits.
+	uploadMaxBackoff = time.Hour
+	// uploadQueueMode is the permission of the files of queued uploads, which hold API keys.
+	uploadQueueMode = 0600
+)
+
+// Results of uploads.
+const (
+	uploadCompleted = "completed"
+	uploadRetried   = "retried"
+	uploadFailed    = "failed"
+)
+
+// ErrInvalidUploader is returned for uploaders that can not upload.
+var ErrInvalidUploader = errors.New("invalid uploader")
+
+// UploadSystem maps a system the scanner names in its recordings to a system at the service.
+type UploadSystem struct {
+	// Name is the system as the scanner names it, matched ignoring case. Empty matches every system.
+	Name string `yaml:"name"`
+	// ID is the system at the service: the system ID at rdio-scanner and Broadcastify Calls, the short name at OpenMHz
+	ID     string `yaml:"id"`
+	APIKey string `yaml:"api_key"`
+}
+
+// Uploader posts every recording of its systems to a call sharing service. Uploads that fail are kept in a
+// queue on disk and retried, also after a restart.
+type Uploader struct {
+	Name string `yaml:"name"`
+	// Type is UploaderRdioScanner, UploaderOpenMHz or UploaderBroadcastify
+	Type string `yaml:"type"`
+	// URL of the service, the address of the server for rdio-scanner and the public API for the others if empty
+	URL string `yaml:"url"`
+	// Systems that are uploaded, recordings of other systems are not
+	Systems []UploadSystem `yaml:"systems"`
+	// Format transcodes recordings with Encoder before uploading them, such as m4a for Broadcastify Calls.
+	// They are uploaded as WAV if empty.
+	Format  string `yaml:"format"`
+	Encoder string `yaml:"encoder"`
+	// MaxAttempts is how often an upload is tried, DefaultUploadAttempts if zero
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	Timeout     time.Duration `yaml:"timeout"`
+
+	service uploadService
+	mu      sync.Mutex
+	jobs    []*uploadJob
+	wake    chan struct{}
+}
+
+// UploadCall is a recording as call sharing services see it.
+type UploadCall struct {
+	System         string        `json:"system"`
+	Talkgroup      string        `json:"talkgroup"`
+	TalkgroupLabel string        `json:"talkgroup_label,omitempty"`
+	TalkgroupGroup string        `json:"talkgroup_group,omitempty"`
+	TalkgroupTag   string        `json:"talkgroup_tag,omitempty"`
+	Frequency      int64         `json:"frequency,omitempty"`
+	Units          []string      `json:"units,omitempty"`
+	Start          time.Time     `json:"start"`
+	Duration       time.Duration `json:"duration"`
+	// AudioName is the file name the recording is uploaded as
+	AudioName string `json:"audio_name"`
+}
+
+// uploadJob is a recording waiting to be uploaded. It is saved as a JSON file in the queue directory.
+type uploadJob struct {
+	ID        string       `json:"id"`
+	Uploader  string       `json:"uploader"`
+	System    UploadSystem `json:"system"`
+	Recording string       `json:"recording"`
+	Call      UploadCall   `json:"call"`
+	Attempts  int          `json:"attempts"`
+	Next      time.Time    `json:"next"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+// uploadService sends a call to a service.
+type uploadService interface {
+	upload(ctx context.Context, client *http.Client, u *Uploader, job *uploadJob, audio []byte) error
+}
+
+// uploadStatusError is a response of a service that tells whether the upload is worth retrying.
+type uploadStatusError struct {
+	status int
+	body   string
+}
+
+func (e *uploadStatusError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("service responded %d %s", e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("service responded %d %s: %s", e.status, http.StatusText(e.status), e.body)
+}
+
+// retryable tells whether an upload that failed with err may succeed later.
+func retryable(err error) bool {
+	var statusErr *uploadStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status == http.StatusTooManyRequests || statusErr.status >= 500
+	}
+	return !errors.Is(err, ErrRecordingNotFound) && !errors.Is(err, ErrInvalidUploader)
+}
+
+// uploadersFile is the layout of a YAML uploader file.
+type uploadersFile struct {
+	Uploaders []*Uploader `yaml:"uploaders"`
+}
+
+func (f *uploadersFile) prepare() error {
+	for _, uploader := range f.Uploaders {
+		if prepareErr := uploader.prepare(); prepareErr != nil {
+			return prepareErr
+		}
+	}
+	return nil
+}
+
+// LoadUploaders reads the uploaders of a YAML file with a top level uploaders list.
+func LoadUploaders(path string) ([]*Uploader, error) {
+	file := uploadersFile{}
+	if loadErr := loadConfigFile(path, "uploader", &file); loadErr != nil {
+		return nil, loadErr
+	}
+	return file.Uploaders, nil
+}
+
+// prepare checks the uploader and fills in the defaults.
+func (u *Uploader) prepare() error {
+	if u.Name == "" {
+		u.Name = u.Type
+	}
+
+	switch u.Type {
+	case UploaderRdioScanner:
+		u.service = rdioScanner{}
+		if u.URL == "" {
+			return fmt.Errorf("%w %s: url of the rdio-scanner server must be set", ErrInvalidUploader, u.Name)
+		}
+	case UploaderOpenMHz:
+		u.service = openMHz{}
+		if u.URL == "" {
+			u.URL = DefaultOpenMHzURL
+		}
+	case UploaderBroadcastify:
+		u.service = broadcastify{}
+		if u.URL == "" {
+			u.URL = DefaultBroadcastifyURL
+		}
+	default:
+		return fmt.Errorf("%w %s: unknown type %q", ErrInvalidUploader, u.Name, u.Type)
+	}
+	if parsed, parseErr := url.Parse(u.URL); parseErr != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("%w %s: url must be http or https", ErrInvalidUploader, u.Name)
+	}
+
+	if len(u.Systems) == 0 {
+		return fmt.Errorf("%w %s: at least one system must be set", ErrInvalidUploader, u.Name)
+	}
+	for _, system := range u.Systems {
+		if system.ID == "" || system.APIKey == "" {
+			return fmt.Errorf("%w %s: system %q needs an id and api_key", ErrInvalidUploader, u.Name, system.Name)
+		}
+	}
+
+	if u.Format != "" {
+		u.Format = strings.TrimPrefix(u.Format, ".")
+		if u.Encoder == "" {
+			u.Encoder = DefaultEncoder
+		}
+		if _, ok := encoderNamed(u.Encoder); !ok {
+			return fmt.Errorf("%w %s: unknown encoder %q", ErrInvalidUploader, u.Name, u.Encoder)
+		}
+	}
+	if u.MaxAttempts <= 0 {
+		u.MaxAttempts = DefaultUploadAttempts
+	}
+	if u.Backoff <= 0 {
+		u.Backoff = DefaultUploadBackoff
+	}
+	if u.Timeout <= 0 {
+		u.Timeout = DefaultUploadTimeout
+	}
+	return nil
+}
+
+// system returns the system at the service of a system the scanner named, or nil if it is not uploaded.
+func (u *Uploader) system(name string) *UploadSystem {
+	for i, system := range u.Systems {
+		if system.Name == "" || strings.EqualFold(system.Name, name) {
+			return &u.Systems[i]
+		}
+	}
+	return nil
+}
+
+// newUploadCall describes a saved recording for the services.
+func newUploadCall(received *FileReceived) UploadCall {
+	channel := recordingChannel(received.Metadata)
+	call := UploadCall{
+		System:         channel.System,
+		Talkgroup:      alias.NormalizeID(channel.TGID),
+		TalkgroupLabel: channel.Channel,
+		TalkgroupGroup: channel.Department,
+		TalkgroupTag:   channel.ServiceType,
+		Start:          time.Now(),
+		AudioName:      path.Base(received.Recording),
+	}
+	if unit := alias.NormalizeID(channel.UnitID); unit != "" {
+		call.Units = []string{unit}
+	}
+	if metadata := received.Metadata; metadata != nil {
+		call.Duration = time.Duration(metadata.Duration)
+		if metadata.Public != nil && metadata.Public.Timestamp != nil {
+			call.Start = *metadata.Public.Timestamp
+		}
+		if metadata.Private != nil {
+			call.Frequency = int64(math.Round(metadata.Private.Metadata.Frequency * 1e6))
+		}
+	}
+	return call
+}
+
+// uploadDispatcher runs the uploaders, each in a goroutine of its own working through its queue.
+type uploadDispatcher struct {
+	uploaders []*Uploader
+	dir       string
+	store     RecordingStore
+	metrics   *metrics
+	client    *http.Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// startUploaders loads the uploads queued in dir and starts uploading.
+func startUploaders(uploaders []*Uploader, dir string, store RecordingStore, m *metrics) (*uploadDispatcher, error) {
+	d := &uploadDispatcher{uploaders: uploaders, dir: dir, store: store, metrics: m, client: &http.Client{}}
+	if prepareErr := (&uploadersFile{Uploaders: uploaders}).prepare(); prepareErr != nil {
+		return nil, prepareErr
+	}
+	for _, uploader := range uploaders {
+		uploader.wake = make(chan struct{}, 1)
+	}
+
+	if mkdirErr := os.MkdirAll(dir, recordingsDirMode); mkdirErr != nil {
+		return nil, fmt.Errorf("failed to create upload queue: %w", mkdirErr)
+	}
+	if loadErr := d.load(); loadErr != nil {
+		return nil, loadErr
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, uploader := range uploaders {
+		d.wg.Add(1)
+		go d.run(uploader)
+	}
+	return d, nil
+}
+
+// load reads the uploads left in the queue by an earlier run.
+func (d *uploadDispatcher) load() error {
+	files, globErr := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if globErr != nil {
+		return globErr
+	}
+	for _, file := range files {
+		data, readErr := ioutil.ReadFile(file)
+		if readErr != nil {
+			return fmt.Errorf("failed to read queued upload: %w", readErr)
+		}
+		job := &uploadJob{}
+		if unmarshalErr := json.Unmarshal(data, job); unmarshalErr != nil {
+			log.Errorf("Upload queue: Skipping %s: %v", file, unmarshalErr)
+			continue
+		}
+		uploader := d.uploader(job.Uploader)
+		if uploader == nil {
+			log.Warnf("Upload queue: Skipping %s for uploader %s, which is not configured", file, job.Uploader)
+			continue
+		}
+		uploader.jobs = append(uploader.jobs, job)
+	}
+	return nil
+}
+
+func (d *uploadDispatcher) uploader(name string) *Uploader {
+	for _, uploader := range d.uploaders {
+		if uploader.Name == name {
+			return uploader
+		}
+	}
+	return nil
+}
+
+// recording queues a saved recording for the uploaders of its system.
+func (d *uploadDispatcher) recording(received *FileReceived) {
+	if d == nil || received.Recording == "" {
+		return
+	}
+
+	call := newUploadCall(received)
+	for _, uploader := range d.uploaders {
+		system := uploader.system(call.System)
+		if system == nil {
+			continue
+		}
+
+		job := &uploadJob{
+			ID:        fmt.Sprintf("%d-%s", time.Now().UnixNano(), pathSegment(uploader.Name)),
+			Uploader:  uploader.Name,
+			System:    *system,
+			Recording: received.Recording,
+			Call:      call,
+			Next:      time.Now(),
+		}
+		if saveErr := d.save(job); saveErr != nil {
+			log.Errorf("Uploader %s: Error when queueing %s: %v", uploader.Name, received.Recording, saveErr)
+			continue
+		}
+
+		uploader.mu.Lock()
+		uploader.jobs = append(uploader.jobs, job)
+		uploader.mu.Unlock()
+		select {
+		case uploader.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// save writes a queued upload to its file, replacing it as a whole.
+func (d *uploadDispatcher) save(job *uploadJob) error {
+	data, marshalErr := json.Marshal(job)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	temp, tempErr := ioutil.TempFile(d.dir, ".upload-*.tmp")
+	if tempErr != nil {
+		return tempErr
+	}
+	defer os.Remove(temp.Name())
+
+	if _, writeErr := temp.Write(data); writeErr != nil {
+		temp.Close()
+		return writeErr
+	}
+	if chmodErr := temp.Chmod(uploadQueueMode); chmodErr != nil {
+		temp.Close()
+		return chmodErr
+	}
+	if closeErr := temp.Close(); closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(temp.Name(), d.jobPath(job))
+}
+
+func (d *uploadDispatcher) jobPath(job *uploadJob) string {
+	return filepath.Join(d.dir, job.ID+".json")
+}
+
+// pending returns how many uploads wait in the queue.
+func (d *uploadDispatcher) pending() int {
+	if d == nil {
+		return 0
+	}
+	count := 0
+	for _, uploader := range d.uploaders {
+		uploader.mu.Lock()
+		count += len(uploader.jobs)
+		uploader.mu.Unlock()
+	}
+	return count
+}
+
+// next returns the upload of an uploader that is due the soonest.
+func (u *Uploader) next() *uploadJob {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.jobs) == 0 {
+		return nil
+	}
+	sort.SliceStable(u.jobs, func(i, j int) bool {
+		return u.jobs[i].Next.Before(u.jobs[j].Next)
+	})
+	return u.jobs[0]
+}
+
+func (u *Uploader) remove(job *uploadJob) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i, queued := range u.jobs {
+		if queued == job {
+			u.jobs = append(u.jobs[:i], u.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *uploadDispatcher) run(uploader *Uploader) {
+	defer d.wg.Done()
+	for {
+		var wait <-chan time.Time
+		if job := uploader.next(); job != nil {
+			if due := time.Until(job.Next); due > 0 {
+				wait = time.After(due)
+			} else {
+				d.attempt(uploader, job)
+				continue
+			}
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-uploader.wake:
+		case <-wait:
+		}
+	}
+}
+
+// attempt uploads a queued recording once. Uploads that failed are retried with exponential backoff until
+// they run out of attempts or can not succeed.
+func (d *uploadDispatcher) attempt(uploader *Uploader, job *uploadJob) {
+	ctx, cancel := context.WithTimeout(d.ctx, uploader.Timeout)
+	uploadErr := d.upload(ctx, uploader, job)
+	cancel()
+	if d.ctx.Err() != nil {
+		// Stopping, the upload stays queued for the next run
+		return
+	}
+
+	job.Attempts++
+	if uploadErr == nil {
+		d.metrics.uploads.WithLabelValues(uploader.Name, uploadCompleted).Inc()
+		log.Infof("Uploader %s: Uploaded %s", uploader.Name, job.Recording)
+		d.finish(uploader, job)
+		return
+	}
+	if !retryable(uploadErr) || job.Attempts >= uploader.MaxAttempts {
+		d.metrics.uploads.WithLabelValues(uploader.Name, uploadFailed).Inc()
+		log.Errorf("Uploader %s: Giving up on %s after %d attempts: %v", uploader.Name, job.Recording, job.Attempts, uploadErr)
+		d.finish(uploader, job)
+		return
+	}
+
+	delay := backoff(uploader.Backoff, job.Attempts, uploadMaxBackoff)
+	job.Next = time.Now().Add(delay)
+	job.LastError = uploadErr.Error()
+	d.metrics.uploads.WithLabelValues(uploader.Name, uploadRetried).Inc()
+	log.Warnf("Uploader %s: Upload of %s failed, retrying in %s: %v", uploader.Name, job.Recording, delay, uploadErr)
+	if saveErr := d.save(job); saveErr != nil {
+		log.Errorf("Uploader %s: Error when saving queued upload of %s: %v", uploader.Name, job.Recording, saveErr)
+	}
+}
+
+// finish takes an upload off the queue.
+func (d *uploadDispatcher) finish(uploader *Uploader, job *uploadJob) {
+	uploader.remove(job)
+	if removeErr := os.Remove(d.jobPath(job)); removeErr != nil && !os.IsNotExist(removeErr) {
+		log.Errorf("Uploader %s: Error when removing queued upload of %s: %v", uploader.Name, job.Recording, removeErr)
+	}
+}
+
+// upload reads the recording from the store, transcodes it if the uploader asks for it and sends it.
+func (d *uploadDispatcher) upload(ctx context.Context, uploader *Uploader, job *uploadJob) error {
+	audio, _, openErr := d.store.Open(job.Recording)
+	if openErr != nil {
+		return openErr
+	}
+	data, readErr := ioutil.ReadAll(audio)
+	audio.Close()
+	if readErr != nil {
+		return readErr
+	}
+
+	if uploader.Format != "" {
+		var encodeErr error
+		if data, encodeErr = transcode(ctx, uploader, data); encodeErr != nil {
+			return fmt.Errorf("failed to encode to %s: %w", uploader.Format, encodeErr)
+		}
+		job.Call.AudioName = strings.TrimSuffix(job.Call.AudioName, path.Ext(job.Call.AudioName)) + "." + uploader.Format
+	}
+	return uploader.service.upload(ctx, d.client, uploader, job, data)
+}
+
+// transcode encodes a WAV recording to the format of an uploader.
+func transcode(ctx context.Context, uploader *Uploader, wav []byte) ([]byte, error) {
+	encoder, ok := encoderNamed(uploader.Encoder)
+	if !ok {
+		return nil, fmt.Errorf("%w %s: unknown encoder %q", ErrInvalidUploader, uploader.Name, uploader.Encoder)
+	}
+
+	dir, tempErr := ioutil.TempDir("", "bearcatter-upload")
+	if tempErr != nil {
+		return nil, tempErr
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "recording.wav")
+	dst := filepath.Join(dir, "recording."+uploader.Format)
+	if writeErr := ioutil.WriteFile(src, wav, recordingMode); writeErr != nil {
+		return nil, writeErr
+	}
+	if encodeErr := encoder.Encode(ctx, src, dst, nil); encodeErr != nil {
+		return nil, encodeErr
+	}
+	return ioutil.ReadFile(dst)
+}
+
+// stop cancels the uploads in progress. Queued uploads are picked up again on the next start.
+func (d *uploadDispatcher) stop() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+	d.wg.Wait()
+}
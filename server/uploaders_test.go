@@ -0,0 +1,291 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// upload is a call received by callServices.
+type upload struct {
+	path   string
+	values map[string][]string
+	file   string
+	audio  []byte
+}
+
+// callServices mocks the upload APIs of rdio-scanner, OpenMHz (below /openmhz) and Broadcastify Calls (at
+// /broadcastify, which has the audio put to /broadcastify/audio).
+type callServices struct {
+	*httptest.Server
+	mu       sync.Mutex
+	uploads  []upload
+	failures map[string]int
+}
+
+func startCallServices(t *testing.T, failures map[string]int) *callServices {
+	services := &callServices{failures: failures}
+	services.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		services.mu.Lock()
+		defer services.mu.Unlock()
+
+		if services.failures[r.URL.Path] > 0 {
+			services.failures[r.URL.Path]--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		received := upload{path: r.URL.Path}
+		if r.Method == http.MethodPut {
+			received.audio, _ = ioutil.ReadAll(r.Body)
+			services.uploads = append(services.uploads, received)
+			return
+		}
+		if parseErr := r.ParseMultipartForm(1 << 20); parseErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received.values = r.MultipartForm.Value
+		for _, files := range r.MultipartForm.File {
+			f, _ := files[0].Open()
+			received.file = files[0].Filename
+			received.audio, _ = ioutil.ReadAll(f)
+			f.Close()
+		}
+		services.uploads = append(services.uploads, received)
+
+		switch {
+		case r.URL.Path == "/broadcastify" && r.FormValue("apiKey") != "broadcastify-key":
+			w.Write([]byte("1 Invalid-API-Key"))
+		case r.URL.Path == "/broadcastify":
+			w.Write([]byte("0 " + services.URL + "/broadcastify/audio"))
+		default:
+			w.Write([]byte("Call imported successfully."))
+		}
+	}))
+	t.Cleanup(services.Close)
+	return services
+}
+
+// received returns the calls posted or put to path.
+func (s *callServices) received(path string) []upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	received := []upload{}
+	for _, u := range s.uploads {
+		if u.path == path {
+			received = append(received, u)
+		}
+	}
+	return received
+}
+
+func TestLoadUploaders(t *testing.T) {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	assert := assert.New(t)
+	path := filepath.Join(dir, "uploaders.yaml")
+	assert.NoError(ioutil.WriteFile(path, []byte(`uploaders:
+  - type: rdio-scanner
+    url: http://rdio.local:3000
+    systems:
+      - name: East Bay Regional Communications System (EBRCS)
+        id: "11"
+        api_key: rdio-key
+  - name: ebrcs
+    type: openmhz
+    max_attempts: 3
+    systems:
+      - id: ebrcs
+        api_key: openmhz-key
+  - type: broadcastify
+    format: m4a
+    backoff: 1m
+    systems:
+      - id: "1234"
+        api_key: broadcastify-key
+`), 0644))
+
+	uploaders, loadErr := server.LoadUploaders(path)
+	assert.NoError(loadErr)
+	if assert.Len(uploaders, 3) {
+		assert.Equal(server.UploaderRdioScanner, uploaders[0].Name)
+		assert.Equal(server.DefaultUploadAttempts, uploaders[0].MaxAttempts)
+		assert.Equal(server.DefaultUploadBackoff, uploaders[0].Backoff)
+		assert.Equal(server.DefaultOpenMHzURL, uploaders[1].URL)
+		assert.Equal(3, uploaders[1].MaxAttempts)
+		assert.Equal(server.DefaultBroadcastifyURL, uploaders[2].URL)
+		assert.Equal(server.DefaultEncoder, uploaders[2].Encoder)
+		assert.Equal(time.Minute, uploaders[2].Backoff)
+	}
+
+	for _, invalid := range []string{
+		"uploaders:\n  - type: trunk-player\n    systems:\n      - id: a\n        api_key: b\n",
+		"uploaders:\n  - type: rdio-scanner\n    systems:\n      - id: a\n        api_key: b\n",
+		"uploaders:\n  - type: openmhz\n",
+		"uploaders:\n  - type: openmhz\n    systems:\n      - id: a\n",
+		"uploaders:\n  - type: broadcastify\n    url: ftp://example.com\n    systems:\n      - id: a\n        api_key: b\n",
+		"uploaders:\n  - type: broadcastify\n    format: m4a\n    encoder: lame\n    systems:\n      - id: a\n        api_key: b\n",
+	} {
+		assert.NoError(ioutil.WriteFile(path, []byte(invalid), 0644))
+		_, loadErr = server.LoadUploaders(path)
+		assert.True(errors.Is(loadErr, server.ErrInvalidUploader), invalid)
+	}
+}
+
+// startUploading starts a server with the uploaders, whose simulated scanner sends the recordings.
+func startUploading(t *testing.T, recordingsPath string, uploaders []*server.Uploader, recordings ...string) *server.ScannerCtrl {
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+	simulator := sim.New(&sim.Scenario{Model: "SDS100", PageSize: 10})
+	for _, recording := range recordings {
+		if queueErr := simulator.Queue(recording); queueErr != nil {
+			t.Fatalf("error when queueing recording: %v", queueErr)
+		}
+	}
+	serveSimulator(t, simulator, scanner)
+
+	return startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath, Uploaders: uploaders})
+}
+
+func TestUploaders(t *testing.T) {
+	services := startCallServices(t, map[string]int{"/api/call-upload": 1})
+	server.RegisterEncoder("copy", &copyEncoder{})
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	uploaders := []*server.Uploader{
+		{Type: server.UploaderRdioScanner, URL: services.URL, Backoff: 10 * time.Millisecond,
+			Systems: []server.UploadSystem{{Name: "east bay regional communications system (ebrcs)", ID: "11", APIKey: "rdio-key"}}},
+		{Type: server.UploaderOpenMHz, URL: services.URL + "/openmhz",
+			Systems: []server.UploadSystem{{ID: "ebrcs", APIKey: "openmhz-key"}}},
+		{Type: server.UploaderBroadcastify, URL: services.URL + "/broadcastify", Encoder: "copy", Format: "m4a",
+			Systems: []server.UploadSystem{{ID: "1234", APIKey: "broadcastify-key"}}},
+		{Name: "refused", Type: server.UploaderBroadcastify, URL: services.URL + "/broadcastify",
+			Systems: []server.UploadSystem{{ID: "1234", APIKey: "expired-key"}}},
+		{Name: "elsewhere", Type: server.UploaderOpenMHz, URL: services.URL + "/elsewhere",
+			Systems: []server.UploadSystem{{Name: "Other System", ID: "other", APIKey: "openmhz-key"}}},
+	}
+	ctrl := startUploading(t, recordingsPath, uploaders, transferFixture)
+
+	assert := assert.New(t)
+	assert.Eventually(func() bool {
+		metrics := scrape(t, ctrl)
+		return strings.Contains(metrics, `bearcatter_uploads_total{result="completed",uploader="rdio-scanner"} 1`) &&
+			strings.Contains(metrics, `bearcatter_uploads_total{result="completed",uploader="openmhz"} 1`) &&
+			strings.Contains(metrics, `bearcatter_uploads_total{result="completed",uploader="broadcastify"} 1`) &&
+			strings.Contains(metrics, `bearcatter_uploads_total{result="failed",uploader="refused"} 1`)
+	}, 10*time.Second, 50*time.Millisecond)
+	metrics := scrape(t, ctrl)
+	assert.Contains(metrics, `bearcatter_uploads_total{result="retried",uploader="rdio-scanner"} 1`)
+	assert.Contains(metrics, `bearcatter_queue_depth{queue="uploads"} 0`)
+	assert.NotContains(metrics, `uploader="elsewhere"`)
+	assert.Empty(services.received("/elsewhere/other/upload"))
+
+	original, _ := ioutil.ReadFile(transferFixture)
+	if rdio := services.received("/api/call-upload"); assert.Len(rdio, 1) {
+		assert.Equal([]string{"rdio-key"}, rdio[0].values["key"])
+		assert.Equal([]string{"11"}, rdio[0].values["system"])
+		assert.Equal([]string{"7715"}, rdio[0].values["talkgroup"])
+		assert.Equal([]string{"Dispatch East"}, rdio[0].values["talkgroupLabel"])
+		assert.Equal([]string{"Contra Costa Co Sheriff"}, rdio[0].values["talkgroupGroup"])
+		assert.Equal([]string{"852925000"}, rdio[0].values["frequency"])
+		assert.Equal([]string{"4010013"}, rdio[0].values["source"])
+		assert.Equal([]string{"2020-06-21T00:00:33Z"}, rdio[0].values["dateTime"])
+		assert.Equal([]string{"audio/wav"}, rdio[0].values["audioType"])
+		assert.Equal("2020-06-21_00-00-32.wav", rdio[0].file)
+		assert.Equal(original, rdio[0].audio)
+	}
+	if openMHz := services.received("/openmhz/ebrcs/upload"); assert.Len(openMHz, 1) {
+		assert.Equal([]string{"openmhz-key"}, openMHz[0].values["api_key"])
+		assert.Equal([]string{"7715"}, openMHz[0].values["talkgroup_num"])
+		assert.Equal([]string{"1592697633"}, openMHz[0].values["start_time"])
+		assert.Equal([]string{`[{"pos":0,"src":4010013}]`}, openMHz[0].values["source_list"])
+		assert.Equal(original, openMHz[0].audio)
+	}
+	broadcastify := services.received("/broadcastify")
+	assert.Len(broadcastify, 2, "The refused uploader announced its call too")
+	for _, call := range broadcastify {
+		if call.values["apiKey"][0] != "broadcastify-key" {
+			continue
+		}
+		assert.Equal([]string{"1234"}, call.values["systemId"])
+		assert.Equal([]string{"7715"}, call.values["tg"])
+		assert.Equal([]string{"852.925"}, call.values["freq"])
+		assert.Equal([]string{"m4a"}, call.values["enc"])
+		assert.Empty(call.audio, "The audio is put after the call was accepted")
+	}
+	if audio := services.received("/broadcastify/audio"); assert.Len(audio, 1) {
+		assert.Equal(original, audio[0].audio)
+	}
+
+	queued, _ := filepath.Glob(filepath.Join(recordingsPath, server.DefaultUploadQueue, "*.json"))
+	assert.Empty(queued, "Finished uploads leave the queue")
+}
+
+func TestUploadersResumeQueue(t *testing.T) {
+	services := startCallServices(t, map[string]int{"/api/call-upload": 1})
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	uploader := func() []*server.Uploader {
+		return []*server.Uploader{{Type: server.UploaderRdioScanner, URL: services.URL, Backoff: time.Hour,
+			Systems: []server.UploadSystem{{ID: "11", APIKey: "rdio-key"}}}}
+	}
+	ctrl := startUploading(t, recordingsPath, uploader(), transferFixture)
+
+	assert := assert.New(t)
+	assert.Eventually(func() bool {
+		return strings.Contains(scrape(t, ctrl), `bearcatter_uploads_total{result="retried",uploader="rdio-scanner"} 1`)
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Contains(scrape(t, ctrl), `bearcatter_queue_depth{queue="uploads"} 1`)
+	ctrl.Stop()
+
+	queued, _ := filepath.Glob(filepath.Join(recordingsPath, server.DefaultUploadQueue, "*.json"))
+	if assert.Len(queued, 1) {
+		info, statErr := os.Stat(queued[0])
+		assert.NoError(statErr)
+		assert.Equal(os.FileMode(0600), info.Mode().Perm(), "Queued uploads hold API keys")
+
+		// Due now instead of in an hour
+		job := map[string]interface{}{}
+		data, _ := ioutil.ReadFile(queued[0])
+		assert.NoError(json.Unmarshal(data, &job))
+		assert.EqualValues(1, job["attempts"])
+		job["next"] = time.Now()
+		data, _ = json.Marshal(job)
+		assert.NoError(ioutil.WriteFile(queued[0], data, 0600))
+	}
+
+	// The upload is picked up again after a restart, the scanner has no new recordings
+	ctrl = startUploading(t, recordingsPath, uploader())
+	assert.Eventually(func() bool {
+		return strings.Contains(scrape(t, ctrl), `bearcatter_uploads_total{result="completed",uploader="rdio-scanner"} 1`)
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Len(services.received("/api/call-upload"), 1)
+	queued, _ = filepath.Glob(filepath.Join(recordingsPath, server.DefaultUploadQueue, "*.json"))
+	assert.Empty(queued)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// uploadResponseLimit is how much of a response is read, services answer with a short status.
+const uploadResponseLimit = 64 << 10
+
+// uploadField is a form field of an upload, written in order.
+type uploadField struct {
+	name  string
+	value string
+}
+
+// audioType returns the MIME type of a recording by its name.
+func audioType(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".wav":
+		return "audio/wav"
+	case ".m4a", ".aac":
+		return "audio/aac"
+	case ".mp3":
+		return "audio/mpeg"
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// postForm posts fields and a file as multipart form and returns the body of a successful response.
+func postForm(ctx context.Context, client *http.Client, target string, fields []uploadField, fileField, fileName string, audio []byte) (string, error) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, field := range fields {
+		if fieldErr := form.WriteField(field.name, field.value); fieldErr != nil {
+			return "", fieldErr
+		}
+	}
+	if fileField != "" {
+		file, createErr := form.CreateFormFile(fileField, fileName)
+		if createErr != nil {
+			return "", createErr
+		}
+		if _, writeErr := file.Write(audio); writeErr != nil {
+			return "", writeErr
+		}
+	}
+	if closeErr := form.Close(); closeErr != nil {
+		return "", closeErr
+	}
+
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if reqErr != nil {
+		return "", reqErr
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return send(client, req)
+}
+
+// send sends an upload request and returns the body of a successful response.
+func send(client *http.Client, req *http.Request) (string, error) {
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		return "", respErr
+	}
+	defer resp.Body.Close()
+
+	data, readErr := ioutil.ReadAll(io.LimitReader(resp.Body, uploadResponseLimit))
+	if readErr != nil {
+		return "", readErr
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", &uploadStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// rdioScanner uploads to the call upload API of an rdio-scanner server.
+type rdioScanner struct{}
+
+func (rdioScanner) upload(ctx context.Context, client *http.Client, u *Uploader, job *uploadJob, audio []byte) error {
+	call := job.Call
+	fields := []uploadField{
+		{"key", job.System.APIKey},
+		{"system", job.System.ID},
+		{"systemLabel", call.System},
+		{"talkgroup", call.Talkgroup},
+		{"talkgroupLabel", call.TalkgroupLabel},
+		{"talkgroupGroup", call.TalkgroupGroup},
+		{"talkgroupTag", call.TalkgroupTag},
+		{"dateTime", call.Start.UTC().Format("2006-01-02T15:04:05Z07:00")},
+		{"frequency", strconv.FormatInt(call.Frequency, 10)},
+		{"audioName", call.AudioName},
+		{"audioType", audioType(call.AudioName)},
+	}
+	if len(call.Units) > 0 {
+		fields = append(fields, uploadField{"source", call.Units[0]})
+	}
+
+	_, postErr := postForm(ctx, client, strings.TrimSuffix(u.URL, "/")+"/api/call-upload", fields, "audio", call.AudioName, audio)
+	return postErr
+}
+
+// openMHzSource is a unit heard during a call, in seconds from its start.
+type openMHzSource struct {
+	Pos float64 `json:"pos"`
+	Src int64   `json:"src"`
+}
+
+// openMHzFrequency is a frequency of a call, in seconds from its start.
+type openMHzFrequency struct {
+	Freq       int64   `json:"freq"`
+	Time       int64   `json:"time"`
+	Pos        float64 `json:"pos"`
+	Len        float64 `json:"len"`
+	ErrorCount int     `json:"error_count"`
+	SpikeCount int     `json:"spike_count"`
+}
+
+// openMHz uploads to the OpenMHz API, to the system with the short name of the system ID.
+type openMHz struct{}
+
+func (openMHz) upload(ctx context.Context, client *http.Client, u *Uploader, job *uploadJob, audio []byte) error {
+	call := job.Call
+	start := call.Start.Unix()
+	length := call.Duration.Seconds()
+
+	sources := []openMHzSource{}
+	for _, unit := range call.Units {
+		if id, parseErr := strconv.ParseInt(unit, 10, 64); parseErr == nil {
+			sources = append(sources, openMHzSource{Src: id})
+		}
+	}
+	sourceList, sourceErr := json.Marshal(sources)
+	if sourceErr != nil {
+		return sourceErr
+	}
+	freqList, freqErr := json.Marshal([]openMHzFrequency{{Freq: call.Frequency, Time: start, Len: length}})
+	if freqErr != nil {
+		return freqErr
+	}
+
+	fields := []uploadField{
+		{"freq", strconv.FormatInt(call.Frequency, 10)},
+		{"start_time", strconv.FormatInt(start, 10)},
+		{"stop_time", strconv.FormatInt(call.Start.Add(call.Duration).Unix(), 10)},
+		{"call_length", strconv.FormatFloat(length, 'f', -1, 64)},
+		{"talkgroup_num", call.Talkgroup},
+		{"emergency", "0"},
+		{"api_key", job.System.APIKey},
+		{"source_list", string(sourceList)},
+		{"freq_list", string(freqList)},
+		{"error_count", "0"},
+		{"spike_count", "0"},
+	}
+
+	target := fmt.Sprintf("%s/%s/upload", strings.TrimSuffix(u.URL, "/"), job.System.ID)
+	_, postErr := postForm(ctx, client, target, fields, "call", call.AudioName, audio)
+	return postErr
+}
+
+// broadcastify uploads to Broadcastify Calls in two steps: the call is announced with its metadata, which is
+// answered with "0 <url>", and the audio is put to that URL.
+type broadcastify struct{}
+
+func (broadcastify) upload(ctx context.Context, client *http.Client, u *Uploader, job *uploadJob, audio []byte) error {
+	call := job.Call
+	fields := []uploadField{
+		{"apiKey", job.System.APIKey},
+		{"systemId", job.System.ID},
+		{"callDuration", strconv.FormatFloat(call.Duration.Seconds(), 'f', -1, 64)},
+		{"ts", strconv.FormatInt(call.Start.Unix(), 10)},
+		{"tg", call.Talkgroup},
+		{"freq", strconv.FormatFloat(float64(call.Frequency)/1e6, 'f', -1, 64)},
+		{"enc", strings.TrimPrefix(path.Ext(call.AudioName), ".")},
+	}
+	if len(call.Units) > 0 {
+		fields = append(fields, uploadField{"src", call.Units[0]})
+	}
+
+	answer, postErr := postForm(ctx, client, u.URL, fields, "", "", nil)
+	if postErr != nil {
+		return postErr
+	}
+	split := strings.SplitN(answer, " ", 2)
+	if split[0] != "0" || len(split) != 2 {
+		// Broadcastify answers with a code other than 0 and a message for calls it refuses
+		return &uploadStatusError{status: http.StatusBadRequest, body: answer}
+	}
+
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSpace(split[1]), bytes.NewReader(audio))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", audioType(call.AudioName))
+	_, putErr := send(client, req)
+	return putErr
+}
@@ -160,6 +160,23 @@ func IsValidXMLMessage(msgType string, buffer []byte) bool {
 	return true
 }
 
+// messageFrom returns the message from offset on, or nothing if the message is shorter.
+func messageFrom(msg []byte, offset int) []byte {
+	if len(msg) < offset {
+		return nil
+	}
+	return msg[offset:]
+}
+
+// isAcknowledgement reports whether the parameters of a reply only say if a set command worked, such as LCR,OK.
+func isAcknowledgement(params []byte) bool {
+	switch string(params) {
+	case "OK", "NG", "ERR":
+		return true
+	}
+	return false
+}
+
 // https://stackoverflow.com/a/52395088/486182
 func ScanLinesWithCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
@@ -187,7 +204,8 @@ func homepatrolChecksum(cmd string) string {
 	return strconv.FormatInt(chk, 10)
 }
 
-func homepatrolCommand(args []string) string {
+// HomePatrolCommand joins the arguments with tabs and appends the checksum and CR the AUF protocol expects.
+func HomePatrolCommand(args []string) string {
 	joined := strings.Join(args, "\t")
 	return fmt.Sprintf("%s\t%s\r", joined, homepatrolChecksum(joined))
 }
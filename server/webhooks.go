@@ -0,0 +1,479 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/wavparse"
+	log "github.com/sirupsen/logrus"
+)
+
+// What webhooks are fired on.
+const (
+	// WebhookOnActivity fires when the scanner moves to a matching channel or hears a matching unit.
+	WebhookOnActivity = "activity"
+	// WebhookOnRecording fires when a matching recording was saved.
+	WebhookOnRecording = "recording"
+)
+
+// Formats of the webhook bodies.
+const (
+	WebhookFormatJSON    = "json"
+	WebhookFormatSlack   = "slack"
+	WebhookFormatDiscord = "discord"
+	WebhookFormatNtfy    = "ntfy"
+)
+
+const (
+	// DefaultWebhookRetries is how often a failed delivery is retried unless the webhook sets Retries.
+	DefaultWebhookRetries = 3
+	// DefaultWebhookBackoff is how long the first retry waits unless the webhook sets Backoff. Every retry waits twice as long.
+	DefaultWebhookBackoff = time.Second
+	// DefaultWebhookTimeout limits a delivery unless the webhook sets Timeout.
+	DefaultWebhookTimeout = 10 * time.Second
+
+	// WebhookSignatureHeader carries the HMAC-SHA256 of the body with the secret of the webhook, as sha256=<hex>.
+	WebhookSignatureHeader = "X-Bearcatter-Signature"
+	// WebhookEventHeader carries the Event of the notification.
+	WebhookEventHeader = "X-Bearcatter-Event"
+
+	// webhookQueueSize is how many notifications wait for a webhook before new ones are dropped.
+	webhookQueueSize = 100
+)
+
+// ErrInvalidWebhook is returned for webhooks that can not be fired.
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// webhookTemplates are the bodies of the formats besides JSON, which is the Notification itself.
+var webhookTemplates = map[string]string{
+	WebhookFormatSlack:   `{"text": {{json .Summary}}}`,
+	WebhookFormatDiscord: `{"content": {{json .Summary}}}`,
+	WebhookFormatNtfy:    `{{.Summary}}`,
+}
+
+// webhookFuncs are available in the templates of webhooks. json quotes a value for JSON bodies.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		marshalled, marshalErr := json.Marshal(v)
+		return string(marshalled), marshalErr
+	},
+}
+
+// WebhookMatch selects what a webhook fires on. Every field that is set must match, names ignoring case.
+type WebhookMatch struct {
+	System     string `yaml:"system"`
+	Department string `yaml:"department"`
+	// TGID and UnitID match with or without their TGID: and UID: prefixes
+	TGID   string `yaml:"tgid"`
+	UnitID string `yaml:"unit_id"`
+	// ServiceType is the name of a service type such as Fire Dispatch
+	ServiceType string `yaml:"service_type"`
+	// Emergency only matches activity the scanner shows an emergency for
+	Emergency bool `yaml:"emergency"`
+}
+
+// Webhook is an HTTP endpoint notified about activity or recordings matching its rule.
+type Webhook struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// On is WebhookOnActivity or WebhookOnRecording, WebhookOnActivity if empty
+	On    string       `yaml:"on"`
+	Match WebhookMatch `yaml:"match"`
+	// Format of the body, WebhookFormatJSON if empty. Template overrides it with a text/template of the Notification.
+	Format   string            `yaml:"format"`
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+	// Secret signs the body in WebhookSignatureHeader, not signed if empty
+	Secret string `yaml:"secret"`
+	// Retries of failed deliveries, DefaultWebhookRetries if zero and none if negative
+	Retries int           `yaml:"retries"`
+	Backoff time.Duration `yaml:"backoff"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	body  *template.Template
+	queue chan *Notification
+}
+
+// Notification is what a webhook is sent, as JSON or rendered with its template.
+type Notification struct {
+	// Event is WebhookOnActivity or WebhookOnRecording
+	Event   string    `json:"event"`
+	Webhook string    `json:"webhook"`
+	Time    time.Time `json:"time"`
+	// Summary describes the notification in a line of text for chat messages
+	Summary   string        `json:"summary"`
+	Emergency bool          `json:"emergency"`
+	Channel   *Channel      `json:"channel,omitempty"`
+	Recording *FileReceived `json:"recording,omitempty"`
+}
+
+// webhooksFile is the layout of a YAML webhook file.
+type webhooksFile struct {
+	Webhooks []*Webhook `yaml:"webhooks"`
+}
+
+func (f *webhooksFile) prepare() error {
+	for _, hook := range f.Webhooks {
+		if prepareErr := hook.prepare(); prepareErr != nil {
+			return prepareErr
+		}
+	}
+	return nil
+}
+
+// LoadWebhooks reads the webhooks of a YAML file with a top level webhooks list.
+func LoadWebhooks(path string) ([]*Webhook, error) {
+	file := webhooksFile{}
+	if loadErr := loadConfigFile(path, "webhook", &file); loadErr != nil {
+		return nil, loadErr
+	}
+	return file.Webhooks, nil
+}
+
+// prepare checks the webhook, fills in the defaults and parses its template.
+func (w *Webhook) prepare() error {
+	if w.Name == "" {
+		w.Name = w.URL
+	}
+	if parsed, parseErr := url.Parse(w.URL); parseErr != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("%w %s: url must be http or https", ErrInvalidWebhook, w.Name)
+	}
+
+	switch w.On {
+	case "":
+		w.On = WebhookOnActivity
+	case WebhookOnActivity, WebhookOnRecording:
+	default:
+		return fmt.Errorf("%w %s: on must be %s or %s, got %q", ErrInvalidWebhook, w.Name, WebhookOnActivity, WebhookOnRecording, w.On)
+	}
+
+	if w.Format == "" {
+		w.Format = WebhookFormatJSON
+	}
+	body := w.Template
+	if body == "" && w.Format != WebhookFormatJSON {
+		var ok bool
+		if body, ok = webhookTemplates[w.Format]; !ok {
+			return fmt.Errorf("%w %s: unknown format %q", ErrInvalidWebhook, w.Name, w.Format)
+		}
+	}
+	if body != "" {
+		var parseErr error
+		if w.body, parseErr = template.New(w.Name).Funcs(webhookFuncs).Parse(body); parseErr != nil {
+			return fmt.Errorf("%w %s: %v", ErrInvalidWebhook, w.Name, parseErr)
+		}
+	}
+
+	if w.Retries == 0 {
+		w.Retries = DefaultWebhookRetries
+	}
+	if w.Backoff <= 0 {
+		w.Backoff = DefaultWebhookBackoff
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = DefaultWebhookTimeout
+	}
+	return nil
+}
+
+// webhookSubject is what the rules of webhooks are matched against, taken from a GSI or PSI update or a recording.
+type webhookSubject struct {
+	channel   *Channel
+	emergency bool
+	// emergencyStarted subjects are an emergency showing up on a channel the other rules were matched against
+	// already, so they only match rules for emergencies
+	emergencyStarted bool
+}
+
+func (m *WebhookMatch) matches(subject *webhookSubject) bool {
+	c := subject.channel
+	switch {
+	case m.System != "" && !strings.EqualFold(m.System, c.System):
+		return false
+	case m.Department != "" && !strings.EqualFold(m.Department, c.Department):
+		return false
+	case m.TGID != "" && alias.NormalizeID(m.TGID) != alias.NormalizeID(c.TGID):
+		return false
+	case m.UnitID != "" && alias.NormalizeID(m.UnitID) != alias.NormalizeID(c.UnitID):
+		return false
+	case m.ServiceType != "" && !matchesServiceType(m.ServiceType, c.ServiceType):
+		return false
+	case m.Emergency && !subject.emergency:
+		return false
+	case subject.emergencyStarted && !m.Emergency:
+		return false
+	}
+	return true
+}
+
+// matchesServiceType compares service types by name. The scanner may report them by number.
+func matchesServiceType(want string, have string) bool {
+	if n, parseErr := strconv.Atoi(have); parseErr == nil {
+		have = wavparse.ServiceType(n).String()
+	}
+	return strings.EqualFold(strings.TrimSpace(want), strings.TrimSpace(have))
+}
+
+// emergencyOf reports whether the display of the scanner shows an emergency for a GSI or PSI update.
+func emergencyOf(si *ScannerInfo) bool {
+	texts := []string{si.ViewDescription.PopupScreen.AttrText}
+	for _, line := range si.ViewDescription.PlainText {
+		texts = append(texts, line.AttrText)
+	}
+	for _, text := range texts {
+		if strings.Contains(strings.ToUpper(text), "EMERGENCY") {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingChannel returns the channel a recording was made on according to its metadata.
+func recordingChannel(recording *wavparse.Recording) *Channel {
+	channel := &Channel{}
+	if recording == nil {
+		return channel
+	}
+	if public := recording.Public; public != nil {
+		channel.Favorite = public.FavoriteListName
+		channel.System = public.System
+		channel.Department = public.Department
+		channel.Channel = public.Channel
+		channel.TGID = public.TGIDFreq
+		channel.UnitID = public.UnitID
+	}
+	if private := recording.Private; private != nil {
+		channel.ServiceType = private.Channel.ServiceType.String()
+		channel.Site = private.Site.Name
+		if private.Metadata.TGID != "" {
+			channel.TGID = private.Metadata.TGID
+		}
+		if private.Metadata.UnitID != "" {
+			channel.UnitID = private.Metadata.UnitID
+		}
+		if private.Metadata.FrequencyFmt != "" {
+			channel.Frequency = private.Metadata.FrequencyFmt
+		}
+	}
+	return channel
+}
+
+// summary describes what the scanner heard in a line of text.
+func (s *webhookSubject) summary(event string) string {
+	c := s.channel
+	names := []string{}
+	for _, name := range []string{c.System, c.Department, c.Channel} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	text := strings.Join(names, " / ")
+	if c.TGID != "" {
+		text += " (" + c.TGID + ")"
+	}
+	if c.UnitID != "" {
+		text += " unit " + alias.NormalizeID(c.UnitID)
+	}
+	if event == WebhookOnRecording {
+		text = "Recording of " + text
+	}
+	if s.emergency {
+		text = "EMERGENCY " + text
+	}
+	return strings.TrimSpace(text)
+}
+
+// webhookDispatcher delivers notifications to the webhooks. Every webhook has a queue and a goroutine of its own
+// so a slow or failing endpoint only holds up its own notifications.
+type webhookDispatcher struct {
+	hooks  []*Webhook
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func startWebhooks(hooks []*Webhook) (*webhookDispatcher, error) {
+	d := &webhookDispatcher{hooks: hooks, client: &http.Client{}}
+	if prepareErr := (&webhooksFile{Webhooks: hooks}).prepare(); prepareErr != nil {
+		return nil, prepareErr
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, hook := range hooks {
+		hook.queue = make(chan *Notification, webhookQueueSize)
+		d.wg.Add(1)
+		go d.run(hook)
+	}
+	return d, nil
+}
+
+// activity notifies the activity webhooks matching a GSI or PSI update. emergencyStarted tells that the channel did
+// not change but an emergency showed up on it, which only notifies the webhooks matching emergencies.
+func (d *webhookDispatcher) activity(si *ScannerInfo, channel *Channel, emergencyStarted bool) {
+	if d == nil {
+		return
+	}
+	d.notify(WebhookOnActivity, &webhookSubject{channel: channel, emergency: emergencyOf(si), emergencyStarted: emergencyStarted}, nil)
+}
+
+// recording notifies the recording webhooks matching a saved recording.
+func (d *webhookDispatcher) recording(received *FileReceived) {
+	if d == nil {
+		return
+	}
+	d.notify(WebhookOnRecording, &webhookSubject{channel: recordingChannel(received.Metadata)}, received)
+}
+
+func (d *webhookDispatcher) notify(event string, subject *webhookSubject, received *FileReceived) {
+	now := time.Now()
+	for _, hook := range d.hooks {
+		if hook.On != event || !hook.Match.matches(subject) {
+			continue
+		}
+
+		notification := &Notification{
+			Event:     event,
+			Webhook:   hook.Name,
+			Time:      now,
+			Summary:   subject.summary(event),
+			Emergency: subject.emergency,
+			Channel:   subject.channel,
+			Recording: received,
+		}
+		select {
+		case hook.queue <- notification:
+		default:
+			log.Warnf("Webhook %s: Queue Full, Dropped Notification: [%s]", hook.Name, notification.Summary)
+		}
+	}
+}
+
+func (d *webhookDispatcher) run(hook *Webhook) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case notification := <-hook.queue:
+			d.deliver(hook, notification)
+		}
+	}
+}
+
+// deliver sends a notification, retrying with exponential backoff on network errors, 429 and 5xx responses.
+func (d *webhookDispatcher) deliver(hook *Webhook, notification *Notification) {
+	body, renderErr := hook.render(notification)
+	if renderErr != nil {
+		log.Errorf("Webhook %s: Error when rendering body: %v", hook.Name, renderErr)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, sendErr := d.send(hook, notification, body)
+		if sendErr == nil {
+			log.Debugf("Webhook %s: Delivered [%s]", hook.Name, notification.Summary)
+			return
+		}
+		if !retry || attempt >= hook.Retries {
+			log.Errorf("Webhook %s: Giving up after %d attempts: %v", hook.Name, attempt+1, sendErr)
+			return
+		}
+
+		delay := backoff(hook.Backoff, attempt+1, 0)
+		log.Warnf("Webhook %s: Delivery failed, retrying in %s: %v", hook.Name, delay, sendErr)
+		if !sleep(d.ctx, delay) {
+			return
+		}
+	}
+}
+
+// send posts a body once. It reports whether a failure is worth retrying.
+func (d *webhookDispatcher) send(hook *Webhook, notification *Notification, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, hook.Timeout)
+	defer cancel()
+
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if reqErr != nil {
+		return false, reqErr
+	}
+	req.Header.Set("Content-Type", hook.contentType())
+	req.Header.Set("User-Agent", "Bearcatter")
+	req.Header.Set(WebhookEventHeader, notification.Event)
+	if hook.Format == WebhookFormatNtfy && hook.Template == "" {
+		req.Header.Set("Title", "Bearcatter")
+		if notification.Emergency {
+			req.Header.Set("Priority", "urgent")
+		}
+	}
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, Signature(hook.Secret, body))
+	}
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, doErr := d.client.Do(req)
+	if doErr != nil {
+		return ctx.Err() != context.Canceled, doErr
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook responded %s", resp.Status)
+}
+
+func (w *Webhook) render(notification *Notification) ([]byte, error) {
+	if w.body == nil {
+		return json.Marshal(notification)
+	}
+	buf := &bytes.Buffer{}
+	if executeErr := w.body.Execute(buf, notification); executeErr != nil {
+		return nil, executeErr
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *Webhook) contentType() string {
+	if w.Format == WebhookFormatNtfy {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// Signature returns the value of WebhookSignatureHeader for a body signed with secret.
+// Receivers compute it the same way and compare with hmac.Equal.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// stop cancels the deliveries in progress and drops the notifications that were not delivered yet.
+func (d *webhookDispatcher) stop() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+	d.wg.Wait()
+}
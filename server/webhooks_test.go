@@ -0,0 +1,206 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bearcatter/bearcatter/server"
+	"github.com/Bearcatter/bearcatter/server/sim"
+	"github.com/stretchr/testify/assert"
+)
+
+// delivery is a request received by a webhook endpoint.
+type delivery struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// webhookEndpoint records the requests it receives. The first failures requests to failing get a 503.
+type webhookEndpoint struct {
+	*httptest.Server
+	mu         sync.Mutex
+	deliveries []delivery
+	failing    string
+	failures   int
+}
+
+func startWebhookEndpoint(t *testing.T, failing string, failures int) *webhookEndpoint {
+	endpoint := &webhookEndpoint{failing: failing, failures: failures}
+	endpoint.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		endpoint.mu.Lock()
+		defer endpoint.mu.Unlock()
+
+		endpoint.deliveries = append(endpoint.deliveries, delivery{path: r.URL.Path, header: r.Header, body: body})
+		if r.URL.Path == endpoint.failing && endpoint.failures > 0 {
+			endpoint.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+	return endpoint
+}
+
+// received returns the requests made to path.
+func (e *webhookEndpoint) received(path string) []delivery {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	received := []delivery{}
+	for _, d := range e.deliveries {
+		if d.path == path {
+			received = append(received, d)
+		}
+	}
+	return received
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	dir, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating temp dir: %v", tempErr)
+	}
+	defer os.RemoveAll(dir)
+
+	assert := assert.New(t)
+	path := filepath.Join(dir, "webhooks.yaml")
+	assert.NoError(ioutil.WriteFile(path, []byte(`webhooks:
+  - name: fire
+    url: https://ntfy.sh/fire
+    format: ntfy
+    match:
+      service_type: Fire Dispatch
+    backoff: 2s
+  - url: https://example.com/recordings
+    on: recording
+    retries: -1
+`), 0644))
+
+	hooks, loadErr := server.LoadWebhooks(path)
+	assert.NoError(loadErr)
+	if assert.Len(hooks, 2) {
+		assert.Equal(server.WebhookOnActivity, hooks[0].On)
+		assert.Equal("Fire Dispatch", hooks[0].Match.ServiceType)
+		assert.Equal(2*time.Second, hooks[0].Backoff)
+		assert.Equal(server.DefaultWebhookRetries, hooks[0].Retries)
+		assert.Equal("https://example.com/recordings", hooks[1].Name)
+		assert.Equal(server.WebhookFormatJSON, hooks[1].Format)
+		assert.Equal(-1, hooks[1].Retries)
+	}
+
+	assert.NoError(ioutil.WriteFile(path, []byte("webhooks:\n  - url: https://example.com\n    format: telegram\n"), 0644))
+	_, loadErr = server.LoadWebhooks(path)
+	assert.True(errors.Is(loadErr, server.ErrInvalidWebhook))
+}
+
+func TestWebhooks(t *testing.T) {
+	endpoint := startWebhookEndpoint(t, "/recording", 1)
+
+	recordingsPath, tempErr := ioutil.TempDir("", "bearcatter")
+	if tempErr != nil {
+		t.Fatalf("error when creating recordings directory: %v", tempErr)
+	}
+	defer os.RemoveAll(recordingsPath)
+
+	host, scanner := server.NewPipe()
+	host.AllowFileTransfer = true
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	serveSimulator(t, simulator, scanner)
+
+	hooks := []*server.Webhook{
+		{URL: endpoint.URL + "/fire", Format: server.WebhookFormatSlack, Secret: "s3cret", Match: server.WebhookMatch{ServiceType: "fire dispatch"}},
+		{URL: endpoint.URL + "/emergency", Format: server.WebhookFormatNtfy, Match: server.WebhookMatch{Emergency: true}},
+		{URL: endpoint.URL + "/unit", Template: `{"unit": {{json .Channel.UnitID}}}`, Match: server.WebhookMatch{TGID: "TGID:10961", UnitID: "1002"}},
+		{URL: endpoint.URL + "/recording", On: server.WebhookOnRecording, Match: server.WebhookMatch{TGID: "7715"}},
+	}
+	// The recording endpoint fails once, so its delivery is retried
+	hooks[3].Backoff = 10 * time.Millisecond
+
+	ctrl := startServer(t, &server.Config{Transport: host, RecordingsPath: recordingsPath, Webhooks: hooks})
+	conn := dialJSON(t, ctrl.Addr())
+
+	assert := assert.New(t)
+	assert.Empty(call(t, conn, "1", "psi.set", map[string]int{"interval": 100}).Error)
+
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Fire", Channel: "Fire Dispatch", TGID: "10961", UnitID: "1001", ServiceType: "Fire Dispatch", Signal: 4})
+	assert.Eventually(func() bool { return len(endpoint.received("/fire")) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	fire := endpoint.received("/fire")[0]
+	assert.Equal(server.Signature("s3cret", fire.body), fire.header.Get(server.WebhookSignatureHeader))
+	assert.Equal(server.WebhookOnActivity, fire.header.Get(server.WebhookEventHeader))
+	slack := map[string]string{}
+	assert.NoError(json.Unmarshal(fire.body, &slack))
+	assert.Equal("Howard County / Fire / Fire Dispatch (TGID:10961) unit 1001", slack["text"])
+
+	simulator.SetCall(&sim.Call{System: "Howard County", Department: "Fire", Channel: "Fire Dispatch", TGID: "10961", UnitID: "1002", Emergency: true, Signal: 4})
+	assert.Eventually(func() bool { return len(endpoint.received("/emergency")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(func() bool { return len(endpoint.received("/unit")) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	emergency := endpoint.received("/emergency")[0]
+	assert.True(strings.HasPrefix(string(emergency.body), "EMERGENCY Howard County"))
+	assert.Equal("urgent", emergency.header.Get("Priority"))
+	assert.Empty(emergency.header.Get(server.WebhookSignatureHeader), "Webhooks without a secret are not signed")
+	assert.JSONEq(`{"unit": "1002"}`, string(endpoint.received("/unit")[0].body))
+
+	if queueErr := simulator.Queue(transferFixture); queueErr != nil {
+		t.Fatalf("error when queueing recording: %v", queueErr)
+	}
+	assert.Eventually(func() bool { return len(endpoint.received("/recording")) == 2 }, 10*time.Second, 10*time.Millisecond)
+
+	notification := server.Notification{}
+	assert.NoError(json.Unmarshal(endpoint.received("/recording")[1].body, &notification))
+	assert.Equal(server.WebhookOnRecording, notification.Event)
+	assert.Equal("East Bay Regional Communications System (EBRCS)", notification.Channel.System)
+	if assert.NotNil(notification.Recording) {
+		assert.Equal(filepath.Join(recordingsPath, filepath.Base(transferFixture)), notification.Recording.Path)
+	}
+	assert.Len(endpoint.received("/fire"), 1, "Only matching activity is sent")
+}
+
+func TestWebhookEmergencyOnSameChannel(t *testing.T) {
+	endpoint := startWebhookEndpoint(t, "", 0)
+
+	host, scanner := server.NewPipe()
+	simulator := sim.New(&sim.Scenario{Model: "SDS200", PageSize: 10})
+	serveSimulator(t, simulator, scanner)
+
+	hooks := []*server.Webhook{
+		{URL: endpoint.URL + "/any"},
+		{URL: endpoint.URL + "/emergency", Match: server.WebhookMatch{Emergency: true}},
+	}
+	ctrl := startServer(t, &server.Config{Transport: host, Webhooks: hooks})
+	conn := dialJSON(t, ctrl.Addr())
+
+	assert := assert.New(t)
+	assert.Empty(call(t, conn, "1", "psi.set", map[string]int{"interval": 50}).Error)
+
+	dispatch := sim.Call{System: "Howard County", Department: "Fire", Channel: "Fire Dispatch", TGID: "10961", UnitID: "1001", Signal: 4}
+	simulator.SetCall(&dispatch)
+	assert.Eventually(func() bool { return len(endpoint.received("/any")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(endpoint.received("/emergency"))
+
+	// The emergency shows up while the scanner stays on the same channel
+	emergency := dispatch
+	emergency.Emergency = true
+	simulator.SetCall(&emergency)
+	assert.Eventually(func() bool { return len(endpoint.received("/emergency")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	notification := server.Notification{}
+	assert.NoError(json.Unmarshal(endpoint.received("/emergency")[0].body, &notification))
+	assert.True(notification.Emergency)
+	assert.Equal("EMERGENCY Howard County / Fire / Fire Dispatch (TGID:10961) unit 1001", notification.Summary)
+
+	// Later updates of the same emergency are no news
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(endpoint.received("/emergency"), 1)
+	assert.Len(endpoint.received("/any"), 1, "Rules that matched the channel already are not notified again")
+}
@@ -1,167 +1,188 @@
 package server
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Bearcatter/bearcatter/alias"
+	"github.com/Bearcatter/bearcatter/history"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	log "github.com/sirupsen/logrus"
 )
 
-func startWSServer(host string, port int, ctrl *ScannerCtrl) (*http.Server, error) {
+func startWSServer(host string, port int, ctrl *ScannerCtrl) (*http.Server, net.Listener, error) {
+	ui := uiHandler()
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		// Browsers opening the server get the web UI, WebSocket clients connect on any path like they always did
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			ui.ServeHTTP(w, r)
+			return
+		}
+
+		// Clients asking for JSONProtocol get JSON, everyone else the raw scanner protocol
+		upgrader := ws.HTTPUpgrader{
+			Protocol: func(protocol string) bool {
+				return protocol == JSONProtocol
+			},
+		}
+		conn, _, hs, err := upgrader.Upgrade(r, w)
 		if err != nil {
-			// handle error
 			log.Errorln("Error during WS upgrade", err)
+			return
 		}
 
-		ctrl.mode.WSClientConnected = true
-
-		defer func() {
-			conn.Close()
-			if ctrl.locker.name == r.RemoteAddr {
-				ctrl.locker.state = false
-				log.Infoln("Unlocking Scanner for new WS Client Connection")
-			}
-		}()
+		client := ctrl.hub.register(r.RemoteAddr, hs.Protocol == JSONProtocol)
 
-		if ctrl.locker.state {
-			log.Infoln("Scanner is already is use by", ctrl.locker.name)
-			if writeErr := wsutil.WriteServerMessage(conn, ws.OpBinary, []byte("Locked by "+ctrl.locker.name)); writeErr != nil {
-				// handle error
-				log.Errorln("Failed to Write", writeErr)
-				return
-			}
-			return
-		} else {
-			log.Infof("Locking Scanner for new WS Client Connection: [%s]", r.RemoteAddr)
-			ctrl.locker.Lock()
-			ctrl.locker.state = true
-			ctrl.locker.name = r.RemoteAddr
-			ctrl.locker.pktSent = 0
-			ctrl.locker.pktRecv = 0
-			ctrl.locker.Unlock()
+		done := make(chan struct{})
+		var doneOnce sync.Once
+		finish := func() {
+			doneOnce.Do(func() { close(done) })
 		}
 
-		quitReader := make(chan bool, 1)
-		quitWriter := make(chan bool, 1)
-		done := make(chan bool, 1)
+		// Commands of JSON clients are canceled once they leave
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
 		// WS Reader routine
 		go func() {
+			defer finish()
 			for {
-				select {
-				case <-quitWriter:
-					return
-				default:
-					time.Sleep(time.Millisecond * 50)
-				}
 				msgFromHost, _, readErr := wsutil.ReadClientData(conn)
 
 				if readErr != nil {
-					// handle error
 					log.Errorln("Failed to read from WS, Terminating Client Connection", readErr)
-					done <- true
-					quitReader <- true
 					return
 				}
 
+				if client.json {
+					ctrl.handleJSONMessage(ctx, client, msgFromHost)
+					continue
+				}
+
 				if !validMsgFromWSClient(msgFromHost) {
 					log.Warnln("Message From WS Failed Validation", crlfStrip(msgFromHost, LF))
 					return
 				}
 
 				strMsg := string(crlfStrip(msgFromHost, LF))
-				if strMsg == TERMINATE {
+				trimmed := strings.TrimSpace(string(msgFromHost))
+				if trimmed == strings.TrimSpace(TERMINATE) {
 					log.Infoln("Received Client QUIT Command: Terminating Client Connection")
-					done <- true
-					quitReader <- true
 					return
 				}
 
-				if strMsg == "" || strMsg == "\n" {
+				if trimmed == "" {
+					continue
+				}
+
+				if trimmed == CONTROL || trimmed == RELEASE {
+					ctrl.hub.handleControl(client, trimmed)
+					continue
+				}
+
+				if !ctrl.hub.authorize(client) {
+					log.Infof("WS Client [%s] is not in control, Msg Not Sent: [%s]", client.name, strMsg)
 					continue
 				}
 
 				if strings.HasPrefix(strMsg, "HP,") {
 					log.Infof("HomePatrol message From Host: [%s]", crlfStrip(msgFromHost, LF))
-					hpCmd := homepatrolCommand(strings.Split(strMsg[3:], "|"))
+					hpCmd := HomePatrolCommand(strings.Split(strMsg[3:], "|"))
 					log.Infof("Sending HomePatrol message %#q\n", hpCmd)
 					success := ctrl.SendToHostMsgChannel([]byte(hpCmd))
 					log.Infoln("Sent message?", success)
 					continue
 				}
-				// log.Infof("Message From Host: [%s]", crlfStrip(msgFromHost, LF))
 				ctrl.SendToHostMsgChannel(msgFromHost)
 			}
 		}()
 
-		// WS Writer routine
-		go func() {
-			for {
-				select {
-				case <-quitReader:
-					return
-				default:
-					time.Sleep(time.Millisecond * 50)
+		// WS Writer, the client gets its own queue so a slow client does not hold up the others
+	writer:
+		for {
+			select {
+			case msgToHost := <-client.send:
+				elapsed := time.Since(msgToHost.ts)
+				log.Debugf("Received[ql=%d] Message To Host at [%s] [%s]",
+					len(client.send), elapsed, crlfStrip(msgToHost.msg, LF|NL))
+				op := ws.OpBinary
+				if client.json {
+					op = ws.OpText
 				}
-
-				msgToHost, ok := ctrl.ReceiveFromRadioMsgChannel()
-
-				if ok {
-					elapsed := time.Since(msgToHost.ts)
-					log.Infof("Received[ql=%d] Message To Host at [%s] [%s]",
-						len(ctrl.radioMsg), elapsed, crlfStrip(msgToHost.msg, LF|NL))
-					if writeErr := wsutil.WriteServerMessage(conn, ws.OpBinary, msgToHost.msg); writeErr != nil {
-						// handle error
-						log.Errorln("Failed to Write", writeErr)
-						done <- true
-						quitWriter <- true
-						return
-					} else {
-						log.Infof("Message To Host: [%s]", string(msgToHost.msg))
-					}
+				if writeErr := wsutil.WriteServerMessage(conn, op, msgToHost.msg); writeErr != nil {
+					log.Errorln("Failed to Write", writeErr)
+					break writer
 				}
+				log.Debugf("Message To Host: [%s]", string(msgToHost.msg))
+			case <-done:
+				break writer
+			case <-ctrl.quit:
+				break writer
 			}
-		}()
+		}
 
+		conn.Close()
 		<-done
-		// TODO - need to reset radio into normal state:  Turn off PSI
+
+		if ctrl.hub.unregister(client) > 0 {
+			return
+		}
+
+		select {
+		case <-ctrl.quit:
+			return
+		default:
+		}
+
+		// Reset the radio into its normal state once the last client is gone
 		ctrl.SendToHostMsgChannel([]byte("PSI,0\r"))
 
 		// drain any UDP Traffic
 		ctrl.drain()
-
-		// Drain WS Messages so new connection won't receive old messages
-		for {
-			_, ok := ctrl.ReceiveFromRadioMsgChannel()
-			if !ok {
-				break
-			} else {
-				log.Infoln("RadioMsgChannel Draining...")
-			}
-		}
-		ctrl.mode.WSClientConnected = false
 	})
 
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle("/api/", apiHandler(ctrl))
+	mux.Handle("/events", eventsHandler(ctrl))
+	mux.Handle("/metrics", ctrl.metrics.handler())
+	if ctrl.aliases != nil {
+		mux.Handle("/api/aliases", alias.Handler(ctrl.aliases))
+	}
+	if ctrl.history != nil {
+		historyHandler := http.StripPrefix("/api/history", history.Handler(ctrl.history, ctrl.openArchived))
+		mux.Handle("/api/history", historyHandler)
+		mux.Handle("/api/history/", historyHandler)
+	}
+
 	s := &http.Server{
-		Addr:           host + ":" + strconv.Itoa(port),
-		Handler:        handler,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		Addr:        host + ":" + strconv.Itoa(port),
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+		// No WriteTimeout, it would end the /events streams. Commands are limited by CommandTimeout instead.
 		MaxHeaderBytes: 1 << 20,
 	}
+	listener, listenErr := net.Listen("tcp", s.Addr)
+	if listenErr != nil {
+		return nil, nil, listenErr
+	}
 	go func() {
-		if listenErr := s.ListenAndServe(); listenErr != nil {
-			log.Fatalln("Error when listening for WebSocket Server", listenErr)
+		if serveErr := s.Serve(listener); serveErr != nil && serveErr != http.ErrServerClosed {
+			log.Errorln("Error when serving WebSocket Server", serveErr)
 		}
 	}()
-	log.Infoln("Started WebSocket Server at", s.Addr)
-	return s, nil
+	log.Infoln("Started WebSocket Server at", listener.Addr())
+	return s, listener, nil
 }
 
 // TODO -- add msg validation
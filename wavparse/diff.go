@@ -0,0 +1,105 @@
+package wavparse
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FieldDiff is a single field that differs between two recordings.
+type FieldDiff struct {
+	Field string
+	Old   string
+	New   string
+}
+
+const wallClockFormat = "2006-01-02T15:04:05"
+
+type csvMarshaller interface {
+	MarshalCSV() (string, error)
+}
+
+// Flatten returns every field of the recording keyed by its dot separated Go field path, for example Private.Metadata.TGID.
+// Chunks that were not decoded are left out.
+func (r *Recording) Flatten() map[string]string {
+	fields := map[string]string{}
+	flattenValue(reflect.ValueOf(r), "", fields)
+	return fields
+}
+
+func flattenValue(v reflect.Value, path string, fields map[string]string) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		if m, ok := v.Interface().(csvMarshaller); ok {
+			fields[path], _ = m.MarshalCSV()
+			return
+		}
+		v = v.Elem()
+	}
+
+	if v.CanAddr() {
+		if m, ok := v.Addr().Interface().(csvMarshaller); ok {
+			fields[path], _ = m.MarshalCSV()
+			return
+		}
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		// Scanner timestamps have no zone, compare the wall clock so results don't depend on the local zone.
+		fields[path] = value.Format(wallClockFormat)
+		return
+	case fmt.Stringer:
+		fields[path] = value.String()
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			fieldPath := t.Field(i).Name
+			if path != "" {
+				fieldPath = path + "." + fieldPath
+			}
+			flattenValue(v.Field(i), fieldPath, fields)
+		}
+	case reflect.Float32, reflect.Float64:
+		fields[path] = strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		fields[path] = fmt.Sprintf("%v", v.Interface())
+	}
+}
+
+// Diff compares two recordings field by field and returns the differences sorted by field path.
+func Diff(old *Recording, new *Recording) []FieldDiff {
+	oldFields := old.Flatten()
+	newFields := new.Flatten()
+
+	diffs := []FieldDiff{}
+
+	for field, oldValue := range oldFields {
+		if newValue := newFields[field]; newValue != oldValue {
+			diffs = append(diffs, FieldDiff{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+
+	for field, newValue := range newFields {
+		if _, ok := oldFields[field]; !ok && newValue != "" {
+			diffs = append(diffs, FieldDiff{Field: field, New: newValue})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Field < diffs[j].Field
+	})
+
+	return diffs
+}
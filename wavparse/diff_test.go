@@ -0,0 +1,84 @@
+package wavparse_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlatten(t *testing.T) {
+	rec := &wavparse.Recording{
+		File:    "2020-06-20_22-22-20.wav",
+		Private: &wavparse.UnidenChunk{Metadata: wavparse.Metadata{TGID: "7715", Frequency: 852.925}},
+	}
+
+	fields := rec.Flatten()
+
+	assert := assert.New(t)
+	assert.Equal("2020-06-20_22-22-20.wav", fields["File"])
+	assert.Equal("7715", fields["Private.Metadata.TGID"])
+	assert.Equal("852.925", fields["Private.Metadata.Frequency"])
+	for field := range fields {
+		assert.False(strings.HasPrefix(field, "Public."), "Chunks that were not decoded should be left out, got %s", field)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	recording := func(public *wavparse.ListChunk, tgid string) *wavparse.Recording {
+		return &wavparse.Recording{
+			File:    "2020-06-20_22-22-20.wav",
+			Public:  public,
+			Private: &wavparse.UnidenChunk{Metadata: wavparse.Metadata{TGID: tgid}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		old      *wavparse.Recording
+		new      *wavparse.Recording
+		expected []wavparse.FieldDiff
+	}{
+		{
+			name:     "Identical",
+			old:      recording(&wavparse.ListChunk{System: "EBRCS"}, "7715"),
+			new:      recording(&wavparse.ListChunk{System: "EBRCS"}, "7715"),
+			expected: []wavparse.FieldDiff{},
+		},
+		{
+			name: "Changed",
+			old:  recording(&wavparse.ListChunk{System: "EBRCS"}, "7715"),
+			new:  recording(&wavparse.ListChunk{System: "East Bay"}, "7716"),
+			expected: []wavparse.FieldDiff{
+				{Field: "Private.Metadata.TGID", Old: "7715", New: "7716"},
+				{Field: "Public.System", Old: "EBRCS", New: "East Bay"},
+			},
+		},
+		{
+			name: "Missing",
+			old:  recording(&wavparse.ListChunk{System: "EBRCS", Channel: "Dispatch East"}, "7715"),
+			new:  recording(nil, "7715"),
+			expected: []wavparse.FieldDiff{
+				{Field: "Public.Channel", Old: "Dispatch East"},
+				{Field: "Public.System", Old: "EBRCS"},
+			},
+		},
+		{
+			name: "Extra",
+			old:  recording(nil, "7715"),
+			new:  recording(&wavparse.ListChunk{System: "EBRCS", Channel: "Dispatch East"}, "7715"),
+			expected: []wavparse.FieldDiff{
+				{Field: "Public.Channel", New: "Dispatch East"},
+				{Field: "Public.System", New: "EBRCS"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, wavparse.Diff(test.old, test.new))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package wavparse_test
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+)
+
+// Regenerate the golden files with go test -update, or the decode command with output.json.multiple.
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+const goldenPath = "testdata/golden"
+
+func TestGolden(t *testing.T) {
+	fixtures, globErr := filepath.Glob("fixtures/*.wav")
+	if globErr != nil {
+		t.Fatalf("error when finding fixtures: %v", globErr)
+	}
+
+	if len(fixtures) == 0 {
+		t.Fatal("Refusing to run without fixtures")
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(filepath.Base(fixture), testGolden(fixture))
+	}
+}
+
+func testGolden(path string) func(t *testing.T) {
+	return func(t *testing.T) {
+		parsed, parsedErr := wavparse.DecodeRecording(path)
+		if parsedErr != nil {
+			t.Fatalf("error when parsing file: %v", parsedErr)
+		}
+
+		goldenFile := filepath.Join(goldenPath, fmt.Sprintf("%s.json", parsed.File))
+
+		if *update {
+			marshalled, marshalErr := json.MarshalIndent(&parsed, "", "\t")
+			if marshalErr != nil {
+				t.Fatalf("error when marshalling golden file: %v", marshalErr)
+			}
+			if writeErr := ioutil.WriteFile(goldenFile, marshalled, 0644); writeErr != nil {
+				t.Fatalf("error when writing golden file: %v", writeErr)
+			}
+			return
+		}
+
+		raw, readErr := ioutil.ReadFile(goldenFile)
+		if os.IsNotExist(readErr) {
+			t.Fatalf("golden file %s is missing, run the tests with -update to create it", goldenFile)
+		} else if readErr != nil {
+			t.Fatalf("error when reading golden file: %v", readErr)
+		}
+
+		golden := &wavparse.Recording{}
+		if unmarshalErr := json.Unmarshal(raw, golden); unmarshalErr != nil {
+			t.Fatalf("error when unmarshalling golden file: %v", unmarshalErr)
+		}
+
+		for _, diff := range wavparse.Diff(golden, parsed) {
+			t.Errorf("%s: golden %q, decoded %q", diff.Field, diff.Old, diff.New)
+		}
+
+		for _, known := range knownIssues[parsed.File] {
+			t.Logf("Known issue %s: %s", known.Issue, known.Note)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package wavparse
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	riff "github.com/go-audio/riff"
+)
+
+// Layout describes where the chunks of a WAV file live on disk. It is used to
+// check that a recording was completely written by the scanner.
+type Layout struct {
+	FileSize   int64  // Size of the file on disk
+	RIFFSize   uint32 // Size declared by the RIFF header, should be FileSize - 8
+	DataOffset int64  // Offset of the first audio byte in the data chunk
+	DataSize   int64  // Size declared by the data chunk header
+	HasLIST    bool
+	HasUNID    bool
+	HasData    bool
+}
+
+// ExpectedFileSize returns the file size implied by the data chunk header.
+func (l *Layout) ExpectedFileSize() int64 {
+	return l.DataOffset + l.DataSize
+}
+
+// DecodeLayout walks the RIFF chunks of the WAV file at the given path without decoding them.
+func DecodeLayout(path string) (*Layout, error) {
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, fmt.Errorf("error when opening wav file: %w", openErr)
+	}
+	defer f.Close()
+
+	info, statErr := f.Stat()
+	if statErr != nil {
+		return nil, fmt.Errorf("error when getting wav file info: %w", statErr)
+	}
+
+	layout := &Layout{
+		FileSize: info.Size(),
+	}
+
+	c := riff.New(f)
+	if parseHeadersErr := c.ParseHeaders(); parseHeadersErr != nil {
+		if parseHeadersErr == io.EOF || parseHeadersErr == io.ErrUnexpectedEOF {
+			return nil, ErrHeaderParsing
+		}
+		return nil, fmt.Errorf("error parsing headers: %w", parseHeadersErr)
+	}
+	layout.RIFFSize = c.Size
+
+	// RIFF ID, size and WAVE format
+	offset := int64(12)
+
+	for {
+		chunk, chunkErr := c.NextChunk()
+		if chunkErr == io.EOF {
+			break
+		} else if chunkErr != nil {
+			return nil, fmt.Errorf("error when getting next chunk of riff header: %w", chunkErr)
+		}
+
+		offset += 8
+
+		switch chunk.ID {
+		case cidLIST:
+			layout.HasLIST = true
+		case cidUNID:
+			layout.HasUNID = true
+		case riff.DataFormatID:
+			layout.HasData = true
+			layout.DataOffset = offset
+			layout.DataSize = int64(chunk.Size)
+			return layout, nil
+		}
+
+		chunk.Done()
+		offset += int64(chunk.Size)
+	}
+
+	return layout, nil
+}
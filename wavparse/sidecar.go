@@ -0,0 +1,65 @@
+package wavparse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Formats of the JSON sidecars saved next to recordings.
+const (
+	// SidecarBearcatter is the Recording itself, saved as <name>.wav.json. It is what the server returns as the
+	// metadata of a recording, and the WAV file is decoded again when it is missing.
+	SidecarBearcatter = "bearcatter"
+	// SidecarTrunkRecorder is the call JSON of trunk-recorder, saved as <name>.json.
+	SidecarTrunkRecorder = "trunk-recorder"
+)
+
+// SidecarFormats are the formats of sidecars a recording may have.
+var SidecarFormats = []string{SidecarBearcatter, SidecarTrunkRecorder}
+
+// ErrInvalidSidecar is returned for sidecar formats other than SidecarBearcatter and SidecarTrunkRecorder.
+var ErrInvalidSidecar = errors.New("invalid sidecar format")
+
+// CheckSidecars returns ErrInvalidSidecar for unknown sidecar formats.
+func CheckSidecars(formats []string) error {
+	for _, format := range formats {
+		if format != SidecarBearcatter && format != SidecarTrunkRecorder {
+			return fmt.Errorf("%w %q, must be %s or %s", ErrInvalidSidecar, format, SidecarBearcatter, SidecarTrunkRecorder)
+		}
+	}
+	return nil
+}
+
+// SidecarName returns the name of the sidecar of a recording in a format.
+func SidecarName(name string, format string) string {
+	if format == SidecarTrunkRecorder {
+		return strings.TrimSuffix(name, path.Ext(name)) + ".json"
+	}
+	return name + ".json"
+}
+
+// Sidecars marshals the metadata of a recording in the formats. shortName names the system in trunk-recorder
+// sidecars, see Recording.TrunkRecorder.
+func (r *Recording) Sidecars(formats []string, shortName string) (map[string][]byte, error) {
+	sidecars := map[string][]byte{}
+	for _, format := range formats {
+		var marshalled []byte
+		var marshalErr error
+		switch format {
+		case SidecarBearcatter:
+			marshalled, marshalErr = json.MarshalIndent(r, "", "    ")
+		case SidecarTrunkRecorder:
+			marshalled, marshalErr = json.MarshalIndent(r.TrunkRecorder(shortName), "", "  ")
+		default:
+			marshalErr = fmt.Errorf("%w %q", ErrInvalidSidecar, format)
+		}
+		if marshalErr != nil {
+			return nil, marshalErr
+		}
+		sidecars[format] = marshalled
+	}
+	return sidecars, nil
+}
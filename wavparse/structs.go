@@ -16,6 +16,14 @@ func (clock *StopwatchDuration) MarshalJSON() ([]byte, error) {
 	return json.Marshal(csv)
 }
 
+func (clock *StopwatchDuration) UnmarshalJSON(data []byte) error {
+	var csv string
+	if err := json.Unmarshal(data, &csv); err != nil {
+		return err
+	}
+	return clock.UnmarshalCSV(csv)
+}
+
 // Convert the internal duration as CSV string.
 func (clock *StopwatchDuration) MarshalCSV() (string, error) {
 	d := time.Duration(*clock)
@@ -43,6 +51,15 @@ type Recording struct {
 	Duration StopwatchDuration `json:",omitempty"`
 	Public   *ListChunk        `csv:"-" json:",omitempty"`
 	Private  *UnidenChunk      `csv:"-" json:",omitempty"`
+	Aliases  *Aliases          `csv:"-" json:",omitempty"`
+}
+
+// Aliases are the names given to the unit and talkgroup of a recording by an alias database. They are not part of the WAV file.
+type Aliases struct {
+	UnitIDName string `csv:"Alias_UnitIDName" json:",omitempty"`
+	UnitIDTags string `csv:"Alias_UnitIDTags" json:",omitempty"`
+	TGIDName   string `csv:"Alias_TGIDName" json:",omitempty"`
+	TGIDTags   string `csv:"Alias_TGIDTags" json:",omitempty"`
 }
 type ListChunk struct {
 	System           string     `csv:"Public_System" json:",omitempty" validate:"omitempty,printascii"`           // IART
@@ -470,6 +487,22 @@ func (s ServiceType) String() string {
 	}
 }
 
+// Convert the CSV string as service type. Accepts either the service type name or number.
+// Names shared by several numbers, such as Reserved, resolve to the lowest number.
+func (s *ServiceType) UnmarshalCSV(csv string) error {
+	if parsed, parseErr := strconv.Atoi(csv); parseErr == nil {
+		*s = ServiceType(parsed)
+		return nil
+	}
+	for i := 0; i <= 255; i++ {
+		if ServiceType(i).String() == csv {
+			*s = ServiceType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown service type %s", csv)
+}
+
 type ChannelInfo struct {
 	Name            string      `csv:"Channel_Name" json:",omitempty" validate:"omitempty,printascii"`
 	Avoid           bool        `csv:"Channel_Avoid"`
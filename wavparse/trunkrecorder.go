@@ -0,0 +1,144 @@
+package wavparse
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TrunkRecorderCall is the JSON trunk-recorder writes next to every call it records, so tools made for
+// trunk-recorder can read recordings of Uniden scanners.
+// See https://github.com/robotastic/trunk-recorder/blob/master/docs/notes/CALL-JSON.md
+type TrunkRecorderCall struct {
+	Freq                 int64                    `json:"freq"`
+	StartTime            int64                    `json:"start_time"`
+	StopTime             int64                    `json:"stop_time"`
+	Emergency            int                      `json:"emergency"`
+	Priority             int                      `json:"priority"`
+	Mode                 int                      `json:"mode"`
+	Duplex               int                      `json:"duplex"`
+	Encrypted            int                      `json:"encrypted"`
+	CallLength           float64                  `json:"call_length"`
+	Talkgroup            int64                    `json:"talkgroup"`
+	TalkgroupTag         string                   `json:"talkgroup_tag"`
+	TalkgroupDescription string                   `json:"talkgroup_description"`
+	TalkgroupGroupTag    string                   `json:"talkgroup_group_tag"`
+	TalkgroupGroup       string                   `json:"talkgroup_group"`
+	AudioType            string                   `json:"audio_type"`
+	ShortName            string                   `json:"short_name"`
+	FreqList             []TrunkRecorderFrequency `json:"freqList"`
+	SrcList              []TrunkRecorderSource    `json:"srcList"`
+}
+
+// TrunkRecorderFrequency is a frequency a call was heard on, from Pos seconds into the recording for Len seconds.
+type TrunkRecorderFrequency struct {
+	Freq       int64   `json:"freq"`
+	Time       int64   `json:"time"`
+	Pos        float64 `json:"pos"`
+	Len        float64 `json:"len"`
+	ErrorCount int     `json:"error_count"`
+	SpikeCount int     `json:"spike_count"`
+}
+
+// TrunkRecorderSource is a unit that transmitted during a call, from Pos seconds into the recording.
+type TrunkRecorderSource struct {
+	Src          int64   `json:"src"`
+	Time         int64   `json:"time"`
+	Pos          float64 `json:"pos"`
+	Emergency    int     `json:"emergency"`
+	SignalSystem string  `json:"signal_system"`
+	Tag          string  `json:"tag"`
+}
+
+// TrunkRecorder describes the recording the way trunk-recorder describes its calls. shortName is the name
+// trunk-recorder knows the system by, ShortName of the system name if empty. Talkgroups and units that are not
+// numbers, like the frequencies of conventional channels, are left zero. Emergency is always zero, recordings do not
+// say whether a call was an emergency, but trunk-recorder always writes it and tools reading its calls expect it.
+func (r *Recording) TrunkRecorder(shortName string) *TrunkRecorderCall {
+	call := &TrunkRecorderCall{
+		CallLength: math.Round(time.Duration(r.Duration).Seconds()*100) / 100,
+		AudioType:  "analog",
+		FreqList:   []TrunkRecorderFrequency{},
+		SrcList:    []TrunkRecorderSource{},
+	}
+
+	var tgid, unitID, system string
+	if public := r.Public; public != nil {
+		system = public.System
+		tgid = public.TGIDFreq
+		unitID = public.UnitID
+		call.TalkgroupTag = public.Channel
+		call.TalkgroupGroup = public.Department
+		if public.Timestamp != nil {
+			call.StartTime = public.Timestamp.Unix()
+		}
+	}
+	if private := r.Private; private != nil {
+		if system == "" {
+			system = private.System.Name
+		}
+		if private.Metadata.TGID != "" {
+			tgid = private.Metadata.TGID
+		}
+		if private.Metadata.UnitID != "" {
+			unitID = private.Metadata.UnitID
+		}
+		call.Freq = int64(math.Round(private.Metadata.Frequency * 1e6))
+		call.TalkgroupGroupTag = private.Channel.ServiceType.String()
+		if private.Metadata.WACN != "" || private.Metadata.NAC != "" {
+			call.AudioType = "digital"
+		}
+		if priority, parseErr := strconv.Atoi(private.Channel.Priority); parseErr == nil {
+			call.Priority = priority
+		}
+	}
+	if r.Aliases != nil && r.Aliases.TGIDName != "" {
+		call.TalkgroupDescription = r.Aliases.TGIDName
+	}
+	call.StopTime = call.StartTime + int64(math.Ceil(call.CallLength))
+	call.Talkgroup = parseID(tgid)
+
+	if shortName == "" {
+		shortName = ShortName(system)
+	}
+	call.ShortName = shortName
+
+	if call.Freq != 0 {
+		call.FreqList = append(call.FreqList, TrunkRecorderFrequency{Freq: call.Freq, Time: call.StartTime, Len: call.CallLength})
+	}
+	if src := parseID(unitID); src != 0 {
+		source := TrunkRecorderSource{Src: src, Time: call.StartTime}
+		if r.Aliases != nil {
+			source.Tag = r.Aliases.UnitIDName
+		}
+		call.SrcList = append(call.SrcList, source)
+	}
+	return call
+}
+
+// ShortName makes a trunk-recorder short name of a system name: the abbreviation in parentheses if it has one,
+// like ebrcs for "East Bay Regional Communications System (EBRCS)", otherwise the words joined with dashes.
+func ShortName(system string) string {
+	if open, end := strings.LastIndex(system, "("), strings.LastIndex(system, ")"); open >= 0 && end > open+1 {
+		system = system[open+1 : end]
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(system), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, "-")
+}
+
+// parseID returns the number of a talkgroup or unit ID, which scanners may prefix like TGID:10961 or UID:2468170.
+func parseID(id string) int64 {
+	if colon := strings.LastIndex(id, ":"); colon >= 0 {
+		id = id[colon+1:]
+	}
+	parsed, parseErr := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+	if parseErr != nil {
+		return 0
+	}
+	return parsed
+}
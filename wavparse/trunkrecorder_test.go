@@ -0,0 +1,61 @@
+package wavparse_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Bearcatter/bearcatter/wavparse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrunkRecorder(t *testing.T) {
+	parsed, parsedErr := wavparse.DecodeRecording("fixtures/2020-06-21_00-00-32.wav")
+	if parsedErr != nil {
+		t.Fatalf("error when parsing file: %v", parsedErr)
+	}
+	parsed.Aliases = &wavparse.Aliases{TGIDName: "CCCSO Dispatch East", UnitIDName: "Unit 13"}
+
+	marshalled, marshalErr := json.Marshal(parsed.TrunkRecorder(""))
+	if marshalErr != nil {
+		t.Fatalf("error when marshalling call: %v", marshalErr)
+	}
+	assert.JSONEq(t, `{
+		"freq": 852925000,
+		"start_time": 1592697633,
+		"stop_time": 1592697634,
+		"emergency": 0,
+		"priority": 0,
+		"mode": 0,
+		"duplex": 0,
+		"encrypted": 0,
+		"call_length": 0.67,
+		"talkgroup": 7715,
+		"talkgroup_tag": "Dispatch East",
+		"talkgroup_description": "CCCSO Dispatch East",
+		"talkgroup_group_tag": "Law Dispatch",
+		"talkgroup_group": "Contra Costa Co Sheriff",
+		"audio_type": "digital",
+		"short_name": "ebrcs",
+		"freqList": [{"freq": 852925000, "time": 1592697633, "pos": 0, "len": 0.67, "error_count": 0, "spike_count": 0}],
+		"srcList": [{"src": 4010013, "time": 1592697633, "pos": 0, "emergency": 0, "signal_system": "", "tag": "Unit 13"}]
+	}`, string(marshalled))
+
+	assert.Equal(t, "cccsd", parsed.TrunkRecorder("cccsd").ShortName)
+
+	empty := (&wavparse.Recording{}).TrunkRecorder("")
+	assert.Empty(t, empty.FreqList)
+	assert.Empty(t, empty.SrcList)
+	assert.Equal(t, "analog", empty.AudioType)
+}
+
+func TestShortName(t *testing.T) {
+	for system, shortName := range map[string]string{
+		"East Bay Regional Communications System (EBRCS)":  "ebrcs",
+		"Silicon Valley Regional Interoperability Project": "silicon-valley-regional-interoperability-project",
+		"Alameda Co. (P25)": "p25",
+		"Marin ()":          "marin",
+		"":                  "",
+	} {
+		assert.Equal(t, shortName, wavparse.ShortName(system), system)
+	}
+}
@@ -96,6 +96,11 @@ func DecodeRecording(path string) (*Recording, error) {
 
 	rec.Duration = StopwatchDuration(duration)
 
+	// Files missing either chunk have nothing to reconcile.
+	if rec.Public == nil || rec.Private == nil {
+		return rec, nil
+	}
+
 	if rec.Public.TGIDFreq == "" && rec.Private.Metadata.TGID != "" {
 		rec.Public.TGIDFreq = rec.Private.Metadata.TGID
 	}